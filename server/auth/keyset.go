@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Key is one signing key of a KeySet
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+	//signKey is nil for retired keys that are only kept to verify tokens they signed
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// KeySet hold the server's token signing keys: the active key signs new tokens,
+// every key verifies the tokens carrying its key id so keys can be rotated without logging everybody out
+type KeySet struct {
+	keys   map[string]*Key
+	active *Key
+}
+
+// keyFile is the json file pointed to by the jwt_keys environment variable:
+//
+//	{
+//	  "active": "2026-10",
+//	  "keys": [
+//	    {"kid": "2026-10", "alg": "HS256", "secret": "<base64, at least 32 bytes>"},
+//	    {"kid": "2026-04", "alg": "RS256", "public": "keys/2026-04.pub.pem"},
+//	    {"kid": "ed1", "alg": "EdDSA", "private": "keys/ed1.pem"}
+//	  ]
+//	}
+//
+// RS256 and EdDSA keys take a PKCS#8 (or PKCS#1 for RSA) private key, or only a public key
+// for a retired key. Relative paths are relative to the key file.
+type keyFile struct {
+	Active string `json:"active"`
+	Keys   []struct {
+		Kid     string `json:"kid"`
+		Alg     string `json:"alg"`
+		Secret  string `json:"secret"`
+		Private string `json:"private"`
+		Public  string `json:"public"`
+	} `json:"keys"`
+}
+
+// LoadKeySet read a key set from a key file
+func LoadKeySet(path string) (*KeySet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var kf keyFile
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return nil, fmt.Errorf("jwt key file %s: %v", path, err)
+	}
+	dir := filepath.Dir(path)
+	readPEM := func(name string) (*pem.Block, error) {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s is not a PEM file", name)
+		}
+		return block, nil
+	}
+
+	ks := &KeySet{keys: make(map[string]*Key)}
+	for _, k := range kf.Keys {
+		key := &Key{ID: k.Kid}
+		switch k.Alg {
+		case "HS256":
+			secret, err := base64.StdEncoding.DecodeString(k.Secret)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: secret is not base64: %v", k.Kid, err)
+			}
+			if len(secret) < 32 {
+				return nil, fmt.Errorf("key %s: HS256 secret must be at least 32 bytes", k.Kid)
+			}
+			key.Method, key.signKey, key.verifyKey = jwt.SigningMethodHS256, secret, secret
+		case "RS256", "EdDSA":
+			key.Method = jwt.GetSigningMethod(k.Alg)
+			if k.Private != "" {
+				block, err := readPEM(k.Private)
+				if err != nil {
+					return nil, fmt.Errorf("key %s: %v", k.Kid, err)
+				}
+				if key.signKey, err = parsePrivateKey(block); err != nil {
+					return nil, fmt.Errorf("key %s: %v", k.Kid, err)
+				}
+				key.verifyKey = key.signKey.(crypto.Signer).Public()
+			} else {
+				block, err := readPEM(k.Public)
+				if err != nil {
+					return nil, fmt.Errorf("key %s: %v", k.Kid, err)
+				}
+				if key.verifyKey, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+					return nil, fmt.Errorf("key %s: %v", k.Kid, err)
+				}
+			}
+			if err := checkKeyType(key); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("key %s: unsupported alg %q", k.Kid, k.Alg)
+		}
+		if err := ks.add(key); err != nil {
+			return nil, err
+		}
+	}
+	if err := ks.SetActive(kf.Active); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// NewHS256KeySet create a key set with a single HS256 key, a random secret is generated when secret is nil
+func NewHS256KeySet(kid string, secret []byte) (*KeySet, error) {
+	if secret == nil {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	ks := &KeySet{keys: make(map[string]*Key)}
+	ks.add(&Key{ID: kid, Method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret})
+	return ks, ks.SetActive(kid)
+}
+
+// SetActive choose the key that signs new tokens
+func (ks *KeySet) SetActive(kid string) error {
+	key, ok := ks.keys[kid]
+	if !ok {
+		return fmt.Errorf("active key %q is not in the key set", kid)
+	}
+	if key.signKey == nil {
+		return fmt.Errorf("active key %q has no private key", kid)
+	}
+	ks.active = key
+	return nil
+}
+
+func (ks *KeySet) add(key *Key) error {
+	if key.ID == "" {
+		return errors.New("every key needs a kid")
+	}
+	if _, ok := ks.keys[key.ID]; ok {
+		return fmt.Errorf("duplicate key id %q", key.ID)
+	}
+	ks.keys[key.ID] = key
+	return nil
+}
+
+// Sign sign claims with the active key, the key id goes in the kid header
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.active.Method, claims)
+	token.Header["kid"] = ks.active.ID
+	return token.SignedString(ks.active.signKey)
+}
+
+// Parse verify a token with the key named by its kid header and decode its claims
+func (ks *KeySet) Parse(tokenStr string, claims jwt.Claims) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenStr, claims, ks.keyFunc)
+}
+
+// keyFunc pick the verification key for a token; the alg of the token must match the key,
+// otherwise an attacker could for example sign with HS256 using an RSA public key as the secret
+func (ks *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("key %q does not sign with %s", kid, token.Method.Alg())
+	}
+	return key.verifyKey, nil
+}
+
+func parsePrivateKey(block *pem.Block) (interface{}, error) {
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+func checkKeyType(key *Key) error {
+	var ok bool
+	switch key.Method.Alg() {
+	case "RS256":
+		_, ok = key.verifyKey.(*rsa.PublicKey)
+	case "EdDSA":
+		_, ok = key.verifyKey.(ed25519.PublicKey)
+	}
+	if !ok {
+		return fmt.Errorf("key %s: not a %s key", key.ID, key.Method.Alg())
+	}
+	return nil
+}
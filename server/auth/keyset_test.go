@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func writeKeyFile(t *testing.T, dir string, active string) string {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(filepath.Join(dir, "ed.pem"), pemData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	secret := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+	conf := `{"active": "` + active + `", "keys": [
+		{"kid": "hs", "alg": "HS256", "secret": "` + secret + `"},
+		{"kid": "ed", "alg": "EdDSA", "private": "ed.pem"}
+	]}`
+	path := filepath.Join(dir, "keys.json")
+	if err := ioutil.WriteFile(path, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestKeySetRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ks, err := LoadKeySet(writeKeyFile(t, dir, "hs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, _, err := ks.IssueAccessToken("alice", "customer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//轮换到EdDSA之后，旧密钥签发的token仍然有效
+	if err := ks.SetActive("ed"); err != nil {
+		t.Fatal(err)
+	}
+	fresh, _, err := ks.IssueAccessToken("bob", "customer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tokenStr, want := range map[string]string{old: "alice", fresh: "bob"} {
+		claims, err := ks.ParseAccessToken(tokenStr)
+		if err != nil {
+			t.Fatalf("ParseAccessToken: %v", err)
+		}
+		if claims.Subject != want {
+			t.Errorf("subject = %q, want %q", claims.Subject, want)
+		}
+	}
+	token, _ := jwt.Parse(fresh, nil)
+	if token.Header["kid"] != "ed" || token.Header["alg"] != "EdDSA" {
+		t.Errorf("header = %v, want kid ed and alg EdDSA", token.Header)
+	}
+}
+
+func TestKeySetRejectsForeignTokens(t *testing.T) {
+	ks, err := NewHS256KeySet("a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := NewHS256KeySet("a", nil)
+	forged, _, _ := other.IssueAccessToken("alice", "customer")
+	if _, err := ks.ParseAccessToken(forged); err == nil {
+		t.Error("token signed with another secret was accepted")
+	}
+
+	unknown, _ := NewHS256KeySet("b", nil)
+	tokenStr, _, _ := unknown.IssueAccessToken("alice", "customer")
+	if _, err := ks.ParseAccessToken(tokenStr); err == nil {
+		t.Error("token with an unknown kid was accepted")
+	}
+}
@@ -0,0 +1,46 @@
+// Package auth deal with user credentials
+package auth
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against when the user does not exist, so that a login for an unknown
+// username takes as long as one with a wrong password
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// MaxPasswordLength is the longest password in bytes, bcrypt only uses the first 72 bytes
+const MaxPasswordLength = 72
+
+// HashPassword hash a password with bcrypt, the password must not be longer than MaxPasswordLength
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// IsHashed report whether a stored password is a bcrypt hash rather than a plaintext password
+func IsHashed(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// CheckPassword compare a password with the stored one.
+// Old records keep the password in plaintext, needsRehash is true when such a record matched
+// and the caller should store HashPassword(password) instead.
+func CheckPassword(stored string, password string) (ok bool, needsRehash bool) {
+	if !IsHashed(stored) {
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return ok, ok
+	}
+	return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil, false
+}
+
+// CheckNoUser burn the same time as CheckPassword for a username that does not exist
+func CheckNoUser(password string) {
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
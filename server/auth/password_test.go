@@ -0,0 +1,29 @@
+package auth
+
+import "testing"
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsHashed(hash) {
+		t.Errorf("hash %q is not recognised as a bcrypt hash", hash)
+	}
+
+	tests := []struct {
+		stored, password string
+		ok, rehash       bool
+	}{
+		{hash, "secret", true, false},
+		{hash, "wrong", false, false},
+		{"secret", "secret", true, true},
+		{"secret", "wrong", false, false},
+	}
+	for _, tt := range tests {
+		ok, rehash := CheckPassword(tt.stored, tt.password)
+		if ok != tt.ok || rehash != tt.rehash {
+			t.Errorf("CheckPassword(%q, %q) = %v, %v, want %v, %v", tt.stored, tt.password, ok, rehash, tt.ok, tt.rehash)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// AccessTokenTTL is how long an access token stays valid, a client renews it with its refresh token
+var AccessTokenTTL = 15 * time.Minute
+
+// RefreshTokenTTL is how long a refresh token stays valid
+var RefreshTokenTTL = 30 * 24 * time.Hour
+
+// Claims are the claims of an access token, Subject is the username and Id (jti) identifies the token
+// in the revocation list
+type Claims struct {
+	Role string `json:"role,omitempty"`
+	jwt.StandardClaims
+}
+
+// IssueAccessToken sign a new access token for a user
+func (ks *KeySet) IssueAccessToken(username string, role string) (string, *Claims, error) {
+	jti, err := randomString(16)
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now()
+	claims := &Claims{Role: role, StandardClaims: jwt.StandardClaims{
+		Id:        jti,
+		Subject:   username,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(AccessTokenTTL).Unix(),
+	}}
+	tokenStr, err := ks.Sign(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	return tokenStr, claims, nil
+}
+
+// ParseAccessToken verify an access token and return its claims
+func (ks *KeySet) ParseAccessToken(tokenStr string) (*Claims, error) {
+	var claims Claims
+	token, err := ks.Parse(tokenStr, &claims)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid || claims.Subject == "" {
+		return nil, errors.New("invalid token")
+	}
+	return &claims, nil
+}
+
+// NewRefreshToken create an opaque refresh token for the client and the id under which the server
+// stores it; only the hash of the token is stored, so a database dump does not leak usable tokens
+func NewRefreshToken() (token string, id string, err error) {
+	token, err = randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	return token, RefreshTokenID(token), nil
+}
+
+// RefreshTokenID is the id under which a refresh token is stored
+func RefreshTokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewFamily create the id of a new refresh token family, every token obtained by rotating
+// a refresh token belongs to the family of the token that was used
+func NewFamily() (string, error) {
+	return randomString(16)
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,177 @@
+// Package config read the server configuration from environment variables
+package config
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultRequestTimeout is used when request_timeout is not set
+const DefaultRequestTimeout = 10 * time.Second
+
+// DefaultUploadExpiry is used when upload_expiry is not set
+const DefaultUploadExpiry = 24 * time.Hour
+
+// DefaultMediaMaxSize is used when media_max_size is not set
+const DefaultMediaMaxSize = 100 << 20
+
+// DefaultPictureGCGrace is used when picture_gc_grace is not set
+const DefaultPictureGCGrace = 7 * 24 * time.Hour
+
+// Config is the configuration of the server
+type Config struct {
+	// Profile is "prod" when running in production (docker compose)
+	Profile string
+	// JWTKeys is the path of the json file holding the token signing keys, see auth.LoadKeySet
+	JWTKeys string
+	// AdminUsers are given the admin role at startup (comma separated admin_users),
+	// other roles are then managed through PUT /users/{user}/role
+	AdminUsers []string
+	// AdminUsersWrittenAt is when admin_users was written (admin_users_written_at, RFC 3339), required with admin_users:
+	// accounts registered later are not promoted, someone could have registered a listed name that had no account yet
+	AdminUsersWrittenAt time.Time
+	// DBBackend is "mongo" (default), "bolt" or "memory"; bolt and memory need no MongoDB
+	DBBackend string
+	// DBFile is the database file of the bolt backend, webapp.db when it is empty
+	DBFile string
+	// DBSnapshot is the JSON file the in-memory database is loaded from at startup and saved to on shutdown,
+	// the data is lost on shutdown when it is empty
+	DBSnapshot string
+	// RequestTimeout is the longest a request may take (request_timeout, e.g. "5s"), the database calls of a
+	// request that takes longer are cancelled and 503 is returned; 0 disables the limit
+	RequestTimeout time.Duration
+	// PictureStorage is where the uploaded pictures are kept: "local" (default) for the directory PictureDir,
+	// "s3" for the bucket S3Bucket of an S3-compatible storage
+	PictureStorage string
+	// PictureDir is the directory of the local storage, ./picture when it is empty
+	PictureDir string
+	// S3Endpoint is the URL of the S3-compatible storage (e.g. http://minio:9000), empty for AWS S3
+	S3Endpoint string
+	// S3Region is the region of the bucket, us-east-1 when it is empty
+	S3Region string
+	// S3Bucket is the bucket of the pictures, it must exist
+	S3Bucket string
+	// S3AccessKey and S3SecretKey are the credentials of the storage, the default AWS credentials are used when they are empty
+	S3AccessKey string
+	S3SecretKey string
+	// PictureLinkExpiry is how long the pre-signed links of the S3 storage are valid (picture_link_expiry, e.g. "15m");
+	// GET /picture/ then redirects to such a link. 0 (default) serves the pictures through the API
+	PictureLinkExpiry time.Duration
+	// UploadDir is the directory of the pictures uploaded in chunks through /picture/uploads until they are complete,
+	// ./uploads when it is empty
+	UploadDir string
+	// UploadExpiry is how long an upload that receives nothing is kept (upload_expiry, e.g. "12h"), 24h by default
+	UploadExpiry time.Duration
+	// MediaMaxSize is the size limit in bytes of the videos and of the uploads through /picture/uploads
+	// (media_max_size in MiB, e.g. "200"), 100 MiB by default; pictures are limited to 10 MiB whatever it is
+	MediaMaxSize int64
+	// PictureGCInterval is how often the pictures no commodity uses are deleted (picture_gc_interval, e.g. "24h");
+	// 0 (default) disables the background collection, POST /admin/pictures/gc still runs it
+	PictureGCInterval time.Duration
+	// PictureGCGrace is how old an unused picture must be to be deleted (picture_gc_grace), 7 days by default
+	PictureGCGrace time.Duration
+}
+
+// Load read the configuration from the environment
+func Load() Config {
+	return Config{
+		Profile:    os.Getenv("profile"),
+		JWTKeys:    os.Getenv("jwt_keys"),
+		AdminUsers: splitList(os.Getenv("admin_users")),
+
+		AdminUsersWrittenAt: parseTime(os.Getenv("admin_users_written_at")),
+
+		DBBackend:  os.Getenv("db_backend"),
+		DBFile:     os.Getenv("db_file"),
+		DBSnapshot: os.Getenv("db_snapshot"),
+
+		RequestTimeout: parseDuration(os.Getenv("request_timeout"), DefaultRequestTimeout),
+
+		PictureStorage: os.Getenv("picture_storage"),
+		PictureDir:     os.Getenv("picture_dir"),
+		S3Endpoint:     os.Getenv("s3_endpoint"),
+		S3Region:       os.Getenv("s3_region"),
+		S3Bucket:       os.Getenv("s3_bucket"),
+		S3AccessKey:    os.Getenv("s3_access_key"),
+		S3SecretKey:    os.Getenv("s3_secret_key"),
+
+		PictureLinkExpiry: parseDuration(os.Getenv("picture_link_expiry"), 0),
+		UploadDir:         os.Getenv("upload_dir"),
+		UploadExpiry:      parseDuration(os.Getenv("upload_expiry"), DefaultUploadExpiry),
+		MediaMaxSize:      parseMiB(os.Getenv("media_max_size"), DefaultMediaMaxSize),
+		PictureGCInterval: parseDuration(os.Getenv("picture_gc_interval"), 0),
+		PictureGCGrace:    parseDuration(os.Getenv("picture_gc_grace"), DefaultPictureGCGrace),
+	}
+}
+
+// parseDuration parse v as a time.Duration, def is used when v is empty or invalid
+func parseDuration(v string, def time.Duration) time.Duration {
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Println("Invalid duration", v, "using", def)
+		return def
+	}
+	return d
+}
+
+// parseTime parse v as an RFC 3339 time, the zero time when v is empty or invalid
+func parseTime(v string) time.Time {
+	if v == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		log.Println("Invalid time", v, "it must look like 2006-01-02T15:04:05Z")
+		return time.Time{}
+	}
+	return t
+}
+
+// parseMiB parse v as a positive number of MiB and give it in bytes, def is used when v is empty or invalid
+func parseMiB(v string, def int64) int64 {
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 || n > 1<<20 {
+		log.Println("Invalid size", v, "using", def>>20, "MiB")
+		return def
+	}
+	return n << 20
+}
+
+func splitList(v string) []string {
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Prod report whether the server runs in production
+func (c Config) Prod() bool {
+	return c.Profile == "prod"
+}
+
+// Memory report whether the in-memory database is used instead of MongoDB
+func (c Config) Memory() bool {
+	return c.DBBackend == "memory"
+}
+
+// Bolt report whether the bolt database file is used instead of MongoDB
+func (c Config) Bolt() bool {
+	return c.DBBackend == "bolt"
+}
+
+// S3 report whether the pictures are kept in an S3-compatible storage instead of a local directory
+func (c Config) S3() bool {
+	return c.PictureStorage == "s3"
+}
@@ -0,0 +1,1045 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+	"webapp/model"
+
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// bucket names, the index buckets map a secondary key to the key of the record
+var (
+	commodityBucket    = []byte("commodity")
+	commoditySlugIndex = []byte("commodity_slug")
+	categoryBucket     = []byte("category")
+	commentBucket      = []byte("comment")
+	//评论按商品索引：commodityId/commentId
+	commentCommodityIndex = []byte("comment_commodity")
+	userBucket            = []byte("user")
+	cartBucket            = []byte("cart")
+	//订单的key：username/orderId
+	orderBucket   = []byte("order")
+	tokenBucket   = []byte("token")
+	revokedBucket = []byte("revoked")
+	metaBucket    = []byte("meta")
+)
+
+// boltSchemaVersion is written to the meta bucket when the buckets are created
+const boltSchemaVersion = "1"
+
+// Bolt store the data in a single file with bbolt, for small deployments that do not want to run MongoDB.
+// Records are JSON, every method runs in one transaction so each call is atomic like the conditional updates of MongoDB.
+type Bolt struct {
+	db *bolt.DB
+}
+
+var _ DB = (*Bolt)(nil)
+
+// OpenBolt open (or create) the database file at path and create the buckets that are missing
+func OpenBolt(path string) (*Bolt, error) {
+	bdb, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{commodityBucket, commoditySlugIndex, categoryBucket, commentBucket, commentCommodityIndex,
+			userBucket, cartBucket, orderBucket, tokenBucket, revokedBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(metaBucket).Put([]byte("schema"), []byte(boltSchemaVersion))
+	})
+	if err != nil {
+		bdb.Close()
+		return nil, err
+	}
+	return &Bolt{db: bdb}, nil
+}
+
+// Close close the database file
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+// get decode the record at key, found is false when there is none
+func get(tx *bolt.Tx, bucket []byte, key string, v interface{}) (bool, error) {
+	data := tx.Bucket(bucket).Get([]byte(key))
+	if data == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+// put encode v and store it at key
+func put(tx *bolt.Tx, bucket []byte, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucket).Put([]byte(key), data)
+}
+
+// ListCommodities get a page of commodities, the filters are applied while scanning the commodity bucket
+func (b *Bolt) ListCommodities(ctx context.Context, q CommodityQuery) (*CommodityPage, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	//扫描时就要用到整理后的筛选条件
+	if _, err := q.normalize(); err != nil {
+		return nil, err
+	}
+	commodities := []*model.Commodity{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		categories, err := listCategoriesTx(tx)
+		if err != nil {
+			return err
+		}
+		q.withSubtree(categories)
+		return tx.Bucket(commodityBucket).ForEach(func(k, v []byte) error {
+			var c model.Commodity
+			if err := json.Unmarshal(v, &c); err != nil {
+				return err
+			}
+			if matchCommodity(&c, &q) {
+				commodities = append(commodities, &c)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pageCommodities(commodities, q)
+}
+
+// CommodityFacets count the commodities matching the filters of q by category, tag and price range
+func (b *Bolt) CommodityFacets(ctx context.Context, q CommodityQuery) (*Facets, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	var facets *Facets
+	err := b.db.View(func(tx *bolt.Tx) error {
+		categories, err := listCategoriesTx(tx)
+		if err != nil {
+			return err
+		}
+		var commodities []*model.Commodity
+		err = tx.Bucket(commodityBucket).ForEach(func(k, v []byte) error {
+			var c model.Commodity
+			if err := json.Unmarshal(v, &c); err != nil {
+				return err
+			}
+			commodities = append(commodities, &c)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		facets, err = scanFacets(commodities, categories, q)
+		return err
+	})
+	return facets, err
+}
+
+func listCategoriesTx(tx *bolt.Tx) ([]*model.Category, error) {
+	categories := []*model.Category{}
+	err := tx.Bucket(categoryBucket).ForEach(func(k, v []byte) error {
+		var c model.Category
+		if err := json.Unmarshal(v, &c); err != nil {
+			return err
+		}
+		categories = append(categories, &c)
+		return nil
+	})
+	sortCategories(categories)
+	return categories, err
+}
+
+// ListCategories get the whole category tree as a flat list
+func (b *Bolt) ListCategories(ctx context.Context) ([]*model.Category, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	var categories []*model.Category
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		categories, err = listCategoriesTx(tx)
+		return err
+	})
+	return categories, err
+}
+
+// GetCategory get one category by id
+func (b *Bolt) GetCategory(ctx context.Context, id string) (*model.Category, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	var category model.Category
+	err := b.db.View(func(tx *bolt.Tx) error {
+		found, err := get(tx, categoryBucket, id, &category)
+		if err == nil && !found {
+			err = ErrCategoryNotFound
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &category, nil
+}
+
+// WriteCategory add a category when category.Id is empty, otherwise rename or move the category with that id
+func (b *Bolt) WriteCategory(ctx context.Context, category *model.Category) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		categories, err := listCategoriesTx(tx)
+		if err != nil {
+			return err
+		}
+		if err := validCategory(category, categories); err != nil {
+			return err
+		}
+		bucket := tx.Bucket(categoryBucket)
+		if category.Id == "" {
+			category.Id = categoryID(category.Name, func(id string) bool { return bucket.Get([]byte(id)) != nil })
+		} else if bucket.Get([]byte(category.Id)) == nil {
+			return ErrCategoryNotFound
+		}
+		return put(tx, categoryBucket, category.Id, category)
+	})
+}
+
+// DeleteCategory delete a category that has no subcategories and no commodities
+func (b *Bolt) DeleteCategory(ctx context.Context, id string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		categories, err := listCategoriesTx(tx)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, c := range categories {
+			if c.Parent == id {
+				return ErrCategoryInUse
+			}
+			found = found || c.Id == id
+		}
+		if !found {
+			return ErrCategoryNotFound
+		}
+		//商品没有按分类的索引，分类很少删除，扫描一遍即可
+		err = tx.Bucket(commodityBucket).ForEach(func(k, v []byte) error {
+			var c model.Commodity
+			if err := json.Unmarshal(v, &c); err != nil {
+				return err
+			}
+			if c.Category == id {
+				return ErrCategoryInUse
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(categoryBucket).Delete([]byte(id))
+	})
+}
+
+// GetOneCommodity get one commodity by id
+func (b *Bolt) GetOneCommodity(ctx context.Context, id string) (*model.Commodity, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	var commodity *model.Commodity
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		commodity, err = findCommodityTx(tx, id)
+		return err
+	})
+	return commodity, err
+}
+
+func findCommodityTx(tx *bolt.Tx, id string) (*model.Commodity, error) {
+	var commodity model.Commodity
+	found, err := get(tx, commodityBucket, id, &commodity)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, &CommodityGoneError{Id: id}
+	}
+	return &commodity, nil
+}
+
+// GetCommodityBySlug get one commodity by slug
+func (b *Bolt) GetCommodityBySlug(ctx context.Context, slug string) (*model.Commodity, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	var commodity *model.Commodity
+	err := b.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(commoditySlugIndex).Get([]byte(slug))
+		if id == nil {
+			return &CommodityGoneError{Id: slug}
+		}
+		var err error
+		commodity, err = findCommodityTx(tx, string(id))
+		return err
+	})
+	return commodity, err
+}
+
+// PostCommodity add a commodity when commodity.Id is empty, otherwise update (or create) the commodity with that id.
+// 库存只在新增商品时写入
+func (b *Bolt) PostCommodity(ctx context.Context, commodity *model.Commodity) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	commodity.Tags = cleanTags(commodity.Tags)
+	if err := validCommodity(commodity); err != nil {
+		return err
+	}
+	if commodity.Id == "" {
+		commodity.Id = primitive.NewObjectID().Hex()
+	}
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		slugs := tx.Bucket(commoditySlugIndex)
+		var old model.Commodity
+		found, err := get(tx, commodityBucket, commodity.Id, &old)
+		if err != nil {
+			return err
+		}
+		if found {
+			commodity.CreatedAt = old.CreatedAt
+		} else if commodity.CreatedAt.IsZero() {
+			commodity.CreatedAt = time.Now()
+		}
+		stored := *commodity
+		//规格只通过SetVariants修改，图片只通过SetImages修改
+		stored.Options, stored.Variants, stored.Images = old.Options, old.Variants, old.Images
+		if found {
+			stored.Stock = old.Stock
+			if err := slugs.Delete([]byte(old.Slug)); err != nil {
+				return err
+			}
+		}
+		commodity.Slug = Slugify(commodity.Name)
+		if id := slugs.Get([]byte(commodity.Slug)); id != nil && string(id) != commodity.Id {
+			commodity.Slug = slugWithID(commodity.Slug, commodity.Id)
+		}
+		stored.Slug = commodity.Slug
+		if err := slugs.Put([]byte(commodity.Slug), []byte(commodity.Id)); err != nil {
+			return err
+		}
+		return put(tx, commodityBucket, commodity.Id, &stored)
+	})
+	if err != nil {
+		log.Println("Error while saving a commodity:", err.Error())
+	}
+	return err
+}
+
+// AdjustStock add delta to the stock of a commodity, or of its variant sku, a negative delta never takes the stock below zero
+func (b *Bolt) AdjustStock(ctx context.Context, id string, sku string, delta int) (*model.Commodity, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	return b.updateStock(id, func(c *model.Commodity) error {
+		return changeStock(c, sku, delta)
+	})
+}
+
+// SetStock overwrite the stock of a commodity, or of its variant sku
+func (b *Bolt) SetStock(ctx context.Context, id string, sku string, stock int) (*model.Commodity, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	return b.updateStock(id, func(c *model.Commodity) error {
+		old, err := StockOf(c, sku)
+		if err != nil {
+			return err
+		}
+		return changeStock(c, sku, stock-old)
+	})
+}
+
+// SetVariants replace the variants of a commodity, see applyVariants
+func (b *Bolt) SetVariants(ctx context.Context, id string, variants []model.Variant) (*model.Commodity, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	options, err := prepareVariants(variants)
+	if err != nil {
+		return nil, err
+	}
+	return b.updateStock(id, func(c *model.Commodity) error {
+		applyVariants(c, variants, options)
+		return nil
+	})
+}
+
+// SetImages replace the images of a commodity in display order if they are still old, see applyImages
+func (b *Bolt) SetImages(ctx context.Context, id string, old []model.Image, images []model.Image) (*model.Commodity, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	images, err := cleanImages(images)
+	if err != nil {
+		return nil, err
+	}
+	return b.updateStock(id, func(c *model.Commodity) error {
+		if !sameImages(shownImages(c), old) {
+			return ErrImagesChanged
+		}
+		applyImages(c, images)
+		return nil
+	})
+}
+
+func (b *Bolt) updateStock(id string, change func(c *model.Commodity) error) (*model.Commodity, error) {
+	var commodity *model.Commodity
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		commodity, err = findCommodityTx(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := change(commodity); err != nil {
+			return err
+		}
+		return put(tx, commodityBucket, id, commodity)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return commodity, nil
+}
+
+// ListComments get a page of the comments of a commodity
+func (b *Bolt) ListComments(ctx context.Context, commodityId string, q CommentQuery) (*CommentPage, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	comments := []*model.Comment{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(commodityId + "/")
+		c := tx.Bucket(commentCommodityIndex).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			var comment model.Comment
+			found, err := get(tx, commentBucket, string(k[len(prefix):]), &comment)
+			if err != nil {
+				return err
+			}
+			if found {
+				comments = append(comments, &comment)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pageComments(comments, q)
+}
+
+// WriteComment add a comment, the id and creation time are assigned here
+func (b *Bolt) WriteComment(ctx context.Context, comment *model.Comment) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	if err := validComment(comment.Comment); err != nil {
+		return err
+	}
+	id := primitive.NewObjectID().Hex()
+	createdAt := time.Now()
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		stored := *comment
+		stored.Id = id
+		stored.CreatedAt = createdAt
+		if err := put(tx, commentBucket, id, &stored); err != nil {
+			return err
+		}
+		return tx.Bucket(commentCommodityIndex).Put([]byte(comment.CommodityId+"/"+id), []byte{})
+	})
+	if err != nil {
+		log.Println("Fail to insert a comment:", err.Error())
+		return err
+	}
+	comment.Id = id
+	comment.CreatedAt = createdAt
+	return nil
+}
+
+// GetComment get a comment by id
+func (b *Bolt) GetComment(ctx context.Context, id string) (*model.Comment, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	var comment model.Comment
+	err := b.db.View(func(tx *bolt.Tx) error {
+		found, err := get(tx, commentBucket, id, &comment)
+		if err == nil && !found {
+			err = ErrCommentNotFound
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &comment, nil
+}
+
+// UpdateComment replace the text of a comment, the old text is appended to its history
+func (b *Bolt) UpdateComment(ctx context.Context, id string, text string) (*model.Comment, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	if err := validComment(text); err != nil {
+		return nil, err
+	}
+	var comment model.Comment
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		found, err := get(tx, commentBucket, id, &comment)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return ErrCommentNotFound
+		}
+		now := time.Now()
+		comment.History = append(comment.History, model.CommentRevision{Comment: comment.Comment, EditedAt: now})
+		comment.Comment = text
+		comment.EditedAt = &now
+		return put(tx, commentBucket, id, &comment)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &comment, nil
+}
+
+// DeleteComment delete a comment by id
+func (b *Bolt) DeleteComment(ctx context.Context, id string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var comment model.Comment
+		found, err := get(tx, commentBucket, id, &comment)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return ErrCommentNotFound
+		}
+		if err := tx.Bucket(commentCommodityIndex).Delete([]byte(comment.CommodityId + "/" + id)); err != nil {
+			return err
+		}
+		return tx.Bucket(commentBucket).Delete([]byte(id))
+	})
+}
+
+// getUser decode a user with its password
+func getUser(tx *bolt.Tx, username string) (*model.User, error) {
+	var stored storedUser
+	found, err := get(tx, userBucket, username, &stored)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrUserNotFound
+	}
+	user := stored.User
+	user.Password = stored.Password
+	return &user, nil
+}
+
+func putUser(tx *bolt.Tx, user *model.User) error {
+	return put(tx, userBucket, user.Username, storedUser{User: *user, Password: user.Password})
+}
+
+// GetUsersInfo get all users
+func (b *Bolt) GetUsersInfo(ctx context.Context) ([]*model.User, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	users := []*model.User{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(userBucket).ForEach(func(k, v []byte) error {
+			user, err := getUser(tx, string(k))
+			if err != nil {
+				return err
+			}
+			users = append(users, user)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// GetAUserInfo get a user, the result is empty when the user does not exist
+func (b *Bolt) GetAUserInfo(ctx context.Context, username string) ([]*model.User, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	user, err := b.GetUser(ctx, username)
+	if err == ErrUserNotFound {
+		return []*model.User{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []*model.User{user}, nil
+}
+
+// UserRegister add a user, an existing user is never overwritten
+func (b *Bolt) UserRegister(ctx context.Context, un string, pw string, bl float64) (*model.User, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	user := model.User{Username: un, Password: pw, Balance: bl, Role: model.RoleCustomer, CreatedAt: time.Now()}
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(userBucket).Get([]byte(un)) != nil {
+			return ErrUserExists
+		}
+		return putUser(tx, &user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// GetUser get a user by username
+func (b *Bolt) GetUser(ctx context.Context, username string) (*model.User, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	var user *model.User
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		user, err = getUser(tx, username)
+		return err
+	})
+	return user, err
+}
+
+// updateUser change a user in one transaction
+func (b *Bolt) updateUser(username string, change func(u *model.User)) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		user, err := getUser(tx, username)
+		if err != nil {
+			return err
+		}
+		change(user)
+		return putUser(tx, user)
+	})
+}
+
+// UpdatePassword replace the stored password of a user
+func (b *Bolt) UpdatePassword(ctx context.Context, username string, password string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	return b.updateUser(username, func(u *model.User) { u.Password = password })
+}
+
+// SetUserRole change the role of a user
+func (b *Bolt) SetUserRole(ctx context.Context, username string, role string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	return b.updateUser(username, func(u *model.User) { u.Role = role })
+}
+
+// SetBalance change the balance of a user
+func (b *Bolt) SetBalance(ctx context.Context, username string, balance float64) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	return b.updateUser(username, func(u *model.User) { u.Balance = balance })
+}
+
+// getCart decode the cart of a user, a user without a cart has an empty one
+func getCart(tx *bolt.Tx, username string) (*model.Cart, error) {
+	cart := model.Cart{Username: username}
+	if _, err := get(tx, cartBucket, username, &cart); err != nil {
+		return nil, err
+	}
+	if cart.Lines == nil {
+		cart.Lines = []model.CartLine{}
+	}
+	return &cart, nil
+}
+
+// GetCart get the cart of a user, a user without a cart has an empty one
+func (b *Bolt) GetCart(ctx context.Context, username string) (*model.Cart, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	var cart *model.Cart
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		cart, err = getCart(tx, username)
+		return err
+	})
+	return cart, err
+}
+
+// WriteCart replace all the lines of the cart
+func (b *Bolt) WriteCart(ctx context.Context, cart *model.Cart) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	if err := validCart(cart); err != nil {
+		return err
+	}
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return put(tx, cartBucket, cart.Username, cart)
+	})
+	if err != nil {
+		log.Println("Error while writing a cart:", err.Error())
+	}
+	return err
+}
+
+// updateCart change the cart of a user in one transaction and return the new cart
+func (b *Bolt) updateCart(username string, change func(c *model.Cart) error) (*model.Cart, error) {
+	var cart *model.Cart
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		cart, err = getCart(tx, username)
+		if err != nil {
+			return err
+		}
+		if err := change(cart); err != nil {
+			return err
+		}
+		return put(tx, cartBucket, username, cart)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cart, nil
+}
+
+// AddCartLine add quantity of a commodity to the cart, the quantity is summed if the commodity is already in the cart
+func (b *Bolt) AddCartLine(ctx context.Context, username string, line model.CartLine) (*model.Cart, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	if err := validLine(line); err != nil {
+		return nil, err
+	}
+	return b.updateCart(username, func(c *model.Cart) error {
+		for i := range c.Lines {
+			if sameLine(c.Lines[i], line) {
+				c.Lines[i].Quantity += line.Quantity
+				return nil
+			}
+		}
+		c.Lines = append(c.Lines, line)
+		return nil
+	})
+}
+
+// SetCartLine change the quantity of a commodity in the cart, a quantity of 0 removes the line
+func (b *Bolt) SetCartLine(ctx context.Context, username string, line model.CartLine) (*model.Cart, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	if line.Quantity <= 0 {
+		return b.RemoveCartLine(ctx, username, line.CommodityId, line.Sku)
+	}
+	return b.updateCart(username, func(c *model.Cart) error {
+		for i := range c.Lines {
+			if sameLine(c.Lines[i], line) {
+				c.Lines[i].Quantity = line.Quantity
+				return nil
+			}
+		}
+		return ErrCartLineNotFound
+	})
+}
+
+// RemoveCartLine remove a commodity, or one variant of it, from the cart
+func (b *Bolt) RemoveCartLine(ctx context.Context, username string, commodityId string, sku string) (*model.Cart, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	return b.updateCart(username, func(c *model.Cart) error {
+		for i := range c.Lines {
+			if sameLine(c.Lines[i], model.CartLine{CommodityId: commodityId, Sku: sku}) {
+				c.Lines = append(c.Lines[:i], c.Lines[i+1:]...)
+				return nil
+			}
+		}
+		return ErrCartLineNotFound
+	})
+}
+
+// Checkout turn the cart of a user into an order, see MongoDB.Checkout.
+// Everything happens in one transaction, a failure leaves stock and balance untouched
+func (b *Bolt) Checkout(ctx context.Context, username string) (*model.Order, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	order := model.Order{
+		Id:        primitive.NewObjectID().Hex(),
+		Username:  username,
+		CreatedAt: time.Now(),
+	}
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		cart, err := getCart(tx, username)
+		if err != nil {
+			return err
+		}
+		if len(cart.Lines) == 0 {
+			return ErrEmptyCart
+		}
+		order.Lines, order.Total, err = PriceLines(cart.Lines, func(id string) (*model.Commodity, error) {
+			return findCommodityTx(tx, id)
+		})
+		if err != nil {
+			return err
+		}
+		quantities, err := orderQuantities(order.Lines)
+		if err != nil {
+			return err
+		}
+		for key, n := range quantities {
+			commodity, err := findCommodityTx(tx, key.id)
+			if err != nil {
+				return err
+			}
+			if err := changeStock(commodity, key.sku, -n); err != nil {
+				return err
+			}
+			if err := put(tx, commodityBucket, key.id, commodity); err != nil {
+				return err
+			}
+		}
+		user, err := getUser(tx, username)
+		if err != nil {
+			return err
+		}
+		if user.Balance < order.Total {
+			return ErrInsufficientBalance
+		}
+		user.Balance -= order.Total
+		if err := putUser(tx, user); err != nil {
+			return err
+		}
+		if orderHook != nil {
+			if err := orderHook(&order); err != nil {
+				return err
+			}
+		}
+		if err := put(tx, orderBucket, username+"/"+order.Id, &order); err != nil {
+			return err
+		}
+		cart.Lines = []model.CartLine{}
+		return put(tx, cartBucket, username, cart)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// GetOrders get all orders of a user, newest first
+func (b *Bolt) GetOrders(ctx context.Context, username string) ([]*model.Order, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	orders := []*model.Order{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(username + "/")
+		c := tx.Bucket(orderBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var order model.Order
+			if err := json.Unmarshal(v, &order); err != nil {
+				return err
+			}
+			if order.Username != username {
+				continue
+			}
+			//id按时间递增，倒序插入得到最新的在前
+			orders = append([]*model.Order{&order}, orders...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// GetOrder get one order of a user
+func (b *Bolt) GetOrder(ctx context.Context, username string, id string) (*model.Order, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	var order model.Order
+	err := b.db.View(func(tx *bolt.Tx) error {
+		found, err := get(tx, orderBucket, username+"/"+id, &order)
+		if err == nil && !found {
+			err = ErrOrderNotFound
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// AddToken save a refresh token, a token with the same id is replaced
+func (b *Bolt) AddToken(ctx context.Context, token *model.RefreshToken) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return put(tx, tokenBucket, token.Id, token)
+	})
+	if err != nil {
+		log.Println("Error while saving a token:", err.Error())
+	}
+	return err
+}
+
+// GetAToken get a refresh token by id
+func (b *Bolt) GetAToken(ctx context.Context, id string) (*model.RefreshToken, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	var token model.RefreshToken
+	err := b.db.View(func(tx *bolt.Tx) error {
+		found, err := get(tx, tokenBucket, id, &token)
+		if err == nil && !found {
+			err = ErrTokenNotFound
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// UseToken mark a refresh token as used, only the first call for a token succeeds
+func (b *Bolt) UseToken(ctx context.Context, id string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var token model.RefreshToken
+		found, err := get(tx, tokenBucket, id, &token)
+		if err != nil {
+			return err
+		}
+		if !found || token.Used || token.Revoked {
+			return ErrTokenReused
+		}
+		token.Used = true
+		return put(tx, tokenBucket, id, &token)
+	})
+}
+
+// RevokeTokenFamily revoke every refresh token of a family
+func (b *Bolt) RevokeTokenFamily(ctx context.Context, family string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var revoke []model.RefreshToken
+		err := tx.Bucket(tokenBucket).ForEach(func(k, v []byte) error {
+			var token model.RefreshToken
+			if err := json.Unmarshal(v, &token); err != nil {
+				return err
+			}
+			if token.Family == family && !token.Revoked {
+				token.Revoked = true
+				revoke = append(revoke, token)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		//ForEach中不能修改bucket
+		for i := range revoke {
+			if err := put(tx, tokenBucket, revoke[i].Id, &revoke[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RevokeAccessToken put the jti of an access token in the revocation list until the token expires.
+// Expired entries are dropped at the same time
+func (b *Bolt) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		revoked := tx.Bucket(revokedBucket)
+		var expired [][]byte
+		err := revoked.ForEach(func(k, v []byte) error {
+			var exp time.Time
+			if err := exp.UnmarshalText(v); err == nil && !exp.After(now) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := revoked.Delete(k); err != nil {
+				return err
+			}
+		}
+		data, err := expiresAt.MarshalText()
+		if err != nil {
+			return err
+		}
+		return revoked.Put([]byte(jti), data)
+	})
+}
+
+// IsAccessTokenRevoked check the revocation list
+func (b *Bolt) IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	if err := checkContext(ctx); err != nil {
+		return false, err
+	}
+	revoked := false
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(revokedBucket).Get([]byte(jti))
+		if v == nil {
+			return nil
+		}
+		var exp time.Time
+		if err := exp.UnmarshalText(v); err != nil {
+			return err
+		}
+		revoked = exp.After(time.Now())
+		return nil
+	})
+	return revoked, err
+}
@@ -0,0 +1,136 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"webapp/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sameLine tell whether two cart lines are for the same commodity and variant
+func sameLine(a model.CartLine, b model.CartLine) bool {
+	return a.CommodityId == b.CommodityId && a.Sku == b.Sku
+}
+
+// lineFilter match the cart line of a commodity and variant, the lines saved before variants have no sku field
+func lineFilter(commodityId string, sku string) bson.M {
+	if sku == "" {
+		return bson.M{"commodityid": commodityId, "sku": bson.M{"$in": bson.A{"", nil}}}
+	}
+	return bson.M{"commodityid": commodityId, "sku": sku}
+}
+
+// AddCartLine add quantity of a commodity to the cart, the quantity is summed if the commodity is already in the cart
+func (m MongoDB) AddCartLine(ctx context.Context, username string, line model.CartLine) (*model.Cart, error) {
+	if err := validLine(line); err != nil {
+		return nil, err
+	}
+	carts := m.database.Collection(cartCollection)
+
+	//保证购物车存在
+	_, err := carts.UpdateOne(ctx, bson.M{"username": username},
+		bson.M{"$setOnInsert": bson.M{"username": username, "lines": []model.CartLine{}}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		log.Println("Error while creating a cart: ", err.Error())
+		return nil, mongoErr(err)
+	}
+	//已有该商品时累加数量，否则添加新的一行；两个操作都带条件，并发添加同一商品不会出现重复的行
+	for {
+		res, err := carts.UpdateOne(ctx,
+			bson.M{"username": username, "lines": bson.M{"$elemMatch": lineFilter(line.CommodityId, line.Sku)}},
+			bson.M{"$inc": bson.M{"lines.$.quantity": line.Quantity}})
+		if err != nil {
+			log.Println("Error while updating a cart line: ", err.Error())
+			return nil, mongoErr(err)
+		}
+		if res.MatchedCount > 0 {
+			break
+		}
+		res, err = carts.UpdateOne(ctx,
+			bson.M{"username": username, "lines": bson.M{"$not": bson.M{"$elemMatch": lineFilter(line.CommodityId, line.Sku)}}},
+			bson.M{"$push": bson.M{"lines": line}})
+		if err != nil {
+			log.Println("Error while adding a cart line: ", err.Error())
+			return nil, mongoErr(err)
+		}
+		if res.MatchedCount > 0 {
+			break
+		}
+	}
+	return m.GetCart(ctx, username)
+}
+
+// SetCartLine change the quantity of a commodity in the cart, a quantity of 0 removes the line
+func (m MongoDB) SetCartLine(ctx context.Context, username string, line model.CartLine) (*model.Cart, error) {
+	if line.Quantity <= 0 {
+		return m.RemoveCartLine(ctx, username, line.CommodityId, line.Sku)
+	}
+	res, err := m.database.Collection(cartCollection).UpdateOne(ctx,
+		bson.M{"username": username, "lines": bson.M{"$elemMatch": lineFilter(line.CommodityId, line.Sku)}},
+		bson.M{"$set": bson.M{"lines.$.quantity": line.Quantity}})
+	if err != nil {
+		log.Println("Error while updating a cart line: ", err.Error())
+		return nil, mongoErr(err)
+	}
+	if res.MatchedCount == 0 {
+		return nil, ErrCartLineNotFound
+	}
+	return m.GetCart(ctx, username)
+}
+
+// RemoveCartLine remove a commodity, or one variant of it, from the cart
+func (m MongoDB) RemoveCartLine(ctx context.Context, username string, commodityId string, sku string) (*model.Cart, error) {
+	res, err := m.database.Collection(cartCollection).UpdateOne(ctx,
+		bson.M{"username": username},
+		bson.M{"$pull": bson.M{"lines": lineFilter(commodityId, sku)}})
+	if err != nil {
+		log.Println("Error while removing a cart line: ", err.Error())
+		return nil, mongoErr(err)
+	}
+	if res.ModifiedCount == 0 {
+		return nil, ErrCartLineNotFound
+	}
+	return m.GetCart(ctx, username)
+}
+
+// PriceLines price the cart lines with the current catalog, find looks up a commodity by id.
+// Lines whose commodity or variant no longer exists are marked Missing and left out of the total,
+// so are lines without a sku for a commodity that has variants.
+func PriceLines(lines []model.CartLine, find func(id string) (*model.Commodity, error)) ([]model.PricedLine, float64, error) {
+	priced := make([]model.PricedLine, 0, len(lines))
+	total := 0.0
+	for _, l := range lines {
+		p := model.PricedLine{CommodityId: l.CommodityId, Sku: l.Sku, Quantity: l.Quantity}
+		commodity, err := find(l.CommodityId)
+		var gone *CommodityGoneError
+		if errors.As(err, &gone) {
+			p.Missing = true
+		} else if err != nil {
+			return nil, 0, err
+		} else {
+			p.Name = commodity.Name
+			p.Price = commodity.Price
+			if v := commodity.Variant(l.Sku); v != nil {
+				p.Price, p.Options = v.Price, v.Options
+			} else if l.Sku != "" || len(commodity.Variants) > 0 {
+				p.Missing = true
+			}
+		}
+		if !p.Missing {
+			p.Amount = roundMoney(p.Price * float64(l.Quantity))
+			total += p.Amount
+		}
+		priced = append(priced, p)
+	}
+	return priced, roundMoney(total), nil
+}
+
+// roundMoney round an amount to cents
+func roundMoney(v float64) float64 {
+	return math.Round(v*100) / 100
+}
@@ -0,0 +1,191 @@
+package db
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"webapp/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var categoryCollection = "category"
+
+// 分类树很小（几十到几百个），各个后端都整棵读出来检查和展开
+
+// subtree give the id of a category and of all the categories below it
+func subtree(categories []*model.Category, id string) map[string]bool {
+	children := make(map[string][]string)
+	for _, c := range categories {
+		children[c.Parent] = append(children[c.Parent], c.Id)
+	}
+	ids := map[string]bool{id: true}
+	queue := []string{id}
+	for len(queue) > 0 {
+		for _, child := range children[queue[0]] {
+			if !ids[child] {
+				ids[child] = true
+				queue = append(queue, child)
+			}
+		}
+		queue = queue[1:]
+	}
+	return ids
+}
+
+// validCategory check a category against the tree: the parent must exist and must not be
+// the category itself or one of its subcategories
+func validCategory(c *model.Category, categories []*model.Category) error {
+	if strings.TrimSpace(c.Name) == "" {
+		return invalid("category name is required")
+	}
+	if c.Parent == "" {
+		return nil
+	}
+	parents := make(map[string]string)
+	for _, cat := range categories {
+		parents[cat.Id] = cat.Parent
+	}
+	if _, ok := parents[c.Parent]; !ok {
+		return invalid("parent category " + strconv.Quote(c.Parent) + " does not exist")
+	}
+	//沿着上级分类向上，遇到自己说明形成了环
+	for p, depth := c.Parent, 0; p != ""; p, depth = parents[p], depth+1 {
+		if p == c.Id && c.Id != "" || depth > len(parents) {
+			return invalid("a category cannot be moved below itself")
+		}
+	}
+	return nil
+}
+
+// categoryID make the id of a new category from its name, a number is appended when the id is taken
+func categoryID(name string, taken func(id string) bool) string {
+	base := Slugify(name)
+	id := base
+	for n := 2; taken(id); n++ {
+		id = base + "-" + strconv.Itoa(n)
+	}
+	return id
+}
+
+// sortCategories list the categories by name, then id
+func sortCategories(categories []*model.Category) {
+	sort.Slice(categories, func(i, j int) bool {
+		if categories[i].Name != categories[j].Name {
+			return categories[i].Name < categories[j].Name
+		}
+		return categories[i].Id < categories[j].Id
+	})
+}
+
+// cleanTags lower case and trim the tags, empty and repeated tags are dropped
+func cleanTags(tags []string) []string {
+	var list []string
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t != "" && !hasTag(list, t) {
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+// ListCategories get the whole category tree as a flat list
+func (m MongoDB) ListCategories(ctx context.Context) ([]*model.Category, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}, {Key: "id", Value: 1}})
+	res, err := m.database.Collection(categoryCollection).Find(ctx, bson.M{}, opts)
+	if err != nil {
+		log.Println("Error while fetching categories:", err.Error())
+		return nil, mongoErr(err)
+	}
+	categories := []*model.Category{}
+	if err := res.All(ctx, &categories); err != nil {
+		log.Println("Error while decoding categories:", err.Error())
+		return nil, mongoErr(err)
+	}
+	return categories, nil
+}
+
+// GetCategory get one category by id
+func (m MongoDB) GetCategory(ctx context.Context, id string) (*model.Category, error) {
+	var category model.Category
+	err := m.database.Collection(categoryCollection).FindOne(ctx, bson.M{"id": id}).Decode(&category)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrCategoryNotFound
+	}
+	if err != nil {
+		log.Println("Error while fetching a category:", err.Error())
+		return nil, mongoErr(err)
+	}
+	return &category, nil
+}
+
+// WriteCategory add a category when category.Id is empty, the new id is written back to category;
+// otherwise rename or move the category with that id
+func (m MongoDB) WriteCategory(ctx context.Context, category *model.Category) error {
+	all, err := m.ListCategories(ctx)
+	if err != nil {
+		return err
+	}
+	if err := validCategory(category, all); err != nil {
+		return err
+	}
+	categories := m.database.Collection(categoryCollection)
+	if category.Id != "" {
+		res, err := categories.UpdateOne(ctx, bson.M{"id": category.Id},
+			bson.M{"$set": bson.M{"name": category.Name, "parent": category.Parent}})
+		if err != nil {
+			log.Println("Error while saving a category:", err.Error())
+			return mongoErr(err)
+		}
+		if res.MatchedCount == 0 {
+			return ErrCategoryNotFound
+		}
+		return nil
+	}
+	ids := make(map[string]bool)
+	for _, c := range all {
+		ids[c.Id] = true
+	}
+	//同时新建同名分类时唯一索引拒绝其中一个，换一个id重试
+	for {
+		category.Id = categoryID(category.Name, func(id string) bool { return ids[id] })
+		_, err := categories.InsertOne(ctx, category)
+		if !isDuplicateKey(err) {
+			if err != nil {
+				log.Println("Error while saving a category:", err.Error())
+			}
+			return mongoErr(err)
+		}
+		ids[category.Id] = true
+	}
+}
+
+// DeleteCategory delete a category that has no subcategories and no commodities
+func (m MongoDB) DeleteCategory(ctx context.Context, id string) error {
+	for _, used := range []struct {
+		collection string
+		field      string
+	}{{categoryCollection, "parent"}, {commodityCollection, "category"}} {
+		n, err := m.database.Collection(used.collection).CountDocuments(ctx, bson.M{used.field: id})
+		if err != nil {
+			return mongoErr(err)
+		}
+		if n > 0 {
+			return ErrCategoryInUse
+		}
+	}
+	res, err := m.database.Collection(categoryCollection).DeleteOne(ctx, bson.M{"id": id})
+	if err != nil {
+		log.Println("Error while deleting a category:", err.Error())
+		return mongoErr(err)
+	}
+	if res.DeletedCount == 0 {
+		return ErrCategoryNotFound
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"context"
+	"log"
+	"time"
+	"webapp/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+//WriteComment add a comment, the id and creation time are assigned here
+func (m MongoDB) WriteComment(ctx context.Context, comment *model.Comment) error {
+	if err := validComment(comment.Comment); err != nil {
+		return err
+	}
+	comment.Id = primitive.NewObjectID().Hex()
+	comment.CreatedAt = time.Now()
+	insertComent, err := m.database.Collection(commentCollection).InsertOne(ctx, *comment)
+	if err != nil {
+		log.Println("Fail to insert a comment:", err.Error())
+		return mongoErr(err)
+	}
+	println("Insert a comment of ", insertComent.InsertedID)
+	return nil
+}
+
+//GetComment get a comment by id
+func (m MongoDB) GetComment(ctx context.Context, id string) (*model.Comment, error) {
+	var comment model.Comment
+	err := m.database.Collection(commentCollection).FindOne(ctx, bson.M{"id": id}).Decode(&comment)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrCommentNotFound
+	}
+	if err != nil {
+		log.Println("Error while fetching a comment:", err.Error())
+		return nil, mongoErr(err)
+	}
+	return &comment, nil
+}
+
+//UpdateComment replace the text of a comment, the old text is appended to its history
+func (m MongoDB) UpdateComment(ctx context.Context, id string, text string) (*model.Comment, error) {
+	if err := validComment(text); err != nil {
+		return nil, err
+	}
+	for {
+		old, err := m.GetComment(ctx, id)
+		if err != nil {
+			return nil, mongoErr(err)
+		}
+		now := time.Now()
+		//只有内容没有被别人同时修改时才会匹配，否则重新读取再试，历史记录不会丢
+		res, err := m.database.Collection(commentCollection).UpdateOne(ctx,
+			bson.M{"id": id, "comment": old.Comment, "editedat": old.EditedAt},
+			bson.M{
+				"$set":  bson.M{"comment": text, "editedat": now},
+				"$push": bson.M{"history": model.CommentRevision{Comment: old.Comment, EditedAt: now}},
+			})
+		if err != nil {
+			log.Println("Error while updating a comment:", err.Error())
+			return nil, mongoErr(err)
+		}
+		if res.MatchedCount > 0 {
+			break
+		}
+	}
+	return m.GetComment(ctx, id)
+}
+
+//DeleteComment delete a comment by id
+func (m MongoDB) DeleteComment(ctx context.Context, id string) error {
+	res, err := m.database.Collection(commentCollection).DeleteOne(ctx, bson.M{"id": id})
+	if err != nil {
+		log.Println("Error while deleting a comment:", err.Error())
+		return mongoErr(err)
+	}
+	if res.DeletedCount == 0 {
+		return ErrCommentNotFound
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+	"webapp/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//PostCommodity add a commodity to the app when commodity.Id is empty, the new id is written back to commodity;
+//otherwise update the commodity with that id. Ids are never changed, renaming a commodity keeps its comments and carts
+//库存只在新增商品时写入，之后通过AdjustStock/SetStock修改；规格只通过SetVariants修改
+func (m MongoDB) PostCommodity(ctx context.Context, commodity *model.Commodity) error {
+	commodity.Tags = cleanTags(commodity.Tags)
+	if err := validCommodity(commodity); err != nil {
+		return err
+	}
+	if commodity.Id == "" {
+		commodity.Id = primitive.NewObjectID().Hex()
+	}
+	if commodity.CreatedAt.IsZero() {
+		commodity.CreatedAt = time.Now()
+	}
+	slug, err := m.uniqueSlug(ctx, commodity.Id, commodity.Name)
+	if err != nil {
+		return mongoErr(err)
+	}
+	commodity.Slug = slug
+	selector := bson.M{"id": commodity.Id}
+
+	updateOpts := options.Update().SetUpsert(true)
+
+	data := bson.M{
+		"$set": bson.M{
+			"name":         commodity.Name,
+			"slug":         commodity.Slug,
+			"introduction": commodity.Introduction,
+			"picture":      commodity.Picture,
+			"price":        commodity.Price,
+			"category":     commodity.Category,
+			"tags":         commodity.Tags,
+		},
+		//上架时间和库存只在新增时写入
+		"$setOnInsert": bson.M{"id": commodity.Id, "stock": commodity.Stock, "createdat": commodity.CreatedAt},
+	}
+
+	_, err = m.database.Collection(commodityCollection).UpdateOne(ctx, selector, data, updateOpts)
+	if err != nil {
+		log.Println("Error while saving a commodity:", err.Error())
+		return mongoErr(err)
+	}
+	return nil
+}
+
+//GetCommodityBySlug get one commodity by slug
+func (m MongoDB) GetCommodityBySlug(ctx context.Context, slug string) (*model.Commodity, error) {
+	var commodity model.Commodity
+	err := m.database.Collection(commodityCollection).FindOne(ctx, bson.M{"slug": slug}).Decode(&commodity)
+	if err == mongo.ErrNoDocuments {
+		return nil, &CommodityGoneError{Id: slug}
+	}
+	if err != nil {
+		log.Println("Error while fetching a commodity: ", err.Error())
+		return nil, mongoErr(err)
+	}
+	return &commodity, nil
+}
+
+// findCommodity look up a commodity of the catalog by id
+func (m MongoDB) findCommodity(ctx context.Context, id string) (*model.Commodity, error) {
+	var commodity model.Commodity
+	err := m.database.Collection(commodityCollection).FindOne(ctx, bson.M{"id": id}).Decode(&commodity)
+	if err == mongo.ErrNoDocuments {
+		return nil, &CommodityGoneError{Id: id}
+	}
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+	return &commodity, nil
+}
+
+// uniqueSlug slugify name, the end of the id is appended when another commodity already uses the slug
+func (m MongoDB) uniqueSlug(ctx context.Context, id string, name string) (string, error) {
+	slug := Slugify(name)
+	n, err := m.database.Collection(commodityCollection).CountDocuments(ctx,
+		bson.M{"slug": slug, "id": bson.M{"$ne": id}})
+	if err != nil {
+		return "", err
+	}
+	if n > 0 {
+		return slugWithID(slug, id), nil
+	}
+	return slug, nil
+}
+
+// slugWithID make a slug unique with the end of the commodity id
+func slugWithID(slug string, id string) string {
+	if len(id) > 6 {
+		id = id[len(id)-6:]
+	}
+	return slug + "-" + id
+}
+
+// Slugify turn a commodity name into the readable part of its url: letters (including Chinese) and digits
+// are kept in lower case, everything else becomes a single "-"
+func Slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	if b.Len() == 0 {
+		return "item"
+	}
+	return b.String()
+}
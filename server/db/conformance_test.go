@@ -0,0 +1,925 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"webapp/model"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 每个DB实现都必须通过的测试，每个用例使用一个新的空数据库
+
+// opener create an empty database for one test case, done releases it
+type opener func(t *testing.T) (d DB, done func())
+
+var conformanceCases = []struct {
+	name string
+	run  func(t *testing.T, d DB)
+}{
+	{"Commodities", testCommodities},
+	{"Stock", testStock},
+	{"Variants", testVariants},
+	{"Images", testImages},
+	{"Comments", testComments},
+	{"Lists", testLists},
+	{"Categories", testCategories},
+	{"Users", testUsers},
+	{"Cart", testCart},
+	{"Checkout", testCheckout},
+	{"ConcurrentCheckout", testConcurrentCheckout},
+	{"FailedCheckout", testFailedCheckout},
+	{"Tokens", testTokens},
+	{"Errors", testErrors},
+}
+
+func runConformance(t *testing.T, open opener) {
+	for _, c := range conformanceCases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			d, done := open(t)
+			defer done()
+			c.run(t, d)
+		})
+	}
+}
+
+func TestMemoryConformance(t *testing.T) {
+	runConformance(t, func(t *testing.T) (DB, func()) {
+		return NewMemory(), func() {}
+	})
+}
+
+func TestBoltConformance(t *testing.T) {
+	runConformance(t, func(t *testing.T) (DB, func()) {
+		dir, err := ioutil.TempDir("", "bolt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := OpenBolt(filepath.Join(dir, "webapp.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b, func() {
+			b.Close()
+			os.RemoveAll(dir)
+		}
+	})
+}
+
+// TestMongoConformance needs a MongoDB, set mongo_test_uri (e.g. mongodb://0.0.0.0:27017) to run it
+func TestMongoConformance(t *testing.T) {
+	uri := os.Getenv("mongo_test_uri")
+	if uri == "" {
+		t.Skip("mongo_test_uri is not set")
+	}
+	client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(context.TODO())
+	runConformance(t, func(t *testing.T) (DB, func()) {
+		database := client.Database(fmt.Sprintf("webapp_test_%d", time.Now().UnixNano()))
+		m := MongoDB{database: database}
+		//和生产环境一样先建立索引
+		if err := m.Migrate(context.TODO()); err != nil {
+			t.Fatal(err)
+		}
+		return m, func() { database.Drop(context.TODO()) }
+	})
+}
+
+func postCommodity(d DB, name string, price float64, stock int) *model.Commodity {
+	ctx := context.Background()
+	c := &model.Commodity{Name: name, Introduction: "about " + name, Price: price, Stock: stock}
+	d.PostCommodity(ctx, c)
+	return c
+}
+
+func testCommodities(t *testing.T, d DB) {
+	ctx := context.Background()
+	tea := postCommodity(d, "Green Tea", 12.5, 3)
+	if tea.Id == "" || tea.Slug != "green-tea" {
+		t.Fatalf("id and slug not assigned: %+v", tea)
+	}
+	postCommodity(d, "Coffee", 30, 1)
+	all, err := d.ListCommodities(ctx, CommodityQuery{})
+	if err != nil || len(all.Commodities) != 2 || all.Commodities[0].Id != tea.Id || all.Next != "" {
+		t.Fatalf("got %+v, %v", all, err)
+	}
+
+	//同名商品的slug带上id的结尾
+	other := postCommodity(d, "Green  tea!", 1, 1)
+	if other.Slug == tea.Slug || other.Slug != "green-tea-"+other.Id[len(other.Id)-6:] {
+		t.Fatalf("slug conflict not resolved: %q", other.Slug)
+	}
+
+	//更新：id不变，库存不被覆盖，slug跟着名字变
+	update := &model.Commodity{Id: tea.Id, Name: "Black Tea", Price: 15, Stock: 100}
+	d.PostCommodity(ctx, update)
+	got, err := d.GetOneCommodity(ctx, tea.Id)
+	if err != nil || got.Name != "Black Tea" || got.Price != 15 || got.Stock != 3 || got.Slug != "black-tea" {
+		t.Fatalf("after update got %+v, %v", got, err)
+	}
+	if _, err := d.GetCommodityBySlug(ctx, "green-tea"); !isGone(err) {
+		t.Fatalf("old slug still found: %v", err)
+	}
+	if got, err := d.GetCommodityBySlug(ctx, "black-tea"); err != nil || got.Id != tea.Id {
+		t.Fatalf("by slug got %+v, %v", got, err)
+	}
+
+	//指定id的新商品（upsert）
+	d.PostCommodity(ctx, &model.Commodity{Id: "000000000000000000000001", Name: "Milk", Price: 3, Stock: 7})
+	if got, err := d.GetOneCommodity(ctx, "000000000000000000000001"); err != nil || got.Stock != 7 {
+		t.Fatalf("upsert got %+v, %v", got, err)
+	}
+
+	if _, err := d.GetOneCommodity(ctx, "missing"); !isGone(err) {
+		t.Fatalf("missing commodity: %v", err)
+	}
+}
+
+func isGone(err error) bool {
+	var gone *CommodityGoneError
+	return errors.As(err, &gone)
+}
+
+func testStock(t *testing.T, d DB) {
+	ctx := context.Background()
+	tea := postCommodity(d, "Tea", 10, 3)
+	c, err := d.AdjustStock(ctx, tea.Id, "", 2)
+	if err != nil || c.Stock != 5 {
+		t.Fatalf("restock got %+v, %v", c, err)
+	}
+	_, err = d.AdjustStock(ctx, tea.Id, "", -6)
+	var stock *StockError
+	if !errors.As(err, &stock) || stock.Available != 5 || stock.Requested != 6 {
+		t.Fatalf("overdraw got %v", err)
+	}
+	if c, err = d.AdjustStock(ctx, tea.Id, "", -5); err != nil || c.Stock != 0 {
+		t.Fatalf("take all got %+v, %v", c, err)
+	}
+	if c, err = d.SetStock(ctx, tea.Id, "", 9); err != nil || c.Stock != 9 {
+		t.Fatalf("set got %+v, %v", c, err)
+	}
+	if _, err := d.AdjustStock(ctx, "missing", "", 1); !isGone(err) {
+		t.Fatalf("missing commodity: %v", err)
+	}
+	if _, err := d.SetStock(ctx, "missing", "", 1); !isGone(err) {
+		t.Fatalf("missing commodity: %v", err)
+	}
+}
+
+func testVariants(t *testing.T, d DB) {
+	ctx := context.Background()
+	shirt := postCommodity(d, "Shirt", 99, 0)
+	variants := []model.Variant{
+		{Options: map[string]string{"color": "Red", "size": "M"}, Price: 89, Stock: 2},
+		{Sku: "shirt-red-l", Options: map[string]string{"color": "Red", "size": "L"}, Price: 99, Stock: 1},
+		{Options: map[string]string{"color": "Blue", "size": "M"}, Price: 79, Stock: 0},
+	}
+	c, err := d.SetVariants(ctx, shirt.Id, variants)
+	if err != nil || len(c.Variants) != 3 || c.Stock != 3 || c.Price != 79 {
+		t.Fatalf("set variants got %+v, %v", c, err)
+	}
+	if c.Variants[0].Sku != "red-m" || c.Variants[1].Sku != "shirt-red-l" {
+		t.Fatalf("skus %+v", c.Variants)
+	}
+	if len(c.Options) != 2 || c.Options[0].Name != "color" || strings.Join(c.Options[0].Values, ",") != "Red,Blue" {
+		t.Fatalf("options %+v", c.Options)
+	}
+
+	//库存按规格修改，商品库存是各规格之和
+	if _, err := d.AdjustStock(ctx, shirt.Id, "", 1); err != ErrSkuRequired {
+		t.Fatalf("stock without sku: %v", err)
+	}
+	if _, err := d.AdjustStock(ctx, shirt.Id, "green-s", 1); !isGone(err) {
+		t.Fatalf("unknown sku: %v", err)
+	}
+	var stock *StockError
+	if _, err := d.AdjustStock(ctx, shirt.Id, "red-m", -3); !errors.As(err, &stock) || stock.Sku != "red-m" || stock.Available != 2 {
+		t.Fatalf("overdraw variant: %v", err)
+	}
+	if c, err = d.AdjustStock(ctx, shirt.Id, "blue-m", 4); err != nil || c.Variant("blue-m").Stock != 4 || c.Stock != 7 {
+		t.Fatalf("restock variant got %+v, %v", c, err)
+	}
+	if c, err = d.SetStock(ctx, shirt.Id, "red-m", 5); err != nil || c.Variant("red-m").Stock != 5 || c.Stock != 10 {
+		t.Fatalf("set variant stock got %+v, %v", c, err)
+	}
+
+	//已有的sku保留库存，去掉的规格不再计入
+	c, err = d.SetVariants(ctx, shirt.Id, []model.Variant{
+		{Sku: "red-m", Options: map[string]string{"color": "Red", "size": "M"}, Price: 89, Stock: 100},
+		{Sku: "blue-m", Options: map[string]string{"color": "Blue", "size": "M"}, Price: 79},
+	})
+	if err != nil || c.Variant("red-m").Stock != 5 || c.Variant("shirt-red-l") != nil || c.Stock != 9 {
+		t.Fatalf("replace variants got %+v, %v", c, err)
+	}
+	//修改商品信息不会改变规格
+	shirt.Name = "Shirt 2"
+	d.PostCommodity(ctx, shirt)
+	if c, _ = d.GetOneCommodity(ctx, shirt.Id); len(c.Variants) != 2 || c.Stock != 9 {
+		t.Fatalf("update dropped the variants %+v", c)
+	}
+
+	for _, bad := range [][]model.Variant{
+		{{Options: map[string]string{"color": "Red"}}, {Options: map[string]string{"size": "M"}}},
+		{{Options: map[string]string{"color": "Red"}}, {Options: map[string]string{"color": "Red"}}},
+		{{Sku: "a", Options: map[string]string{"color": "Red"}}, {Sku: "a", Options: map[string]string{"color": "Blue"}}},
+		{{Options: map[string]string{}}},
+		{{Options: map[string]string{"color": "Red"}, Price: -1}},
+	} {
+		if _, err := d.SetVariants(ctx, shirt.Id, bad); !errors.Is(err, ErrInvalid) {
+			t.Fatalf("variants %+v: %v", bad, err)
+		}
+	}
+	if _, err := d.SetVariants(ctx, "missing", nil); !isGone(err) {
+		t.Fatalf("missing commodity: %v", err)
+	}
+
+	//购物车按商品和规格分行，下单扣规格的库存
+	d.UserRegister(ctx, "alice", "hash", 500)
+	d.AddCartLine(ctx, "alice", model.CartLine{CommodityId: shirt.Id, Sku: "red-m", Quantity: 1})
+	d.AddCartLine(ctx, "alice", model.CartLine{CommodityId: shirt.Id, Sku: "blue-m", Quantity: 2})
+	cart, err := d.AddCartLine(ctx, "alice", model.CartLine{CommodityId: shirt.Id, Sku: "red-m", Quantity: 1})
+	if err != nil || len(cart.Lines) != 2 || cart.Lines[0].Quantity != 2 {
+		t.Fatalf("cart %+v, %v", cart, err)
+	}
+	if cart, err = d.SetCartLine(ctx, "alice", model.CartLine{CommodityId: shirt.Id, Sku: "blue-m", Quantity: 1}); err != nil || cart.Lines[1].Quantity != 1 {
+		t.Fatalf("set line %+v, %v", cart, err)
+	}
+	if _, err := d.SetCartLine(ctx, "alice", model.CartLine{CommodityId: shirt.Id, Quantity: 1}); err != ErrCartLineNotFound {
+		t.Fatalf("line without sku: %v", err)
+	}
+	order, err := d.Checkout(ctx, "alice")
+	if err != nil || order.Total != 257 || order.Lines[0].Sku != "red-m" || order.Lines[0].Options["color"] != "Red" {
+		t.Fatalf("checkout got %+v, %v", order, err)
+	}
+	if c, _ = d.GetOneCommodity(ctx, shirt.Id); c.Variant("red-m").Stock != 3 || c.Variant("blue-m").Stock != 3 || c.Stock != 6 {
+		t.Fatalf("stock after checkout %+v", c)
+	}
+
+	d.AddCartLine(ctx, "alice", model.CartLine{CommodityId: shirt.Id, Sku: "blue-m", Quantity: 4})
+	if _, err := d.Checkout(ctx, "alice"); !errors.As(err, &stock) || stock.Sku != "blue-m" || stock.Available != 3 {
+		t.Fatalf("variant stock error: %v", err)
+	}
+	if cart, err = d.RemoveCartLine(ctx, "alice", shirt.Id, "blue-m"); err != nil || len(cart.Lines) != 0 {
+		t.Fatalf("remove line %+v, %v", cart, err)
+	}
+	d.AddCartLine(ctx, "alice", model.CartLine{CommodityId: shirt.Id, Quantity: 1})
+	if _, err := d.Checkout(ctx, "alice"); !isGone(err) {
+		t.Fatalf("line without sku: %v", err)
+	}
+}
+
+func testImages(t *testing.T, d DB) {
+	ctx := context.Background()
+	tea := postCommodity(d, "Tea", 10, 1)
+	c, err := d.SetImages(ctx, tea.Id, nil, []model.Image{{Id: " front.jpg ", URL: "/picture/front.jpg", Alt: "front"}, {Id: "back.png"}})
+	if err != nil || len(c.Images) != 2 || c.Images[0].Id != "front.jpg" || c.Images[0].URL != "" || c.Picture != "front.jpg" {
+		t.Fatalf("set images got %+v, %v", c, err)
+	}
+	//修改商品信息不会改变图片
+	tea.Name = "Green Tea"
+	d.PostCommodity(ctx, tea)
+	if c, _ = d.GetOneCommodity(ctx, tea.Id); len(c.Images) != 2 || c.Images[1].Id != "back.png" || c.Images[0].Alt != "front" {
+		t.Fatalf("update dropped the images %+v", c)
+	}
+	//读到图片之后图片被修改了
+	if _, err := d.SetImages(ctx, tea.Id, c.Images[:1], nil); err != ErrImagesChanged {
+		t.Fatalf("changed images: %v", err)
+	}
+	if _, err := d.SetImages(ctx, tea.Id, nil, nil); err != ErrImagesChanged {
+		t.Fatalf("changed images: %v", err)
+	}
+	if c, err = d.SetImages(ctx, tea.Id, c.Images, nil); err != nil || len(c.Images) != 0 || c.Picture != "" {
+		t.Fatalf("clear images got %+v, %v", c, err)
+	}
+	for _, bad := range [][]model.Image{
+		{{Id: ""}},
+		{{Id: "a.jpg"}, {Id: "a.jpg"}},
+		{{Id: "a.jpg", Alt: strings.Repeat("x", 201)}},
+	} {
+		if _, err := d.SetImages(ctx, tea.Id, nil, bad); !errors.Is(err, ErrInvalid) {
+			t.Fatalf("images %+v: %v", bad, err)
+		}
+	}
+	if _, err := d.SetImages(ctx, "missing", nil, nil); !isGone(err) {
+		t.Fatalf("missing commodity: %v", err)
+	}
+
+	//只有picture的旧商品，picture就是读到的唯一图片
+	old := &model.Commodity{Name: "Old", Introduction: "about Old", Price: 1, Picture: "old.jpg"}
+	d.PostCommodity(ctx, old)
+	if _, err := d.SetImages(ctx, old.Id, nil, []model.Image{{Id: "new.jpg"}}); err != ErrImagesChanged {
+		t.Fatalf("picture changed: %v", err)
+	}
+	c, err = d.SetImages(ctx, old.Id, []model.Image{{Id: "old.jpg"}}, []model.Image{{Id: "old.jpg"}, {Id: "new.jpg"}})
+	if err != nil || len(c.Images) != 2 || c.Picture != "old.jpg" {
+		t.Fatalf("legacy picture got %+v, %v", c, err)
+	}
+}
+
+func testComments(t *testing.T, d DB) {
+	ctx := context.Background()
+	tea := postCommodity(d, "Tea", 10, 1)
+	coffee := postCommodity(d, "Coffee", 10, 1)
+	first := &model.Comment{Username: "alice", CommodityId: tea.Id, Comment: "nice"}
+	d.WriteComment(ctx, first)
+	if first.Id == "" || first.CreatedAt.IsZero() {
+		t.Fatalf("id and time not assigned: %+v", first)
+	}
+	d.WriteComment(ctx, &model.Comment{Username: "bob", CommodityId: tea.Id, Comment: "ok"})
+	d.WriteComment(ctx, &model.Comment{Username: "bob", CommodityId: coffee.Id, Comment: "bitter"})
+
+	comments, err := d.ListComments(ctx, tea.Id, CommentQuery{})
+	if err != nil || len(comments.Comments) != 2 || comments.Comments[0].Id != first.Id {
+		t.Fatalf("got %+v, %v", comments, err)
+	}
+
+	c, err := d.UpdateComment(ctx, first.Id, "very nice")
+	if err != nil || c.Comment != "very nice" || c.EditedAt == nil || len(c.History) != 1 || c.History[0].Comment != "nice" {
+		t.Fatalf("update got %+v, %v", c, err)
+	}
+	d.UpdateComment(ctx, first.Id, "great")
+	c, err = d.GetComment(ctx, first.Id)
+	if err != nil || c.Comment != "great" || len(c.History) != 2 || c.Username != "alice" || c.CommodityId != tea.Id {
+		t.Fatalf("get got %+v, %v", c, err)
+	}
+
+	if err := d.DeleteComment(ctx, first.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetComment(ctx, first.Id); err != ErrCommentNotFound {
+		t.Fatalf("deleted comment: %v", err)
+	}
+	if err := d.DeleteComment(ctx, first.Id); err != ErrCommentNotFound {
+		t.Fatalf("delete twice: %v", err)
+	}
+	if _, err := d.UpdateComment(ctx, first.Id, "x"); err != ErrCommentNotFound {
+		t.Fatalf("update deleted: %v", err)
+	}
+	if comments, _ := d.ListComments(ctx, tea.Id, CommentQuery{}); len(comments.Comments) != 1 {
+		t.Fatalf("got %d comments after delete", len(comments.Comments))
+	}
+}
+
+// listAll follow the cursors from page to page and return the names of all the commodities
+func listAll(t *testing.T, d DB, q CommodityQuery) []string {
+	t.Helper()
+	var names []string
+	for {
+		page, err := d.ListCommodities(context.Background(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Commodities) > q.Limit {
+			t.Fatalf("page of %d commodities, limit %d", len(page.Commodities), q.Limit)
+		}
+		for _, c := range page.Commodities {
+			names = append(names, c.Name)
+		}
+		if page.Next == "" {
+			return names
+		}
+		q.Cursor = page.Next
+	}
+}
+
+func testLists(t *testing.T, d DB) {
+	ctx := context.Background()
+	for _, c := range []struct {
+		name     string
+		price    float64
+		category string
+	}{
+		{"Tea", 10, "drink"}, {"Apple", 3, "fruit"}, {"Coffee", 30, "drink"},
+		{"Banana", 3, "fruit"}, {"Green Tea", 12, "drink"},
+	} {
+		d.PostCommodity(ctx, &model.Commodity{Name: c.name, Introduction: "fresh " + c.category, Price: c.price, Category: c.category})
+	}
+	price := func(p float64) *float64 { return &p }
+
+	for _, c := range []struct {
+		q    CommodityQuery
+		want string
+	}{
+		{CommodityQuery{Limit: 2}, "Tea Apple Coffee Banana Green Tea"},
+		{CommodityQuery{Limit: 2, Sort: SortNewest}, "Green Tea Banana Coffee Apple Tea"},
+		{CommodityQuery{Limit: 2, Sort: SortName}, "Apple Banana Coffee Green Tea Tea"},
+		//价格相同时按id排序，顺序与上架顺序一致
+		{CommodityQuery{Limit: 3, Sort: SortPrice}, "Apple Banana Tea Green Tea Coffee"},
+		{CommodityQuery{Limit: 1, Sort: SortPriceDesc}, "Coffee Green Tea Tea Banana Apple"},
+		{CommodityQuery{Limit: 2, MinPrice: price(3), MaxPrice: price(10)}, "Tea Apple Banana"},
+		{CommodityQuery{Limit: 2, Category: "drink", Sort: SortPrice}, "Tea Green Tea Coffee"},
+		{CommodityQuery{Limit: 2, Keyword: "TEA"}, "Tea Green Tea"},
+		{CommodityQuery{Limit: 2, Keyword: "fruit"}, "Apple Banana"},
+		{CommodityQuery{Limit: 2, Keyword: "a.*"}, ""},
+	} {
+		if got := strings.Join(listAll(t, d, c.q), " "); got != c.want {
+			t.Errorf("%+v: got %q want %q", c.q, got, c.want)
+		}
+	}
+
+	for _, q := range []CommodityQuery{
+		{Sort: "stock"},
+		{MinPrice: price(5), MaxPrice: price(1)},
+		{Cursor: "not a cursor"},
+	} {
+		if _, err := d.ListCommodities(ctx, q); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%+v: got %v", q, err)
+		}
+	}
+	page, _ := d.ListCommodities(ctx, CommodityQuery{Limit: 1, Sort: SortName})
+	if _, err := d.ListCommodities(ctx, CommodityQuery{Sort: SortPrice, Cursor: page.Next}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("cursor of another sort: %v", err)
+	}
+
+	tea := postCommodity(d, "Oolong", 10, 1)
+	for _, text := range []string{"one", "two", "three"} {
+		d.WriteComment(ctx, &model.Comment{Username: "alice", CommodityId: tea.Id, Comment: text})
+	}
+	var texts []string
+	q := CommentQuery{Limit: 2, Sort: SortNewest}
+	for {
+		page, err := d.ListComments(ctx, tea.Id, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range page.Comments {
+			texts = append(texts, c.Comment)
+		}
+		if page.Next == "" {
+			break
+		}
+		q.Cursor = page.Next
+	}
+	if got := strings.Join(texts, " "); got != "three two one" {
+		t.Fatalf("comments newest first: %q", got)
+	}
+}
+
+func testCategories(t *testing.T, d DB) {
+	ctx := context.Background()
+	category := func(name string, parent string) *model.Category {
+		c := &model.Category{Name: name, Parent: parent}
+		if err := d.WriteCategory(ctx, c); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+		return c
+	}
+	drinks := category("Drinks", "")
+	tea := category("Tea", drinks.Id)
+	green := category("Green Tea", tea.Id)
+	fruit := category("Fruit", "")
+	//同名分类的id带上序号
+	if other := category("Tea", fruit.Id); drinks.Id != "drinks" || tea.Id != "tea" || other.Id != "tea-2" {
+		t.Fatalf("ids %q %q %q", drinks.Id, tea.Id, other.Id)
+	}
+	all, err := d.ListCategories(ctx)
+	if err != nil || len(all) != 5 || all[0].Name != "Drinks" {
+		t.Fatalf("list got %+v, %v", all, err)
+	}
+
+	for _, c := range []*model.Category{
+		{Name: ""},
+		{Name: "Oolong", Parent: "missing"},
+		{Id: drinks.Id, Name: "Drinks", Parent: green.Id},
+		{Id: tea.Id, Name: "Tea", Parent: tea.Id},
+	} {
+		if err := d.WriteCategory(ctx, c); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%+v: got %v", c, err)
+		}
+	}
+	if err := d.WriteCategory(ctx, &model.Category{Id: "missing", Name: "x"}); err != ErrCategoryNotFound {
+		t.Errorf("update a missing category: %v", err)
+	}
+	//移动和改名，id不变
+	if err := d.WriteCategory(ctx, &model.Category{Id: green.Id, Name: "Green", Parent: drinks.Id}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := d.GetCategory(ctx, green.Id); err != nil || got.Name != "Green" || got.Parent != drinks.Id {
+		t.Fatalf("moved category %+v, %v", got, err)
+	}
+	d.WriteCategory(ctx, &model.Category{Id: green.Id, Name: "Green Tea", Parent: tea.Id})
+
+	for _, c := range []*model.Commodity{
+		{Name: "Longjing", Price: 80, Category: green.Id, Tags: []string{"Hot", " new ", "hot"}},
+		{Name: "Black Tea", Price: 30, Category: tea.Id, Tags: []string{"hot"}},
+		{Name: "Cola", Price: 3, Category: drinks.Id},
+		{Name: "Apple", Price: 5, Category: fruit.Id, Tags: []string{"new"}},
+		{Name: "Gift Box", Price: 6000},
+	} {
+		if err := d.PostCommodity(ctx, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, _ := d.GetCommodityBySlug(ctx, "longjing"); strings.Join(got.Tags, ",") != "hot,new" {
+		t.Fatalf("tags not cleaned: %q", got.Tags)
+	}
+	for _, c := range []struct {
+		q    CommodityQuery
+		want string
+	}{
+		{CommodityQuery{Limit: 2, Category: drinks.Id}, "Longjing Black Tea Cola"},
+		{CommodityQuery{Limit: 2, Category: tea.Id, Sort: SortPrice}, "Black Tea Longjing"},
+		{CommodityQuery{Limit: 2, Category: green.Id}, "Longjing"},
+		{CommodityQuery{Limit: 2, Tags: []string{"HOT"}}, "Longjing Black Tea"},
+		{CommodityQuery{Limit: 2, Tags: []string{"hot", "new"}}, "Longjing"},
+		{CommodityQuery{Limit: 2, Category: drinks.Id, Tags: []string{"new"}}, "Longjing"},
+	} {
+		if got := strings.Join(listAll(t, d, c.q), " "); got != c.want {
+			t.Errorf("%+v: got %q want %q", c.q, got, c.want)
+		}
+	}
+
+	facets, err := d.CommodityFacets(ctx, CommodityQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(facets.Categories); got != "[{drinks Drinks  3} {tea Tea drinks 2} {fruit Fruit  1} {green-tea Green Tea tea 1}]" {
+		t.Errorf("category facets %s", got)
+	}
+	if got := fmt.Sprint(facets.Tags); got != "[{hot 2} {new 2}]" {
+		t.Errorf("tag facets %s", got)
+	}
+	var prices []string
+	for _, p := range facets.Prices {
+		max := "+"
+		if p.Max != nil {
+			max = fmt.Sprint(*p.Max)
+		}
+		prices = append(prices, fmt.Sprintf("%v-%s:%d", p.Min, max, p.Count))
+	}
+	if got := strings.Join(prices, " "); got != "0-50:3 50-100:1 5000-+:1" {
+		t.Errorf("price facets %s", got)
+	}
+	//统计只包含筛选出的商品
+	price := 50.0
+	facets, err = d.CommodityFacets(ctx, CommodityQuery{Category: tea.Id, MaxPrice: &price})
+	if err != nil || fmt.Sprint(facets.Categories) != "[{drinks Drinks  1} {tea Tea drinks 1}]" || len(facets.Prices) != 1 {
+		t.Errorf("filtered facets %+v, %v", facets, err)
+	}
+
+	if err := d.DeleteCategory(ctx, tea.Id); err != ErrCategoryInUse {
+		t.Errorf("delete a category with subcategories: %v", err)
+	}
+	if err := d.DeleteCategory(ctx, fruit.Id); err != ErrCategoryInUse {
+		t.Errorf("delete a category with commodities: %v", err)
+	}
+	if err := d.DeleteCategory(ctx, "tea-2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetCategory(ctx, "tea-2"); err != ErrCategoryNotFound {
+		t.Errorf("deleted category: %v", err)
+	}
+	if err := d.DeleteCategory(ctx, "tea-2"); err != ErrCategoryNotFound {
+		t.Errorf("delete twice: %v", err)
+	}
+}
+
+func testUsers(t *testing.T, d DB) {
+	ctx := context.Background()
+	before := time.Now().Add(-time.Second)
+	u, err := d.UserRegister(ctx, "alice", "hash", 10)
+	if err != nil || u.Role != model.RoleCustomer || u.CreatedAt.Before(before) {
+		t.Fatalf("register got %+v, %v", u, err)
+	}
+	if _, err := d.UserRegister(ctx, "alice", "other", 1000); err != ErrUserExists {
+		t.Fatalf("register twice: %v", err)
+	}
+	if u, err = d.GetUser(ctx, "alice"); err != nil || u.Password != "hash" || u.Balance != 10 || u.CreatedAt.Before(before) {
+		t.Fatalf("get got %+v, %v", u, err)
+	}
+	if _, err := d.GetUser(ctx, "bob"); err != ErrUserNotFound {
+		t.Fatalf("missing user: %v", err)
+	}
+
+	if err := d.UpdatePassword(ctx, "alice", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetUserRole(ctx, "alice", model.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ = d.GetUser(ctx, "alice"); u.Password != "new" || u.Role != model.RoleAdmin {
+		t.Fatalf("after update got %+v", u)
+	}
+	if err := d.UpdatePassword(ctx, "bob", "x"); err != ErrUserNotFound {
+		t.Fatalf("missing user: %v", err)
+	}
+	if err := d.SetUserRole(ctx, "bob", model.RoleAdmin); err != ErrUserNotFound {
+		t.Fatalf("missing user: %v", err)
+	}
+	if err := d.SetBalance(ctx, "alice", 42); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ = d.GetUser(ctx, "alice"); u.Balance != 42 {
+		t.Fatalf("balance %v", u.Balance)
+	}
+	if err := d.SetBalance(ctx, "bob", 1); err != ErrUserNotFound {
+		t.Fatalf("missing user: %v", err)
+	}
+
+	d.UserRegister(ctx, "bob", "hash", 0)
+	users, err := d.GetUsersInfo(ctx)
+	if err != nil || len(users) != 2 {
+		t.Fatalf("got %d users, %v", len(users), err)
+	}
+	if users, _ = d.GetAUserInfo(ctx, "bob"); len(users) != 1 {
+		t.Fatalf("got %d users", len(users))
+	}
+	if users, _ = d.GetAUserInfo(ctx, "carol"); len(users) != 0 {
+		t.Fatalf("got %d users", len(users))
+	}
+}
+
+func testCart(t *testing.T, d DB) {
+	ctx := context.Background()
+	cart, err := d.GetCart(ctx, "alice")
+	if err != nil || cart.Username != "alice" || cart.Lines == nil || len(cart.Lines) != 0 {
+		t.Fatalf("new cart %+v, %v", cart, err)
+	}
+	d.AddCartLine(ctx, "alice", model.CartLine{CommodityId: "a", Quantity: 1})
+	d.AddCartLine(ctx, "alice", model.CartLine{CommodityId: "b", Quantity: 2})
+	cart, err = d.AddCartLine(ctx, "alice", model.CartLine{CommodityId: "a", Quantity: 3})
+	if err != nil || len(cart.Lines) != 2 || cart.Lines[0].Quantity != 4 {
+		t.Fatalf("add got %+v, %v", cart, err)
+	}
+	if cart, err = d.SetCartLine(ctx, "alice", model.CartLine{CommodityId: "b", Quantity: 5}); err != nil || cart.Lines[1].Quantity != 5 {
+		t.Fatalf("set got %+v, %v", cart, err)
+	}
+	if cart, err = d.SetCartLine(ctx, "alice", model.CartLine{CommodityId: "b", Quantity: 0}); err != nil || len(cart.Lines) != 1 {
+		t.Fatalf("set 0 got %+v, %v", cart, err)
+	}
+	if _, err := d.SetCartLine(ctx, "alice", model.CartLine{CommodityId: "c", Quantity: 1}); err != ErrCartLineNotFound {
+		t.Fatalf("set missing line: %v", err)
+	}
+	if _, err := d.RemoveCartLine(ctx, "alice", "c", ""); err != ErrCartLineNotFound {
+		t.Fatalf("remove missing line: %v", err)
+	}
+	if _, err := d.RemoveCartLine(ctx, "bob", "a", ""); err != ErrCartLineNotFound {
+		t.Fatalf("remove without cart: %v", err)
+	}
+	if cart, err = d.RemoveCartLine(ctx, "alice", "a", ""); err != nil || len(cart.Lines) != 0 {
+		t.Fatalf("remove got %+v, %v", cart, err)
+	}
+
+	//WriteCart创建或替换整个购物车
+	d.WriteCart(ctx, &model.Cart{Username: "bob", Lines: []model.CartLine{{CommodityId: "x", Quantity: 1}}})
+	d.WriteCart(ctx, &model.Cart{Username: "bob", Lines: []model.CartLine{{CommodityId: "y", Quantity: 2}}})
+	if cart, _ = d.GetCart(ctx, "bob"); len(cart.Lines) != 1 || cart.Lines[0].CommodityId != "y" {
+		t.Fatalf("written cart %+v", cart)
+	}
+}
+
+func testCheckout(t *testing.T, d DB) {
+	ctx := context.Background()
+	tea := postCommodity(d, "Tea", 10, 3)
+	coffee := postCommodity(d, "Coffee", 25, 1)
+	d.UserRegister(ctx, "alice", "hash", 50)
+
+	if _, err := d.Checkout(ctx, "alice"); err != ErrEmptyCart {
+		t.Fatalf("empty cart: %v", err)
+	}
+
+	//余额不足时库存不变
+	d.AddCartLine(ctx, "alice", model.CartLine{CommodityId: tea.Id, Quantity: 3})
+	d.AddCartLine(ctx, "alice", model.CartLine{CommodityId: coffee.Id, Quantity: 1})
+	if _, err := d.Checkout(ctx, "alice"); err != ErrInsufficientBalance {
+		t.Fatalf("insufficient balance: %v", err)
+	}
+	if c, _ := d.GetOneCommodity(ctx, tea.Id); c.Stock != 3 {
+		t.Fatalf("stock changed to %d", c.Stock)
+	}
+
+	d.SetCartLine(ctx, "alice", model.CartLine{CommodityId: coffee.Id, Quantity: 2})
+	var stock *StockError
+	if _, err := d.Checkout(ctx, "alice"); !errors.As(err, &stock) || stock.Id != coffee.Id {
+		t.Fatalf("stock error: %v", err)
+	}
+
+	d.SetCartLine(ctx, "alice", model.CartLine{CommodityId: tea.Id, Quantity: 1})
+	d.SetCartLine(ctx, "alice", model.CartLine{CommodityId: coffee.Id, Quantity: 1})
+	order, err := d.Checkout(ctx, "alice")
+	if err != nil || order.Id == "" || order.Total != 35 || len(order.Lines) != 2 || order.Username != "alice" {
+		t.Fatalf("checkout got %+v, %v", order, err)
+	}
+	if u, _ := d.GetUser(ctx, "alice"); u.Balance != 15 {
+		t.Fatalf("balance %v", u.Balance)
+	}
+	if c, _ := d.GetOneCommodity(ctx, tea.Id); c.Stock != 2 {
+		t.Fatalf("stock %d", c.Stock)
+	}
+	if cart, _ := d.GetCart(ctx, "alice"); len(cart.Lines) != 0 {
+		t.Fatalf("cart not emptied %+v", cart)
+	}
+
+	d.AddCartLine(ctx, "alice", model.CartLine{CommodityId: "gone", Quantity: 1})
+	if _, err := d.Checkout(ctx, "alice"); !isGone(err) {
+		t.Fatalf("gone commodity: %v", err)
+	}
+	d.RemoveCartLine(ctx, "alice", "gone", "")
+	d.AddCartLine(ctx, "alice", model.CartLine{CommodityId: tea.Id, Quantity: 1})
+	time.Sleep(time.Millisecond)
+	second, err := d.Checkout(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orders, err := d.GetOrders(ctx, "alice")
+	if err != nil || len(orders) != 2 || orders[0].Id != second.Id {
+		t.Fatalf("orders %+v, %v", orders, err)
+	}
+	if got, err := d.GetOrder(ctx, "alice", order.Id); err != nil || got.Total != 35 {
+		t.Fatalf("order %+v, %v", got, err)
+	}
+	if _, err := d.GetOrder(ctx, "bob", order.Id); err != ErrOrderNotFound {
+		t.Fatalf("order of another user: %v", err)
+	}
+	if orders, _ := d.GetOrders(ctx, "bob"); len(orders) != 0 {
+		t.Fatalf("bob has %d orders", len(orders))
+	}
+	if _, err := d.Checkout(ctx, "nobody"); err != ErrEmptyCart {
+		t.Fatalf("checkout without cart: %v", err)
+	}
+}
+
+// 同一个购物车同时结算只能生成一个订单
+func testConcurrentCheckout(t *testing.T, d DB) {
+	ctx := context.Background()
+	tea := postCommodity(d, "Tea", 10, 20)
+	d.UserRegister(ctx, "alice", "hash", 100)
+	d.AddCartLine(ctx, "alice", model.CartLine{CommodityId: tea.Id, Quantity: 2})
+
+	const n = 5
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := d.Checkout(ctx, "alice")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	succeeded := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case err != ErrEmptyCart:
+			t.Fatalf("concurrent checkout: %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("%d checkouts succeeded", succeeded)
+	}
+	if orders, _ := d.GetOrders(ctx, "alice"); len(orders) != 1 {
+		t.Fatalf("%d orders", len(orders))
+	}
+	if u, _ := d.GetUser(ctx, "alice"); u.Balance != 80 {
+		t.Fatalf("balance %v", u.Balance)
+	}
+	if c, _ := d.GetOneCommodity(ctx, tea.Id); c.Stock != 18 {
+		t.Fatalf("stock %d", c.Stock)
+	}
+}
+
+// 订单写入失败时结算的每一步都要撤销
+func testFailedCheckout(t *testing.T, d DB) {
+	ctx := context.Background()
+	tea := postCommodity(d, "Tea", 10, 5)
+	d.UserRegister(ctx, "alice", "hash", 100)
+	d.AddCartLine(ctx, "alice", model.CartLine{CommodityId: tea.Id, Quantity: 2})
+
+	failed := errors.New("order not written")
+	orderHook = func(*model.Order) error { return failed }
+	_, err := d.Checkout(ctx, "alice")
+	orderHook = nil
+	if !errors.Is(err, failed) {
+		t.Fatalf("got %v want the error of the order write", err)
+	}
+	if u, _ := d.GetUser(ctx, "alice"); u.Balance != 100 {
+		t.Fatalf("balance %v", u.Balance)
+	}
+	if c, _ := d.GetOneCommodity(ctx, tea.Id); c.Stock != 5 {
+		t.Fatalf("stock %d", c.Stock)
+	}
+	if cart, _ := d.GetCart(ctx, "alice"); len(cart.Lines) != 1 || cart.Lines[0].Quantity != 2 {
+		t.Fatalf("cart %+v", cart)
+	}
+	if orders, _ := d.GetOrders(ctx, "alice"); len(orders) != 0 {
+		t.Fatalf("%d orders", len(orders))
+	}
+	if _, err := d.Checkout(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testTokens(t *testing.T, d DB) {
+	ctx := context.Background()
+	now := time.Now()
+	token := &model.RefreshToken{Id: "t1", Family: "f", Username: "alice", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	d.AddToken(ctx, token)
+	d.AddToken(ctx, &model.RefreshToken{Id: "t2", Family: "f", Username: "alice", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	d.AddToken(ctx, &model.RefreshToken{Id: "t3", Family: "g", Username: "alice", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+
+	//相同id覆盖
+	token.Username = "bob"
+	d.AddToken(ctx, token)
+	if got, err := d.GetAToken(ctx, "t1"); err != nil || got.Username != "bob" || got.Family != "f" {
+		t.Fatalf("token %+v, %v", got, err)
+	}
+	if _, err := d.GetAToken(ctx, "missing"); err != ErrTokenNotFound {
+		t.Fatalf("missing token: %v", err)
+	}
+
+	if err := d.UseToken(ctx, "t1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.UseToken(ctx, "t1"); err != ErrTokenReused {
+		t.Fatalf("use twice: %v", err)
+	}
+	if err := d.RevokeTokenFamily(ctx, "f"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := d.GetAToken(ctx, "t2"); !got.Revoked {
+		t.Fatal("family not revoked")
+	}
+	if err := d.UseToken(ctx, "t2"); err != ErrTokenReused {
+		t.Fatalf("use revoked: %v", err)
+	}
+	if got, _ := d.GetAToken(ctx, "t3"); got.Revoked {
+		t.Fatal("other family revoked")
+	}
+
+	d.RevokeAccessToken(ctx, "expired", now.Add(-time.Minute))
+	d.RevokeAccessToken(ctx, "current", now.Add(time.Minute))
+	if revoked, err := d.IsAccessTokenRevoked(ctx, "current"); err != nil || !revoked {
+		t.Fatalf("current: %v, %v", revoked, err)
+	}
+	if revoked, _ := d.IsAccessTokenRevoked(ctx, "expired"); revoked {
+		t.Fatal("expired revocation still active")
+	}
+	if revoked, _ := d.IsAccessTokenRevoked(ctx, "unknown"); revoked {
+		t.Fatal("unknown jti revoked")
+	}
+}
+
+func testErrors(t *testing.T, d DB) {
+	ctx := context.Background()
+	if err := d.PostCommodity(ctx, &model.Commodity{Price: 1}); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("commodity without name: %v", err)
+	}
+	if err := d.PostCommodity(ctx, &model.Commodity{Name: "Tea", Price: -1}); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("negative price: %v", err)
+	}
+	for _, price := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		if err := d.PostCommodity(ctx, &model.Commodity{Name: "Tea", Price: price}); !errors.Is(err, ErrInvalid) {
+			t.Fatalf("price %v: %v", price, err)
+		}
+	}
+	if err := d.WriteComment(ctx, &model.Comment{Username: "alice", CommodityId: "x"}); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("empty comment: %v", err)
+	}
+	if _, err := d.AddCartLine(ctx, "alice", model.CartLine{CommodityId: "x"}); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("line without quantity: %v", err)
+	}
+	if err := d.WriteCart(ctx, &model.Cart{Username: "alice", Lines: []model.CartLine{{Quantity: 1}}}); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("line without commodity: %v", err)
+	}
+
+	//具体的错误属于对应的种类
+	if _, err := d.GetUser(ctx, "nobody"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("missing user is not ErrNotFound: %v", err)
+	}
+	if _, err := d.GetOneCommodity(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("missing commodity is not ErrNotFound: %v", err)
+	}
+	d.UserRegister(ctx, "alice", "hash", 0)
+	if _, err := d.UserRegister(ctx, "alice", "hash", 0); !errors.Is(err, ErrConflict) {
+		t.Fatalf("existing user is not ErrConflict: %v", err)
+	}
+
+	//已经取消的请求
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := d.ListCommodities(cancelled, CommodityQuery{}); !errors.Is(err, ErrUnavailable) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled request: %v", err)
+	}
+	if _, err := d.GetUser(cancelled, "alice"); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("cancelled request: %v", err)
+	}
+}
@@ -2,11 +2,15 @@ package db
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"log"
+	"regexp"
+	"strings"
+	"time"
 	"webapp/model"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -16,28 +20,72 @@ var commodityCollection = "commodity"
 var commentCollection = "comment"
 var userCollection = "user"
 var cartCollection = "cart"
-var TokenCollection = "token"
 
 //DB 对数据库的操作接口
+//每个方法的第一个参数是请求的context，超时或取消时返回ErrUnavailable；
+//其他错误属于ErrNotFound、ErrConflict、ErrInvalid之一，见errors.go
 type DB interface {
-	//get获取所有商品|post:上传商品
-	GetAllCommodity() ([]*model.Commodity, error)
+	//分页获取商品，按CommodityQuery筛选排序
+	ListCommodities(ctx context.Context, q CommodityQuery) (*CommodityPage, error)
+	//按分类、标签和价格区间统计符合CommodityQuery筛选条件的商品数量
+	CommodityFacets(ctx context.Context, q CommodityQuery) (*Facets, error)
 	//
-	GetOneCommodity(name string) (*model.Commodity, error)
-	GetCommentsForCM(com string) ([]*model.Comment, error)
-	WriteComment(comment *model.Comment)
-	DeleteComment(comment *model.Comment)
-	UpdateComment(comment *model.Comment)
+	GetOneCommodity(ctx context.Context, id string) (*model.Commodity, error)
+	//按名字生成的slug查找商品
+	GetCommodityBySlug(ctx context.Context, slug string) (*model.Commodity, error)
+	//分页获取商品的评论
+	ListComments(ctx context.Context, commodityId string, q CommentQuery) (*CommentPage, error)
+	//WriteComment分配评论的Id和创建时间
+	WriteComment(ctx context.Context, comment *model.Comment) error
+	GetComment(ctx context.Context, id string) (*model.Comment, error)
+	//修改评论内容，旧的内容保存在History中
+	UpdateComment(ctx context.Context, id string, text string) (*model.Comment, error)
+	DeleteComment(ctx context.Context, id string) error
 	//
-	GetUsersInfo() ([]*model.User, error)
-	GetAUserInfo(string) ([]*model.User, error)
-	UserRegister(string, string, float64) (*model.User, error)
-	GetCart(username string) (*model.Cart, error)
-	WriteCart(cart *model.Cart)
-	PostCommodity(commodity *model.Commodity)
-
-	AddToken(token *model.TokenKey)
-	GetAToken(user string) (*model.TokenKey, error)
+	GetUsersInfo(ctx context.Context) ([]*model.User, error)
+	GetAUserInfo(ctx context.Context, username string) ([]*model.User, error)
+	//注册新用户，password应该是已经哈希过的密码；用户名已存在时返回ErrUserExists
+	UserRegister(ctx context.Context, username string, password string, balance float64) (*model.User, error)
+	GetUser(ctx context.Context, username string) (*model.User, error)
+	UpdatePassword(ctx context.Context, username string, password string) error
+	SetUserRole(ctx context.Context, username string, role string) error
+	//修改用户余额，只有管理员可以调用
+	SetBalance(ctx context.Context, username string, balance float64) error
+	GetCart(ctx context.Context, username string) (*model.Cart, error)
+	WriteCart(ctx context.Context, cart *model.Cart) error
+	//购物车中的单个商品：添加（数量累加），修改数量，删除
+	AddCartLine(ctx context.Context, username string, line model.CartLine) (*model.Cart, error)
+	SetCartLine(ctx context.Context, username string, line model.CartLine) (*model.Cart, error)
+	//sku为空表示没有规格的商品
+	RemoveCartLine(ctx context.Context, username string, commodityId string, sku string) (*model.Cart, error)
+	//Id为空时新增商品并分配Id，否则更新该Id的商品
+	PostCommodity(ctx context.Context, commodity *model.Commodity) error
+	//商品分类树：Id为空时新增分类（Id由名字生成），否则修改名字和上级分类
+	ListCategories(ctx context.Context) ([]*model.Category, error)
+	GetCategory(ctx context.Context, id string) (*model.Category, error)
+	WriteCategory(ctx context.Context, category *model.Category) error
+	//只能删除没有下级分类和商品的分类，否则返回ErrCategoryInUse
+	DeleteCategory(ctx context.Context, id string) error
+	//库存：delta为正数补货，为负数减少，库存不会小于0；有规格的商品按sku修改规格的库存，商品的库存是各规格之和
+	AdjustStock(ctx context.Context, id string, sku string, delta int) (*model.Commodity, error)
+	SetStock(ctx context.Context, id string, sku string, stock int) (*model.Commodity, error)
+	//替换商品的规格，已有的sku保留库存；商品的价格是最低的规格价格
+	SetVariants(ctx context.Context, id string, variants []model.Variant) (*model.Commodity, error)
+	//替换商品的图片（按展示顺序），第一张是封面；old是读到的图片，图片已经被修改时返回ErrImagesChanged
+	SetImages(ctx context.Context, id string, old []model.Image, images []model.Image) (*model.Commodity, error)
+	//下单：将购物车转为订单并扣除余额
+	Checkout(ctx context.Context, username string) (*model.Order, error)
+	GetOrders(ctx context.Context, username string) ([]*model.Order, error)
+	GetOrder(ctx context.Context, username string, id string) (*model.Order, error)
+
+	//刷新token：保存，查询，标记为已使用（只能成功一次），按family撤销
+	AddToken(ctx context.Context, token *model.RefreshToken) error
+	GetAToken(ctx context.Context, id string) (*model.RefreshToken, error)
+	UseToken(ctx context.Context, id string) error
+	RevokeTokenFamily(ctx context.Context, family string) error
+	//access token撤销列表，过期之后的记录不再生效
+	RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error
+	IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error)
 }
 
 // MongoDB is the database
@@ -52,209 +100,335 @@ func NewMongo(client *mongo.Client) MongoDB {
 	return MongoDB{database: webapp}
 }
 
-//GetAllCommodity get获取所有商品
-func (m MongoDB) GetAllCommodity() ([]*model.Commodity, error) {
-	//获取商品表中所有的数据
-	res, err := m.database.Collection(commodityCollection).Find(context.TODO(), bson.M{})
+//ListCommodities get a page of commodities, filtering, sorting and paging are done by MongoDB
+func (m MongoDB) ListCommodities(ctx context.Context, q CommodityQuery) (*CommodityPage, error) {
+	after, err := q.normalize()
 	if err != nil {
-		log.Println("Error while fetching commodities:", err.Error())
 		return nil, err
 	}
-
-	var commodities []*model.Commodity
-	err = res.All(context.TODO(), &commodities)
-
-	fmt.Println(len(commodities))
-
+	if q.Category != "" {
+		categories, err := m.ListCategories(ctx)
+		if err != nil {
+			return nil, err
+		}
+		q.withSubtree(categories)
+	}
+	filter := bson.A{commodityFilter(q)}
+	field, dir := "createdat", 1
+	switch q.Sort {
+	case SortNewest:
+		dir = -1
+	case SortPrice:
+		field = "price"
+	case SortPriceDesc:
+		field, dir = "price", -1
+	case SortName:
+		field = "name"
+	}
+	if after != nil {
+		var value interface{} = after.Time
+		switch field {
+		case "price":
+			value = after.Price
+		case "name":
+			value = after.Name
+		}
+		filter = append(filter, afterFilter(field, value, after.Id, dir))
+	}
+	query := bson.M{"$and": filter}
+	//多取一个，判断是否还有下一页
+	opts := options.Find().SetSort(bson.D{{Key: field, Value: dir}, {Key: "id", Value: dir}}).SetLimit(int64(q.Limit + 1))
+	res, err := m.database.Collection(commodityCollection).Find(ctx, query, opts)
 	if err != nil {
+		log.Println("Error while fetching commodities:", err.Error())
+		return nil, mongoErr(err)
+	}
+	commodities := []*model.Commodity{}
+	if err := res.All(ctx, &commodities); err != nil {
 		log.Println("Error while decoding commodities:", err.Error())
-		return nil, err
+		return nil, mongoErr(err)
 	}
-	return commodities, nil
+	return commodityPage(commodities, q), nil
 }
 
-//GetOneCommodity get one commodity
-func (m MongoDB) GetOneCommodity(comName string) (*model.Commodity, error) {
-
-	var commod model.Commodity
-	err := m.database.Collection(commodityCollection).FindOne(context.Background(), bson.M{"name": comName}).Decode(&commod)
-	if err != nil {
-		log.Println("Errorn while fetching a commodity: ", err.Error())
-		return nil, err
+// commodityFilter select the commodities matching the filters of q, q.subtree must be set when q has a category
+func commodityFilter(q CommodityQuery) bson.M {
+	filter := bson.A{}
+	if q.MinPrice != nil {
+		filter = append(filter, bson.M{"price": bson.M{"$gte": *q.MinPrice}})
 	}
-	return &commod, nil
-}
-
-//WriteComment add a comment
-func (m MongoDB) WriteComment(comment *model.Comment) {
-	insertComent, err := m.database.Collection(commentCollection).InsertOne(context.Background(), *comment)
-	if err != nil {
-		fmt.Println("Fail to insert a comment")
+	if q.MaxPrice != nil {
+		filter = append(filter, bson.M{"price": bson.M{"$lte": *q.MaxPrice}})
+	}
+	if q.Category != "" {
+		ids := bson.A{}
+		for id := range q.subtree {
+			ids = append(ids, id)
+		}
+		filter = append(filter, bson.M{"category": bson.M{"$in": ids}})
+	}
+	if len(q.Tags) > 0 {
+		filter = append(filter, bson.M{"tags": bson.M{"$all": q.Tags}})
+	}
+	if q.Keyword != "" {
+		re := primitive.Regex{Pattern: regexp.QuoteMeta(q.Keyword), Options: "i"}
+		filter = append(filter, bson.M{"$or": bson.A{bson.M{"name": re}, bson.M{"introduction": re}}})
 	}
-	println("Insert a comment of ", insertComent.InsertedID)
+	if len(filter) == 0 {
+		return bson.M{}
+	}
+	return bson.M{"$and": filter}
 }
 
-//DeleteComment delete a comment
-func (m MongoDB) DeleteComment(comment *model.Comment) {
-	deleComment, err := m.database.Collection(commentCollection).DeleteOne(context.Background(), bson.M{"username": comment.Username, "commodity": comment.Commodity, "comment": comment.Comment})
-	if err != nil {
-		log.Fatal(err)
+// afterFilter select the documents after (field, id) = (value, after) in a list sorted by field and id in direction dir
+func afterFilter(field string, value interface{}, after string, dir int) bson.M {
+	op := "$gt"
+	if dir < 0 {
+		op = "$lt"
 	}
-	println("Delete result: ", deleComment)
+	return bson.M{"$or": bson.A{
+		bson.M{field: bson.M{op: value}},
+		bson.M{field: value, "id": bson.M{op: after}},
+	}}
 }
 
-//UpdateComment update a comment
-func (m MongoDB) UpdateComment(comment *model.Comment) {
-	selector := bson.M{"username": comment.Username, "commodity": comment.Commodity}
-	data := bson.M{"$set": bson.M{"comment": comment.Comment}}
-	updateResult, err := m.database.Collection("comment").UpdateOne(context.Background(), selector, data)
+//GetOneCommodity get one commodity by id
+func (m MongoDB) GetOneCommodity(ctx context.Context, id string) (*model.Commodity, error) {
+
+	commod, err := m.findCommodity(ctx, id)
 	if err != nil {
-		log.Fatal(err)
+		log.Println("Errorn while fetching a commodity: ", err.Error())
+		return nil, mongoErr(err)
 	}
-	fmt.Println("Updateresult: ", updateResult)
-
+	return commod, nil
 }
 
-//GetCommentsForCM get all comments for a commodity
-func (m MongoDB) GetCommentsForCM(commodity string) ([]*model.Comment, error) {
-	res, err := m.database.Collection(commentCollection).Find(context.TODO(), bson.M{"commodity": commodity})
-
+//ListComments get a page of the comments of a commodity, sorted by creation time
+func (m MongoDB) ListComments(ctx context.Context, commodityId string, q CommentQuery) (*CommentPage, error) {
+	after, err := q.normalize()
 	if err != nil {
-		log.Println("Error while fetching comments:", err.Error())
 		return nil, err
 	}
-
-	var comments []*model.Comment
-	err = res.All(context.TODO(), &comments)
-
-	fmt.Println(len(comments))
-
+	dir := 1
+	if q.Sort == SortNewest {
+		dir = -1
+	}
+	//使用索引 (commodityid, createdat)
+	query := bson.M{"commodityid": commodityId}
+	if after != nil {
+		query = bson.M{"$and": bson.A{query, afterFilter("createdat", after.Time, after.Id, dir)}}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: dir}, {Key: "id", Value: dir}}).SetLimit(int64(q.Limit + 1))
+	res, err := m.database.Collection(commentCollection).Find(ctx, query, opts)
 	if err != nil {
+		log.Println("Error while fetching comments:", err.Error())
+		return nil, mongoErr(err)
+	}
+	comments := []*model.Comment{}
+	if err := res.All(ctx, &comments); err != nil {
 		log.Println("Error while decoding comments:", err.Error())
-		return nil, err
+		return nil, mongoErr(err)
 	}
-	return comments, nil
+	return commentPage(comments, q), nil
 }
 
 /////////////////////////////////////zjy
 
 //GetUsersInfo get usersinfo
-func (m MongoDB) GetUsersInfo() ([]*model.User, error) {
-	res, err := m.database.Collection(userCollection).Find(context.TODO(), bson.M{})
+func (m MongoDB) GetUsersInfo(ctx context.Context) ([]*model.User, error) {
+	res, err := m.database.Collection(userCollection).Find(ctx, bson.M{})
 	if err != nil {
 		log.Println("Error while fetching all users:", err.Error())
-		return nil, err
+		return nil, mongoErr(err)
 	}
 
 	var users []*model.User
-	err = res.All(context.TODO(), &users)
+	err = res.All(ctx, &users)
 	if err != nil {
 		log.Println("Error while decoding all users:", err.Error())
-		return nil, err
+		return nil, mongoErr(err)
 	}
 	return users, nil
 }
 
 //GetAUserInfo get a userinfo
-func (m MongoDB) GetAUserInfo(username string) ([]*model.User, error) {
-	res, err := m.database.Collection(userCollection).Find(context.TODO(), bson.M{"username": username})
+func (m MongoDB) GetAUserInfo(ctx context.Context, username string) ([]*model.User, error) {
+	res, err := m.database.Collection(userCollection).Find(ctx, bson.M{"username": username})
 	if err != nil {
 		log.Println("Error while fetching a user:", err.Error())
-		return nil, err
+		return nil, mongoErr(err)
 	}
 
 	var user []*model.User
-	err = res.All(context.TODO(), &user)
+	err = res.All(ctx, &user)
 	if err != nil {
 		log.Println("Error while decoding a user:", err.Error())
-		return nil, err
+		return nil, mongoErr(err)
 	}
 	return user, nil
 }
 
-//UserRegister insert a userInfo to database
-func (m MongoDB) UserRegister(un string, pw string, bl float64) (*model.User, error) {
+//UserRegister insert a userInfo to database, an existing user is never overwritten
+func (m MongoDB) UserRegister(ctx context.Context, un string, pw string, bl float64) (*model.User, error) {
 	var user model.User
 
 	user.Username = un
 	user.Password = pw
 	user.Balance = bl
+	user.Role = model.RoleCustomer
+	user.CreatedAt = time.Now()
 
+	//只在用户不存在时插入，UpsertedCount为0说明用户名已被注册
 	selector := bson.M{"username": un}
 	updateOpts := options.Update().SetUpsert(true)
-	data := bson.M{"$set": user}
+	data := bson.M{"$setOnInsert": user}
 
-	updateResult, err := m.database.Collection(cartCollection).UpdateOne(context.Background(), selector, data, updateOpts)
+	updateResult, err := m.database.Collection(userCollection).UpdateOne(ctx, selector, data, updateOpts)
+	if isDuplicateKey(err) { //同时注册同一个用户名时，唯一索引拒绝了另一个插入
+		return nil, ErrUserExists
+	}
 	if err != nil {
-		log.Fatal(err)
+		log.Println("Error while registering a user:", err.Error())
+		return nil, mongoErr(err)
+	}
+	if updateResult.UpsertedCount == 0 {
+		return nil, ErrUserExists
 	}
-	fmt.Println("Updateresult: ", updateResult)
 	return &user, nil
 }
 
-// GetCart get the cart of a user
-func (m MongoDB) GetCart(username string) (*model.Cart, error) {
-	var cart model.Cart
-	err := m.database.Collection(cartCollection).FindOne(context.Background(), bson.M{"username": username}).Decode(&cart)
+//GetUser get a user by username
+func (m MongoDB) GetUser(ctx context.Context, username string) (*model.User, error) {
+	var user model.User
+	err := m.database.Collection(userCollection).FindOne(ctx, bson.M{"username": username}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrUserNotFound
+	}
 	if err != nil {
-		log.Println("Errorn while fetching a cart: ", err.Error())
-		return nil, err
+		log.Println("Error while fetching a user:", err.Error())
+		return nil, mongoErr(err)
 	}
-	return &cart, nil
+	return &user, nil
 }
 
-//WriteCart update the cart after the user add commodity to cart or remove commodity from cart
-func (m MongoDB) WriteCart(cart *model.Cart) {
-	selector := bson.M{"username": cart.Username}
-	updateOpts := options.Update().SetUpsert(true)
-
-	//data := bson.M{"$set": bson.M{"comment": comment.Comment}}
-	data := bson.M{"$set": cart}
+//UpdatePassword replace the stored password of a user
+func (m MongoDB) UpdatePassword(ctx context.Context, username string, password string) error {
+	res, err := m.database.Collection(userCollection).UpdateOne(ctx,
+		bson.M{"username": username}, bson.M{"$set": bson.M{"password": password}})
+	if err != nil {
+		log.Println("Error while updating a password:", err.Error())
+		return mongoErr(err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
 
-	updateResult, err := m.database.Collection(cartCollection).UpdateOne(context.Background(), selector, data, updateOpts)
+//SetUserRole change the role of a user
+func (m MongoDB) SetUserRole(ctx context.Context, username string, role string) error {
+	res, err := m.database.Collection(userCollection).UpdateOne(ctx,
+		bson.M{"username": username}, bson.M{"$set": bson.M{"role": role}})
 	if err != nil {
-		log.Fatal(err)
+		log.Println("Error while updating a role:", err.Error())
+		return mongoErr(err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrUserNotFound
 	}
-	fmt.Println("Updateresult: ", updateResult)
+	return nil
+}
 
+//SetBalance change the balance of a user
+func (m MongoDB) SetBalance(ctx context.Context, username string, balance float64) error {
+	res, err := m.database.Collection(userCollection).UpdateOne(ctx,
+		bson.M{"username": username}, bson.M{"$set": bson.M{"balance": balance}})
+	if err != nil {
+		log.Println("Error while updating a balance:", err.Error())
+		return mongoErr(err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
 }
 
-//PostCommodity update or add a commodity to the app
-func (m MongoDB) PostCommodity(commodity *model.Commodity) {
-	selector := bson.M{"name": commodity.Name}
+// GetCart get the cart of a user, a user without a cart has an empty one
+func (m MongoDB) GetCart(ctx context.Context, username string) (*model.Cart, error) {
+	cart := model.Cart{Username: username}
+	err := m.database.Collection(cartCollection).FindOne(ctx, bson.M{"username": username}).Decode(&cart)
+	if err != nil && err != mongo.ErrNoDocuments {
+		log.Println("Errorn while fetching a cart: ", err.Error())
+		return nil, mongoErr(err)
+	}
+	if cart.Lines == nil {
+		cart.Lines = []model.CartLine{}
+	}
+	return &cart, nil
+}
 
+//WriteCart replace all the lines of the cart
+func (m MongoDB) WriteCart(ctx context.Context, cart *model.Cart) error {
+	if err := validCart(cart); err != nil {
+		return err
+	}
+	selector := bson.M{"username": cart.Username}
 	updateOpts := options.Update().SetUpsert(true)
 
 	//data := bson.M{"$set": bson.M{"comment": comment.Comment}}
-	data := bson.M{"$set": commodity}
+	data := bson.M{"$set": cart}
 
-	updateResult, err := m.database.Collection(commodityCollection).UpdateOne(context.Background(), selector, data, updateOpts)
+	_, err := m.database.Collection(cartCollection).UpdateOne(ctx, selector, data, updateOpts)
 	if err != nil {
-		log.Fatal(err)
+		log.Println("Error while writing a cart:", err.Error())
+		return mongoErr(err)
 	}
-	fmt.Println("Updateresult: ", updateResult)
+	return nil
 }
 
-//AddToken add a new token to ad
-func (m MongoDB) AddToken(token *model.TokenKey) {
-	selector := bson.M{"username": token.Username}
-	updateOpts := options.Update().SetUpsert(true)
-	data := bson.M{"$set": token}
-
-	updateResult, err := m.database.Collection(TokenCollection).UpdateOne(context.Background(), selector, data, updateOpts)
-	if err != nil {
-		log.Fatal(err)
+// mongoErr turn an error of the mongo driver into one of the error kinds of this package:
+// timeouts and connection problems become ErrUnavailable, duplicate keys ErrConflict.
+// Errors that already have a kind are returned as they are
+func mongoErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, kind := range []error{ErrNotFound, ErrConflict, ErrInvalid, ErrUnavailable} {
+		if errors.Is(err, kind) {
+			return err
+		}
+	}
+	var cmd mongo.CommandError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return Unavailable(err)
+	//选择服务器超时的错误没有包装原始错误，只能比较内容
+	case strings.Contains(err.Error(), "server selection"):
+		return Unavailable(err)
+	case errors.As(err, &cmd) && cmd.HasErrorLabel("NetworkError"):
+		return Unavailable(err)
+	case isDuplicateKey(err):
+		return &kindError{err.Error(), ErrConflict}
 	}
-	fmt.Println("Updateresult: ", updateResult)
+	return err
 }
 
-//GetAToken  get the token key of a user
-func (m MongoDB) GetAToken(user string) (*model.TokenKey, error) {
-	var token model.TokenKey
-	err := m.database.Collection(TokenCollection).FindOne(context.TODO(), bson.M{"username": user}).Decode(&token)
-	if err != nil {
-		log.Println("Error while fetching a token:", err.Error())
-		return nil, err
+// duplicateKey is the code of the mongo error for a unique index violation
+const duplicateKey = 11000
+
+// isDuplicateKey report whether err is a unique index violation
+func isDuplicateKey(err error) bool {
+	var cmd mongo.CommandError
+	if errors.As(err, &cmd) {
+		return cmd.Code == duplicateKey
+	}
+	var write mongo.WriteException
+	if errors.As(err, &write) {
+		for _, we := range write.WriteErrors {
+			if we.Code == duplicateKey {
+				return true
+			}
+		}
 	}
-	return &token, nil
+	return false
 }
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// 错误的种类，每个具体的错误都属于其中一种，web层只需要按种类转换成http状态码：
+// errors.Is(err, ErrNotFound) 对 ErrUserNotFound、CommodityGoneError 等都成立
+var (
+	// ErrNotFound the requested record does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrConflict the change conflicts with the current data (duplicate key, not enough stock, token reuse...)
+	ErrConflict = errors.New("conflict")
+	// ErrInvalid the request cannot be carried out with the given arguments
+	ErrInvalid = errors.New("invalid")
+	// ErrUnavailable the database did not answer in time or cannot be reached, the request may be retried
+	ErrUnavailable = errors.New("database unavailable")
+)
+
+// kindError is a specific error of a kind
+type kindError struct {
+	msg  string
+	kind error
+}
+
+func (e *kindError) Error() string { return e.msg }
+
+func (e *kindError) Unwrap() error { return e.kind }
+
+// 数据库操作可能返回的具体错误，调用者通过 errors.Is / errors.As 判断
+var (
+	// ErrEmptyCart the user's cart has nothing to check out
+	ErrEmptyCart = &kindError{"cart is empty", ErrInvalid}
+	// ErrInsufficientBalance the user's balance is lower than the order total
+	ErrInsufficientBalance = &kindError{"insufficient balance", ErrConflict}
+	// ErrUserNotFound no user with the given username
+	ErrUserNotFound = &kindError{"user not found", ErrNotFound}
+	// ErrUserExists the username is already registered
+	ErrUserExists = &kindError{"username already exists", ErrConflict}
+	// ErrOrderNotFound no order with the given id for the user
+	ErrOrderNotFound = &kindError{"order not found", ErrNotFound}
+	// ErrCommentNotFound no comment with the given id
+	ErrCommentNotFound = &kindError{"comment not found", ErrNotFound}
+	// ErrTokenNotFound no refresh token with the given id
+	ErrTokenNotFound = &kindError{"token not found", ErrNotFound}
+	// ErrTokenReused the refresh token was already used or revoked
+	ErrTokenReused = &kindError{"token already used", ErrConflict}
+	// ErrCartLineNotFound the cart has no line for the given commodity
+	ErrCartLineNotFound = &kindError{"cart line not found", ErrNotFound}
+	// ErrCategoryNotFound no category with the given id
+	ErrCategoryNotFound = &kindError{"category not found", ErrNotFound}
+	// ErrSkuRequired the commodity has variants, a stock change or a cart line must name one of them
+	ErrSkuRequired = &kindError{"the commodity has variants, a sku is required", ErrInvalid}
+	// ErrCategoryInUse the category still has subcategories or commodities
+	ErrCategoryInUse = &kindError{"category has subcategories or commodities", ErrConflict}
+	// ErrImageNotFound the commodity has no image with the given id
+	ErrImageNotFound = &kindError{"image not found", ErrNotFound}
+	// ErrImageAttached the picture is already an image of the commodity
+	ErrImageAttached = &kindError{"image is already attached to the commodity", ErrConflict}
+	// ErrImagesChanged the images of the commodity were changed since they were read
+	ErrImagesChanged = &kindError{"the images of the commodity changed, try again", ErrConflict}
+	// ErrStockChanged the stock of the commodity kept changing while it was being updated
+	ErrStockChanged = &kindError{"the stock of the commodity keeps changing, try again", ErrConflict}
+	// ErrImageOrder a new order of the images does not list every image of the commodity exactly once
+	ErrImageOrder = &kindError{"order must list every image of the commodity once", ErrInvalid}
+)
+
+// CommodityGoneError is returned when a commodity, or the variant Sku of a commodity, does not exist (any more) in the catalog
+type CommodityGoneError struct {
+	Id  string
+	Sku string
+}
+
+func (e *CommodityGoneError) Error() string {
+	if e.Sku != "" {
+		return fmt.Sprintf("commodity %q has no variant %q", e.Id, e.Sku)
+	}
+	return fmt.Sprintf("commodity %q does not exist", e.Id)
+}
+
+// Unwrap make a CommodityGoneError an ErrNotFound
+func (e *CommodityGoneError) Unwrap() error { return ErrNotFound }
+
+// StockError is returned when a commodity (or its variant Sku) has less stock than requested
+type StockError struct {
+	Id        string
+	Sku       string
+	Requested int
+	Available int
+}
+
+func (e *StockError) Error() string {
+	if e.Sku != "" {
+		return fmt.Sprintf("commodity %q variant %q has %d in stock, %d requested", e.Id, e.Sku, e.Available, e.Requested)
+	}
+	return fmt.Sprintf("commodity %q has %d in stock, %d requested", e.Id, e.Available, e.Requested)
+}
+
+// Unwrap make a StockError an ErrConflict
+func (e *StockError) Unwrap() error { return ErrConflict }
+
+// unavailableError is an error of the database itself, the request timed out or the server cannot be reached
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string { return "database unavailable: " + e.err.Error() }
+
+// Is make an unavailableError an ErrUnavailable while Unwrap keeps the original error (context.DeadlineExceeded...)
+func (e *unavailableError) Is(target error) bool { return target == ErrUnavailable }
+
+func (e *unavailableError) Unwrap() error { return e.err }
+
+// Unavailable mark err as an ErrUnavailable
+func Unavailable(err error) error {
+	if err == nil || errors.Is(err, ErrUnavailable) {
+		return err
+	}
+	return &unavailableError{err}
+}
+
+// checkContext return an ErrUnavailable when ctx is already done, for the backends that never block
+func checkContext(ctx context.Context) error {
+	return Unavailable(ctx.Err())
+}
@@ -0,0 +1,223 @@
+package db
+
+import (
+	"context"
+	"log"
+	"sort"
+	"webapp/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// PriceBuckets are the lower bounds of the price ranges counted by the facets, the last range has no upper bound
+var PriceBuckets = []float64{0, 50, 100, 500, 1000, 5000}
+
+// Facets count the commodities matching a query by category, tag and price range.
+// Only the values that have commodities are listed
+type Facets struct {
+	Categories []CategoryCount `json:"categories"`
+	Tags       []TagCount      `json:"tags"`
+	Prices     []PriceCount    `json:"prices"`
+}
+
+// CategoryCount is the number of commodities in a category, including its subcategories
+type CategoryCount struct {
+	Id     string `json:"categoryId"`
+	Name   string `json:"name"`
+	Parent string `json:"parentId,omitempty"`
+	Count  int    `json:"count"`
+}
+
+// TagCount is the number of commodities with a tag
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// PriceCount is the number of commodities with Min <= price < Max, Max is nil for the last range
+type PriceCount struct {
+	Min   float64  `json:"min"`
+	Max   *float64 `json:"max,omitempty"`
+	Count int      `json:"count"`
+}
+
+// facetCounts are the raw counts of the facets: commodities per category stored on them,
+// per tag and per index of PriceBuckets
+type facetCounts struct {
+	categories map[string]int
+	tags       map[string]int
+	prices     map[int]int
+}
+
+func newFacetCounts() *facetCounts {
+	return &facetCounts{categories: make(map[string]int), tags: make(map[string]int), prices: make(map[int]int)}
+}
+
+// add count a commodity, for the backends that scan the commodities
+func (f *facetCounts) add(c *model.Commodity) {
+	if c.Category != "" {
+		f.categories[c.Category]++
+	}
+	for _, t := range c.Tags {
+		f.tags[t]++
+	}
+	f.prices[priceBucket(c.Price)]++
+}
+
+// priceBucket give the index of the price range of price
+func priceBucket(price float64) int {
+	return sort.Search(len(PriceBuckets), func(i int) bool { return PriceBuckets[i] > price }) - 1
+}
+
+// facets turn the counts into Facets: the count of a category is added to all the categories above it,
+// most frequent values first
+func (f *facetCounts) facets(categories []*model.Category) *Facets {
+	byId := make(map[string]*model.Category)
+	for _, c := range categories {
+		byId[c.Id] = c
+	}
+	total := make(map[string]int)
+	for id, n := range f.categories {
+		//不在分类树中的旧分类只计算自己
+		seen := make(map[string]bool)
+		for cur := id; cur != "" && !seen[cur]; {
+			seen[cur] = true
+			total[cur] += n
+			c, ok := byId[cur]
+			if !ok {
+				break
+			}
+			cur = c.Parent
+		}
+	}
+
+	facets := &Facets{Categories: []CategoryCount{}, Tags: []TagCount{}, Prices: []PriceCount{}}
+	for id, n := range total {
+		cc := CategoryCount{Id: id, Name: id, Count: n}
+		if c, ok := byId[id]; ok {
+			cc.Name, cc.Parent = c.Name, c.Parent
+		}
+		facets.Categories = append(facets.Categories, cc)
+	}
+	sort.Slice(facets.Categories, func(i, j int) bool {
+		a, b := facets.Categories[i], facets.Categories[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Id < b.Id
+	})
+	for tag, n := range f.tags {
+		facets.Tags = append(facets.Tags, TagCount{Tag: tag, Count: n})
+	}
+	sort.Slice(facets.Tags, func(i, j int) bool {
+		a, b := facets.Tags[i], facets.Tags[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Tag < b.Tag
+	})
+	for i, min := range PriceBuckets {
+		if f.prices[i] == 0 {
+			continue
+		}
+		pc := PriceCount{Min: min, Count: f.prices[i]}
+		if i+1 < len(PriceBuckets) {
+			max := PriceBuckets[i+1]
+			pc.Max = &max
+		}
+		facets.Prices = append(facets.Prices, pc)
+	}
+	return facets
+}
+
+// scanFacets count the facets of the commodities matching q, for the backends that scan all the commodities
+func scanFacets(all []*model.Commodity, categories []*model.Category, q CommodityQuery) (*Facets, error) {
+	if _, err := q.normalize(); err != nil {
+		return nil, err
+	}
+	q.withSubtree(categories)
+	counts := newFacetCounts()
+	for _, c := range all {
+		if matchCommodity(c, &q) {
+			counts.add(c)
+		}
+	}
+	return counts.facets(categories), nil
+}
+
+// CommodityFacets count the commodities matching the filters of q by category, tag and price range
+// in one aggregation; the sort, limit and cursor of q are ignored
+func (m MongoDB) CommodityFacets(ctx context.Context, q CommodityQuery) (*Facets, error) {
+	if _, err := q.normalize(); err != nil {
+		return nil, err
+	}
+	categories, err := m.ListCategories(ctx)
+	if err != nil {
+		return nil, err
+	}
+	q.withSubtree(categories)
+	bounds := bson.A{}
+	for _, b := range PriceBuckets {
+		bounds = append(bounds, b)
+	}
+	count := bson.D{{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}}}
+	group := func(field string) bson.D {
+		return bson.D{{Key: "$group", Value: append(bson.D{{Key: "_id", Value: field}}, count...)}}
+	}
+	res, err := m.database.Collection(commodityCollection).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: commodityFilter(q)}},
+		{{Key: "$facet", Value: bson.D{
+			{Key: "categories", Value: bson.A{
+				bson.D{{Key: "$match", Value: bson.D{{Key: "category", Value: bson.D{{Key: "$nin", Value: bson.A{"", nil}}}}}}},
+				group("$category"),
+			}},
+			{Key: "tags", Value: bson.A{bson.D{{Key: "$unwind", Value: "$tags"}}, group("$tags")}},
+			//$bucket的最后一个边界是上限，没有上限的最后一个区间由default统计
+			{Key: "prices", Value: bson.A{bson.D{{Key: "$bucket", Value: bson.D{
+				{Key: "groupBy", Value: "$price"},
+				{Key: "boundaries", Value: bounds},
+				{Key: "default", Value: "last"},
+				{Key: "output", Value: count},
+			}}}}},
+		}}},
+	})
+	if err != nil {
+		log.Println("Error while counting facets:", err.Error())
+		return nil, mongoErr(err)
+	}
+	type bucket struct {
+		Id    interface{} `bson:"_id"`
+		Count int         `bson:"count"`
+	}
+	var out []struct {
+		Categories []bucket `bson:"categories"`
+		Tags       []bucket `bson:"tags"`
+		Prices     []bucket `bson:"prices"`
+	}
+	if err := res.All(ctx, &out); err != nil {
+		log.Println("Error while decoding facets:", err.Error())
+		return nil, mongoErr(err)
+	}
+	counts := newFacetCounts()
+	if len(out) == 1 {
+		for _, b := range out[0].Categories {
+			if id, ok := b.Id.(string); ok {
+				counts.categories[id] = b.Count
+			}
+		}
+		for _, b := range out[0].Tags {
+			if tag, ok := b.Id.(string); ok {
+				counts.tags[tag] = b.Count
+			}
+		}
+		for _, b := range out[0].Prices {
+			if min, ok := b.Id.(float64); ok {
+				counts.prices[priceBucket(min)] = b.Count
+			} else {
+				counts.prices[len(PriceBuckets)-1] = b.Count
+			}
+		}
+	}
+	return counts.facets(categories), nil
+}
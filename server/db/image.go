@@ -0,0 +1,88 @@
+package db
+
+import (
+	"context"
+	"log"
+	"webapp/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// applyImages replace the images of a commodity, the first one becomes the cover (Picture);
+// without images the commodity has no cover
+func applyImages(c *model.Commodity, images []model.Image) {
+	c.Images = images
+	c.Picture = ""
+	if len(images) > 0 {
+		c.Picture = images[0].Id
+	}
+}
+
+// shownImages give the images of a commodity as they are shown:
+// an old commodity with only a picture has this picture as its only image
+func shownImages(c *model.Commodity) []model.Image {
+	if len(c.Images) == 0 && c.Picture != "" {
+		return []model.Image{{Id: c.Picture}}
+	}
+	return c.Images
+}
+
+// sameImages tell whether two lists of images are the same, an empty list is the same as nil
+func sameImages(a, b []model.Image) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Id != b[i].Id || a[i].Alt != b[i].Alt {
+			return false
+		}
+	}
+	return true
+}
+
+// SetImages replace the images of a commodity in display order, see applyImages.
+// The images are replaced only if they are still old, the images read before (see shownImages)
+func (m MongoDB) SetImages(ctx context.Context, id string, old []model.Image, images []model.Image) (*model.Commodity, error) {
+	images, err := cleanImages(images)
+	if err != nil {
+		return nil, err
+	}
+	//读到的图片没有变化时才更新；没有图片的旧商品还要比较picture
+	noImages := bson.M{"$or": bson.A{bson.M{"images": nil}, bson.M{"images": bson.M{"$size": 0}}}}
+	var unchanged bson.A
+	switch {
+	case len(old) == 0:
+		unchanged = bson.A{noImages, bson.M{"picture": bson.M{"$in": bson.A{nil, ""}}}}
+	case len(old) == 1 && old[0].Alt == "":
+		unchanged = bson.A{bson.M{"$or": bson.A{
+			bson.M{"images": old},
+			bson.M{"$and": bson.A{noImages, bson.M{"picture": old[0].Id}}},
+		}}}
+	default:
+		unchanged = bson.A{bson.M{"images": old}}
+	}
+	filter := bson.M{"$and": append(bson.A{bson.M{"id": id}}, unchanged...)}
+	var commodity model.Commodity
+	applyImages(&commodity, images)
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = m.database.Collection(commodityCollection).FindOneAndUpdate(ctx, filter,
+		bson.M{"$set": bson.M{"images": commodity.Images, "picture": commodity.Picture}}, opts).Decode(&commodity)
+	if err == mongo.ErrNoDocuments {
+		//商品不存在，或者图片已经被修改
+		n, err := m.database.Collection(commodityCollection).CountDocuments(ctx, bson.M{"id": id})
+		if err != nil {
+			return nil, mongoErr(err)
+		}
+		if n == 0 {
+			return nil, &CommodityGoneError{Id: id}
+		}
+		return nil, ErrImagesChanged
+	}
+	if err != nil {
+		log.Println("Error while saving images:", err.Error())
+		return nil, mongoErr(err)
+	}
+	return &commodity, nil
+}
@@ -0,0 +1,954 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+	"webapp/model"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Memory keep all the data in memory, it is used for local development without a MongoDB and by the handler tests.
+// Every method holds one lock, so each call is atomic like the conditional updates of MongoDB.
+// The data can be loaded from and saved to a JSON snapshot.
+type Memory struct {
+	mu sync.Mutex
+	//按创建顺序保存的商品id
+	ids         []string
+	commodities map[string]*model.Commodity
+	categories  map[string]*model.Category
+	comments    []*model.Comment
+	users       map[string]*model.User
+	carts       map[string]*model.Cart
+	orders      []*model.Order
+	tokens      map[string]*model.RefreshToken
+	//被撤销的access token的jti和过期时间
+	revoked map[string]time.Time
+}
+
+var _ DB = (*Memory)(nil)
+
+// NewMemory create an empty in-memory database
+func NewMemory() *Memory {
+	return &Memory{
+		commodities: make(map[string]*model.Commodity),
+		categories:  make(map[string]*model.Category),
+		users:       make(map[string]*model.User),
+		carts:       make(map[string]*model.Cart),
+		tokens:      make(map[string]*model.RefreshToken),
+		revoked:     make(map[string]time.Time),
+	}
+}
+
+// storedUser keep the password that is hidden from the JSON of model.User,
+// it is how the in-memory snapshot and the bolt database store users
+type storedUser struct {
+	model.User
+	Password string `json:"password"`
+}
+
+// snapshot is the JSON form of Memory
+type snapshot struct {
+	Commodities []*model.Commodity    `json:"commodities"`
+	Categories  []*model.Category     `json:"categories"`
+	Comments    []*model.Comment      `json:"comments"`
+	Users       []storedUser          `json:"users"`
+	Carts       []*model.Cart         `json:"carts"`
+	Orders      []*model.Order        `json:"orders"`
+	Tokens      []*model.RefreshToken `json:"tokens"`
+	Revoked     map[string]time.Time  `json:"revoked"`
+}
+
+// LoadMemory create an in-memory database from the snapshot at path, a missing file gives an empty database
+func LoadMemory(path string) (*Memory, error) {
+	m := NewMemory()
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	for _, c := range s.Commodities {
+		m.ids = append(m.ids, c.Id)
+		m.commodities[c.Id] = c
+	}
+	for _, c := range s.Categories {
+		m.categories[c.Id] = c
+	}
+	m.comments = s.Comments
+	for _, u := range s.Users {
+		user := u.User
+		user.Password = u.Password
+		m.users[user.Username] = &user
+	}
+	for _, c := range s.Carts {
+		m.carts[c.Username] = c
+	}
+	m.orders = s.Orders
+	for _, t := range s.Tokens {
+		m.tokens[t.Id] = t
+	}
+	for jti, exp := range s.Revoked {
+		m.revoked[jti] = exp
+	}
+	return m, nil
+}
+
+// Save write a snapshot of the database to path, the file is replaced atomically
+func (m *Memory) Save(path string) error {
+	m.mu.Lock()
+	s := snapshot{Revoked: make(map[string]time.Time)}
+	for _, id := range m.ids {
+		s.Commodities = append(s.Commodities, m.commodities[id])
+	}
+	s.Categories = m.categoryList()
+	s.Comments = m.comments
+	for _, name := range m.usernames() {
+		u := m.users[name]
+		s.Users = append(s.Users, storedUser{User: *u, Password: u.Password})
+	}
+	for _, c := range m.carts {
+		s.Carts = append(s.Carts, c)
+	}
+	s.Orders = m.orders
+	for _, t := range m.tokens {
+		s.Tokens = append(s.Tokens, t)
+	}
+	now := time.Now()
+	for jti, exp := range m.revoked {
+		if exp.After(now) {
+			s.Revoked[jti] = exp
+		}
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// usernames list the users in a stable order
+func (m *Memory) usernames() []string {
+	names := make([]string, 0, len(m.users))
+	for name := range m.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 返回给调用者的都是副本，调用者修改结果不会影响数据库
+
+func copyCommodity(c *model.Commodity) *model.Commodity {
+	cp := *c
+	cp.Tags = append([]string(nil), c.Tags...)
+	cp.Variants = copyVariants(c.Variants)
+	cp.Images = append([]model.Image(nil), c.Images...)
+	cp.Options = nil
+	for _, o := range c.Options {
+		cp.Options = append(cp.Options, model.Option{Name: o.Name, Values: append([]string(nil), o.Values...)})
+	}
+	return &cp
+}
+
+func copyComment(c *model.Comment) *model.Comment {
+	cp := *c
+	if c.EditedAt != nil {
+		t := *c.EditedAt
+		cp.EditedAt = &t
+	}
+	cp.History = append([]model.CommentRevision(nil), c.History...)
+	return &cp
+}
+
+func copyCart(c *model.Cart) *model.Cart {
+	cp := *c
+	cp.Lines = append([]model.CartLine{}, c.Lines...)
+	return &cp
+}
+
+func copyOrder(o *model.Order) *model.Order {
+	cp := *o
+	cp.Lines = append([]model.PricedLine(nil), o.Lines...)
+	return &cp
+}
+
+// ListCommodities get a page of commodities
+func (m *Memory) ListCommodities(ctx context.Context, q CommodityQuery) (*CommodityPage, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q.withSubtree(m.categoryList())
+	page, err := pageCommodities(m.commodityList(), q)
+	if err != nil {
+		return nil, err
+	}
+	for i, c := range page.Commodities {
+		page.Commodities[i] = copyCommodity(c)
+	}
+	return page, nil
+}
+
+// CommodityFacets count the commodities matching the filters of q by category, tag and price range
+func (m *Memory) CommodityFacets(ctx context.Context, q CommodityQuery) (*Facets, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return scanFacets(m.commodityList(), m.categoryList(), q)
+}
+
+// commodityList list the commodities in creation order, the lock must be held
+func (m *Memory) commodityList() []*model.Commodity {
+	all := make([]*model.Commodity, 0, len(m.ids))
+	for _, id := range m.ids {
+		all = append(all, m.commodities[id])
+	}
+	return all
+}
+
+// categoryList list the categories by name, the lock must be held
+func (m *Memory) categoryList() []*model.Category {
+	list := make([]*model.Category, 0, len(m.categories))
+	for _, c := range m.categories {
+		list = append(list, c)
+	}
+	sortCategories(list)
+	return list
+}
+
+// ListCategories get the whole category tree as a flat list
+func (m *Memory) ListCategories(ctx context.Context) ([]*model.Category, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := m.categoryList()
+	for i, c := range list {
+		cp := *c
+		list[i] = &cp
+	}
+	return list, nil
+}
+
+// GetCategory get one category by id
+func (m *Memory) GetCategory(ctx context.Context, id string) (*model.Category, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.categories[id]
+	if !ok {
+		return nil, ErrCategoryNotFound
+	}
+	cp := *c
+	return &cp, nil
+}
+
+// WriteCategory add a category when category.Id is empty, otherwise rename or move the category with that id
+func (m *Memory) WriteCategory(ctx context.Context, category *model.Category) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := validCategory(category, m.categoryList()); err != nil {
+		return err
+	}
+	if category.Id == "" {
+		category.Id = categoryID(category.Name, func(id string) bool { return m.categories[id] != nil })
+	} else if _, ok := m.categories[category.Id]; !ok {
+		return ErrCategoryNotFound
+	}
+	c := *category
+	m.categories[c.Id] = &c
+	return nil
+}
+
+// DeleteCategory delete a category that has no subcategories and no commodities
+func (m *Memory) DeleteCategory(ctx context.Context, id string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.categories[id]; !ok {
+		return ErrCategoryNotFound
+	}
+	for _, c := range m.categories {
+		if c.Parent == id {
+			return ErrCategoryInUse
+		}
+	}
+	for _, c := range m.commodities {
+		if c.Category == id {
+			return ErrCategoryInUse
+		}
+	}
+	delete(m.categories, id)
+	return nil
+}
+
+// GetOneCommodity get one commodity by id
+func (m *Memory) GetOneCommodity(ctx context.Context, id string) (*model.Commodity, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.findCommodity(id)
+}
+
+// findCommodity look up a commodity by id, the lock must be held
+func (m *Memory) findCommodity(id string) (*model.Commodity, error) {
+	c, ok := m.commodities[id]
+	if !ok {
+		return nil, &CommodityGoneError{Id: id}
+	}
+	return copyCommodity(c), nil
+}
+
+// GetCommodityBySlug get one commodity by slug
+func (m *Memory) GetCommodityBySlug(ctx context.Context, slug string) (*model.Commodity, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range m.ids {
+		if c := m.commodities[id]; c.Slug == slug {
+			return copyCommodity(c), nil
+		}
+	}
+	return nil, &CommodityGoneError{Id: slug}
+}
+
+// PostCommodity add a commodity when commodity.Id is empty, otherwise update the commodity with that id.
+// 库存只在新增商品时写入
+func (m *Memory) PostCommodity(ctx context.Context, commodity *model.Commodity) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	commodity.Tags = cleanTags(commodity.Tags)
+	if err := validCommodity(commodity); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if commodity.Id == "" {
+		commodity.Id = primitive.NewObjectID().Hex()
+	}
+	commodity.Slug = m.uniqueSlug(commodity.Id, commodity.Name)
+	c := *commodity
+	//规格只通过SetVariants修改，图片只通过SetImages修改
+	c.Options, c.Variants, c.Images = nil, nil, nil
+	if old, ok := m.commodities[c.Id]; ok {
+		c.Stock = old.Stock
+		c.CreatedAt = old.CreatedAt
+		c.Options, c.Variants, c.Images = old.Options, old.Variants, old.Images
+	} else {
+		m.ids = append(m.ids, c.Id)
+		if c.CreatedAt.IsZero() {
+			c.CreatedAt = time.Now()
+		}
+	}
+	commodity.CreatedAt = c.CreatedAt
+	c.Tags = append([]string(nil), commodity.Tags...)
+	m.commodities[c.Id] = &c
+	return nil
+}
+
+// uniqueSlug slugify name, the end of the id is appended when another commodity already uses the slug
+func (m *Memory) uniqueSlug(id string, name string) string {
+	slug := Slugify(name)
+	for _, c := range m.commodities {
+		if c.Slug == slug && c.Id != id {
+			return slugWithID(slug, id)
+		}
+	}
+	return slug
+}
+
+// AdjustStock add delta to the stock of a commodity, or of its variant sku, a negative delta never takes the stock below zero
+func (m *Memory) AdjustStock(ctx context.Context, id string, sku string, delta int) (*model.Commodity, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.commodities[id]
+	if !ok {
+		return nil, &CommodityGoneError{Id: id}
+	}
+	if err := changeStock(c, sku, delta); err != nil {
+		return nil, err
+	}
+	return copyCommodity(c), nil
+}
+
+// SetStock overwrite the stock of a commodity, or of its variant sku
+func (m *Memory) SetStock(ctx context.Context, id string, sku string, stock int) (*model.Commodity, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.commodities[id]
+	if !ok {
+		return nil, &CommodityGoneError{Id: id}
+	}
+	old, err := StockOf(c, sku)
+	if err != nil {
+		return nil, err
+	}
+	if err := changeStock(c, sku, stock-old); err != nil {
+		return nil, err
+	}
+	return copyCommodity(c), nil
+}
+
+// SetVariants replace the variants of a commodity, see applyVariants
+func (m *Memory) SetVariants(ctx context.Context, id string, variants []model.Variant) (*model.Commodity, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	options, err := prepareVariants(variants)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.commodities[id]
+	if !ok {
+		return nil, &CommodityGoneError{Id: id}
+	}
+	applyVariants(c, copyVariants(variants), options)
+	return copyCommodity(c), nil
+}
+
+// SetImages replace the images of a commodity in display order if they are still old, see applyImages
+func (m *Memory) SetImages(ctx context.Context, id string, old []model.Image, images []model.Image) (*model.Commodity, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	images, err := cleanImages(images)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.commodities[id]
+	if !ok {
+		return nil, &CommodityGoneError{Id: id}
+	}
+	if !sameImages(shownImages(c), old) {
+		return nil, ErrImagesChanged
+	}
+	applyImages(c, images)
+	return copyCommodity(c), nil
+}
+
+// ListComments get a page of the comments of a commodity
+func (m *Memory) ListComments(ctx context.Context, commodityId string, q CommentQuery) (*CommentPage, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var all []*model.Comment
+	for _, c := range m.comments {
+		if c.CommodityId == commodityId {
+			all = append(all, c)
+		}
+	}
+	page, err := pageComments(all, q)
+	if err != nil {
+		return nil, err
+	}
+	for i, c := range page.Comments {
+		page.Comments[i] = copyComment(c)
+	}
+	return page, nil
+}
+
+// WriteComment add a comment, the id and creation time are assigned here
+func (m *Memory) WriteComment(ctx context.Context, comment *model.Comment) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	if err := validComment(comment.Comment); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	comment.Id = primitive.NewObjectID().Hex()
+	comment.CreatedAt = time.Now()
+	m.comments = append(m.comments, copyComment(comment))
+	return nil
+}
+
+// findComment get the index of a comment, the lock must be held
+func (m *Memory) findComment(id string) int {
+	for i, c := range m.comments {
+		if c.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// GetComment get a comment by id
+func (m *Memory) GetComment(ctx context.Context, id string) (*model.Comment, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.findComment(id)
+	if i < 0 {
+		return nil, ErrCommentNotFound
+	}
+	return copyComment(m.comments[i]), nil
+}
+
+// UpdateComment replace the text of a comment, the old text is appended to its history
+func (m *Memory) UpdateComment(ctx context.Context, id string, text string) (*model.Comment, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	if err := validComment(text); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.findComment(id)
+	if i < 0 {
+		return nil, ErrCommentNotFound
+	}
+	c := m.comments[i]
+	now := time.Now()
+	c.History = append(c.History, model.CommentRevision{Comment: c.Comment, EditedAt: now})
+	c.Comment = text
+	c.EditedAt = &now
+	return copyComment(c), nil
+}
+
+// DeleteComment delete a comment by id
+func (m *Memory) DeleteComment(ctx context.Context, id string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.findComment(id)
+	if i < 0 {
+		return ErrCommentNotFound
+	}
+	m.comments = append(m.comments[:i], m.comments[i+1:]...)
+	return nil
+}
+
+// GetUsersInfo get all users
+func (m *Memory) GetUsersInfo(ctx context.Context) ([]*model.User, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var users []*model.User
+	for _, name := range m.usernames() {
+		u := *m.users[name]
+		users = append(users, &u)
+	}
+	return users, nil
+}
+
+// GetAUserInfo get a user, the result is empty when the user does not exist
+func (m *Memory) GetAUserInfo(ctx context.Context, username string) ([]*model.User, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var users []*model.User
+	if u, ok := m.users[username]; ok {
+		cp := *u
+		users = append(users, &cp)
+	}
+	return users, nil
+}
+
+// UserRegister add a user, an existing user is never overwritten
+func (m *Memory) UserRegister(ctx context.Context, un string, pw string, bl float64) (*model.User, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[un]; ok {
+		return nil, ErrUserExists
+	}
+	user := model.User{Username: un, Password: pw, Balance: bl, Role: model.RoleCustomer, CreatedAt: time.Now()}
+	cp := user
+	m.users[un] = &cp
+	return &user, nil
+}
+
+// GetUser get a user by username
+func (m *Memory) GetUser(ctx context.Context, username string) (*model.User, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	cp := *u
+	return &cp, nil
+}
+
+// UpdatePassword replace the stored password of a user
+func (m *Memory) UpdatePassword(ctx context.Context, username string, password string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+	u.Password = password
+	return nil
+}
+
+// SetUserRole change the role of a user
+func (m *Memory) SetUserRole(ctx context.Context, username string, role string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+	u.Role = role
+	return nil
+}
+
+// SetBalance change the balance of a user
+func (m *Memory) SetBalance(ctx context.Context, username string, balance float64) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+	u.Balance = balance
+	return nil
+}
+
+// GetCart get the cart of a user, a user without a cart has an empty one
+func (m *Memory) GetCart(ctx context.Context, username string) (*model.Cart, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cart(username), nil
+}
+
+// cart copy the cart of a user, the lock must be held
+func (m *Memory) cart(username string) *model.Cart {
+	c, ok := m.carts[username]
+	if !ok {
+		return &model.Cart{Username: username, Lines: []model.CartLine{}}
+	}
+	return copyCart(c)
+}
+
+// WriteCart replace all the lines of the cart
+func (m *Memory) WriteCart(ctx context.Context, cart *model.Cart) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	if err := validCart(cart); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.carts[cart.Username] = copyCart(cart)
+	return nil
+}
+
+// AddCartLine add quantity of a commodity to the cart, the quantity is summed if the commodity is already in the cart
+func (m *Memory) AddCartLine(ctx context.Context, username string, line model.CartLine) (*model.Cart, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	if err := validLine(line); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.carts[username]
+	if !ok {
+		c = &model.Cart{Username: username}
+		m.carts[username] = c
+	}
+	found := false
+	for i := range c.Lines {
+		if sameLine(c.Lines[i], line) {
+			c.Lines[i].Quantity += line.Quantity
+			found = true
+			break
+		}
+	}
+	if !found {
+		c.Lines = append(c.Lines, line)
+	}
+	return m.cart(username), nil
+}
+
+// SetCartLine change the quantity of a commodity in the cart, a quantity of 0 removes the line
+func (m *Memory) SetCartLine(ctx context.Context, username string, line model.CartLine) (*model.Cart, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	if line.Quantity <= 0 {
+		return m.RemoveCartLine(ctx, username, line.CommodityId, line.Sku)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.carts[username]; ok {
+		for i := range c.Lines {
+			if sameLine(c.Lines[i], line) {
+				c.Lines[i].Quantity = line.Quantity
+				return m.cart(username), nil
+			}
+		}
+	}
+	return nil, ErrCartLineNotFound
+}
+
+// RemoveCartLine remove a commodity, or one variant of it, from the cart
+func (m *Memory) RemoveCartLine(ctx context.Context, username string, commodityId string, sku string) (*model.Cart, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.carts[username]; ok {
+		for i := range c.Lines {
+			if sameLine(c.Lines[i], model.CartLine{CommodityId: commodityId, Sku: sku}) {
+				c.Lines = append(c.Lines[:i], c.Lines[i+1:]...)
+				return m.cart(username), nil
+			}
+		}
+	}
+	return nil, ErrCartLineNotFound
+}
+
+// Checkout turn the cart of a user into an order, see MongoDB.Checkout.
+// The whole checkout happens under the lock, so nothing has to be given back on failure
+func (m *Memory) Checkout(ctx context.Context, username string) (*model.Order, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cart := m.cart(username)
+	if len(cart.Lines) == 0 {
+		return nil, ErrEmptyCart
+	}
+	order := model.Order{
+		Id:        primitive.NewObjectID().Hex(),
+		Username:  username,
+		CreatedAt: time.Now(),
+	}
+	var err error
+	order.Lines, order.Total, err = PriceLines(cart.Lines, m.findCommodity)
+	if err != nil {
+		return nil, err
+	}
+	quantities, err := orderQuantities(order.Lines)
+	if err != nil {
+		return nil, err
+	}
+	for key, n := range quantities {
+		stock, err := StockOf(m.commodities[key.id], key.sku)
+		if err != nil {
+			return nil, err
+		}
+		if stock < n {
+			return nil, &StockError{Id: key.id, Sku: key.sku, Requested: n, Available: stock}
+		}
+	}
+	user, ok := m.users[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	if user.Balance < order.Total {
+		return nil, ErrInsufficientBalance
+	}
+	if orderHook != nil {
+		if err := orderHook(&order); err != nil {
+			return nil, err
+		}
+	}
+
+	for key, n := range quantities {
+		changeStock(m.commodities[key.id], key.sku, -n)
+	}
+	user.Balance -= order.Total
+	m.orders = append(m.orders, copyOrder(&order))
+	m.carts[username].Lines = []model.CartLine{}
+	return &order, nil
+}
+
+// GetOrders get all orders of a user, newest first
+func (m *Memory) GetOrders(ctx context.Context, username string) ([]*model.Order, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	orders := []*model.Order{}
+	for i := len(m.orders) - 1; i >= 0; i-- {
+		if o := m.orders[i]; o.Username == username {
+			orders = append(orders, copyOrder(o))
+		}
+	}
+	return orders, nil
+}
+
+// GetOrder get one order of a user
+func (m *Memory) GetOrder(ctx context.Context, username string, id string) (*model.Order, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, o := range m.orders {
+		if o.Username == username && o.Id == id {
+			return copyOrder(o), nil
+		}
+	}
+	return nil, ErrOrderNotFound
+}
+
+// AddToken save a refresh token
+func (m *Memory) AddToken(ctx context.Context, token *model.RefreshToken) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := *token
+	m.tokens[t.Id] = &t
+	return nil
+}
+
+// GetAToken get a refresh token by id
+func (m *Memory) GetAToken(ctx context.Context, id string) (*model.RefreshToken, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[id]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	cp := *t
+	return &cp, nil
+}
+
+// UseToken mark a refresh token as used, only the first call for a token succeeds
+func (m *Memory) UseToken(ctx context.Context, id string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[id]
+	if !ok || t.Used || t.Revoked {
+		return ErrTokenReused
+	}
+	t.Used = true
+	return nil
+}
+
+// RevokeTokenFamily revoke every refresh token of a family
+func (m *Memory) RevokeTokenFamily(ctx context.Context, family string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.tokens {
+		if t.Family == family {
+			t.Revoked = true
+		}
+	}
+	return nil
+}
+
+// RevokeAccessToken put the jti of an access token in the revocation list until the token expires
+func (m *Memory) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.revoked[jti] = expiresAt
+	return nil
+}
+
+// IsAccessTokenRevoked check the revocation list
+func (m *Memory) IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	if err := checkContext(ctx); err != nil {
+		return false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	exp, ok := m.revoked[jti]
+	return ok && exp.After(time.Now()), nil
+}
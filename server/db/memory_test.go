@@ -0,0 +1,108 @@
+package db
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"webapp/model"
+)
+
+func TestMemorySnapshot(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	drinks := &model.Category{Name: "Drinks"}
+	m.WriteCategory(ctx, drinks)
+	tea := &model.Commodity{Name: "Tea", Price: 10, Stock: 2, Category: drinks.Id, Tags: []string{"hot"}}
+	m.PostCommodity(ctx, tea)
+	if _, err := m.UserRegister(ctx, "alice", "hash", 30); err != nil {
+		t.Fatal(err)
+	}
+	m.WriteComment(ctx, &model.Comment{Username: "alice", CommodityId: tea.Id, Comment: "nice"})
+	if _, err := m.AddCartLine(ctx, "alice", model.CartLine{CommodityId: tea.Id, Quantity: 1}); err != nil {
+		t.Fatal(err)
+	}
+	m.RevokeAccessToken(ctx, "old", time.Now().Add(-time.Minute))
+	m.RevokeAccessToken(ctx, "current", time.Now().Add(time.Minute))
+
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.json")
+	if err := m.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadMemory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := loaded.GetUser(ctx, "alice")
+	if err != nil || user.Password != "hash" || user.Balance != 30 {
+		t.Fatalf("user %+v, %v", user, err)
+	}
+	c, err := loaded.GetCommodityBySlug(ctx, "tea")
+	if err != nil || c.Id != tea.Id || c.Stock != 2 || len(c.Tags) != 1 {
+		t.Fatalf("commodity %+v, %v", c, err)
+	}
+	if _, err := loaded.GetCategory(ctx, drinks.Id); err != nil {
+		t.Fatalf("category %v", err)
+	}
+	comments, _ := loaded.ListComments(ctx, tea.Id, CommentQuery{})
+	if len(comments.Comments) != 1 {
+		t.Fatalf("got %d comments", len(comments.Comments))
+	}
+	cart, _ := loaded.GetCart(ctx, "alice")
+	if len(cart.Lines) != 1 {
+		t.Fatalf("cart %+v", cart)
+	}
+	if revoked, _ := loaded.IsAccessTokenRevoked(ctx, "current"); !revoked {
+		t.Fatal("revocation lost")
+	}
+	if len(loaded.revoked) != 1 {
+		t.Fatal("expired revocation saved")
+	}
+
+	empty, err := LoadMemory(filepath.Join(dir, "missing.json"))
+	if err != nil || len(empty.ids) != 0 {
+		t.Fatalf("missing snapshot: %v", err)
+	}
+}
+
+func TestMemoryConcurrentCheckout(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	tea := &model.Commodity{Name: "Tea", Price: 1, Stock: 5}
+	m.PostCommodity(ctx, tea)
+	users := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}
+	for _, u := range users {
+		m.UserRegister(ctx, u, "hash", 10)
+		m.AddCartLine(ctx, u, model.CartLine{CommodityId: tea.Id, Quantity: 1})
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sold := 0
+	for _, u := range users {
+		wg.Add(1)
+		go func(u string) {
+			defer wg.Done()
+			if _, err := m.Checkout(ctx, u); err == nil {
+				mu.Lock()
+				sold++
+				mu.Unlock()
+			}
+		}(u)
+	}
+	wg.Wait()
+
+	c, _ := m.GetOneCommodity(ctx, tea.Id)
+	if sold != 5 || c.Stock != 0 {
+		t.Fatalf("sold %d, stock left %d", sold, c.Stock)
+	}
+}
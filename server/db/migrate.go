@@ -0,0 +1,293 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"webapp/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var migrationCollection = "migrations"
+
+// migration is a versioned change of the schema (indexes) or of the shape of the stored data.
+// Migrations are applied in the order of their versions and each one only once; up should still be
+// safe to run again, in case the server stopped before the version was recorded.
+type migration struct {
+	version int
+	name    string
+	up      func(m MongoDB, ctx context.Context) error
+}
+
+// 新的迁移只能追加在末尾，已经发布的迁移不能修改版本号
+var migrations = []migration{
+	{1, "back-fill commodity and comment ids", MongoDB.migrateCommodityIDs},
+	{2, "create indexes", MongoDB.createIndexes},
+	{3, "back-fill user roles", MongoDB.migrateUserRoles},
+	{4, "back-fill commodity creation times, add list indexes", MongoDB.migrateCommodityTimes},
+	{5, "create categories from commodity categories, add category and tag indexes", MongoDB.migrateCategories},
+	{6, "back-fill user registration times", MongoDB.migrateUserTimes},
+}
+
+// MigrationState is the state of a migration in the migrations collection
+type MigrationState struct {
+	Version int
+	Name    string
+	//AppliedAt is nil when the migration is pending
+	AppliedAt *time.Time
+}
+
+// migrationRecord is the document of an applied (or running) migration, _id is the version
+type migrationRecord struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	Running   bool      `bson:"running"`
+	StartedAt time.Time `bson:"startedat"`
+	AppliedAt time.Time `bson:"appliedat"`
+}
+
+// Migrate apply the pending migrations in order. A migration is claimed in the migrations collection
+// before it runs, so two servers starting together do not apply it twice: the second one gets an ErrConflict.
+func (m MongoDB) Migrate(ctx context.Context) error {
+	records := m.database.Collection(migrationCollection)
+	for _, mig := range migrations {
+		claim := migrationRecord{Version: mig.version, Name: mig.name, Running: true, StartedAt: time.Now()}
+		_, err := records.InsertOne(ctx, claim)
+		if isDuplicateKey(err) {
+			var rec migrationRecord
+			if err := records.FindOne(ctx, bson.M{"_id": mig.version}).Decode(&rec); err != nil {
+				return mongoErr(err)
+			}
+			if rec.Running {
+				return &kindError{fmt.Sprintf("migration %d (%s) is being applied since %s, remove it from %s if that server stopped",
+					mig.version, mig.name, rec.StartedAt.Format(time.RFC3339), migrationCollection), ErrConflict}
+			}
+			continue
+		}
+		if err != nil {
+			return mongoErr(err)
+		}
+
+		log.Printf("Applying migration %d: %s\n", mig.version, mig.name)
+		if err := mig.up(m, ctx); err != nil {
+			//删除占用记录，修复问题后可以重新运行
+			rctx, cancel := detached()
+			records.DeleteOne(rctx, bson.M{"_id": mig.version})
+			cancel()
+			return fmt.Errorf("migration %d (%s): %w", mig.version, mig.name, mongoErr(err))
+		}
+		_, err = records.UpdateOne(ctx, bson.M{"_id": mig.version},
+			bson.M{"$set": bson.M{"running": false, "appliedat": time.Now()}})
+		if err != nil {
+			return mongoErr(err)
+		}
+	}
+	return nil
+}
+
+// MigrationStatus list every known migration with the time it was applied
+func (m MongoDB) MigrationStatus(ctx context.Context) ([]MigrationState, error) {
+	cur, err := m.database.Collection(migrationCollection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+	var records []migrationRecord
+	if err := cur.All(ctx, &records); err != nil {
+		return nil, mongoErr(err)
+	}
+	applied := make(map[int]time.Time)
+	for _, rec := range records {
+		if !rec.Running {
+			applied[rec.Version] = rec.AppliedAt
+		}
+	}
+	states := make([]MigrationState, len(migrations))
+	for i, mig := range migrations {
+		states[i] = MigrationState{Version: mig.version, Name: mig.name}
+		if at, ok := applied[mig.version]; ok {
+			states[i].AppliedAt = &at
+		}
+	}
+	return states, nil
+}
+
+// index is an index of a collection, the name is fixed so that it can be found again
+type index struct {
+	collection string
+	name       string
+	keys       bson.D
+	unique     bool
+	//expireAfter > 0 makes a TTL index
+	expireAfter time.Duration
+}
+
+// 用户名、商品id和slug唯一；评论按商品和时间查询；撤销的access token过期后由MongoDB自动删除
+var indexes = []index{
+	{collection: userCollection, name: "username", keys: bson.D{{Key: "username", Value: 1}}, unique: true},
+	{collection: commodityCollection, name: "id", keys: bson.D{{Key: "id", Value: 1}}, unique: true},
+	{collection: commodityCollection, name: "slug", keys: bson.D{{Key: "slug", Value: 1}}, unique: true},
+	{collection: commodityCollection, name: "createdat_id", keys: bson.D{{Key: "createdat", Value: 1}, {Key: "id", Value: 1}}},
+	{collection: commodityCollection, name: "price_id", keys: bson.D{{Key: "price", Value: 1}, {Key: "id", Value: 1}}},
+	{collection: commodityCollection, name: "name_id", keys: bson.D{{Key: "name", Value: 1}, {Key: "id", Value: 1}}},
+	{collection: commodityCollection, name: "category", keys: bson.D{{Key: "category", Value: 1}}},
+	{collection: commodityCollection, name: "tags", keys: bson.D{{Key: "tags", Value: 1}}},
+	{collection: categoryCollection, name: "id", keys: bson.D{{Key: "id", Value: 1}}, unique: true},
+	{collection: categoryCollection, name: "parent", keys: bson.D{{Key: "parent", Value: 1}}},
+	{collection: commentCollection, name: "id", keys: bson.D{{Key: "id", Value: 1}}, unique: true},
+	{collection: commentCollection, name: "commodity_date", keys: bson.D{{Key: "commodityid", Value: 1}, {Key: "createdat", Value: 1}}},
+	{collection: cartCollection, name: "username", keys: bson.D{{Key: "username", Value: 1}}, unique: true},
+	{collection: orderCollection, name: "username_id", keys: bson.D{{Key: "username", Value: 1}, {Key: "id", Value: 1}}, unique: true},
+	{collection: orderCollection, name: "username_date", keys: bson.D{{Key: "username", Value: 1}, {Key: "createdat", Value: -1}}},
+	{collection: tokenCollection, name: "id", keys: bson.D{{Key: "id", Value: 1}}, unique: true},
+	{collection: tokenCollection, name: "family", keys: bson.D{{Key: "family", Value: 1}}},
+	{collection: revokedCollection, name: "jti", keys: bson.D{{Key: "jti", Value: 1}}, unique: true},
+	{collection: revokedCollection, name: "expiresat", keys: bson.D{{Key: "expiresat", Value: 1}}, expireAfter: time.Second},
+}
+
+// createIndexes create the indexes, unique indexes fail with the list of the duplicated values
+// when the existing data has duplicates. Indexes that already exist are left as they are,
+// so a new index is added by a new migration that runs createIndexes again
+func (m MongoDB) createIndexes(ctx context.Context) error {
+	for _, idx := range indexes {
+		if idx.unique {
+			if err := m.checkDuplicates(ctx, idx); err != nil {
+				return err
+			}
+		}
+		opts := options.Index().SetName(idx.name)
+		if idx.unique {
+			opts.SetUnique(true)
+		}
+		if idx.expireAfter > 0 {
+			//expiresat本身就是过期时间，只需要很短的延迟
+			opts.SetExpireAfterSeconds(int32(idx.expireAfter / time.Second))
+		}
+		_, err := m.database.Collection(idx.collection).Indexes().CreateOne(ctx, mongo.IndexModel{Keys: idx.keys, Options: opts})
+		if err != nil {
+			return fmt.Errorf("index %s.%s: %w", idx.collection, idx.name, err)
+		}
+	}
+	return nil
+}
+
+// checkDuplicates return an ErrConflict listing the values of the keys of idx that are stored more than once
+func (m MongoDB) checkDuplicates(ctx context.Context, idx index) error {
+	group := bson.D{}
+	for _, k := range idx.keys {
+		group = append(group, bson.E{Key: k.Key, Value: "$" + k.Key})
+	}
+	cur, err := m.database.Collection(idx.collection).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.D{{Key: "_id", Value: group}, {Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}}}}},
+		{{Key: "$match", Value: bson.D{{Key: "count", Value: bson.D{{Key: "$gt", Value: 1}}}}}},
+		{{Key: "$limit", Value: 10}},
+	})
+	if err != nil {
+		return err
+	}
+	var dups []struct {
+		Id    bson.M `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	if err := cur.All(ctx, &dups); err != nil {
+		return err
+	}
+	if len(dups) == 0 {
+		return nil
+	}
+	var list []string
+	for _, d := range dups {
+		list = append(list, fmt.Sprintf("%v (%d times)", d.Id, d.Count))
+	}
+	return &kindError{fmt.Sprintf("cannot create the unique index %s.%s, fix the duplicates first: %s",
+		idx.collection, idx.name, strings.Join(list, ", ")), ErrConflict}
+}
+
+// migrateUserRoles give the users registered before roles existed the customer role
+func (m MongoDB) migrateUserRoles(ctx context.Context) error {
+	res, err := m.database.Collection(userCollection).UpdateMany(ctx,
+		bson.M{"$or": bson.A{bson.M{"role": bson.M{"$exists": false}}, bson.M{"role": ""}}},
+		bson.M{"$set": bson.M{"role": model.RoleCustomer}})
+	if err != nil {
+		return err
+	}
+	log.Println("User roles back-filled:", res.ModifiedCount)
+	return nil
+}
+
+// migrateUserTimes give the users registered before they had a registration time the time stored in _id,
+// so that the admin_users given at startup can be checked against it
+func (m MongoDB) migrateUserTimes(ctx context.Context) error {
+	users := m.database.Collection(userCollection)
+	cur, err := users.Find(ctx, bson.M{"createdat": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	var docs []struct {
+		OID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cur.All(ctx, &docs); err != nil {
+		return err
+	}
+	for _, d := range docs {
+		_, err := users.UpdateOne(ctx, bson.M{"_id": d.OID}, bson.M{"$set": bson.M{"createdat": d.OID.Timestamp()}})
+		if err != nil {
+			return err
+		}
+	}
+	log.Println("User registration times back-filled:", len(docs))
+	return nil
+}
+
+// migrateCommodityTimes give the commodities created before they had a creation time the time stored in _id,
+// then create the indexes used to sort the commodity list
+func (m MongoDB) migrateCommodityTimes(ctx context.Context) error {
+	commodities := m.database.Collection(commodityCollection)
+	cur, err := commodities.Find(ctx, bson.M{"createdat": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	var docs []struct {
+		OID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cur.All(ctx, &docs); err != nil {
+		return err
+	}
+	for _, d := range docs {
+		_, err := commodities.UpdateOne(ctx, bson.M{"_id": d.OID}, bson.M{"$set": bson.M{"createdat": d.OID.Timestamp()}})
+		if err != nil {
+			return err
+		}
+	}
+	log.Println("Commodity creation times back-filled:", len(docs))
+	return m.createIndexes(ctx)
+}
+
+// migrateCategories turn the category names stored on the commodities before the category tree existed
+// into root categories with the name as id, so the commodities keep their category, then create the indexes
+func (m MongoDB) migrateCategories(ctx context.Context) error {
+	names, err := m.database.Collection(commodityCollection).Distinct(ctx, "category", bson.M{})
+	if err != nil {
+		return err
+	}
+	created := 0
+	for _, v := range names {
+		name, ok := v.(string)
+		if !ok || name == "" {
+			continue
+		}
+		res, err := m.database.Collection(categoryCollection).UpdateOne(ctx, bson.M{"id": name},
+			bson.M{"$setOnInsert": model.Category{Id: name, Name: name}}, options.Update().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+		created += int(res.UpsertedCount)
+	}
+	log.Println("Categories created from commodities:", created)
+	return m.createIndexes(ctx)
+}
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"context"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// migrateCommodityIDs back-fill the ids of commodities created before ids were assigned by the server,
+// then rewrite the comments, carts and orders that still reference commodities by name.
+// Comments without an id get one too.
+// It is safe to run more than once.
+func (m MongoDB) migrateCommodityIDs(ctx context.Context) error {
+	commodities := m.database.Collection(commodityCollection)
+
+	//商品：用文档的_id作为id，同时生成slug
+	cur, err := commodities.Find(ctx, bson.M{"$or": bson.A{bson.M{"id": bson.M{"$exists": false}}, bson.M{"id": ""}}})
+	if err != nil {
+		return err
+	}
+	var docs []struct {
+		OID  primitive.ObjectID `bson:"_id"`
+		Name string             `bson:"name"`
+	}
+	if err := cur.All(ctx, &docs); err != nil {
+		return err
+	}
+	for _, d := range docs {
+		id := d.OID.Hex()
+		slug, err := m.uniqueSlug(ctx, id, d.Name)
+		if err != nil {
+			return err
+		}
+		_, err = commodities.UpdateOne(ctx, bson.M{"_id": d.OID},
+			bson.M{"$set": bson.M{"id": id, "slug": slug}})
+		if err != nil {
+			return err
+		}
+	}
+	log.Println("Commodity ids back-filled:", len(docs))
+
+	//名字到id的映射
+	cur, err = commodities.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	var all []struct {
+		Id   string `bson:"id"`
+		Name string `bson:"name"`
+	}
+	if err := cur.All(ctx, &all); err != nil {
+		return err
+	}
+	ids := make(map[string]string)
+	for _, c := range all {
+		ids[c.Name] = c.Id
+	}
+
+	//评论：commodity(名字) -> commodityid
+	comments := m.database.Collection(commentCollection)
+	for name, id := range ids {
+		res, err := comments.UpdateMany(ctx, bson.M{"commodity": name},
+			bson.M{"$set": bson.M{"commodityid": id}, "$unset": bson.M{"commodity": ""}})
+		if err != nil {
+			return err
+		}
+		if res.ModifiedCount > 0 {
+			log.Println("Comments migrated for", name, ":", res.ModifiedCount)
+		}
+	}
+
+	if err := m.migrateCommentIDs(ctx); err != nil {
+		return err
+	}
+
+	//购物车和订单中的每一行：commodity(名字) -> commodityid
+	for _, collection := range []string{cartCollection, orderCollection} {
+		if err := m.migrateLines(ctx, collection, ids); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateLines rewrite the lines of the documents of a collection (carts or orders) that reference commodities by name
+func (m MongoDB) migrateLines(ctx context.Context, collection string, ids map[string]string) error {
+	c := m.database.Collection(collection)
+	cur, err := c.Find(ctx, bson.M{"lines.commodity": bson.M{"$exists": true}})
+	if err != nil {
+		return err
+	}
+	var docs []bson.M
+	if err := cur.All(ctx, &docs); err != nil {
+		return err
+	}
+	for _, d := range docs {
+		lines, _ := d["lines"].(bson.A)
+		for _, l := range lines {
+			line, ok := l.(bson.M)
+			if !ok {
+				continue
+			}
+			if name, ok := line["commodity"].(string); ok {
+				//已经不存在的商品保留名字，结算时会被标记为已下架
+				id, found := ids[name]
+				if !found {
+					id = name
+				}
+				line["commodityid"] = id
+				delete(line, "commodity")
+			}
+		}
+		if _, err := c.UpdateOne(ctx, bson.M{"_id": d["_id"]}, bson.M{"$set": bson.M{"lines": lines}}); err != nil {
+			return err
+		}
+	}
+	log.Println(collection, "documents migrated:", len(docs))
+	return nil
+}
+
+// migrateCommentIDs give the comments written before comments had ids an id (the hex of _id)
+// and a creation time (the time stored in _id)
+func (m MongoDB) migrateCommentIDs(ctx context.Context) error {
+	comments := m.database.Collection(commentCollection)
+	cur, err := comments.Find(ctx, bson.M{"$or": bson.A{bson.M{"id": bson.M{"$exists": false}}, bson.M{"id": ""}}})
+	if err != nil {
+		return err
+	}
+	var docs []struct {
+		OID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cur.All(ctx, &docs); err != nil {
+		return err
+	}
+	for _, d := range docs {
+		_, err := comments.UpdateOne(ctx, bson.M{"_id": d.OID},
+			bson.M{"$set": bson.M{"id": d.OID.Hex(), "createdat": d.OID.Timestamp()}})
+		if err != nil {
+			return err
+		}
+	}
+	log.Println("Comment ids back-filled:", len(docs))
+	return nil
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestMigrationVersions(t *testing.T) {
+	for i, mig := range migrations {
+		if mig.version != i+1 {
+			t.Fatalf("migration %q has version %d, want %d", mig.name, mig.version, i+1)
+		}
+	}
+	names := make(map[string]bool)
+	for _, idx := range indexes {
+		key := idx.collection + "." + idx.name
+		if names[key] {
+			t.Fatalf("index %s defined twice", key)
+		}
+		names[key] = true
+	}
+}
+
+// TestMongoMigrate needs a MongoDB like TestMongoConformance
+func TestMongoMigrate(t *testing.T) {
+	uri := os.Getenv("mongo_test_uri")
+	if uri == "" {
+		t.Skip("mongo_test_uri is not set")
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+	database := client.Database(fmt.Sprintf("webapp_migrate_%d", time.Now().UnixNano()))
+	defer database.Drop(ctx)
+	m := MongoDB{database: database}
+
+	//旧数据：没有角色的用户，重复的用户名
+	users := database.Collection(userCollection)
+	users.InsertOne(ctx, bson.M{"username": "alice", "password": "x"})
+	users.InsertOne(ctx, bson.M{"username": "alice", "password": "y"})
+	//分类树之前保存在商品上的分类名
+	database.Collection(commodityCollection).InsertOne(ctx, bson.M{"id": "c1", "name": "Tea", "slug": "tea", "category": "drink"})
+	if err := m.Migrate(ctx); !errors.Is(err, ErrConflict) {
+		t.Fatalf("duplicates: got %v", err)
+	}
+	states, _ := m.MigrationStatus(ctx)
+	if states[0].AppliedAt == nil || states[1].AppliedAt != nil {
+		t.Fatalf("after a failed migration: %+v", states)
+	}
+
+	users.DeleteOne(ctx, bson.M{"password": "y"})
+	if err := m.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Migrate(ctx); err != nil {
+		t.Fatal("second run:", err)
+	}
+	states, _ = m.MigrationStatus(ctx)
+	for _, s := range states {
+		if s.AppliedAt == nil {
+			t.Fatalf("migration %d not applied", s.Version)
+		}
+	}
+	if u, err := m.GetUser(ctx, "alice"); err != nil || u.Role != "customer" {
+		t.Fatalf("role not back-filled: %+v %v", u, err)
+	}
+	if c, err := m.GetCategory(ctx, "drink"); err != nil || c.Name != "drink" || c.Parent != "" {
+		t.Fatalf("category not created: %+v %v", c, err)
+	}
+	if page, err := m.ListCommodities(ctx, CommodityQuery{Category: "drink"}); err != nil || len(page.Commodities) != 1 {
+		t.Fatalf("commodity lost its category: %+v %v", page, err)
+	}
+	if _, err := users.InsertOne(ctx, bson.M{"username": "alice"}); !isDuplicateKey(err) {
+		t.Fatalf("username is not unique: %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package db
+
+import (
+	"context"
+	"log"
+	"time"
+	"webapp/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var orderCollection = "order"
+
+// Checkout turn the cart of a user into an order: the commodities are re-priced from the catalog, their stock is
+// reserved, the balance is debited, the order is written and the cart is emptied, all in one transaction.
+// Either every step is applied or none is, even when the server stops in the middle; a concurrent change of the cart
+// makes the transaction start again. Transactions need MongoDB to run as a replica set (a single member is enough)
+func (m MongoDB) Checkout(ctx context.Context, username string) (*model.Order, error) {
+	session, err := m.database.Client().StartSession()
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+	defer session.EndSession(ctx)
+	res, err := session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return m.checkout(sc, username)
+	})
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+	return res.(*model.Order), nil
+}
+
+// checkout is the transaction of Checkout, it may run several times
+func (m MongoDB) checkout(ctx mongo.SessionContext, username string) (*model.Order, error) {
+	cart, err := m.GetCart(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if len(cart.Lines) == 0 {
+		return nil, ErrEmptyCart
+	}
+
+	//以商品表中的当前价格为准
+	order := model.Order{
+		Id:        primitive.NewObjectID().Hex(),
+		Username:  username,
+		CreatedAt: time.Now(),
+	}
+	order.Lines, order.Total, err = PriceLines(cart.Lines, func(id string) (*model.Commodity, error) {
+		return m.findCommodity(ctx, id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	quantities, err := orderQuantities(order.Lines)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.reserveStock(ctx, quantities); err != nil {
+		return nil, err
+	}
+
+	//余额足够时才扣款
+	users := m.database.Collection(userCollection)
+	res, err := users.UpdateOne(ctx,
+		bson.M{"username": username, "balance": bson.M{"$gte": order.Total}},
+		bson.M{"$inc": bson.M{"balance": -order.Total}})
+	if err != nil {
+		log.Println("Error while debiting a user: ", err.Error())
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		n, err := users.CountDocuments(ctx, bson.M{"username": username})
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, ErrUserNotFound
+		}
+		return nil, ErrInsufficientBalance
+	}
+
+	if orderHook != nil {
+		if err := orderHook(&order); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := m.database.Collection(orderCollection).InsertOne(ctx, order); err != nil {
+		log.Println("Error while inserting an order: ", err.Error())
+		return nil, err
+	}
+	//同一个购物车的另一个结算也会写这个文档，事务冲突后重新开始时读到的是空购物车
+	_, err = m.database.Collection(cartCollection).UpdateOne(ctx,
+		bson.M{"username": username}, bson.M{"$set": bson.M{"lines": []model.CartLine{}}})
+	if err != nil {
+		log.Println("Error while emptying a cart: ", err.Error())
+		return nil, err
+	}
+	return &order, nil
+}
+
+// GetOrders get all orders of a user, newest first
+func (m MongoDB) GetOrders(ctx context.Context, username string) ([]*model.Order, error) {
+	opts := options.Find().SetSort(bson.M{"createdat": -1})
+	res, err := m.database.Collection(orderCollection).Find(ctx, bson.M{"username": username}, opts)
+	if err != nil {
+		log.Println("Error while fetching orders:", err.Error())
+		return nil, mongoErr(err)
+	}
+
+	orders := []*model.Order{}
+	err = res.All(ctx, &orders)
+	if err != nil {
+		log.Println("Error while decoding orders:", err.Error())
+		return nil, mongoErr(err)
+	}
+	return orders, nil
+}
+
+// GetOrder get one order of a user
+func (m MongoDB) GetOrder(ctx context.Context, username string, id string) (*model.Order, error) {
+	var order model.Order
+	err := m.database.Collection(orderCollection).FindOne(ctx, bson.M{"username": username, "id": id}).Decode(&order)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrOrderNotFound
+	}
+	if err != nil {
+		log.Println("Error while fetching an order: ", err.Error())
+		return nil, mongoErr(err)
+	}
+	return &order, nil
+}
@@ -0,0 +1,321 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+	"webapp/model"
+)
+
+// 列表的排序方式
+const (
+	// SortOldest list in creation order, the default
+	SortOldest = "oldest"
+	// SortNewest list the latest first
+	SortNewest = "newest"
+	// SortPrice list the cheapest first
+	SortPrice = "price"
+	// SortPriceDesc list the most expensive first
+	SortPriceDesc = "-price"
+	// SortName list by name
+	SortName = "name"
+)
+
+const (
+	// DefaultLimit is the page size when the query has no limit
+	DefaultLimit = 20
+	// MaxLimit is the largest page size, larger limits are reduced to it
+	MaxLimit = 100
+)
+
+// CommodityQuery select a page of commodities. Cursor is the Next of the previous page,
+// the other fields must stay the same from page to page
+type CommodityQuery struct {
+	Sort string
+	//价格区间，包含两端，nil表示不限
+	MinPrice *float64
+	MaxPrice *float64
+	//分类的id，包含它的所有下级分类
+	Category string
+	//商品必须有全部的标签
+	Tags []string
+	//在名字和介绍中查找，不区分大小写
+	Keyword string
+	Limit   int
+	Cursor  string
+
+	//Category和它的下级分类，由后端在筛选前通过withSubtree设置
+	subtree map[string]bool
+}
+
+// CommodityPage is a page of commodities, Next is empty on the last page
+type CommodityPage struct {
+	Commodities []*model.Commodity
+	Next        string
+}
+
+// CommentQuery select a page of the comments of a commodity, sorted by SortOldest (default) or SortNewest
+type CommentQuery struct {
+	Sort   string
+	Limit  int
+	Cursor string
+}
+
+// CommentPage is a page of comments, Next is empty on the last page
+type CommentPage struct {
+	Comments []*model.Comment
+	Next     string
+}
+
+// cursor is the position after the last item of a page: the sort key and the id of that item.
+// It is given to the client as opaque base64 JSON
+type cursor struct {
+	Sort  string    `json:"s"`
+	Price float64   `json:"p,omitempty"`
+	Name  string    `json:"n,omitempty"`
+	Time  time.Time `json:"t,omitempty"`
+	Id    string    `json:"i"`
+}
+
+func (c cursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor read the cursor of a query sorted by sortBy, nil when s is empty
+func decodeCursor(s string, sortBy string) (*cursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, invalid("invalid cursor")
+	}
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil || c.Id == "" {
+		return nil, invalid("invalid cursor")
+	}
+	if c.Sort != sortBy {
+		return nil, invalid("the cursor belongs to a list sorted by " + c.Sort)
+	}
+	return &c, nil
+}
+
+// pageLimit apply the default and the maximum page size
+func pageLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultLimit
+	}
+	if limit > MaxLimit {
+		return MaxLimit
+	}
+	return limit
+}
+
+// normalize check the query and fill in the defaults, the decoded cursor is returned
+func (q *CommodityQuery) normalize() (*cursor, error) {
+	switch q.Sort {
+	case "":
+		q.Sort = SortOldest
+	case SortOldest, SortNewest, SortPrice, SortPriceDesc, SortName:
+	default:
+		return nil, invalid("sort must be oldest, newest, price, -price or name")
+	}
+	if q.MinPrice != nil && q.MaxPrice != nil && *q.MinPrice > *q.MaxPrice {
+		return nil, invalid("minPrice is greater than maxPrice")
+	}
+	q.Tags = cleanTags(q.Tags)
+	q.Limit = pageLimit(q.Limit)
+	return decodeCursor(q.Cursor, q.Sort)
+}
+
+func (q *CommentQuery) normalize() (*cursor, error) {
+	switch q.Sort {
+	case "":
+		q.Sort = SortOldest
+	case SortOldest, SortNewest:
+	default:
+		return nil, invalid("sort must be oldest or newest")
+	}
+	q.Limit = pageLimit(q.Limit)
+	return decodeCursor(q.Cursor, q.Sort)
+}
+
+// commodityCursor is the cursor after c in a list sorted by sortBy
+func commodityCursor(c *model.Commodity, sortBy string) cursor {
+	cur := cursor{Sort: sortBy, Id: c.Id}
+	switch sortBy {
+	case SortPrice, SortPriceDesc:
+		cur.Price = c.Price
+	case SortName:
+		cur.Name = c.Name
+	default:
+		cur.Time = c.CreatedAt
+	}
+	return cur
+}
+
+// compareCommodities order a and b by sortBy, the id breaks ties in the same direction
+func compareCommodities(sortBy string, a, b *model.Commodity) int {
+	var n int
+	switch sortBy {
+	case SortPrice, SortPriceDesc:
+		n = compareFloat(a.Price, b.Price)
+	case SortName:
+		n = strings.Compare(a.Name, b.Name)
+	default:
+		n = compareTime(a.CreatedAt, b.CreatedAt)
+	}
+	if n == 0 {
+		n = strings.Compare(a.Id, b.Id)
+	}
+	if sortBy == SortPriceDesc || sortBy == SortNewest {
+		return -n
+	}
+	return n
+}
+
+// matchCommodity check c against the filters of q
+func matchCommodity(c *model.Commodity, q *CommodityQuery) bool {
+	if q.MinPrice != nil && c.Price < *q.MinPrice {
+		return false
+	}
+	if q.MaxPrice != nil && c.Price > *q.MaxPrice {
+		return false
+	}
+	if q.Category != "" && !q.inCategory(c.Category) {
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !hasTag(c.Tags, tag) {
+			return false
+		}
+	}
+	if q.Keyword != "" {
+		kw := strings.ToLower(q.Keyword)
+		if !strings.Contains(strings.ToLower(c.Name), kw) && !strings.Contains(strings.ToLower(c.Introduction), kw) {
+			return false
+		}
+	}
+	return true
+}
+
+// withSubtree give the query the category tree, so that the commodities of the subcategories of q.Category match.
+// A category that is not in the tree (a category name stored before the tree existed) only matches itself
+func (q *CommodityQuery) withSubtree(categories []*model.Category) {
+	if q.Category != "" {
+		q.subtree = subtree(categories, q.Category)
+	}
+}
+
+func (q *CommodityQuery) inCategory(category string) bool {
+	if q.subtree != nil {
+		return q.subtree[category]
+	}
+	return category == q.Category
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// pageCommodities select a page of commodities for the backends that scan all the commodities
+func pageCommodities(all []*model.Commodity, q CommodityQuery) (*CommodityPage, error) {
+	after, err := q.normalize()
+	if err != nil {
+		return nil, err
+	}
+	var from *model.Commodity
+	if after != nil {
+		from = &model.Commodity{Id: after.Id, Price: after.Price, Name: after.Name, CreatedAt: after.Time}
+	}
+	list := []*model.Commodity{}
+	for _, c := range all {
+		if matchCommodity(c, &q) && (from == nil || compareCommodities(q.Sort, c, from) > 0) {
+			list = append(list, c)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return compareCommodities(q.Sort, list[i], list[j]) < 0 })
+	return commodityPage(list, q), nil
+}
+
+// commodityPage make a page of the sorted list, which holds the commodities after the cursor,
+// at least one more than the limit when there is a next page
+func commodityPage(list []*model.Commodity, q CommodityQuery) *CommodityPage {
+	page := &CommodityPage{Commodities: list}
+	if len(list) > q.Limit {
+		page.Commodities = list[:q.Limit]
+		page.Next = commodityCursor(list[q.Limit-1], q.Sort).encode()
+	}
+	return page
+}
+
+// compareComments order the comments by creation time and id, reversed for SortNewest
+func compareComments(sortBy string, a, b *model.Comment) int {
+	n := compareTime(a.CreatedAt, b.CreatedAt)
+	if n == 0 {
+		n = strings.Compare(a.Id, b.Id)
+	}
+	if sortBy == SortNewest {
+		return -n
+	}
+	return n
+}
+
+// pageComments select a page of the comments of a commodity for the backends that scan all of them
+func pageComments(all []*model.Comment, q CommentQuery) (*CommentPage, error) {
+	after, err := q.normalize()
+	if err != nil {
+		return nil, err
+	}
+	var from *model.Comment
+	if after != nil {
+		from = &model.Comment{Id: after.Id, CreatedAt: after.Time}
+	}
+	list := []*model.Comment{}
+	for _, c := range all {
+		if from == nil || compareComments(q.Sort, c, from) > 0 {
+			list = append(list, c)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return compareComments(q.Sort, list[i], list[j]) < 0 })
+	return commentPage(list, q), nil
+}
+
+// commentPage make a page of the sorted list like commodityPage
+func commentPage(list []*model.Comment, q CommentQuery) *CommentPage {
+	page := &CommentPage{Comments: list}
+	if len(list) > q.Limit {
+		page.Comments = list[:q.Limit]
+		last := list[q.Limit-1]
+		page.Next = cursor{Sort: q.Sort, Time: last.CreatedAt, Id: last.Id}.encode()
+	}
+	return page
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareTime(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
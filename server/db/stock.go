@@ -0,0 +1,72 @@
+package db
+
+import (
+	"context"
+	"log"
+	"time"
+	"webapp/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AdjustStock add delta to the stock of a commodity, or of its variant sku, a negative delta never takes the stock below zero
+func (m MongoDB) AdjustStock(ctx context.Context, id string, sku string, delta int) (*model.Commodity, error) {
+	return m.incStock(ctx, id, sku, delta)
+}
+
+// SetStock overwrite the stock of a commodity, or of its variant sku, ErrStockChanged when the stock keeps changing meanwhile
+func (m MongoDB) SetStock(ctx context.Context, id string, sku string, stock int) (*model.Commodity, error) {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	for i := 0; i < stockAttempts; i++ {
+		current, err := m.findCommodity(ctx, id)
+		if err != nil {
+			return nil, mongoErr(err)
+		}
+		old, err := StockOf(current, sku)
+		if err != nil {
+			return nil, err
+		}
+		//库存和读到的一样时才覆盖，规格的库存变化同时计入商品的总库存
+		selector := stockSelector(id, sku, 0)
+		update := bson.M{"$set": bson.M{"stock": stock}}
+		if sku == "" {
+			selector["stock"] = old
+		} else {
+			selector["variants"] = bson.M{"$elemMatch": bson.M{"sku": sku, "stock": old}}
+			update = bson.M{"$set": bson.M{"variants.$.stock": stock}, "$inc": bson.M{"stock": stock - old}}
+		}
+		var commodity model.Commodity
+		err = m.database.Collection(commodityCollection).FindOneAndUpdate(ctx, selector, update, opts).Decode(&commodity)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			log.Println("Error while updating stock: ", err.Error())
+			return nil, mongoErr(err)
+		}
+		return &commodity, nil
+	}
+	return nil, ErrStockChanged
+}
+
+// reserveStock decrement the stock of every commodity or variant in quantities. It runs in the transaction of
+// a checkout: when one of them has not enough stock the transaction is aborted and nothing stays reserved
+func (m MongoDB) reserveStock(ctx context.Context, quantities map[stockKey]int) error {
+	for key, n := range quantities {
+		//只有库存足够时才会匹配，并发下单不会超卖
+		if _, err := m.incStock(ctx, key.id, key.sku, -n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compensationTimeout bound the writes that undo or finish a checkout after the request context is done
+const compensationTimeout = 10 * time.Second
+
+// detached give a context for the writes that must not be abandoned with the request
+func detached() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), compensationTimeout)
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"context"
+	"log"
+	"time"
+	"webapp/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var tokenCollection = "token"
+var revokedCollection = "revoked"
+
+// AddToken save a refresh token
+func (m MongoDB) AddToken(ctx context.Context, token *model.RefreshToken) error {
+	selector := bson.M{"id": token.Id}
+	updateOpts := options.Update().SetUpsert(true)
+	data := bson.M{"$set": token}
+
+	_, err := m.database.Collection(tokenCollection).UpdateOne(ctx, selector, data, updateOpts)
+	if err != nil {
+		log.Println("Error while saving a token:", err.Error())
+	}
+	return mongoErr(err)
+}
+
+// GetAToken get a refresh token by id
+func (m MongoDB) GetAToken(ctx context.Context, id string) (*model.RefreshToken, error) {
+	var token model.RefreshToken
+	err := m.database.Collection(tokenCollection).FindOne(ctx, bson.M{"id": id}).Decode(&token)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrTokenNotFound
+	}
+	if err != nil {
+		log.Println("Error while fetching a token:", err.Error())
+		return nil, mongoErr(err)
+	}
+	return &token, nil
+}
+
+// UseToken mark a refresh token as used, only the first call for a token succeeds
+func (m MongoDB) UseToken(ctx context.Context, id string) error {
+	res, err := m.database.Collection(tokenCollection).UpdateOne(ctx,
+		bson.M{"id": id, "used": false, "revoked": false},
+		bson.M{"$set": bson.M{"used": true}})
+	if err != nil {
+		log.Println("Error while using a token:", err.Error())
+		return mongoErr(err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrTokenReused
+	}
+	return nil
+}
+
+// RevokeTokenFamily revoke every refresh token of a family
+func (m MongoDB) RevokeTokenFamily(ctx context.Context, family string) error {
+	_, err := m.database.Collection(tokenCollection).UpdateMany(ctx,
+		bson.M{"family": family}, bson.M{"$set": bson.M{"revoked": true}})
+	if err != nil {
+		log.Println("Error while revoking tokens:", err.Error())
+	}
+	return mongoErr(err)
+}
+
+// RevokeAccessToken put the jti of an access token in the revocation list until the token expires
+func (m MongoDB) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	_, err := m.database.Collection(revokedCollection).UpdateOne(ctx,
+		bson.M{"jti": jti}, bson.M{"$set": bson.M{"jti": jti, "expiresat": expiresAt}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		log.Println("Error while revoking an access token:", err.Error())
+	}
+	return mongoErr(err)
+}
+
+// IsAccessTokenRevoked check the revocation list
+func (m MongoDB) IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	n, err := m.database.Collection(revokedCollection).CountDocuments(ctx,
+		bson.M{"jti": jti, "expiresat": bson.M{"$gt": time.Now()}})
+	if err != nil {
+		log.Println("Error while checking the revocation list:", err.Error())
+		return false, mongoErr(err)
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"math"
+	"strings"
+	"unicode/utf8"
+	"webapp/model"
+)
+
+// 商品标签和图片的数量和长度限制
+const (
+	maxTags      = 20
+	maxTagLength = 32
+	maxImages    = 20
+	maxAltLength = 200
+)
+
+// 写入前的检查，不合法的数据返回ErrInvalid，不会写进数据库
+
+func invalid(msg string) error {
+	return &kindError{msg, ErrInvalid}
+}
+
+func validCommodity(c *model.Commodity) error {
+	switch {
+	case c.Name == "":
+		return invalid("commodity name is required")
+	case math.IsNaN(c.Price) || math.IsInf(c.Price, 0):
+		return invalid("price must be a finite number")
+	case c.Price < 0:
+		return invalid("price must not be negative")
+	case c.Stock < 0:
+		return invalid("stock must not be negative")
+	case len(c.Tags) > maxTags:
+		return invalid("a commodity has at most 20 tags")
+	}
+	for _, t := range c.Tags {
+		if utf8.RuneCountInString(t) > maxTagLength {
+			return invalid("a tag has at most 32 characters")
+		}
+	}
+	return nil
+}
+
+// cleanImages trim the images of a commodity and check them, the URLs are dropped: they are not saved
+func cleanImages(images []model.Image) ([]model.Image, error) {
+	if len(images) > maxImages {
+		return nil, invalid("a commodity has at most 20 images")
+	}
+	var list []model.Image
+	seen := make(map[string]bool)
+	for _, img := range images {
+		img = model.Image{Id: strings.TrimSpace(img.Id), Alt: strings.TrimSpace(img.Alt)}
+		switch {
+		case img.Id == "":
+			return nil, invalid("every image needs an imageId")
+		case seen[img.Id]:
+			return nil, invalid("image " + img.Id + " is attached twice")
+		case utf8.RuneCountInString(img.Alt) > maxAltLength:
+			return nil, invalid("an alt text has at most 200 characters")
+		}
+		seen[img.Id] = true
+		list = append(list, img)
+	}
+	return list, nil
+}
+
+func validLine(l model.CartLine) error {
+	if l.CommodityId == "" || l.Quantity <= 0 {
+		return invalid("every cart line needs a commodityId and a positive quantity")
+	}
+	return nil
+}
+
+func validCart(c *model.Cart) error {
+	if c.Username == "" {
+		return invalid("cart has no username")
+	}
+	for _, l := range c.Lines {
+		if err := validLine(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validComment(text string) error {
+	if text == "" {
+		return invalid("comment is empty")
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package db
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"webapp/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxVariants is the largest number of variants of a commodity
+const maxVariants = 100
+
+// prepareVariants check the variants of a commodity and give the variants without a sku one made from their option values.
+// Every variant must have a value for the same options and no two variants the same values;
+// the options are returned with their values in the order they first appear
+func prepareVariants(variants []model.Variant) ([]model.Option, error) {
+	if len(variants) > maxVariants {
+		return nil, invalid("a commodity has at most 100 variants")
+	}
+	if len(variants) == 0 {
+		return nil, nil
+	}
+	//规格名按字母排序，取值按第一次出现的顺序
+	var names []string
+	for name := range variants[0].Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return nil, invalid("every variant needs option values")
+	}
+	options := make([]model.Option, len(names))
+	for i, name := range names {
+		options[i].Name = name
+	}
+	skus := make(map[string]bool)
+	combinations := make(map[string]bool)
+	for i := range variants {
+		v := &variants[i]
+		if len(v.Options) != len(names) {
+			return nil, invalid("every variant needs a value for the options " + strings.Join(names, ", "))
+		}
+		values := make([]string, len(names))
+		for j, name := range names {
+			value := strings.TrimSpace(v.Options[name])
+			if value == "" {
+				return nil, invalid("every variant needs a value for the options " + strings.Join(names, ", "))
+			}
+			values[j] = value
+			if !hasTag(options[j].Values, value) {
+				options[j].Values = append(options[j].Values, value)
+			}
+		}
+		key := strings.Join(values, "\x00")
+		if combinations[key] {
+			return nil, invalid("two variants have the options " + strings.Join(values, " "))
+		}
+		combinations[key] = true
+		if v.Sku = strings.TrimSpace(v.Sku); v.Sku == "" {
+			v.Sku = Slugify(strings.Join(values, " "))
+		}
+		if skus[v.Sku] {
+			return nil, invalid("two variants have the sku " + v.Sku)
+		}
+		skus[v.Sku] = true
+		switch {
+		case v.Price < 0:
+			return nil, invalid("price must not be negative")
+		case v.Stock < 0:
+			return nil, invalid("stock must not be negative")
+		}
+	}
+	return options, nil
+}
+
+// applyVariants replace the variants of a commodity. The variants that already exist keep their stock,
+// it only changes through the stock methods; the commodity takes the lowest price and the total stock of its variants
+func applyVariants(c *model.Commodity, variants []model.Variant, options []model.Option) {
+	for i := range variants {
+		if old := c.Variant(variants[i].Sku); old != nil {
+			variants[i].Stock = old.Stock
+		}
+	}
+	c.Options, c.Variants = options, variants
+	if len(variants) == 0 {
+		c.Options, c.Variants = nil, nil
+		c.Stock = 0
+		return
+	}
+	c.Stock, c.Price = 0, variants[0].Price
+	for _, v := range variants {
+		c.Stock += v.Stock
+		if v.Price < c.Price {
+			c.Price = v.Price
+		}
+	}
+}
+
+// StockOf give the stock of a commodity, or of its variant sku. A commodity with variants has no stock of its own
+func StockOf(c *model.Commodity, sku string) (int, error) {
+	if sku == "" {
+		if len(c.Variants) > 0 {
+			return 0, ErrSkuRequired
+		}
+		return c.Stock, nil
+	}
+	v := c.Variant(sku)
+	if v == nil {
+		return 0, &CommodityGoneError{Id: c.Id, Sku: sku}
+	}
+	return v.Stock, nil
+}
+
+// changeStock add delta to the stock of a commodity or of its variant sku, the stock never goes below zero
+func changeStock(c *model.Commodity, sku string, delta int) error {
+	stock, err := StockOf(c, sku)
+	if err != nil {
+		return err
+	}
+	if stock+delta < 0 {
+		return &StockError{Id: c.Id, Sku: sku, Requested: -delta, Available: stock}
+	}
+	if sku != "" {
+		c.Variant(sku).Stock += delta
+	}
+	c.Stock += delta
+	return nil
+}
+
+// stockKey is a commodity, or a variant of it, whose stock is taken by a checkout
+type stockKey struct {
+	id  string
+	sku string
+}
+
+// orderQuantities sum the quantities of the priced lines per commodity and variant, a line whose commodity
+// or variant is gone fails the checkout
+func orderQuantities(lines []model.PricedLine) (map[stockKey]int, error) {
+	quantities := make(map[stockKey]int)
+	for _, l := range lines {
+		if l.Missing {
+			return nil, &CommodityGoneError{Id: l.CommodityId, Sku: l.Sku}
+		}
+		quantities[stockKey{l.CommodityId, l.Sku}] += l.Quantity
+	}
+	return quantities, nil
+}
+
+// orderHook is called by every backend just before the order of a checkout is written, nil outside the tests.
+// Its error fails the write: the tests check that such a checkout leaves the stock, the balance and the cart as they were
+var orderHook func(order *model.Order) error
+
+// copyVariants copy the variants of a commodity with their option values
+func copyVariants(variants []model.Variant) []model.Variant {
+	if variants == nil {
+		return nil
+	}
+	cp := make([]model.Variant, len(variants))
+	for i, v := range variants {
+		cp[i] = v
+		cp[i].Options = make(map[string]string, len(v.Options))
+		for name, value := range v.Options {
+			cp[i].Options[name] = value
+		}
+		cp[i].Images = append([]string(nil), v.Images...)
+	}
+	return cp
+}
+
+// stockSelector select the commodity id that has at least min of stock, or whose variant sku has; min 0 only checks
+// that the commodity has no variants or that the variant exists. The positional $ of the update is the variant
+func stockSelector(id string, sku string, min int) bson.M {
+	selector := bson.M{"id": id}
+	if sku == "" {
+		selector["variants.0"] = bson.M{"$exists": false}
+		if min > 0 {
+			selector["stock"] = bson.M{"$gte": min}
+		}
+		return selector
+	}
+	match := bson.M{"sku": sku}
+	if min > 0 {
+		match["stock"] = bson.M{"$gte": min}
+	}
+	selector["variants"] = bson.M{"$elemMatch": match}
+	return selector
+}
+
+// stockAttempts is how many times a conditional update of the stock or the variants is tried when the stock
+// changes between the read and the update, ErrStockChanged is returned after that
+const stockAttempts = 5
+
+// incStock add delta to the stock of a commodity or of its variant sku in one conditional update,
+// the stock never goes below zero and the total stock of a commodity with variants stays the sum of their stock
+func (m MongoDB) incStock(ctx context.Context, id string, sku string, delta int) (*model.Commodity, error) {
+	inc := bson.M{"stock": delta}
+	if sku != "" {
+		inc["variants.$.stock"] = delta
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	for i := 0; i < stockAttempts; i++ {
+		var commodity model.Commodity
+		err := m.database.Collection(commodityCollection).FindOneAndUpdate(ctx,
+			stockSelector(id, sku, -delta), bson.M{"$inc": inc}, opts).Decode(&commodity)
+		if err != mongo.ErrNoDocuments {
+			if err != nil {
+				log.Println("Error while updating stock: ", err.Error())
+				return nil, mongoErr(err)
+			}
+			return &commodity, nil
+		}
+		//区分商品或规格不存在、没有选择规格和库存不足
+		current, err := m.findCommodity(ctx, id)
+		if err != nil {
+			return nil, mongoErr(err)
+		}
+		if err := changeStock(current, sku, delta); err != nil {
+			return nil, err
+		}
+		//两次查询之间库存变了，重新尝试
+	}
+	return nil, ErrStockChanged
+}
+
+// SetVariants replace the variants of a commodity, see applyVariants. The update only succeeds when the stock
+// read before has not changed in the meantime, so a concurrent checkout is never overwritten; after stockAttempts
+// changes ErrStockChanged is returned
+func (m MongoDB) SetVariants(ctx context.Context, id string, variants []model.Variant) (*model.Commodity, error) {
+	options, err := prepareVariants(variants)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < stockAttempts; i++ {
+		commodity, err := m.findCommodity(ctx, id)
+		if err != nil {
+			return nil, mongoErr(err)
+		}
+		//读到的库存没有变化时才更新
+		unchanged := bson.A{bson.M{"id": id}, bson.M{"stock": commodity.Stock},
+			bson.M{"variants." + strconv.Itoa(len(commodity.Variants)): bson.M{"$exists": false}}}
+		for _, v := range commodity.Variants {
+			unchanged = append(unchanged, bson.M{"variants": bson.M{"$elemMatch": bson.M{"sku": v.Sku, "stock": v.Stock}}})
+		}
+		applyVariants(commodity, append([]model.Variant(nil), variants...), options)
+		res, err := m.database.Collection(commodityCollection).UpdateOne(ctx, bson.M{"$and": unchanged},
+			bson.M{"$set": bson.M{"options": commodity.Options, "variants": commodity.Variants,
+				"stock": commodity.Stock, "price": commodity.Price}})
+		if err != nil {
+			log.Println("Error while saving variants:", err.Error())
+			return nil, mongoErr(err)
+		}
+		if res.MatchedCount > 0 {
+			return commodity, nil
+		}
+	}
+	return nil, ErrStockChanged
+}
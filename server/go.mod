@@ -1,8 +1,26 @@
 module webapp
 
-go 1.13
+go 1.18
 
 require (
+	github.com/aws/aws-sdk-go v1.29.15
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/mozillazg/go-pinyin v0.18.0
+	go.etcd.io/bbolt v1.3.5
 	go.mongodb.org/mongo-driver v1.4.1
+	golang.org/x/crypto v0.23.0
+	golang.org/x/image v0.18.0
+)
+
+require (
+	github.com/go-stack/stack v1.8.0 // indirect
+	github.com/golang/snappy v0.0.1 // indirect
+	github.com/jmespath/go-jmespath v0.0.0-20180206201540-c2b33e8439af // indirect
+	github.com/klauspost/compress v1.9.5 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/xdg/scram v0.0.0-20180814205039-7eeb5667e42c // indirect
+	github.com/xdg/stringprep v0.0.0-20180714160509-73f8eece6fdc // indirect
+	golang.org/x/sync v0.7.0 // indirect
+	golang.org/x/sys v0.20.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
 )
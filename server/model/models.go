@@ -1,42 +1,165 @@
 package model
 
+import "time"
+
 // Commodity define a commodity
 type Commodity struct {
-	Id 			 string `json:"itemId"`
+	Id           string  `json:"itemId"`
 	Name         string  `json:"itemName"`
+	Slug         string  `json:"itemSlug"`
 	Introduction string  `json:"itemDetails"`
-	Picture      string  `json:itemImage"`
+	Picture      string  `json:"itemImage"`
 	Price        float64 `json:"itemPrice"`
+	Stock        int     `json:"itemStock"`
+	//分类的id，筛选上级分类时也会包含它
+	Category string   `json:"itemCategory,omitempty"`
+	Tags     []string `json:"itemTags,omitempty"`
+	//上架时间，用于按最新排序
+	CreatedAt time.Time `json:"createdAt"`
+	//有规格的商品：Options是可选的规格和取值，每个Variant是一种组合（SKU）；
+	//此时Price是最低的规格价格，Stock是所有规格库存的和
+	Options  []Option  `json:"options,omitempty"`
+	Variants []Variant `json:"variants,omitempty"`
+	//商品图片，按展示顺序排列，第一张是封面，Picture与封面保持一致
+	Images []Image `json:"images,omitempty"`
+}
+
+// Image define an image of a commodity: a picture uploaded through /picture/upload and its alt text.
+// URL is filled in when the commodity is sent to clients, it is not saved
+type Image struct {
+	Id  string `json:"imageId"`
+	URL string `json:"url,omitempty"`
+	Alt string `json:"alt,omitempty"`
+}
+
+// Variant returns the variant of the commodity with the sku, nil when there is none
+func (c *Commodity) Variant(sku string) *Variant {
+	for i := range c.Variants {
+		if c.Variants[i].Sku == sku {
+			return &c.Variants[i]
+		}
+	}
+	return nil
+}
+
+// Option define an option of the variants of a commodity (colour, size...) and its values in display order
+type Option struct {
+	Name   string   `json:"name"`
+	Values []string `json:"values"`
+}
+
+// Variant define a SKU of a commodity: a value for every option, with its own price, stock and images
+type Variant struct {
+	Sku     string            `json:"sku"`
+	Options map[string]string `json:"options"`
+	Price   float64           `json:"price"`
+	Stock   int               `json:"stock"`
+	Images  []string          `json:"images,omitempty"`
+}
+
+// Category define a node of the category tree, a root category has no parent.
+// The id is made from the name when the category is created and never changes
+type Category struct {
+	Id     string `json:"categoryId"`
+	Name   string `json:"name"`
+	Parent string `json:"parentId,omitempty"`
+}
+
+// CartLine define a line of a shopping cart, the price always comes from the catalog
+type CartLine struct {
+	CommodityId string `json:"commodityId"`
+	//有规格的商品必须选择规格
+	Sku      string `json:"sku,omitempty"`
+	Quantity int    `json:"quantity"`
 }
 
 // Cart define a shopping cart
 type Cart struct {
-	Username    string      `json:"username"`
-	Commodities []Commodity `json:"commodities"`
+	Username string     `json:"username"`
+	Lines    []CartLine `json:"lines"`
 }
 
+// PricedLine define a cart line priced from the current catalog
+type PricedLine struct {
+	CommodityId string            `json:"commodityId"`
+	Sku         string            `json:"sku,omitempty"`
+	Name        string            `json:"name"`
+	Options     map[string]string `json:"options,omitempty"`
+	Quantity    int               `json:"quantity"`
+	Price       float64           `json:"price"`
+	Amount      float64           `json:"amount"`
+	//商品或规格已经不在商品表中
+	Missing bool `json:"missing,omitempty"`
+}
+
+// PricedCart define a shopping cart with the per-line and total amounts
+type PricedCart struct {
+	Username string       `json:"username"`
+	Lines    []PricedLine `json:"lines"`
+	Total    float64      `json:"total"`
+}
+
+// 用户角色
+const (
+	RoleCustomer = "customer"
+	RoleMerchant = "merchant"
+	RoleAdmin    = "admin"
+)
+
 // User define a user
 type User struct {
-	Username string  `json:"username"`
-	Password string  `json:"password"`
+	Username string `json:"username"`
+	//密码哈希不返回给客户端
+	Password string  `json:"-"`
 	Balance  float64 `json:"balance"`
+	Role     string  `json:"role"`
+	//注册时间，启动时只把配置写好之前注册的账号设为管理员
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Order define an order, a snapshot of a user's cart taken at checkout
+type Order struct {
+	Id        string       `json:"orderId"`
+	Username  string       `json:"username"`
+	Lines     []PricedLine `json:"lines"`
+	Total     float64      `json:"total"`
+	CreatedAt time.Time    `json:"createdAt"`
 }
 
 // Comment define a comment
 type Comment struct {
-	Username  string `json:"username"`
-	Commodity string `json:"commodity"`
-	Comment   string `json:"comment"`
+	Id          string     `json:"commentId"`
+	Username    string     `json:"username"`
+	CommodityId string     `json:"commodityId"`
+	Comment     string     `json:"comment"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	EditedAt    *time.Time `json:"editedAt,omitempty"`
+	//修改前的内容，按时间顺序
+	History []CommentRevision `json:"history,omitempty"`
+}
+
+// CommentRevision define an earlier text of an edited comment and when it was replaced
+type CommentRevision struct {
+	Comment  string    `json:"comment"`
+	EditedAt time.Time `json:"editedAt"`
 }
 
-//Token define a user's token
+//Token define the tokens given to a user at login
 type Token struct {
-	Username string `json:"username"`
-	TokenStr string `json:"tokenstr"`
+	Username     string `json:"username"`
+	TokenStr     string `json:"tokenstr"`
+	ExpiresIn    int64  `json:"expiresIn"`
+	RefreshToken string `json:"refreshToken"`
 }
 
-//TokenKey use to save the key in mongoDB
-type TokenKey struct {
-	Username string `json:"username"`
-	Key      string `json:"key"`
+//RefreshToken define a refresh token saved on the server, Id is the hash of the token given to the client
+type RefreshToken struct {
+	Id        string    `json:"id"`
+	Family    string    `json:"family"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	//已经换过新token，再次使用说明token被盗用
+	Used    bool `json:"used"`
+	Revoked bool `json:"revoked"`
 }
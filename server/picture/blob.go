@@ -0,0 +1,177 @@
+package picture
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Blobs keep named files: a local directory or the bucket of an S3-compatible storage.
+// Names are relative paths separated by "/", a missing blob is reported as os.ErrNotExist
+type Blobs interface {
+	// Put store data under name, an existing blob is replaced
+	Put(ctx context.Context, name string, data []byte, contentType string) error
+	// Get open blob name
+	Get(ctx context.Context, name string) (*Object, error)
+	// Exists tell whether there is a blob name
+	Exists(ctx context.Context, name string) (bool, error)
+	// URL give a time-limited link to download blob name directly from the storage,
+	// "" when the storage does not hand out links and the blobs are served by the API
+	URL(name string) (string, error)
+	// List call fn for every blob, in no particular order; an error of fn stops the listing
+	List(ctx context.Context, fn func(BlobInfo) error) error
+	// Delete remove blob name, a missing blob is not an error
+	Delete(ctx context.Context, name string) error
+}
+
+// BlobInfo describe a stored blob
+type BlobInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Object is an opened blob, it must be closed
+type Object struct {
+	io.ReadSeeker
+	io.Closer
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Local keep the blobs as the files of a directory
+type Local struct {
+	dir string
+}
+
+// NewLocal give the blobs of directory dir, it is created by the first Put
+func NewLocal(dir string) *Local {
+	return &Local{dir: dir}
+}
+
+// path give the file of blob name, names leaving the directory are refused
+func (l *Local) path(name string) (string, error) {
+	if name == "" || path.Clean(name) != name || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", os.ErrNotExist
+	}
+	return filepath.Join(l.dir, filepath.FromSlash(name)), nil
+}
+
+// Put write the file of blob name through a temporary file, readers never see a blob half written
+func (l *Local) Put(ctx context.Context, name string, data []byte, contentType string) error {
+	p, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	return writeFile(p, data)
+}
+
+// Get open the file of blob name
+func (l *Local) Get(ctx context.Context, name string) (*Object, error) {
+	p, err := l.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, os.ErrNotExist
+	}
+	return &Object{ReadSeeker: f, Closer: f, Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Exists tell whether there is a file for blob name
+func (l *Local) Exists(ctx context.Context, name string) (bool, error) {
+	p, err := l.path(name)
+	if err != nil {
+		return false, nil
+	}
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return info.Mode().IsRegular(), nil
+}
+
+// URL is always "", the files are served by the API
+func (l *Local) URL(name string) (string, error) {
+	return "", nil
+}
+
+// List walk the directory, the files of the hidden directories are listed too
+func (l *Local) List(ctx context.Context, fn func(BlobInfo) error) error {
+	err := filepath.Walk(l.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		name, err := filepath.Rel(l.dir, p)
+		if err != nil {
+			return err
+		}
+		return fn(BlobInfo{Name: filepath.ToSlash(name), Size: info.Size(), ModTime: info.ModTime()})
+	})
+	//还没有保存过图片
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Delete remove the file of blob name
+func (l *Local) Delete(ctx context.Context, name string) error {
+	p, err := l.path(name)
+	if err != nil {
+		return nil
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeFile write a file through a temporary file renamed at the end, readers never see a file half written
+func writeFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
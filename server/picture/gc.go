@@ -0,0 +1,114 @@
+package picture
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultGrace is how old an orphaned picture must be before it is deleted when no grace period is given.
+// A picture is uploaded before it is attached to a commodity, the grace period leaves the time to attach it
+const DefaultGrace = 7 * 24 * time.Hour
+
+// ErrCollecting a collection of the orphaned pictures is already running
+var ErrCollecting = errors.New("the orphaned pictures are already being collected")
+
+// Orphan is a stored picture that no commodity uses
+type Orphan struct {
+	Id         string    `json:"imageId"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modifiedAt"`
+	// Collectable is true when the picture is older than the grace period, Deleted when it was deleted (not for a dry run)
+	Collectable bool `json:"collectable"`
+	Deleted     bool `json:"deleted"`
+}
+
+// Usage report the storage used by the pictures and the orphaned pictures found by Collect
+type Usage struct {
+	Pictures int   `json:"pictures"`
+	Bytes    int64 `json:"bytes"`
+	// CacheBytes is the size of the cached variants
+	CacheBytes int64 `json:"cacheBytes"`
+	Referenced int   `json:"referenced"`
+	// Orphans are sorted from the oldest
+	Orphans      []Orphan `json:"orphans"`
+	OrphanBytes  int64    `json:"orphanBytes"`
+	Deleted      int      `json:"deleted"`
+	DeletedBytes int64    `json:"deletedBytes"`
+	DryRun       bool     `json:"dryRun"`
+	Grace        string   `json:"grace"`
+}
+
+// Collect find the stored pictures that are not in referenced and delete, with their variants, those older than grace.
+// A dry run only reports them. Only the pictures are considered: the cached variants, the hidden files
+// and the other directories of the storage are left alone
+func (s *Store) Collect(ctx context.Context, referenced map[string]bool, grace time.Duration, dryRun bool) (*Usage, error) {
+	select {
+	case s.collecting <- struct{}{}:
+		defer func() { <-s.collecting }()
+	default:
+		return nil, ErrCollecting
+	}
+	usage := &Usage{Orphans: []Orphan{}, DryRun: dryRun, Grace: grace.String()}
+	err := s.blobs.List(ctx, func(b BlobInfo) error {
+		if strings.HasPrefix(b.Name, cacheDir+"/") {
+			usage.CacheBytes += b.Size
+			return nil
+		}
+		if !validID(b.Name) {
+			return nil
+		}
+		usage.Pictures++
+		usage.Bytes += b.Size
+		if referenced[b.Name] {
+			usage.Referenced++
+			return nil
+		}
+		usage.Orphans = append(usage.Orphans, Orphan{Id: b.Name, Size: b.Size, ModifiedAt: b.ModTime})
+		usage.OrphanBytes += b.Size
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(usage.Orphans, func(i, j int) bool {
+		return usage.Orphans[i].ModifiedAt.Before(usage.Orphans[j].ModifiedAt)
+	})
+	limit := time.Now().Add(-grace)
+	for i := range usage.Orphans {
+		o := &usage.Orphans[i]
+		o.Collectable = !o.ModifiedAt.After(limit)
+		if !o.Collectable || dryRun {
+			continue
+		}
+		//先删变体，中途失败时图片还在，下次还会被找到
+		for _, name := range variantNames(o.Id) {
+			if err := s.blobs.Delete(ctx, name); err != nil {
+				return usage, err
+			}
+		}
+		if err := s.blobs.Delete(ctx, o.Id); err != nil {
+			return usage, err
+		}
+		o.Deleted = true
+		usage.Deleted++
+		usage.DeletedBytes += o.Size
+	}
+	return usage, nil
+}
+
+// variantNames give the names of all the variants Variants may have cached for picture id
+func variantNames(id string) []string {
+	base := strings.TrimSuffix(id, path.Ext(id))
+	var names []string
+	for _, width := range Widths {
+		for _, ext := range []string{".jpg", ".png"} {
+			names = append(names, path.Join(cacheDir, strconv.Itoa(width), base+ext))
+		}
+	}
+	return names
+}
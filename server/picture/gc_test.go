@@ -0,0 +1,99 @@
+package picture
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCollect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "picture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewStore(NewLocal(dir))
+	ctx := context.Background()
+
+	save := func(w, h int, age time.Duration) *Info {
+		info, _, err := s.Save(ctx, encodePNG(t, w, h))
+		if err != nil {
+			t.Fatal(err)
+		}
+		old := time.Now().Add(-age)
+		os.Chtimes(filepath.Join(dir, info.Id), old, old)
+		return info
+	}
+	used := save(3, 2, 30*24*time.Hour)
+	orphan := save(4, 2, 30*24*time.Hour)
+	recent := save(5, 2, time.Hour)
+	if _, err := NewVariants(s).Locate(ctx, orphan.Id, 160); err != nil {
+		t.Fatal(err)
+	}
+	//隐藏文件和其他目录不是图片
+	ioutil.WriteFile(filepath.Join(dir, ".gitignore"), []byte("*"), 0644)
+	os.MkdirAll(filepath.Join(dir, ".uploads"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".uploads", "abc"), []byte("partial"), 0644)
+	refs := map[string]bool{used.Id: true, "gone.png": true}
+
+	usage, err := s.Collect(ctx, refs, 7*24*time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Pictures != 3 || usage.Referenced != 1 || usage.CacheBytes == 0 || len(usage.Orphans) != 2 || usage.Deleted != 0 || !usage.DryRun {
+		t.Fatalf("unexpected dry run %+v", usage)
+	}
+	if usage.Bytes != int64(used.Size+orphan.Size+recent.Size) || usage.OrphanBytes != int64(orphan.Size+recent.Size) {
+		t.Fatalf("unexpected sizes %+v", usage)
+	}
+	if o := usage.Orphans[0]; o.Id != orphan.Id || !o.Collectable || o.Deleted {
+		t.Fatalf("unexpected orphan %+v", o)
+	}
+	if o := usage.Orphans[1]; o.Id != recent.Id || o.Collectable {
+		t.Fatalf("unexpected orphan %+v", o)
+	}
+	if ok, _ := s.Exists(ctx, orphan.Id); !ok {
+		t.Fatal("dry run deleted a picture")
+	}
+
+	usage, err = s.Collect(ctx, refs, 7*24*time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Deleted != 1 || usage.DeletedBytes != int64(orphan.Size) || !usage.Orphans[0].Deleted || usage.Orphans[1].Deleted {
+		t.Fatalf("unexpected collection %+v", usage)
+	}
+	for id, want := range map[string]bool{used.Id: true, orphan.Id: false, recent.Id: true} {
+		if ok, _ := s.Exists(ctx, id); ok != want {
+			t.Fatalf("%s exists %v want %v", id, ok, want)
+		}
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, cacheDir, "160")); len(files) != 0 {
+		t.Fatalf("variants left: %v", files)
+	}
+	for _, name := range []string{".gitignore", ".uploads/abc"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	//上传已有的图片重新开始宽限期
+	if _, _, err := s.Save(ctx, encodePNG(t, 3, 2)); err != nil {
+		t.Fatal(err)
+	}
+	usage, _ = s.Collect(ctx, map[string]bool{}, 7*24*time.Hour, true)
+	for _, o := range usage.Orphans {
+		if o.Id == used.Id && o.Collectable {
+			t.Fatalf("saving again did not renew %s", o.Id)
+		}
+	}
+
+	s.collecting <- struct{}{}
+	if _, err := s.Collect(ctx, refs, 0, true); err != ErrCollecting {
+		t.Fatalf("got %v want ErrCollecting", err)
+	}
+	<-s.collecting
+}
@@ -0,0 +1,85 @@
+package picture
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"path"
+)
+
+// mediaDir is the directory of the blobs where the videos are kept, apart from the pictures
+const mediaDir = "media"
+
+var (
+	// ErrMediaTooLarge the video is larger than the media size limit
+	ErrMediaTooLarge = errors.New("video is larger than the media size limit")
+	// ErrUnsupportedMedia the content is neither a picture nor an MP4 or WebM video
+	ErrUnsupportedMedia = errors.New("media must be a JPEG, PNG, WebP or GIF image, or an MP4 or WebM video")
+)
+
+// videoFormats map the content types sniffed from the data to the extension of the file
+var videoFormats = map[string]string{
+	"video/mp4":  ".mp4",
+	"video/webm": ".webm",
+}
+
+// IsVideo tell whether data is an MP4 or WebM video. The type is sniffed from the content like for the pictures
+func IsVideo(data []byte) bool {
+	_, ok := videoFormats[http.DetectContentType(data)]
+	return ok
+}
+
+// Media keep the videos as blobs of the directory media, named by the hash of their content like the pictures.
+// Videos are not decoded: only their type and size are checked
+type Media struct {
+	blobs   Blobs
+	maxSize int64
+}
+
+// NewMedia give a store of the videos of at most maxSize bytes kept in blobs
+func NewMedia(blobs Blobs, maxSize int64) *Media {
+	return &Media{blobs: blobs, maxSize: maxSize}
+}
+
+// MaxSize is the size limit of the videos
+func (m *Media) MaxSize() int64 {
+	return m.maxSize
+}
+
+// Save check and store a video, created reports whether the video is new. The answer describes it like a picture
+// without width and height
+func (m *Media) Save(ctx context.Context, data []byte) (info *Info, created bool, err error) {
+	if int64(len(data)) > m.maxSize {
+		return nil, false, ErrMediaTooLarge
+	}
+	contentType := http.DetectContentType(data)
+	ext, ok := videoFormats[contentType]
+	if !ok {
+		return nil, false, ErrUnsupportedMedia
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	info = &Info{Id: hash + ext, ContentType: contentType, Size: len(data), Hash: hash}
+	exists, err := m.blobs.Exists(ctx, m.name(info.Id))
+	if err != nil {
+		return nil, false, err
+	}
+	if err := m.blobs.Put(ctx, m.name(info.Id), data, contentType); err != nil {
+		return nil, false, err
+	}
+	return info, !exists, nil
+}
+
+// Name give the name of the blob of video id, "" when id is not a valid name
+func (m *Media) Name(id string) string {
+	if !validID(id) {
+		return ""
+	}
+	return m.name(id)
+}
+
+func (m *Media) name(id string) string {
+	return path.Join(mediaDir, id)
+}
@@ -0,0 +1,56 @@
+package picture
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// tinyMP4 is the start of an MP4 video: its ftyp box and an empty mdat box
+const tinyMP4 = "\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom\x00\x00\x00\x08mdat"
+
+// tinyWebM is the start of a WebM video: the EBML header
+const tinyWebM = "\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\xf7\x81\x01\x42\x82\x84webm"
+
+func TestMedia(t *testing.T) {
+	dir, err := ioutil.TempDir("", "media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	m := NewMedia(NewLocal(dir), 256)
+
+	if !IsVideo([]byte(tinyMP4)) || !IsVideo([]byte(tinyWebM)) || IsVideo(encodePNG(t, 2, 2)) {
+		t.Fatal("videos not told apart from pictures")
+	}
+	info, created, err := m.Save(ctx, []byte(tinyMP4))
+	if err != nil || !created {
+		t.Fatalf("save: %v %v", created, err)
+	}
+	if !strings.HasSuffix(info.Id, ".mp4") || info.ContentType != "video/mp4" || info.Size != len(tinyMP4) || info.Width != 0 {
+		t.Fatalf("unexpected info %+v", info)
+	}
+	//视频和图片分开保存，不会被当成图片
+	if _, err := os.Stat(dir + "/media/" + info.Id); err != nil {
+		t.Fatal(err)
+	}
+	if m.Name(info.Id) != "media/"+info.Id || m.Name("../"+info.Id) != "" {
+		t.Fatalf("unexpected names %q", m.Name(info.Id))
+	}
+	if _, created, err := m.Save(ctx, []byte(tinyMP4)); err != nil || created {
+		t.Fatalf("save again: %v %v", created, err)
+	}
+	if info, _, err := m.Save(ctx, []byte(tinyWebM)); err != nil || !strings.HasSuffix(info.Id, ".webm") {
+		t.Fatalf("webm: %+v %v", info, err)
+	}
+
+	if _, _, err := m.Save(ctx, encodePNG(t, 2, 2)); err != ErrUnsupportedMedia {
+		t.Fatalf("got %v want ErrUnsupportedMedia", err)
+	}
+	if _, _, err := m.Save(ctx, []byte(tinyMP4+strings.Repeat("x", 256))); err != ErrMediaTooLarge {
+		t.Fatalf("got %v want ErrMediaTooLarge", err)
+	}
+}
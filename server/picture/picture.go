@@ -0,0 +1,104 @@
+// Package picture check and store the pictures uploaded for commodities
+package picture
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	//注册图片解码器
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+)
+
+// 上传图片的大小限制，像素数限制防止很小的文件解码出巨大的图片
+const (
+	MaxSize   = 10 << 20
+	MaxPixels = 40000000
+)
+
+var (
+	// ErrTooLarge the picture is larger than MaxSize bytes
+	ErrTooLarge = errors.New("picture is larger than 10 MiB")
+	// ErrTooManyPixels the picture has more than MaxPixels pixels
+	ErrTooManyPixels = errors.New("picture has more than 40 million pixels")
+	// ErrUnsupported the content is not a JPEG, PNG, WebP or GIF image
+	ErrUnsupported = errors.New("picture must be a JPEG, PNG, WebP or GIF image")
+	// ErrCorrupt the content looks like an image but cannot be decoded
+	ErrCorrupt = errors.New("picture cannot be decoded")
+)
+
+// formats map the content types sniffed from the data to the name of their decoder and the extension of the file
+var formats = map[string]struct{ name, ext string }{
+	"image/jpeg": {"jpeg", ".jpg"},
+	"image/png":  {"png", ".png"},
+	"image/gif":  {"gif", ".gif"},
+	"image/webp": {"webp", ".webp"},
+}
+
+// Info describe a stored picture, Id is its file name: the hash of its content and the extension of its format
+type Info struct {
+	Id          string `json:"imageId"`
+	ContentType string `json:"contentType"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Size        int    `json:"size"`
+	Hash        string `json:"hash"`
+}
+
+// Read read an uploaded picture, ErrTooLarge is returned as soon as it is larger than MaxSize
+func Read(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, MaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxSize {
+		return nil, ErrTooLarge
+	}
+	return data, nil
+}
+
+// Inspect check that data is a whole JPEG, PNG, WebP or GIF image and describe it.
+// The type is sniffed from the content, the name and content type given by the client are never trusted
+func Inspect(data []byte) (*Info, error) {
+	if len(data) > MaxSize {
+		return nil, ErrTooLarge
+	}
+	contentType := http.DetectContentType(data)
+	format, ok := formats[contentType]
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	//先只读尺寸，像素太多时不解码
+	config, name, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || name != format.name {
+		return nil, ErrCorrupt
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, ErrCorrupt
+	}
+	if config.Width*config.Height > MaxPixels {
+		return nil, ErrTooManyPixels
+	}
+	if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+		return nil, ErrCorrupt
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	return &Info{
+		Id:          hash + format.ext,
+		ContentType: contentType,
+		Width:       config.Width,
+		Height:      config.Height,
+		Size:        len(data),
+		Hash:        hash,
+	}, nil
+}
@@ -0,0 +1,278 @@
+package picture
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tinyWebP is a 1x1 lossless WebP image
+const tinyWebP = "UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA=="
+
+func testImage(w, h int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		img.Set(x, 0, color.RGBA{R: 200, A: 255})
+	}
+	return img
+}
+
+func encodePNG(t *testing.T, w, h int) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(w, h)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestInspect(t *testing.T) {
+	var jpg, gf bytes.Buffer
+	if err := jpeg.Encode(&jpg, testImage(4, 3), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := gif.Encode(&gf, testImage(2, 5), nil); err != nil {
+		t.Fatal(err)
+	}
+	webp, _ := base64.StdEncoding.DecodeString(tinyWebP)
+	for _, c := range []struct {
+		data          []byte
+		contentType   string
+		ext           string
+		width, height int
+	}{
+		{encodePNG(t, 3, 2), "image/png", ".png", 3, 2},
+		{jpg.Bytes(), "image/jpeg", ".jpg", 4, 3},
+		{gf.Bytes(), "image/gif", ".gif", 2, 5},
+		{webp, "image/webp", ".webp", 1, 1},
+	} {
+		info, err := Inspect(c.data)
+		if err != nil {
+			t.Fatalf("%s: %v", c.contentType, err)
+		}
+		if info.ContentType != c.contentType || info.Width != c.width || info.Height != c.height || info.Size != len(c.data) {
+			t.Fatalf("%s: got %+v", c.contentType, info)
+		}
+		if len(info.Hash) != 64 || info.Id != info.Hash+c.ext {
+			t.Fatalf("%s: id %s hash %s", c.contentType, info.Id, info.Hash)
+		}
+	}
+
+	pngData := encodePNG(t, 3, 2)
+	for _, c := range []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"text", []byte("<html><body>hello</body></html>"), ErrUnsupported},
+		{"svg", []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"></svg>`), ErrUnsupported},
+		{"truncated", pngData[:len(pngData)-20], ErrCorrupt},
+		{"header only", pngData[:40], ErrCorrupt},
+		{"too many pixels", encodePNG(t, 8000, 6000), ErrTooManyPixels},
+	} {
+		if _, err := Inspect(c.data); err != c.err {
+			t.Fatalf("%s: got %v want %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	if data, err := Read(strings.NewReader("small")); err != nil || string(data) != "small" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+	if _, err := Read(bytes.NewReader(make([]byte, MaxSize+1))); err != ErrTooLarge {
+		t.Fatalf("got %v want ErrTooLarge", err)
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "picture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewStore(NewLocal(filepath.Join(dir, "pictures")))
+	ctx := context.Background()
+
+	data := encodePNG(t, 3, 2)
+	info, created, err := s.Save(ctx, data)
+	if err != nil || !created {
+		t.Fatalf("save got %+v, %v, %v", info, created, err)
+	}
+	stored, err := ioutil.ReadFile(filepath.Join(dir, "pictures", info.Id))
+	if err != nil || !bytes.Equal(stored, data) {
+		t.Fatalf("stored file %v", err)
+	}
+	//同样的内容得到同样的id，不会重复保存
+	again, created, err := s.Save(ctx, data)
+	if err != nil || created || again.Id != info.Id {
+		t.Fatalf("save again got %+v, %v, %v", again, created, err)
+	}
+	if _, _, err := s.Save(ctx, []byte("not a picture")); err != ErrUnsupported {
+		t.Fatalf("got %v want ErrUnsupported", err)
+	}
+
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "pictures"))
+	if len(files) != 1 {
+		t.Fatalf("temporary files left: %v", files)
+	}
+	if ok, err := s.Exists(ctx, info.Id); !ok || err != nil {
+		t.Fatalf("%s does not exist: %v", info.Id, err)
+	}
+	if read, err := s.Read(ctx, info.Id); err != nil || !bytes.Equal(read, data) {
+		t.Fatalf("read %v", err)
+	}
+	for _, id := range []string{"", ".", "..", "../pictures/" + info.Id, "missing.png"} {
+		if ok, _ := s.Exists(ctx, id); ok {
+			t.Fatalf("%q exists", id)
+		}
+		if _, err := s.Open(ctx, id); !os.IsNotExist(err) {
+			t.Fatalf("%q: got %v", id, err)
+		}
+	}
+}
+
+// withOrientation insert an Exif segment with the orientation o after the start of a JPEG picture
+func withOrientation(jpg []byte, o byte) []byte {
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8, 0, 1, 0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, o, 0, 0, 0, 0, 0, 0, 0, 0}
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	size := len(segment) + 2
+	app1 := append([]byte{0xFF, 0xE1, byte(size >> 8), byte(size)}, segment...)
+	out := append([]byte{}, jpg[:2]...)
+	out = append(out, app1...)
+	return append(out, jpg[2:]...)
+}
+
+func TestVariantWidth(t *testing.T) {
+	for w, want := range map[int]int{1: 160, 160: 160, 161: 320, 700: 800, 1920: 1920} {
+		if got, err := VariantWidth(w); err != nil || got != want {
+			t.Fatalf("%d: got %d, %v want %d", w, got, err, want)
+		}
+	}
+	for _, w := range []int{0, -5, 1921} {
+		if _, err := VariantWidth(w); err != ErrWidth {
+			t.Fatalf("%d: got %v want ErrWidth", w, err)
+		}
+	}
+}
+
+func TestOrientation(t *testing.T) {
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, testImage(4, 2), nil); err != nil {
+		t.Fatal(err)
+	}
+	if o := Orientation(jpg.Bytes()); o != 1 {
+		t.Fatalf("no exif got %d", o)
+	}
+	if o := Orientation(withOrientation(jpg.Bytes(), 6)); o != 6 {
+		t.Fatalf("got %d want 6", o)
+	}
+	if o := Orientation(encodePNG(t, 2, 2)); o != 1 {
+		t.Fatalf("png got %d", o)
+	}
+
+	//第一行是红色，旋转90度后在最右一列
+	img := testImage(4, 2)
+	for o, want := range map[int]image.Point{1: {4, 2}, 3: {4, 2}, 6: {2, 4}, 8: {2, 4}} {
+		upright := orient(img, o)
+		if upright.Bounds().Size() != want {
+			t.Fatalf("%d: size %v want %v", o, upright.Bounds().Size(), want)
+		}
+	}
+	upright := orient(img, 6)
+	if r, _, _, _ := upright.At(1, 0).RGBA(); r == 0 {
+		t.Fatalf("orientation 6: right column is not red")
+	}
+	if r, _, _, _ := upright.At(0, 0).RGBA(); r != 0 {
+		t.Fatalf("orientation 6: left column is red")
+	}
+}
+
+func TestVariants(t *testing.T) {
+	dir, err := ioutil.TempDir("", "picture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewStore(NewLocal(dir))
+	v := NewVariants(s)
+	ctx := context.Background()
+
+	size := func(f *Object) (image.Config, string) {
+		defer f.Close()
+		config, format, err := image.DecodeConfig(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config, format
+	}
+
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, testImage(400, 200), nil); err != nil {
+		t.Fatal(err)
+	}
+	info, _, err := s.Save(ctx, withOrientation(jpg.Bytes(), 6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := v.Open(ctx, info.Id, 160)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := f.Name
+	//摆正后是200x400，缩放到160宽
+	if config, format := size(f); config.Width != 160 || config.Height != 320 || format != "jpeg" {
+		t.Fatalf("got %dx%d %s", config.Width, config.Height, format)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	if Orientation(data) != 1 || bytes.Contains(data, []byte("Exif")) {
+		t.Fatalf("metadata kept in the variant")
+	}
+	//第二次从缓存读
+	f, err = v.Open(ctx, info.Id, 160)
+	if err != nil || f.Name != name {
+		t.Fatalf("got %v, %v want the cached %s", f, err, name)
+	}
+	f.Close()
+	//不放大
+	f, err = v.Open(ctx, info.Id, 1920)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config, _ := size(f); config.Width != 200 || config.Height != 400 {
+		t.Fatalf("upscaled to %dx%d", config.Width, config.Height)
+	}
+
+	//透明的图片保持PNG
+	clear := image.NewNRGBA(image.Rect(0, 0, 320, 320))
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, clear); err != nil {
+		t.Fatal(err)
+	}
+	info, _, err = s.Save(ctx, buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err = v.Open(ctx, info.Id, 160)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config, format := size(f); config.Width != 160 || format != "png" {
+		t.Fatalf("got %d %s", config.Width, format)
+	}
+
+	for _, id := range []string{"missing.png", "../" + info.Id, ".cache"} {
+		if _, err := v.Open(ctx, id, 160); !os.IsNotExist(err) {
+			t.Fatalf("%q: got %v", id, err)
+		}
+	}
+}
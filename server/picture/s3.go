@@ -0,0 +1,165 @@
+package picture
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3Config configure the bucket of an S3-compatible storage (AWS S3, MinIO...)
+type S3Config struct {
+	// Endpoint is the URL of the storage, e.g. http://minio:9000; empty for AWS S3
+	Endpoint string
+	// Region is the region of the bucket, us-east-1 when it is empty
+	Region string
+	Bucket string
+	// AccessKey and SecretKey are the credentials, the default AWS credentials (environment, shared files) are used
+	// when they are empty
+	AccessKey string
+	SecretKey string
+	// LinkExpiry is how long the pre-signed links given by URL are valid, 0 gives no links and the pictures
+	// are served by the API
+	LinkExpiry time.Duration
+}
+
+// S3 keep the blobs as the objects of a bucket
+type S3 struct {
+	client *s3.S3
+	bucket string
+	expiry time.Duration
+}
+
+// NewS3 give the blobs of the bucket of c. The bucket is not checked, it must exist
+func NewS3(c S3Config) (*S3, error) {
+	if c.Bucket == "" {
+		return nil, errors.New("the bucket of the pictures is not set")
+	}
+	region := c.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	//MinIO 等兼容的存储只支持路径形式的地址
+	cfg := aws.NewConfig().WithRegion(region).WithS3ForcePathStyle(true)
+	if c.Endpoint != "" {
+		cfg = cfg.WithEndpoint(c.Endpoint)
+	}
+	if c.AccessKey != "" {
+		cfg = cfg.WithCredentials(credentials.NewStaticCredentials(c.AccessKey, c.SecretKey, ""))
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &S3{client: s3.New(sess), bucket: c.Bucket, expiry: c.LinkExpiry}, nil
+}
+
+// Put upload blob name as an object
+func (s *S3) Put(ctx context.Context, name string, data []byte, contentType string) error {
+	_, err := s.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(name),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+// Get download blob name. Pictures are small, the whole object is read so that it can be served with ranges
+func (s *S3) Get(ctx context.Context, name string) (*Object, error) {
+	out, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		return nil, s3Err(err)
+	}
+	defer out.Body.Close()
+	data, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, err
+	}
+	obj := &Object{ReadSeeker: bytes.NewReader(data), Closer: ioutil.NopCloser(nil), Name: name, Size: int64(len(data))}
+	if out.LastModified != nil {
+		obj.ModTime = *out.LastModified
+	}
+	return obj, nil
+}
+
+// Exists ask for the metadata of blob name
+func (s *S3) Exists(ctx context.Context, name string) (bool, error) {
+	_, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	})
+	if err == nil {
+		return true, nil
+	}
+	if err = s3Err(err); os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// URL give a link pre-signed for LinkExpiry to download blob name, "" when LinkExpiry is 0
+func (s *S3) URL(name string) (string, error) {
+	if s.expiry <= 0 {
+		return "", nil
+	}
+	req, _ := s.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	})
+	return req.Presign(s.expiry)
+}
+
+// List list the objects of the bucket page by page
+func (s *S3) List(ctx context.Context, fn func(BlobInfo) error) error {
+	var fnErr error
+	err := s.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{Bucket: aws.String(s.bucket)},
+		func(page *s3.ListObjectsV2Output, last bool) bool {
+			for _, o := range page.Contents {
+				info := BlobInfo{Name: aws.StringValue(o.Key), Size: aws.Int64Value(o.Size), ModTime: aws.TimeValue(o.LastModified)}
+				if fnErr = fn(info); fnErr != nil {
+					return false
+				}
+			}
+			return true
+		})
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+// Delete remove the object of blob name, S3 does not complain about missing objects
+func (s *S3) Delete(ctx context.Context, name string) error {
+	_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	})
+	if os.IsNotExist(s3Err(err)) {
+		return nil
+	}
+	return err
+}
+
+// s3Err turn the errors of missing objects into os.ErrNotExist
+func s3Err(err error) error {
+	if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == http.StatusNotFound {
+		return os.ErrNotExist
+	}
+	if e, ok := err.(awserr.Error); ok && e.Code() == s3.ErrCodeNoSuchKey {
+		return os.ErrNotExist
+	}
+	return err
+}
@@ -0,0 +1,142 @@
+package picture
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a stand-in for an S3-compatible storage keeping the objects of path-style requests in memory
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	types   map[string]string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := r.URL.Path
+	if r.Method == "GET" && r.URL.Query().Get("list-type") == "2" {
+		//一页列出桶里所有的对象
+		prefix := key + "/"
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult><IsTruncated>false</IsTruncated>`)
+		for k, data := range f.objects {
+			if strings.HasPrefix(k, prefix) {
+				fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified></Contents>",
+					strings.TrimPrefix(k, prefix), len(data), time.Now().UTC().Format(time.RFC3339))
+			}
+		}
+		fmt.Fprint(w, `</ListBucketResult>`)
+		return
+	}
+	switch r.Method {
+	case "PUT":
+		data, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = data
+		f.types[key] = r.Header.Get("Content-Type")
+	case "GET", "HEAD":
+		data, ok := f.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == "GET" {
+				w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`))
+			}
+			return
+		}
+		w.Header().Set("Content-Type", f.types[key])
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+	case "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestS3(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{}, types: map[string]string{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	if _, err := NewS3(S3Config{Endpoint: srv.URL}); err == nil {
+		t.Fatal("no error without a bucket")
+	}
+	b, err := NewS3(S3Config{Endpoint: srv.URL, Bucket: "pictures", AccessKey: "key", SecretKey: "secret", LinkExpiry: 15 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	s := NewStore(b)
+	data := encodePNG(t, 3, 2)
+	info, created, err := s.Save(ctx, data)
+	if err != nil || !created {
+		t.Fatalf("save got %+v, %v, %v", info, created, err)
+	}
+	if string(fake.objects["/pictures/"+info.Id]) != string(data) || fake.types["/pictures/"+info.Id] != "image/png" {
+		t.Fatalf("unexpected objects %v", fake.types)
+	}
+	if _, created, err := s.Save(ctx, data); err != nil || created {
+		t.Fatalf("save again got %v, %v", created, err)
+	}
+	if ok, err := s.Exists(ctx, "missing.png"); ok || err != nil {
+		t.Fatalf("missing picture got %v, %v", ok, err)
+	}
+	if _, err := s.Open(ctx, "missing.png"); !os.IsNotExist(err) {
+		t.Fatalf("got %v want os.ErrNotExist", err)
+	}
+	read, err := s.Read(ctx, info.Id)
+	if err != nil || string(read) != string(data) {
+		t.Fatalf("read %v", err)
+	}
+
+	//变体缓存在同一个桶里
+	name, err := NewVariants(s).Locate(ctx, info.Id, 160)
+	if err != nil || !strings.HasPrefix(name, ".cache/160/") {
+		t.Fatalf("got %q, %v", name, err)
+	}
+	if _, ok := fake.objects["/pictures/"+name]; !ok {
+		t.Fatalf("variant %s not stored", name)
+	}
+
+	link, err := b.URL(info.Id)
+	if err != nil || !strings.HasPrefix(link, srv.URL+"/pictures/"+info.Id+"?") || !strings.Contains(link, "X-Amz-Expires=900") || !strings.Contains(link, "X-Amz-Signature=") {
+		t.Fatalf("got link %q, %v", link, err)
+	}
+	resp, err := http.Get(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != string(data) {
+		t.Fatalf("link gave %d bytes", len(body))
+	}
+
+	//列出图片和变体，删除没有用到的图片和它的变体
+	usage, err := s.Collect(ctx, map[string]bool{}, 0, false)
+	if err != nil || usage.Pictures != 1 || usage.CacheBytes == 0 || usage.Deleted != 1 {
+		t.Fatalf("got %+v, %v", usage, err)
+	}
+	if len(fake.objects) != 0 {
+		t.Fatalf("objects left: %v", fake.types)
+	}
+
+	//没有设置有效期时不给链接
+	b.expiry = 0
+	if link, err := b.URL(info.Id); link != "" || err != nil {
+		t.Fatalf("got link %q, %v", link, err)
+	}
+}
@@ -0,0 +1,74 @@
+package picture
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Store keep the pictures as blobs named by the hash of their content
+type Store struct {
+	blobs Blobs
+	//同时只运行一次Collect
+	collecting chan struct{}
+}
+
+// NewStore give a store of the pictures kept in blobs
+func NewStore(blobs Blobs) *Store {
+	return &Store{blobs: blobs, collecting: make(chan struct{}, 1)}
+}
+
+// Blobs is where the pictures are kept
+func (s *Store) Blobs() Blobs {
+	return s.blobs
+}
+
+// Save check and store a picture. The same content always gets the same id, created reports whether the picture is new.
+// Saving a picture again writes it again so that its time is renewed: an orphaned picture uploaded again
+// gets a new grace period before Collect deletes it
+func (s *Store) Save(ctx context.Context, data []byte) (info *Info, created bool, err error) {
+	info, err = Inspect(data)
+	if err != nil {
+		return nil, false, err
+	}
+	exists, err := s.blobs.Exists(ctx, info.Id)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := s.blobs.Put(ctx, info.Id, data, info.ContentType); err != nil {
+		return nil, false, err
+	}
+	return info, !exists, nil
+}
+
+// Open open picture id, os.ErrNotExist when there is none
+func (s *Store) Open(ctx context.Context, id string) (*Object, error) {
+	if !validID(id) {
+		return nil, os.ErrNotExist
+	}
+	return s.blobs.Get(ctx, id)
+}
+
+// Read read picture id, os.ErrNotExist when there is none
+func (s *Store) Read(ctx context.Context, id string) ([]byte, error) {
+	obj, err := s.Open(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return ioutil.ReadAll(obj)
+}
+
+// Exists tell whether id names a stored picture. Ids are plain names, paths are never accepted
+func (s *Store) Exists(ctx context.Context, id string) (bool, error) {
+	if !validID(id) {
+		return false, nil
+	}
+	return s.blobs.Exists(ctx, id)
+}
+
+// validID accept the names of the pictures: no separator, not hidden
+func validID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, `/\`) && id[0] != '.'
+}
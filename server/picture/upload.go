@@ -0,0 +1,269 @@
+package picture
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrLength the announced length of an upload is not positive
+	ErrLength = errors.New("upload length must be a positive number of bytes")
+	// ErrOffset the offset of a chunk is not the number of bytes received so far
+	ErrOffset = errors.New("upload offset does not match the bytes received")
+	// ErrUploadBusy another chunk of the upload is being received
+	ErrUploadBusy = errors.New("another chunk of the upload is being received")
+	// ErrUploadTooLarge the upload is larger than the size limit of the uploads, or a chunk goes past its length
+	ErrUploadTooLarge = errors.New("upload is larger than its announced length or the size limit")
+)
+
+// SweepInterval is the shortest time between two removals of the expired uploads, and how often RunSweep runs in the server
+const SweepInterval = time.Minute
+
+// Upload is a picture or a video uploaded in chunks
+type Upload struct {
+	Id    string `json:"id"`
+	Owner string `json:"owner"`
+	// Length is the size announced when the upload was created, Offset the number of bytes received
+	Length int64 `json:"length"`
+	Offset int64 `json:"offset"`
+	// ExpiresAt is when the upload is removed, every chunk received pushes it back
+	ExpiresAt time.Time `json:"expiresAt"`
+	// Picture is the stored picture or video once the upload is complete
+	Picture *Info `json:"picture,omitempty"`
+}
+
+// Done tell whether all the bytes of the upload were received
+func (u *Upload) Done() bool {
+	return u.Offset == u.Length
+}
+
+// Uploads keep the uploads in progress as files of a directory: the bytes received in <id> and the state in <id>.json.
+// An upload that receives nothing for expiry is removed
+type Uploads struct {
+	dir     string
+	maxSize int64
+	expiry  time.Duration
+	now     func() time.Time
+
+	mu sync.Mutex
+	//正在接收数据的上传，同一个上传同时只接收一块
+	busy  map[string]bool
+	swept time.Time
+}
+
+// NewUploads give the uploads of at most maxSize bytes kept in dir, abandoned after expiry
+func NewUploads(dir string, maxSize int64, expiry time.Duration) *Uploads {
+	return &Uploads{dir: dir, maxSize: maxSize, expiry: expiry, now: time.Now, busy: make(map[string]bool)}
+}
+
+// MaxSize is the size limit of the uploads
+func (u *Uploads) MaxSize() int64 {
+	return u.maxSize
+}
+
+// Create start the upload of length bytes for owner
+func (u *Uploads) Create(owner string, length int64) (*Upload, error) {
+	if length <= 0 {
+		return nil, ErrLength
+	}
+	if length > u.maxSize {
+		return nil, ErrUploadTooLarge
+	}
+	u.sweep()
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	up := &Upload{Id: hex.EncodeToString(b), Owner: owner, Length: length, ExpiresAt: u.now().Add(u.expiry)}
+	if err := writeFile(u.path(up.Id), nil); err != nil {
+		return nil, err
+	}
+	if err := u.save(up); err != nil {
+		os.Remove(u.path(up.Id))
+		return nil, err
+	}
+	return up, nil
+}
+
+// Get give upload id, os.ErrNotExist when there is none or it has expired
+func (u *Uploads) Get(id string) (*Upload, error) {
+	if !validID(id) || strings.Contains(id, ".") {
+		return nil, os.ErrNotExist
+	}
+	data, err := ioutil.ReadFile(u.path(id) + ".json")
+	if err != nil {
+		return nil, err
+	}
+	var up Upload
+	if err := json.Unmarshal(data, &up); err != nil {
+		return nil, err
+	}
+	if !u.now().Before(up.ExpiresAt) {
+		u.mu.Lock()
+		if !u.busy[id] {
+			u.remove(id)
+		}
+		u.mu.Unlock()
+		return nil, os.ErrNotExist
+	}
+	return &up, nil
+}
+
+// Append add the bytes of r to upload id. The chunk must start at the offset of the upload (ErrOffset)
+// and must not go past its length (ErrUploadTooLarge). When r fails the bytes received before are kept,
+// the client asks for the offset and goes on from there
+func (u *Uploads) Append(id string, offset int64, r io.Reader) (*Upload, error) {
+	u.mu.Lock()
+	if u.busy[id] {
+		u.mu.Unlock()
+		return nil, ErrUploadBusy
+	}
+	u.busy[id] = true
+	u.mu.Unlock()
+	defer func() {
+		u.mu.Lock()
+		delete(u.busy, id)
+		u.mu.Unlock()
+	}()
+
+	up, err := u.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if offset != up.Offset {
+		return up, ErrOffset
+	}
+	if up.Picture != nil {
+		//已经完成，收到的数据已经交给图片存储
+		return up, nil
+	}
+	f, err := os.OpenFile(u.path(id), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return nil, err
+	}
+	n, copyErr := io.Copy(f, io.LimitReader(r, up.Length-up.Offset+1))
+	if up.Offset+n > up.Length {
+		//超出长度的块整块丢弃
+		f.Truncate(up.Offset)
+		f.Close()
+		return up, ErrUploadTooLarge
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	up.Offset += n
+	up.ExpiresAt = u.now().Add(u.expiry)
+	if err := u.save(up); err != nil {
+		return nil, err
+	}
+	return up, copyErr
+}
+
+// Data read the bytes received for upload id
+func (u *Uploads) Data(id string) ([]byte, error) {
+	if _, err := u.Get(id); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(u.path(id))
+}
+
+// Complete record the picture or video stored from upload id, the bytes received are no longer needed.
+// The upload is still described by Get until it expires, a client that missed the answer can find its picture
+func (u *Uploads) Complete(id string, info *Info) (*Upload, error) {
+	up, err := u.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	up.Picture = info
+	if err := u.save(up); err != nil {
+		return nil, err
+	}
+	os.Remove(u.path(id))
+	return up, nil
+}
+
+// Delete remove upload id, ErrUploadBusy while a chunk is being received
+func (u *Uploads) Delete(id string) error {
+	u.mu.Lock()
+	busy := u.busy[id]
+	u.mu.Unlock()
+	if busy {
+		return ErrUploadBusy
+	}
+	if _, err := u.Get(id); err != nil {
+		return err
+	}
+	u.remove(id)
+	return nil
+}
+
+func (u *Uploads) path(id string) string {
+	return filepath.Join(u.dir, id)
+}
+
+func (u *Uploads) save(up *Upload) error {
+	data, err := json.Marshal(up)
+	if err != nil {
+		return err
+	}
+	return writeFile(u.path(up.Id)+".json", data)
+}
+
+func (u *Uploads) remove(id string) {
+	os.Remove(u.path(id))
+	os.Remove(u.path(id) + ".json")
+}
+
+// RunSweep remove the expired uploads every interval until ctx is done, so that abandoned uploads do not
+// wait for the next upload to be removed
+func (u *Uploads) RunSweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		u.mu.Lock()
+		u.swept = u.now()
+		u.mu.Unlock()
+		u.removeExpired()
+	}
+}
+
+// sweep remove the expired uploads, at most once every SweepInterval
+func (u *Uploads) sweep() {
+	u.mu.Lock()
+	if u.now().Sub(u.swept) < SweepInterval {
+		u.mu.Unlock()
+		return
+	}
+	u.swept = u.now()
+	u.mu.Unlock()
+	u.removeExpired()
+}
+
+// removeExpired remove the uploads that received nothing for expiry
+func (u *Uploads) removeExpired() {
+	files, err := ioutil.ReadDir(u.dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if id := strings.TrimSuffix(f.Name(), ".json"); id != f.Name() {
+			//Get 删除过期的上传
+			u.Get(id)
+		}
+	}
+}
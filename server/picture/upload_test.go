@@ -0,0 +1,139 @@
+package picture
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// failingReader give its data then fail like a connection that drops
+type failingReader struct {
+	data []byte
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if len(f.data) == 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func TestUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	u := NewUploads(dir, MaxSize, time.Hour)
+	now := time.Now()
+	u.now = func() time.Time { return now }
+
+	if _, err := u.Create("shop", 0); err != ErrLength {
+		t.Fatalf("got %v want ErrLength", err)
+	}
+	if _, err := u.Create("shop", MaxSize+1); err != ErrUploadTooLarge {
+		t.Fatalf("got %v want ErrUploadTooLarge", err)
+	}
+	up, err := u.Create("shop", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//连接断开时保留已经收到的数据
+	up, err = u.Append(up.Id, 0, &failingReader{[]byte("abcd")})
+	if err == nil || up.Offset != 4 {
+		t.Fatalf("got %+v, %v", up, err)
+	}
+	if _, err := u.Append(up.Id, 0, bytes.NewReader([]byte("abcd"))); err != ErrOffset {
+		t.Fatalf("got %v want ErrOffset", err)
+	}
+	if _, err := u.Append(up.Id, 4, bytes.NewReader([]byte("efghijklmn"))); err != ErrUploadTooLarge {
+		t.Fatalf("got %v want ErrUploadTooLarge", err)
+	}
+
+	//同时只接收一块
+	r, w := io.Pipe()
+	done := make(chan error)
+	go func() {
+		_, err := u.Append(up.Id, 4, r)
+		done <- err
+	}()
+	w.Write([]byte("ef"))
+	if _, err := u.Append(up.Id, 4, bytes.NewReader([]byte("efghij"))); err != ErrUploadBusy {
+		t.Fatalf("got %v want ErrUploadBusy", err)
+	}
+	if err := u.Delete(up.Id); err != ErrUploadBusy {
+		t.Fatalf("got %v want ErrUploadBusy", err)
+	}
+	w.Write([]byte("ghij"))
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	up, err = u.Get(up.Id)
+	if err != nil || !up.Done() {
+		t.Fatalf("got %+v, %v", up, err)
+	}
+	if data, err := u.Data(up.Id); err != nil || string(data) != "abcdefghij" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+
+	//每收到一块都推迟过期时间，没有收到数据的上传过期后被删除
+	abandoned, _ := u.Create("shop", 10)
+	now = now.Add(50 * time.Minute)
+	u.Append(up.Id, 10, bytes.NewReader(nil))
+	now = now.Add(20 * time.Minute)
+	if _, err := u.Get(abandoned.Id); !os.IsNotExist(err) {
+		t.Fatalf("got %v want os.ErrNotExist", err)
+	}
+	if _, err := u.Get(up.Id); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Hour)
+	if _, err := u.Create("shop", 10); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 {
+		t.Fatalf("expired uploads left: %v", files)
+	}
+	for _, id := range []string{"", "../x", up.Id + ".json"} {
+		if _, err := u.Get(id); !os.IsNotExist(err) {
+			t.Fatalf("%q: got %v", id, err)
+		}
+	}
+}
+
+func TestRunSweep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	u := NewUploads(dir, MaxSize, time.Hour)
+	up, err := u.Create("shop", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(2 * time.Hour)
+	u.now = func() time.Time { return later }
+
+	//没有新的上传时过期的上传也会被删除
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go u.RunSweep(ctx, 10*time.Millisecond)
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(u.path(up.Id) + ".json"); os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("expired upload not removed")
+}
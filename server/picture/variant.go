@@ -0,0 +1,152 @@
+package picture
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Widths are the widths of the resized variants. A requested width is rounded up to the next one,
+// so only a few variants of a picture are cached whatever the clients ask for
+var Widths = []int{160, 320, 480, 640, 800, 1024, 1280, 1920}
+
+// Presets name the widths used by the pages: thumbnails, commodity lists and the commodity page
+var Presets = map[string]int{"thumb": 160, "list": 320, "detail": 800}
+
+// ErrWidth the requested width is not between 1 and the largest of Widths
+var ErrWidth = errors.New("w must be a width between 1 and 1920")
+
+// jpegQuality is the quality of the JPEG variants
+const jpegQuality = 85
+
+// VariantWidth round a requested width up to one of Widths
+func VariantWidth(w int) (int, error) {
+	for _, width := range Widths {
+		if w > 0 && width >= w {
+			return width, nil
+		}
+	}
+	return 0, ErrWidth
+}
+
+// cacheDir is the hidden directory of the blobs where the variants are cached
+const cacheDir = ".cache"
+
+// Variants make the resized variants of the pictures of a store and cache them next to the pictures
+type Variants struct {
+	store *Store
+	//缩放很耗CPU，同时缩放的图片数不超过CPU数
+	slots chan struct{}
+}
+
+// NewVariants give the variants of the pictures of store
+func NewVariants(store *Store) *Variants {
+	return &Variants{store: store, slots: make(chan struct{}, runtime.NumCPU())}
+}
+
+// Locate give the name of the blob of the variant of picture id at width (one of Widths), it is made and cached on first use.
+// A variant is upright (the EXIF orientation is applied), has no metadata and is never wider than the picture;
+// opaque pictures become JPEG, the others PNG
+func (v *Variants) Locate(ctx context.Context, id string, width int) (string, error) {
+	if !validID(id) {
+		return "", os.ErrNotExist
+	}
+	base := path.Join(cacheDir, strconv.Itoa(width), strings.TrimSuffix(id, path.Ext(id)))
+	for _, ext := range []string{".jpg", ".png"} {
+		exists, err := v.store.blobs.Exists(ctx, base+ext)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return base + ext, nil
+		}
+	}
+	data, err := v.store.Read(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	v.slots <- struct{}{}
+	out, ext, err := resize(data, width)
+	<-v.slots
+	if err != nil {
+		return "", err
+	}
+	//同时请求同一个变体时各自生成，后写的覆盖前面的，内容相同
+	contentType := "image/jpeg"
+	if ext == ".png" {
+		contentType = "image/png"
+	}
+	if err := v.store.blobs.Put(ctx, base+ext, out, contentType); err != nil {
+		return "", err
+	}
+	return base + ext, nil
+}
+
+// Open open the variant of picture id at width, see Locate
+func (v *Variants) Open(ctx context.Context, id string, width int) (*Object, error) {
+	name, err := v.Locate(ctx, id, width)
+	if err != nil {
+		return nil, err
+	}
+	return v.store.blobs.Get(ctx, name)
+}
+
+// resize make the variant of a picture at width, see Variants.Open. It gives the encoded variant and its extension
+func resize(data []byte, width int) ([]byte, string, error) {
+	//旧的图片没有经过上传检查，解码前先检查像素数
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", ErrCorrupt
+	}
+	if config.Width*config.Height > MaxPixels {
+		return nil, "", ErrTooManyPixels
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", ErrCorrupt
+	}
+	orientation := Orientation(data)
+	//宽高按摆正之后计算，不放大
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if swapsAxes(orientation) {
+		w, h = h, w
+	}
+	if width > w {
+		width = w
+	}
+	height := (h*width + w/2) / w
+	if height < 1 {
+		height = 1
+	}
+	sw, sh := width, height
+	if swapsAxes(orientation) {
+		sw, sh = height, width
+	}
+	scaled := image.NewNRGBA(image.Rect(0, 0, sw, sh))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, b, draw.Src, nil)
+	upright := orient(scaled, orientation)
+
+	//重新编码，原图的元数据都不会保留
+	var buf bytes.Buffer
+	if o, ok := upright.(interface{ Opaque() bool }); ok && o.Opaque() {
+		if err := jpeg.Encode(&buf, upright, &jpeg.Options{Quality: jpegQuality}); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), ".jpg", nil
+	}
+	if err := png.Encode(&buf, upright); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), ".png", nil
+}
@@ -0,0 +1,85 @@
+package search
+
+import "unicode/utf8"
+
+// maxEdits is the number of typos tolerated in a term: none below 4 characters, 1 up to 7, then 2
+func maxEdits(term string) int {
+	switch n := utf8.RuneCountInString(term); {
+	case n < 4:
+		return 0
+	case n < 8:
+		return 1
+	}
+	return 2
+}
+
+// editDistance is the number of insertions, deletions, substitutions and transpositions of two neighbours
+// turning a into b (optimal string alignment). With prefix, it is the smallest distance between a and
+// any prefix of b, so that a partly typed word matches. The computation stops as soon as the distance
+// is known to exceed max, max+1 is returned then
+func editDistance(a, b []rune, max int, prefix bool) int {
+	var m matrix
+	return m.distance(a, b, max, prefix)
+}
+
+// matrix keep the rows of editDistance between calls, to compare a query with many keys without allocating
+type matrix struct {
+	rows []int
+}
+
+func (m *matrix) distance(a, b []rune, max int, prefix bool) int {
+	if prefix && len(b) > len(a)+max {
+		b = b[:len(a)+max] //更长的前缀距离只会更大
+	}
+	//只保留三行：上上行（换位用）、上一行、当前行
+	n := len(b) + 1
+	if cap(m.rows) < 3*n {
+		m.rows = make([]int, 3*n)
+	}
+	prev2, prev, cur := m.rows[:n], m.rows[n:2*n], m.rows[2*n:3*n]
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d := prev[j-1] + cost
+			if v := prev[j] + 1; v < d {
+				d = v
+			}
+			if v := cur[j-1] + 1; v < d {
+				d = v
+			}
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				if v := prev2[j-2] + 1; v < d {
+					d = v
+				}
+			}
+			cur[j] = d
+			if d < rowMin {
+				rowMin = d
+			}
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	d := prev[len(b)]
+	if prefix {
+		for _, v := range prev {
+			if v < d {
+				d = v
+			}
+		}
+	}
+	if d > max {
+		return max + 1
+	}
+	return d
+}
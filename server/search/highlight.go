@@ -0,0 +1,85 @@
+package search
+
+import (
+	"html"
+	"strings"
+	"unicode/utf8"
+)
+
+// snippetLength is the number of characters of the introduction shown in a hit
+const snippetLength = 80
+
+// matches find the spans of text made of query terms, overlapping and touching spans are merged.
+// With pinyin, chinese text also matches the pinyin of its characters
+func matches(text string, terms map[string]bool, pinyin bool) [][2]int {
+	var spans [][2]int
+	for _, t := range Tokenize(text) {
+		if !terms[t.Term] && !(pinyin && matchPinyin(t, terms)) {
+			continue
+		}
+		//词元按起始位置排列，只需要和最后一段比较
+		if last := len(spans) - 1; last >= 0 && t.Start <= spans[last][1] {
+			if t.End > spans[last][1] {
+				spans[last][1] = t.End
+			}
+			continue
+		}
+		spans = append(spans, [2]int{t.Start, t.End})
+	}
+	return spans
+}
+
+func matchPinyin(t Token, terms map[string]bool) bool {
+	for _, key := range pinyinKeys(t) {
+		if terms[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// highlight escape text for HTML and wrap the matches of the terms in <em></em>
+func highlight(text string, terms map[string]bool, pinyin bool) string {
+	var sb strings.Builder
+	pos := 0
+	for _, s := range matches(text, terms, pinyin) {
+		sb.WriteString(html.EscapeString(text[pos:s[0]]))
+		sb.WriteString("<em>")
+		sb.WriteString(html.EscapeString(text[s[0]:s[1]]))
+		sb.WriteString("</em>")
+		pos = s[1]
+	}
+	sb.WriteString(html.EscapeString(text[pos:]))
+	return sb.String()
+}
+
+// snippet cut a long text to about max characters around its first match, then highlight it.
+// Only the name is matched by pinyin, a syllable like "ke" would mark half of an introduction
+func snippet(text string, terms map[string]bool, max int) string {
+	if utf8.RuneCountInString(text) <= max {
+		return highlight(text, terms, false)
+	}
+	first := 0
+	if spans := matches(text, terms, false); len(spans) > 0 {
+		first = utf8.RuneCountInString(text[:spans[0][0]])
+	}
+	//匹配之前保留四分之一的长度作为上下文
+	runes := []rune(text)
+	start := first - max/4
+	if start < 0 {
+		start = 0
+	}
+	end := start + max
+	if end > len(runes) {
+		end = len(runes)
+		start = end - max
+	}
+	s := highlight(string(runes[start:end]), terms, false)
+	if start > 0 {
+		s = "…" + s
+	}
+	if end < len(runes) {
+		s += "…"
+	}
+	return s
+}
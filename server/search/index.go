@@ -0,0 +1,284 @@
+package search
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"webapp/db"
+	"webapp/model"
+)
+
+// 文档的字段：名字的权重比介绍高
+// 拼音字段是名字的拼音和首字母，用英文字母输入时匹配
+const (
+	fieldName = iota
+	fieldIntroduction
+	fieldPinyin
+	fieldCount
+)
+
+var boosts = [fieldCount]float64{fieldName: 3, fieldIntroduction: 1, fieldPinyin: 2}
+
+// fuzzyWeight scale the score of a term found by fuzzy matching instead of the term of the query
+const fuzzyWeight = 0.5
+
+// BM25 的参数
+const (
+	k1 = 1.2
+	b  = 0.75
+)
+
+// document is an indexed commodity, length is the number of terms of each field
+type document struct {
+	commodity model.Commodity
+	length    [fieldCount]int
+}
+
+// postings give the frequency of a term in each field of the documents that contain it
+type postings map[string]*[fieldCount]int
+
+// Index is an inverted index of the commodities, safe for concurrent use.
+// It lives in the server process: it is built from the database at startup and
+// kept up to date by calling Add whenever a commodity is saved.
+type Index struct {
+	mu    sync.RWMutex
+	docs  map[string]*document
+	terms map[string]postings
+	//每个字段的总长度，用于计算平均长度
+	total [fieldCount]int
+	//自动补全的键，unsorted时在下一次Suggest之前排序
+	entries  []entry
+	unsorted bool
+}
+
+// NewIndex create an empty index
+func NewIndex() *Index {
+	return &Index{docs: make(map[string]*document), terms: make(map[string]postings)}
+}
+
+// Load add every commodity of the database to the index
+func (x *Index) Load(ctx context.Context, d db.DB) error {
+	q := db.CommodityQuery{Limit: db.MaxLimit}
+	for {
+		page, err := d.ListCommodities(ctx, q)
+		if err != nil {
+			return err
+		}
+		for _, c := range page.Commodities {
+			x.Add(c)
+		}
+		if page.Next == "" {
+			return nil
+		}
+		q.Cursor = page.Next
+	}
+}
+
+// Add index a commodity, the previous version of the commodity is replaced
+func (x *Index) Add(c *model.Commodity) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.remove(c.Id)
+	doc := &document{commodity: *c}
+	for f, terms := range fieldTerms(c) {
+		doc.length[f] = len(terms)
+		x.total[f] += len(terms)
+		for _, term := range terms {
+			p, ok := x.terms[term]
+			if !ok {
+				p = make(postings)
+				x.terms[term] = p
+			}
+			tf, ok := p[c.Id]
+			if !ok {
+				tf = new([fieldCount]int)
+				p[c.Id] = tf
+			}
+			tf[f]++
+		}
+	}
+	x.docs[c.Id] = doc
+	x.addEntries(c)
+}
+
+// fieldTerms give the terms of every field of a commodity
+func fieldTerms(c *model.Commodity) [fieldCount][]string {
+	var terms [fieldCount][]string
+	for f, text := range [...]string{fieldName: c.Name, fieldIntroduction: c.Introduction} {
+		for _, t := range Tokenize(text) {
+			terms[f] = append(terms[f], t.Term)
+		}
+	}
+	terms[fieldPinyin] = pinyinTerms(c.Name)
+	return terms
+}
+
+// Remove take a commodity out of the index
+func (x *Index) Remove(id string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.remove(id)
+}
+
+// remove take a commodity out of the index, the lock must be held
+func (x *Index) remove(id string) {
+	doc, ok := x.docs[id]
+	if !ok {
+		return
+	}
+	for f, terms := range fieldTerms(&doc.commodity) {
+		x.total[f] -= doc.length[f]
+		for _, term := range terms {
+			if p, ok := x.terms[term]; ok {
+				delete(p, id)
+				if len(p) == 0 {
+					delete(x.terms, term)
+				}
+			}
+		}
+	}
+	delete(x.docs, id)
+	x.removeEntries(id)
+}
+
+// Len is the number of indexed commodities
+func (x *Index) Len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.docs)
+}
+
+// Hit is a commodity found by a search, the matched terms of the highlight are wrapped in <em></em>
+type Hit struct {
+	Id        string    `json:"itemId"`
+	Name      string    `json:"itemName"`
+	Slug      string    `json:"itemSlug"`
+	Picture   string    `json:"itemImage"`
+	Price     float64   `json:"itemPrice"`
+	Score     float64   `json:"score"`
+	Highlight Highlight `json:"highlight"`
+}
+
+// Highlight is the name and a snippet of the introduction with the matches marked, HTML escaped
+type Highlight struct {
+	Name         string `json:"itemName"`
+	Introduction string `json:"itemDetails,omitempty"`
+}
+
+// Result is a page of hits, Total is the number of commodities matching the query
+type Result struct {
+	Query string `json:"query"`
+	Total int    `json:"total"`
+	Hits  []Hit  `json:"hits"`
+}
+
+// Search find the commodities matching the query, best first. A commodity matches when it contains
+// one of the terms of the query; the score is the BM25 score of the fields weighted by boosts,
+// scaled by the share of the query terms found, so commodities containing every term come first
+func (x *Index) Search(query string, offset int, limit int) Result {
+	res := Result{Query: query, Hits: []Hit{}}
+	terms := distinctTerms(queryTokens(query))
+	if len(terms) == 0 {
+		return res
+	}
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	n := float64(len(x.docs))
+	var avg [fieldCount]float64
+	for f := range avg {
+		avg[f] = math.Max(float64(x.total[f])/math.Max(n, 1), 1)
+	}
+	scores := make(map[string]float64)
+	matched := make(map[string]int)
+	found := make(map[string]bool)
+	for term := range terms {
+		weights := map[string]float64{term: 1}
+		if len(x.terms[term]) == 0 {
+			//没有完全相同的词时，使用编辑距离相近的词（拼写错误）
+			weights = x.similarTerms(term)
+		}
+		matchedTerm := make(map[string]bool)
+		for similar, weight := range weights {
+			p := x.terms[similar]
+			idf := math.Log(1 + (n-float64(len(p))+0.5)/(float64(len(p))+0.5))
+			for id, tf := range p {
+				doc := x.docs[id]
+				for f := 0; f < fieldCount; f++ {
+					if tf[f] == 0 {
+						continue
+					}
+					freq := float64(tf[f])
+					norm := 1 - b + b*float64(doc.length[f])/avg[f]
+					scores[id] += weight * boosts[f] * idf * freq * (k1 + 1) / (freq + k1*norm)
+				}
+				if !matchedTerm[id] {
+					matchedTerm[id] = true
+					matched[id]++
+				}
+			}
+			found[similar] = true
+		}
+	}
+
+	ids := make([]string, 0, len(scores))
+	for id := range scores {
+		scores[id] *= float64(matched[id]) / float64(len(terms))
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	res.Total = len(ids)
+	if offset > len(ids) {
+		offset = len(ids)
+	}
+	if end := offset + limit; end < len(ids) {
+		ids = ids[:end]
+	}
+	for _, id := range ids[offset:] {
+		c := x.docs[id].commodity
+		res.Hits = append(res.Hits, Hit{
+			Id:      c.Id,
+			Name:    c.Name,
+			Slug:    c.Slug,
+			Picture: c.Picture,
+			Price:   c.Price,
+			Score:   scores[id],
+			Highlight: Highlight{
+				Name:         highlight(c.Name, found, true),
+				Introduction: snippet(c.Introduction, found, snippetLength),
+			},
+		})
+	}
+	return res
+}
+
+// similarTerms find the terms of the index close to a latin term of the query, with the weight of each.
+// Short terms are not expanded: almost every short word is one or two edits away from another
+func (x *Index) similarTerms(term string) map[string]float64 {
+	weights := make(map[string]float64)
+	max := maxEdits(term)
+	if max == 0 || !isWord([]rune(term)[0]) {
+		return weights
+	}
+	q := []rune(term)
+	for t := range x.terms {
+		if d := editDistance(q, []rune(t), max, false); d <= max {
+			weights[t] = fuzzyWeight / float64(d)
+		}
+	}
+	return weights
+}
+
+func distinctTerms(tokens []Token) map[string]bool {
+	terms := make(map[string]bool)
+	for _, t := range tokens {
+		terms[t.Term] = true
+	}
+	return terms
+}
@@ -0,0 +1,120 @@
+package search
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"webapp/model"
+)
+
+func terms(tokens []Token) []string {
+	var list []string
+	for _, t := range tokens {
+		list = append(list, t.Term)
+	}
+	return list
+}
+
+func TestTokenize(t *testing.T) {
+	got := terms(Tokenize("iPhone 11手机壳, 64GB"))
+	want := []string{"iphone", "11", "手", "手机", "机", "机壳", "壳", "64gb"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	if got := terms(queryTokens("手机壳 茶")); !reflect.DeepEqual(got, []string{"手机", "机壳", "茶"}) {
+		t.Fatalf("query got %q", got)
+	}
+	text := "绿茶"
+	for _, tok := range Tokenize(text) {
+		if text[tok.Start:tok.End] != tok.Term {
+			t.Fatalf("offsets of %+v", tok)
+		}
+	}
+}
+
+func testIndex() *Index {
+	x := NewIndex()
+	for _, c := range []*model.Commodity{
+		{Id: "1", Name: "华为手机", Introduction: "大屏幕智能手机，续航长"},
+		{Id: "2", Name: "手机壳", Introduction: "适用于各种手机的保护壳"},
+		{Id: "3", Name: "西湖龙井绿茶", Introduction: "明前茶叶 <特级>"},
+		{Id: "4", Name: "Green Tea", Introduction: "Japanese green tea, a cup a day"},
+	} {
+		x.Add(c)
+	}
+	return x
+}
+
+func ids(res Result) []string {
+	var list []string
+	for _, h := range res.Hits {
+		list = append(list, h.Id)
+	}
+	return list
+}
+
+func TestSearch(t *testing.T) {
+	x := testIndex()
+	res := x.Search("手机", 0, 10)
+	if res.Total != 2 || len(res.Hits) != 2 {
+		t.Fatalf("got %+v", res)
+	}
+	//名字更短、介绍中也出现两次的商品排在前面
+	if got := x.Search("手机壳", 0, 10); got.Hits[0].Id != "2" {
+		t.Fatalf("手机壳 ranked %v", ids(got))
+	}
+	if got := x.Search("GREEN tea", 0, 10); !reflect.DeepEqual(ids(got), []string{"4"}) {
+		t.Fatalf("latin search got %v", ids(got))
+	}
+	if got := x.Search("茶", 0, 10); !reflect.DeepEqual(ids(got), []string{"3"}) {
+		t.Fatalf("single character got %v", ids(got))
+	}
+	if got := x.Search("!!", 0, 10); got.Total != 0 || got.Hits == nil {
+		t.Fatalf("empty query got %+v", got)
+	}
+	if got := x.Search("手机", 1, 10); len(got.Hits) != 1 || got.Total != 2 {
+		t.Fatalf("offset got %+v", got)
+	}
+	if got := x.Search("手机", 5, 10); len(got.Hits) != 0 {
+		t.Fatalf("offset past the end got %+v", got)
+	}
+}
+
+func TestIncrementalUpdate(t *testing.T) {
+	x := testIndex()
+	x.Add(&model.Commodity{Id: "3", Name: "红茶", Introduction: "正山小种"})
+	if got := x.Search("龙井", 0, 10); got.Total != 0 {
+		t.Fatalf("old name still found: %v", ids(got))
+	}
+	if got := x.Search("红茶", 0, 10); !reflect.DeepEqual(ids(got), []string{"3"}) {
+		t.Fatalf("new name got %v", ids(got))
+	}
+	x.Remove("1")
+	x.Remove("2")
+	if got := x.Search("手机", 0, 10); got.Total != 0 || x.Len() != 2 {
+		t.Fatalf("removed commodities found: %v", ids(got))
+	}
+	if _, ok := x.terms["手机"]; ok {
+		t.Fatal("empty posting list kept")
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	x := testIndex()
+	h := x.Search("绿茶", 0, 1).Hits[0].Highlight
+	if h.Name != "西湖龙井<em>绿茶</em>" {
+		t.Fatalf("name %q", h.Name)
+	}
+	if h := x.Search("茶叶", 0, 1).Hits[0].Highlight; h.Introduction != "明前<em>茶叶</em> &lt;特级&gt;" {
+		t.Fatalf("introduction %q", h.Introduction)
+	}
+	if h := x.Search("green tea", 0, 1).Hits[0].Highlight; h.Name != "<em>Green</em> <em>Tea</em>" {
+		t.Fatalf("latin %q", h.Name)
+	}
+
+	long := "开头" + strings.Repeat("很长的介绍", 30) + "关键词" + strings.Repeat("结尾", 30)
+	s := snippet(long, map[string]bool{"关键": true}, 20)
+	if want := "…很长的介绍<em>关键</em>词结尾结尾结尾结尾结尾结尾…"; s != want {
+		t.Fatalf("snippet %q want %q", s, want)
+	}
+}
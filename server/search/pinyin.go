@@ -0,0 +1,79 @@
+package search
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mozillazg/go-pinyin"
+)
+
+// pinyinArgs give the most common reading of a character without tones, ü is written v
+var pinyinArgs = pinyin.NewArgs()
+
+// syllable is the pinyin of a chinese character, empty for other characters
+func syllable(r rune) string {
+	if p := pinyin.SinglePinyin(r, pinyinArgs); len(p) > 0 {
+		return p[0]
+	}
+	return ""
+}
+
+// pinyinKeys give the pinyin terms of a CJK token: the syllables joined ("shouji" for 手机)
+// and, for a bigram, the initials ("sj"); latin tokens have none
+func pinyinKeys(t Token) []string {
+	var full, initials strings.Builder
+	for _, r := range t.Term {
+		s := syllable(r)
+		if s == "" {
+			return nil
+		}
+		full.WriteString(s)
+		initials.WriteByte(s[0])
+	}
+	if utf8.RuneCountInString(t.Term) == 1 {
+		return []string{full.String()}
+	}
+	return []string{full.String(), initials.String()}
+}
+
+// pinyinTerms are the terms of the pinyin field of a name
+func pinyinTerms(name string) []string {
+	var terms []string
+	for _, t := range Tokenize(name) {
+		terms = append(terms, pinyinKeys(t)...)
+	}
+	return terms
+}
+
+// unit is a character of a name or a latin word, with how it is typed in pinyin
+type unit struct {
+	//在名字中的字节位置
+	start int
+	text  string
+	//拼音（或小写的英文单词），以及首字母
+	spelling string
+	initial  string
+	cjk      bool
+}
+
+// units split a name into the characters and words a user may start typing from,
+// punctuation and spaces are dropped
+func units(name string) []unit {
+	var list []unit
+	for _, t := range tokenize(name, true) {
+		if utf8.RuneCountInString(t.Term) > 1 && isCJK([]rune(t.Term)[0]) {
+			continue //bigram
+		}
+		u := unit{start: t.Start, text: name[t.Start:t.End], spelling: t.Term}
+		if r, _ := utf8.DecodeRuneInString(t.Term); isCJK(r) {
+			u.cjk = true
+			if s := syllable(r); s != "" {
+				u.spelling = s
+			}
+		}
+		_, size := utf8.DecodeRuneInString(u.spelling)
+		u.initial = u.spelling[:size]
+		list = append(list, u)
+	}
+	return list
+}
@@ -0,0 +1,186 @@
+package search
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"unicode/utf8"
+	"webapp/model"
+)
+
+// 补全键的种类：名字本身，名字的拼音，拼音首字母
+const (
+	keyName = iota
+	keyPinyin
+	keyInitials
+)
+
+var keyKinds = [...]string{keyName: "name", keyPinyin: "pinyin", keyInitials: "initials"}
+
+// 种类的权重：输入名字本身比拼音更明确
+var kindWeights = [...]float64{keyName: 1, keyPinyin: 0.9, keyInitials: 0.8}
+
+// entry is a completion key of a commodity. A name gives a key for every character or word it may be
+// typed from, pos is the number of characters and words skipped before the key starts
+type entry struct {
+	key  string
+	id   string
+	kind int
+	pos  int
+}
+
+// suggestEntries make the completion keys of a commodity: "华为手机" gives 华为手机, huaweishouji, hwsj,
+// 为手机, weishouji, wsj, 手机, shouji, sj...
+func suggestEntries(c *model.Commodity) []entry {
+	var entries []entry
+	us := units(c.Name)
+	for k := range us {
+		entries = append(entries, entry{key: strings.ToLower(c.Name[us[k].start:]), id: c.Id, kind: keyName, pos: k})
+		cjk := false
+		var full, initials strings.Builder
+		for _, u := range us[k:] {
+			cjk = cjk || u.cjk
+			full.WriteString(u.spelling)
+			initials.WriteString(u.initial)
+		}
+		if cjk {
+			entries = append(entries,
+				entry{key: full.String(), id: c.Id, kind: keyPinyin, pos: k},
+				entry{key: initials.String(), id: c.Id, kind: keyInitials, pos: k})
+		}
+	}
+	return entries
+}
+
+// addEntries add the completion keys of a commodity, they are sorted again by the next Suggest.
+// The lock must be held
+func (x *Index) addEntries(c *model.Commodity) {
+	x.entries = append(x.entries, suggestEntries(c)...)
+	x.unsorted = true
+}
+
+// removeEntries remove the completion keys of a commodity, the lock must be held
+func (x *Index) removeEntries(id string) {
+	kept := x.entries[:0]
+	for _, e := range x.entries {
+		if e.id != id {
+			kept = append(kept, e)
+		}
+	}
+	x.entries = kept
+}
+
+// sortEntries sort the completion keys after commodities were added
+func (x *Index) sortEntries() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.unsorted {
+		sort.Slice(x.entries, func(i, j int) bool { return x.entries[i].key < x.entries[j].key })
+		x.unsorted = false
+	}
+}
+
+// Suggestion is a completion of a prefix, Match tells how the prefix matched the name:
+// name, pinyin, initials or fuzzy (with typos)
+type Suggestion struct {
+	Id    string  `json:"itemId"`
+	Name  string  `json:"itemName"`
+	Slug  string  `json:"itemSlug"`
+	Match string  `json:"match"`
+	Score float64 `json:"score"`
+}
+
+// Suggest complete a prefix typed by a user into commodity names, best first. The prefix matches the name,
+// its pinyin ("shouj") or the initials of its pinyin ("sj") from the start of any character or word of the name;
+// when that gives less than limit names, names whose start is a few typos away from the prefix are added.
+// The fuzzy scan stops when ctx is done, the completions found so far are returned
+func (x *Index) Suggest(ctx context.Context, prefix string, limit int) []Suggestion {
+	p := strings.ToLower(strings.TrimSpace(prefix))
+	//拼音输入时忽略空格和隔音符号
+	compact := strings.NewReplacer(" ", "", "'", "").Replace(p)
+	if p == "" || limit <= 0 {
+		return []Suggestion{}
+	}
+	x.sortEntries()
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	best := make(map[string]*Suggestion)
+	consider := func(e entry, match string, score float64) {
+		if s, ok := best[e.id]; !ok || score > s.Score {
+			best[e.id] = &Suggestion{Id: e.id, Match: match, Score: score}
+		}
+	}
+	queries := []string{p}
+	if compact != p {
+		queries = append(queries, compact)
+	}
+	for _, q := range queries {
+		i := sort.Search(len(x.entries), func(i int) bool { return x.entries[i].key >= q })
+		for ; i < len(x.entries) && strings.HasPrefix(x.entries[i].key, q); i++ {
+			e := x.entries[i]
+			if q != compact && e.kind != keyName || q != p && e.kind == keyName {
+				continue //名字用原样的前缀匹配，拼音用去掉空格的前缀匹配
+			}
+			consider(e, keyKinds[e.kind], prefixScore(e, q, kindWeights[e.kind]))
+		}
+	}
+
+	if max := maxEdits(compact); len(best) < limit && max > 0 {
+		fp, fc := []rune(p), []rune(compact)
+		//只需要键开头的几个字
+		buf := make([]rune, 0, len(fp)+max)
+		var m matrix
+		head := func(key string) []rune {
+			buf = buf[:0]
+			for _, r := range key {
+				if len(buf) == cap(buf) {
+					break
+				}
+				buf = append(buf, r)
+			}
+			return buf
+		}
+		for i, e := range x.entries {
+			if i%1024 == 0 && ctx.Err() != nil {
+				break
+			}
+			if e.kind == keyInitials {
+				continue //首字母太短，模糊匹配没有意义
+			}
+			q := fc
+			if e.kind == keyName {
+				q = fp
+			}
+			if d := m.distance(q, head(e.key), max, true); d > 0 && d <= max {
+				consider(e, "fuzzy", prefixScore(e, "", fuzzyWeight*kindWeights[e.kind]/float64(d)))
+			}
+		}
+	}
+
+	list := make([]Suggestion, 0, len(best))
+	for id, s := range best {
+		c := x.docs[id].commodity
+		s.Name, s.Slug = c.Name, c.Slug
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Score != list[j].Score {
+			return list[i].Score > list[j].Score
+		}
+		return list[i].Name < list[j].Name
+	})
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list
+}
+
+// prefixScore rate a key starting with q: the whole name is better than a part of it,
+// and a longer share of the key typed means a closer completion
+func prefixScore(e entry, q string, weight float64) float64 {
+	if e.pos > 0 {
+		weight *= 0.7
+	}
+	return weight + 0.1*float64(utf8.RuneCountInString(q))/float64(utf8.RuneCountInString(e.key))
+}
@@ -0,0 +1,118 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+	"webapp/model"
+)
+
+func suggestIndex() *Index {
+	x := NewIndex()
+	for i, name := range []string{"华为手机", "手机壳", "苹果手机", "绿茶", "Green Tea", "咖啡机", "iPhone 11"} {
+		x.Add(&model.Commodity{Id: fmt.Sprint(i + 1), Name: name})
+	}
+	return x
+}
+
+func names(list []Suggestion) []string {
+	var out []string
+	for _, s := range list {
+		out = append(out, s.Name+"/"+s.Match)
+	}
+	return out
+}
+
+func TestSuggest(t *testing.T) {
+	x := suggestIndex()
+	ctx := context.Background()
+	for _, c := range []struct {
+		prefix string
+		want   string
+	}{
+		{"手机", "[手机壳/name 华为手机/name 苹果手机/name]"},
+		{"shouj", "[手机壳/pinyin 华为手机/pinyin 苹果手机/pinyin]"},
+		{"sj", "[手机壳/initials 华为手机/initials 苹果手机/initials]"},
+		{"hw", "[华为手机/initials]"},
+		{"shou ji k", "[手机壳/pinyin 华为手机/fuzzy 苹果手机/fuzzy]"},
+		{"GREEN", "[Green Tea/name]"},
+		{"lvc", "[绿茶/pinyin]"},
+		{"lc", "[绿茶/initials]"},
+		//拼写错误
+		{"iphome", "[iPhone 11/fuzzy]"},
+		{"kafie", "[咖啡机/fuzzy]"},
+		{"xyz", "[]"},
+	} {
+		if got := fmt.Sprint(names(x.Suggest(ctx, c.prefix, 5))); got != c.want {
+			t.Errorf("%q: got %s want %s", c.prefix, got, c.want)
+		}
+	}
+	if got := x.Suggest(ctx, "sj", 1); len(got) != 1 {
+		t.Fatalf("limit: %v", names(got))
+	}
+
+	//修改和删除后补全立即更新
+	x.Add(&model.Commodity{Id: "2", Name: "平板电脑"})
+	x.Remove("3")
+	if got := fmt.Sprint(names(x.Suggest(ctx, "sj", 5))); got != "[华为手机/initials]" {
+		t.Fatalf("after update: %s", got)
+	}
+	if got := fmt.Sprint(names(x.Suggest(ctx, "pingb", 5))); got != "[平板电脑/pinyin]" {
+		t.Fatalf("after update: %s", got)
+	}
+}
+
+func TestSuggestLatency(t *testing.T) {
+	x := NewIndex()
+	for i := 0; i < 5000; i++ {
+		x.Add(&model.Commodity{Id: fmt.Sprint(i), Name: fmt.Sprintf("商品%d号 手机配件 Product %d", i, i)})
+	}
+	x.Suggest(context.Background(), "s", 1) //排序
+	for _, prefix := range []string{"shouji", "sjpj", "prodcut", "商品12"} {
+		start := time.Now()
+		if got := x.Suggest(context.Background(), prefix, 10); len(got) == 0 {
+			t.Fatalf("%q: no suggestions", prefix)
+		}
+		t.Logf("%q: %v", prefix, time.Since(start))
+	}
+	//超时后不再做模糊匹配
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got := x.Suggest(ctx, "prodcut", 10); len(got) != 0 {
+		t.Fatalf("cancelled fuzzy scan got %d", len(got))
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	for _, c := range []struct {
+		a, b   string
+		prefix bool
+		want   int
+	}{
+		{"kitten", "sittin", false, 2},
+		{"kitten", "sitting", false, 3},
+		{"ab", "ba", false, 1},
+		{"iphome", "iphone 11", true, 1},
+		{"iphome", "iphone 11", false, 3},
+		{"abc", "xyz", false, 3},
+	} {
+		if got := editDistance([]rune(c.a), []rune(c.b), 2, c.prefix); got != c.want {
+			t.Errorf("%q %q: got %d want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestPinyinSearch(t *testing.T) {
+	x := suggestIndex()
+	res := x.Search("shouji", 0, 10)
+	if res.Total != 3 || res.Hits[0].Highlight.Name == res.Hits[0].Name {
+		t.Fatalf("pinyin search got %+v", res)
+	}
+	if res := x.Search("lvcha", 0, 10); res.Total != 1 || res.Hits[0].Highlight.Name != "<em>绿茶</em>" {
+		t.Fatalf("pinyin search got %+v", res)
+	}
+	if res := x.Search("grean", 0, 10); res.Total != 1 || res.Hits[0].Highlight.Name != "<em>Green</em> Tea" {
+		t.Fatalf("fuzzy search got %+v", res)
+	}
+}
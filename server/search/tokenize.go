@@ -0,0 +1,91 @@
+// Package search is the full-text search of the commodities: an in-process inverted index over
+// the name and the introduction, ranked with BM25 and highlighted
+package search
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Token is a term of a text and where it is, Start and End are byte offsets in the text
+type Token struct {
+	Term  string
+	Start int
+	End   int
+}
+
+// isCJK report whether r is written without spaces between words
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// isWord report whether r is part of a latin word or a number
+func isWord(r rune) bool {
+	return (unicode.IsLetter(r) || unicode.IsDigit(r)) && !isCJK(r)
+}
+
+// Tokenize split a text into terms. Latin words and numbers are lower cased terms;
+// chinese (and other CJK) text has no spaces, every character and every pair of
+// neighbouring characters (bigram) is a term, so "手机壳" gives 手 手机 机 机壳 壳.
+func Tokenize(text string) []Token {
+	return tokenize(text, true)
+}
+
+// queryTokens tokenize a query: a CJK run of two or more characters only gives its bigrams,
+// which are far more selective than the single characters
+func queryTokens(text string) []Token {
+	return tokenize(text, false)
+}
+
+func tokenize(text string, unigrams bool) []Token {
+	var tokens []Token
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		switch {
+		case isCJK(r):
+			var starts []int
+			j := i
+			for j < len(text) {
+				r, size := utf8.DecodeRuneInString(text[j:])
+				if !isCJK(r) {
+					break
+				}
+				starts = append(starts, j)
+				j += size
+			}
+			starts = append(starts, j)
+			tokens = append(tokens, cjkTokens(text, starts, unigrams)...)
+			i = j
+		case isWord(r):
+			j := i
+			for j < len(text) {
+				r, size := utf8.DecodeRuneInString(text[j:])
+				if !isWord(r) {
+					break
+				}
+				j += size
+			}
+			tokens = append(tokens, Token{Term: strings.ToLower(text[i:j]), Start: i, End: j})
+			i = j
+		default:
+			i += size
+		}
+	}
+	return tokens
+}
+
+// cjkTokens make the terms of a CJK run, starts holds the offset of every character and the end of the run
+func cjkTokens(text string, starts []int, unigrams bool) []Token {
+	n := len(starts) - 1
+	var tokens []Token
+	for k := 0; k < n; k++ {
+		if unigrams || n == 1 {
+			tokens = append(tokens, Token{Term: text[starts[k]:starts[k+1]], Start: starts[k], End: starts[k+1]})
+		}
+		if k+1 < n {
+			tokens = append(tokens, Token{Term: text[starts[k]:starts[k+2]], Start: starts[k], End: starts[k+2]})
+		}
+	}
+	return tokens
+}
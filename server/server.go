@@ -2,9 +2,18 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"webapp/auth"
+	"webapp/config"
 	"webapp/db"
+	"webapp/model"
+	"webapp/picture"
 	"webapp/web"
 
 	"go.mongodb.org/mongo-driver/mongo"
@@ -12,19 +21,72 @@ import (
 )
 
 func main() {
-	client, err := mongo.Connect(context.TODO(), clientOptions())
+	cfg := config.Load()
+	//server migrate 只运行迁移，server migrate status 查看迁移状态；migrate-ids 是旧的命令名
+	//迁移不需要签发token，在加载密钥之前处理
+	if len(os.Args) > 1 && (os.Args[1] == "migrate" || os.Args[1] == "migrate-ids") {
+		if err := runMigrate(cfg, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	keys, err := loadKeySet(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer client.Disconnect(context.TODO())
 
-	//client1, err := mongo.Connect(context.TODO(), clientOptions())
-	mongoDB := db.NewMongo(client)
+	var d db.DB
+	if cfg.Memory() {
+		mem, err := openMemory(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		d = mem
+	} else if cfg.Bolt() {
+		path := cfg.DBFile
+		if path == "" {
+			path = "webapp.db"
+		}
+		b, err := db.OpenBolt(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer b.Close()
+		log.Println("Using the bolt database", path)
+		d = b
+	} else {
+		client, err := mongo.Connect(context.TODO(), clientOptions())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer client.Disconnect(context.TODO())
+
+		//client1, err := mongo.Connect(context.TODO(), clientOptions())
+		mongoDB := db.NewMongo(client)
+		//启动时应用未运行过的迁移（索引、数据格式）
+		if err := mongoDB.Migrate(context.TODO()); err != nil {
+			log.Fatal(err)
+		}
+		d = mongoDB
+	}
+	if err := promoteAdmins(context.TODO(), d, cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	blobs, err := openPictures(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// CORS is enabled only in prod profile
-	cors := os.Getenv("profile") == "prod"
+	cors := cfg.Prod()
 	//设置路由
-	app1 := web.NewApp(mongoDB, cors) //////
+	uploads := openUploads(cfg)
+	go uploads.RunSweep(context.Background(), picture.SweepInterval)
+	app1 := web.NewApp(d, keys, cors, cfg.RequestTimeout, blobs, uploads) //////
+	if cfg.PictureGCInterval > 0 {
+		go app1.RunPictureGC(context.Background(), cfg.PictureGCInterval, cfg.PictureGCGrace)
+	}
 	//appcomment := web.NewCommentApp(mongoDB, cors)
 
 	//建立服务器
@@ -33,6 +95,38 @@ func main() {
 	log.Println("Error", err)
 }
 
+// runMigrate apply the pending migrations of the mongo database, or only print their state with the argument status.
+// The memory and bolt databases have no migrations, asking for them is an error
+func runMigrate(cfg config.Config, args []string) error {
+	if cfg.Memory() || cfg.Bolt() {
+		return errors.New("migrations only apply to the mongo database, the memory and bolt databases need none")
+	}
+	ctx := context.TODO()
+	client, err := mongo.Connect(ctx, clientOptions())
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+	m := db.NewMongo(client)
+	if len(args) == 0 || args[0] != "status" {
+		if err := m.Migrate(ctx); err != nil {
+			return err
+		}
+	}
+	states, err := m.MigrationStatus(ctx)
+	if err != nil {
+		return err
+	}
+	for _, s := range states {
+		applied := "pending"
+		if s.AppliedAt != nil {
+			applied = "applied " + s.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%3d  %-40s %s\n", s.Version, s.Name, applied)
+	}
+	return nil
+}
+
 func clientOptions() *options.ClientOptions {
 	host := "db"
 	if os.Getenv("profile") != "prod" {
@@ -42,3 +136,117 @@ func clientOptions() *options.ClientOptions {
 		"mongodb://" + host + ":27017",
 	)
 }
+
+// loadKeySet load the token signing keys; without a key file a random key is used outside prod,
+// so every token becomes invalid when the server restarts
+func loadKeySet(cfg config.Config) (*auth.KeySet, error) {
+	if cfg.JWTKeys != "" {
+		return auth.LoadKeySet(cfg.JWTKeys)
+	}
+	if cfg.Prod() {
+		return nil, errors.New("jwt_keys must point to the jwt key file in prod")
+	}
+	log.Println("jwt_keys is not set, signing tokens with a random key")
+	return auth.NewHS256KeySet("dev", nil)
+}
+
+// openPictures give the storage of the uploaded pictures: the bucket of an S3-compatible storage or a local directory
+func openPictures(cfg config.Config) (picture.Blobs, error) {
+	if cfg.S3() {
+		log.Println("Keeping the pictures in the bucket", cfg.S3Bucket)
+		return picture.NewS3(picture.S3Config{
+			Endpoint:   cfg.S3Endpoint,
+			Region:     cfg.S3Region,
+			Bucket:     cfg.S3Bucket,
+			AccessKey:  cfg.S3AccessKey,
+			SecretKey:  cfg.S3SecretKey,
+			LinkExpiry: cfg.PictureLinkExpiry,
+		})
+	}
+	dir := cfg.PictureDir
+	if dir == "" {
+		dir = "./picture"
+	}
+	return picture.NewLocal(dir), nil
+}
+
+// promoteAdmins give the admin role to the users of admin_users. Only the accounts registered before the list
+// was written are promoted: a listed name without an account could be registered by anyone before the restart.
+// Those, the accounts of unknown registration time and the missing accounts are skipped with a warning;
+// admin_users without admin_users_written_at is an error
+func promoteAdmins(ctx context.Context, d db.DB, cfg config.Config) error {
+	if len(cfg.AdminUsers) == 0 {
+		return nil
+	}
+	if cfg.AdminUsersWrittenAt.IsZero() {
+		return errors.New("admin_users needs admin_users_written_at, the time the list was written (e.g. 2006-01-02T15:04:05Z)")
+	}
+	for _, admin := range cfg.AdminUsers {
+		user, err := d.GetUser(ctx, admin)
+		if errors.Is(err, db.ErrNotFound) {
+			log.Println("WARNING: admin user", admin, "is not registered, it is not made an admin")
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("cannot make %s an admin: %v", admin, err)
+		}
+		if user.Role == model.RoleAdmin {
+			continue
+		}
+		//旧版本注册的账号没有注册时间（mongo 由迁移补上）
+		if user.CreatedAt.IsZero() {
+			log.Println("WARNING: admin user", admin, "has no registration time, it is not made an admin;",
+				"use PUT /users/{user}/role")
+			continue
+		}
+		if user.CreatedAt.After(cfg.AdminUsersWrittenAt) {
+			log.Println("WARNING: admin user", admin, "was registered at", user.CreatedAt.Format(time.RFC3339),
+				"after admin_users_written_at, it is not made an admin")
+			continue
+		}
+		if err := d.SetUserRole(ctx, admin, model.RoleAdmin); err != nil {
+			return fmt.Errorf("cannot make %s an admin: %v", admin, err)
+		}
+		log.Println("User", admin, "is now an admin")
+	}
+	return nil
+}
+
+// openUploads give the pictures and videos being uploaded in chunks, the videos may be up to the media size limit
+func openUploads(cfg config.Config) *picture.Uploads {
+	dir := cfg.UploadDir
+	if dir == "" {
+		dir = "./uploads"
+	}
+	maxSize := cfg.MediaMaxSize
+	if maxSize < picture.MaxSize {
+		maxSize = picture.MaxSize
+	}
+	return picture.NewUploads(dir, maxSize, cfg.UploadExpiry)
+}
+
+// openMemory load the in-memory database from its snapshot; the snapshot is saved again when the server is stopped
+func openMemory(cfg config.Config) (*db.Memory, error) {
+	if cfg.DBSnapshot == "" {
+		log.Println("Using the in-memory database, the data is lost when the server stops")
+		return db.NewMemory(), nil
+	}
+	mem, err := db.LoadMemory(cfg.DBSnapshot)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Using the in-memory database, snapshot", cfg.DBSnapshot)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		if err := mem.Save(cfg.DBSnapshot); err != nil {
+			log.Println("Cannot save the snapshot:", err)
+			os.Exit(1)
+		}
+		log.Println("Snapshot saved to", cfg.DBSnapshot)
+		os.Exit(0)
+	}()
+	return mem, nil
+}
@@ -1,37 +1,45 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
-	"io"
+	"errors"
 	"log"
 	"net/http"
-	"net/url"
-	"os"
-	"regexp"
 	"strconv"
 	"time"
+	"webapp/auth"
 	"webapp/db"
 	"webapp/model"
-
-	"github.com/dgrijalva/jwt-go"
-	"github.com/dgrijalva/jwt-go/request"
+	"webapp/picture"
+	"webapp/search"
 )
 
 //App define a app
 type App struct {
-	d        db.DB
-	handlers map[string]http.HandlerFunc
+	d       db.DB
+	keys    *auth.KeySet
+	handler http.Handler
+	//商品的全文索引，保存商品时更新
+	index *search.Index
+	//上传的图片和缩放后的图片
+	pictures *picture.Store
+	variants *picture.Variants
+	//分块上传的视频，和图片保存在同一个存储的 media 目录
+	media *picture.Media
+	//分块上传中的图片和视频
+	uploads *picture.Uploads
 }
 
 //Serve start the webapp server
 func (a *App) Serve() error {
-	for path, handler := range a.handlers {
-		http.Handle(path, handler)
-	}
-
 	log.Println("Web server is available on port 8080")
-	return http.ListenAndServe(":8080", nil)
+	return http.ListenAndServe(":8080", a)
+}
+
+// ServeHTTP dispatch a request to its route
+func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.handler.ServeHTTP(w, r)
 }
 
 func sendErr(w http.ResponseWriter, code int, message string) {
@@ -40,46 +48,107 @@ func sendErr(w http.ResponseWriter, code int, message string) {
 }
 
 // Needed in order to disable CORS for local development
-func disableCors(h http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+func disableCors(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "*")
 		w.Header().Set("Access-Control-Allow-Headers", "*")
-		h(w, r)
-	}
+		//分页的下一页在Link头中，分块上传的进度在Upload-*和Tus-*头中
+		w.Header().Set("Access-Control-Expose-Headers", "Link, Location, Upload-Offset, Upload-Length, Upload-Expires, Tus-Resumable, Tus-Version, Tus-Max-Size, Tus-Extension")
+		h.ServeHTTP(w, r)
+	})
 }
 
-// NewApp init the webapp routes
-func NewApp(d db.DB, cors bool) App {
+// NewApp init the webapp routes, every request is cancelled after timeout (0: no limit).
+// The uploaded pictures, their variants and the videos are kept in blobs, the pictures and videos uploaded in chunks
+// in uploads until they are complete; videos may be as large as the uploads
+func NewApp(d db.DB, keys *auth.KeySet, cors bool, timeout time.Duration, blobs picture.Blobs, uploads *picture.Uploads) App {
 	app := App{
 		d:        d,
-		handlers: make(map[string]http.HandlerFunc),
+		keys:     keys,
+		index:    search.NewIndex(),
+		pictures: picture.NewStore(blobs),
+		uploads:  uploads,
 	}
-
-	commodityHandler := app.GetCommodity
-	commoditiesHandler := app.GetCommodities
-	userRegister := app.UserRegister
-	getAUserInfo := app.GetAUserInfo
-	getUsersInfo := app.GetUsersInfo
-
+	app.variants = picture.NewVariants(app.pictures)
+	app.media = picture.NewMedia(blobs, uploads.MaxSize())
+	if err := app.index.Load(context.Background(), d); err != nil {
+		log.Println("Cannot build the search index:", err)
+	}
+	log.Println("Search index built:", app.index.Len(), "commodities")
+
+	//分配路径，同时也是权限表：public 不需要登录，loggedIn 需要登录，only 限定角色
+	merchant := only(model.RoleMerchant, model.RoleAdmin)
+	admin := only(model.RoleAdmin)
+	rt := newRouter([]route{
+		{"GET", "/", public, writeApiRoot},
+		{"GET", "/picture/{file...}", public, app.ServePicture},
+		{"GET", "/media/{file}", public, app.ServeMedia},
+		{"POST", "/picture/upload", merchant, app.UploadPicture},
+		{"OPTIONS", "/picture/uploads", public, app.UploadOptions},
+		{"POST", "/picture/uploads", merchant, app.CreateUpload},
+		{"HEAD", "/picture/uploads/{id}", merchant, app.UploadProgress},
+		{"PATCH", "/picture/uploads/{id}", merchant, app.AppendUpload},
+		{"DELETE", "/picture/uploads/{id}", merchant, app.DeleteUpload},
+		{"GET", "/admin/pictures", admin, app.PictureUsage},
+		{"POST", "/admin/pictures/gc", admin, app.CollectOrphans},
+
+		{"GET", "/search", public, app.Search},
+		{"GET", "/search/suggest", public, app.Suggest},
+
+		{"GET", "/categories", public, app.GetCategories},
+		{"POST", "/categories", admin, app.PostCategory},
+		{"GET", "/categories/{id}", public, app.GetCategory},
+		{"PUT", "/categories/{id}", admin, app.UpdateCategory},
+		{"DELETE", "/categories/{id}", admin, app.DeleteCategory},
+
+		{"GET", "/commodities", public, app.GetCommodities},
+		{"POST", "/commodities", merchant, app.PostCommodity},
+		{"GET", "/commodities/by-slug/{slug}", public, app.GetCommodityBySlug},
+		{"GET", "/commodities/{id}", public, app.GetCommodity},
+		{"PUT", "/commodities/{id}", merchant, app.UpdateCommodity},
+		{"PATCH", "/commodities/{id}/stock", admin, app.AdjustStock},
+		{"PUT", "/commodities/{id}/stock", admin, app.SetStock},
+		{"PUT", "/commodities/{id}/variants", merchant, app.SetVariants},
+		{"POST", "/commodities/{id}/images", merchant, app.AttachImage},
+		{"PUT", "/commodities/{id}/images", merchant, app.ReorderImages},
+		{"PATCH", "/commodities/{id}/images/{image}", merchant, app.UpdateImage},
+		{"DELETE", "/commodities/{id}/images/{image}", merchant, app.DetachImage},
+		//评论只能由作者本人或管理员修改删除，在checkAuthor中检查
+		{"GET", "/commodities/{id}/comments", public, app.GetComments},
+		{"POST", "/commodities/{id}/comments", loggedIn, app.PostComment},
+		{"GET", "/commodities/{id}/comments/{comment}", public, app.GetComment},
+		{"PATCH", "/commodities/{id}/comments/{comment}", loggedIn, app.UpdateComment},
+		{"DELETE", "/commodities/{id}/comments/{comment}", loggedIn, app.DeleteComment},
+
+		{"GET", "/users", admin, app.GetUsersInfo},
+		{"POST", "/users/register", public, app.UserRegister},
+		{"POST", "/users/login", public, app.UserLogin},
+		//余额和角色只有本人和管理员可以查看，在checkUserOrAdmin中检查
+		{"GET", "/users/{user}", loggedIn, app.GetAUserInfo},
+		{"PUT", "/users/{user}/role", admin, app.SetUserRole},
+		{"PUT", "/users/{user}/balance", admin, app.SetBalance},
+		//购物车和订单只能由用户本人访问，在checkUser中检查
+		{"GET", "/users/{user}/cart", loggedIn, app.GetAUserCart},
+		{"POST", "/users/{user}/cart", loggedIn, app.WriteCart},
+		{"POST", "/users/{user}/cart/lines", loggedIn, app.AddCartLine},
+		{"PATCH", "/users/{user}/cart/lines/{id}", loggedIn, app.SetCartLine},
+		{"DELETE", "/users/{user}/cart/lines/{id}", loggedIn, app.RemoveCartLine},
+		{"POST", "/users/{user}/orders", loggedIn, app.Checkout},
+		{"GET", "/users/{user}/orders", loggedIn, app.GetOrders},
+		{"GET", "/users/{user}/orders/{order}", loggedIn, app.GetOrder},
+
+		{"POST", "/auth/refresh", public, app.RefreshToken},
+		{"POST", "/auth/logout", public, app.Logout},
+	})
+
+	//所有请求先经过认证，CORS头在最外层，这样401/403也能被前端读到
+	//超时在认证之前设置，查询吊销列表也受限制
+	h := withTimeout(app.authenticate(rt), timeout)
 	if !cors {
-		commodityHandler = disableCors(commodityHandler)
-		commoditiesHandler = disableCors(commoditiesHandler)
-		///
-		getUsersInfo = disableCors(getUsersInfo)
-		getAUserInfo = disableCors(getAUserInfo)
-		userRegister = disableCors(userRegister)
-	}
-	//分配路径
-	app.handlers["/picture/"] = http.StripPrefix("/picture/", http.FileServer(http.Dir("./picture"))).ServeHTTP
-	app.handlers["/picture/upload"] = recieveImage
-	app.handlers["/commodities/"] = commodityHandler
-	app.handlers["/commodities"] = commoditiesHandler
-
-	app.handlers["/users"] = getUsersInfo
-	app.handlers["/users/"] = getAUserInfo
-	app.handlers["/users/register"] = userRegister
-	app.handlers["/"] = writeApiRoot
+		h = disableCors(h)
+	}
+	app.handler = h
 	return app
 }
 
@@ -98,15 +167,32 @@ func writeApiRoot(w http.ResponseWriter, r *http.Request) {
 	apiStr := make(map[string]string)
 	apiStr["all_commodities_url"] = "http://localhost:8080/commodities"
 	apiStr["post_commoditie_url:http"] = "//localhost:8080/commodities"
-	apiStr["get_commoditie_info_url"] = "http://localhost:8080/commodities/{commodity}"
-	apiStr["get_comment_url"] = "http://localhost:8080/commodities/{commodity}/comments"
-	apiStr["post_comment_url"] = "http://localhost:8080/commodities"
-	apiStr["delete_comment_url"] = "http://localhost:8080/commodities"
+	apiStr["get_commoditie_info_url"] = "http://localhost:8080/commodities/{id}"
+	apiStr["update_commoditie_url"] = "http://localhost:8080/commodities/{id}"
+	apiStr["get_commoditie_by_slug_url"] = "http://localhost:8080/commodities/by-slug/{slug}"
+	apiStr["categories_url"] = "http://localhost:8080/categories"
+	apiStr["category_url"] = "http://localhost:8080/categories/{id}"
+	apiStr["get_comment_url"] = "http://localhost:8080/commodities/{id}/comments"
+	apiStr["post_comment_url"] = "http://localhost:8080/commodities/{id}/comments"
+	apiStr["comment_url"] = "http://localhost:8080/commodities/{id}/comments/{commentId}"
 	apiStr["get_alluser_url"] = "http://localhost:8080/users"
 	apiStr["user_register_url"] = "http://localhost:8080/users/register"
+	apiStr["user_login_url"] = "http://localhost:8080/users/login"
+	apiStr["set_user_role_url"] = "http://localhost:8080/users/{user}/role"
+	apiStr["refresh_token_url"] = "http://localhost:8080/auth/refresh"
+	apiStr["logout_url"] = "http://localhost:8080/auth/logout"
 	apiStr["get_a_user_url"] = "http://localhost:8080/users/{user}"
 	apiStr["get_user_cart"] = "http://localhost:8080/users/{user}/cart"
-	apiStr["update_comment_url"] = "http://localhost:8080/users/{user}/cart"
+	apiStr["add_cart_line_url"] = "http://localhost:8080/users/{user}/cart/lines"
+	apiStr["update_cart_line_url"] = "http://localhost:8080/users/{user}/cart/lines/{id}"
+	apiStr["update_stock_url"] = "http://localhost:8080/commodities/{id}/stock"
+	apiStr["commodity_images_url"] = "http://localhost:8080/commodities/{id}/images"
+	apiStr["commodity_image_url"] = "http://localhost:8080/commodities/{id}/images/{image}"
+	apiStr["checkout_url"] = "http://localhost:8080/users/{user}/orders"
+	apiStr["get_orders_url"] = "http://localhost:8080/users/{user}/orders"
+	apiStr["get_an_order_url"] = "http://localhost:8080/users/{user}/orders/{order}"
+	apiStr["search_url"] = "http://localhost:8080/search?q={query}"
+	apiStr["suggest_url"] = "http://localhost:8080/search/suggest?prefix={prefix}"
 	apiStr["get_picture"] = "http://localhost:8080/picture/{picture}"
 	apiStr["post_picture"] = "http://localhost:8080/picture/upload"
 	//发送到根root
@@ -116,164 +202,281 @@ func writeApiRoot(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-//revcieveImage  recieve the upload image
-func recieveImage(w http.ResponseWriter, r *http.Request) {
-	//获取图片文件
-	f, h, err := r.FormFile("image")
-	fmt.Println("recieve a img")
+// GetCommodities get all commodities
+func (a *App) GetCommodities(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	//筛选、排序和分页都在数据库中完成
+	q := db.CommodityQuery{
+		Sort:     r.FormValue("sort"),
+		Category: r.FormValue("category"),
+		Keyword:  r.FormValue("q"),
+		Cursor:   r.FormValue("cursor"),
+	}
+	//tag可以出现多次，商品要有全部的标签；r.Form已经由FormValue解析
+	q.Tags = r.Form["tag"]
+	var ok bool
+	if q.Limit, ok = intParam(w, r, "limit"); !ok {
+		return
+	}
+	if q.MinPrice, ok = priceParam(w, r, "minPrice"); !ok {
+		return
+	}
+	if q.MaxPrice, ok = priceParam(w, r, "maxPrice"); !ok {
+		return
+	}
+	withFacets, ok := boolParam(w, r, "facets")
+	if !ok {
+		return
+	}
+	page, err := a.d.ListCommodities(r.Context(), q)
+	if err != nil {
+		sendDBErr(w, err)
+		return
+	}
+	setNextLink(w, r, page.Next)
+	for i, c := range page.Commodities {
+		page.Commodities[i] = withImageURLs(c)
+	}
+	var body interface{} = page.Commodities
+	if withFacets {
+		//按当前筛选条件统计，与翻到第几页无关
+		facets, err := a.d.CommodityFacets(r.Context(), q)
+		if err != nil {
+			sendDBErr(w, err)
+			return
+		}
+		body = struct {
+			Items  []*model.Commodity `json:"items"`
+			Facets *db.Facets         `json:"facets"`
+		}{page.Commodities, facets}
+	}
+	//将信息写入response
+	err = json.NewEncoder(w).Encode(body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		sendErr(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// PostCommodity add a new commodity, the server assigns its id
+func (a *App) PostCommodity(w http.ResponseWriter, r *http.Request) {
+	//为商店添加新商品
+	commodity, ok := commodityFromForm(w, r)
+	if !ok || !a.checkCategory(w, r, commodity.Category) {
+		return
+	}
+	//初始库存，只在新增商品时生效，没有填时为0
+	if v := r.FormValue("stock"); v != "" {
+		stock, err := strconv.Atoi(v)
+		if err != nil || stock < 0 {
+			sendErr(w, http.StatusBadRequest, "stock must be a non-negative integer")
+			return
+		}
+		commodity.Stock = stock
+	}
+	if err := a.d.PostCommodity(r.Context(), commodity); err != nil {
+		sendDBErr(w, err)
 		return
 	}
-	//在路径./picture/下创建新文件
-	filename := h.Filename
-	defer f.Close()
-	t, err := os.Create("./picture/" + filename)
+	a.index.Add(commodity)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(withImageURLs(commodity))
+}
 
+// UpdateCommodity update the name, introduction, picture and price of a commodity, its id never changes
+func (a *App) UpdateCommodity(w http.ResponseWriter, r *http.Request) {
+	old, err := a.d.GetOneCommodity(r.Context(), pathParam(r, "id"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeCommodity(w, nil, err)
 		return
 	}
-	defer t.Close()
-	//将图片复制到同名新文件
-	if _, err := io.Copy(t, f); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	commodity, ok := commodityFromForm(w, r)
+	//没有改分类时不检查，分类树之前保存的分类名仍然可用
+	if !ok || commodity.Category != old.Category && !a.checkCategory(w, r, commodity.Category) {
 		return
 	}
+	commodity.Id = old.Id
+	commodity.Stock = old.Stock
+	commodity.CreatedAt = old.CreatedAt
+	//有规格的商品价格由规格决定
+	commodity.Options, commodity.Variants = old.Options, old.Variants
+	if len(old.Variants) > 0 {
+		commodity.Price = old.Price
+	}
+	//图片只通过 /images 修改，有图片时封面不变
+	commodity.Images = old.Images
+	if len(old.Images) > 0 {
+		commodity.Picture = old.Picture
+	}
+	err = a.d.PostCommodity(r.Context(), commodity)
+	if err == nil {
+		a.index.Add(commodity)
+	}
+	writeCommodity(w, commodity, err)
 }
 
-// GetCommodities if r.Method is GET it will get all commodities, if r.Method is POST will add or update a commodity
-func (a *App) GetCommodities(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Println("get all commodities")
-	//获取所有商品信息
-	if r.Method == "GET" {
-		//从数据库取所有商品信息的数据
-		commodities, err := a.d.GetAllCommodity()
-		if err != nil {
-			sendErr(w, http.StatusInternalServerError, err.Error())
-			return
-		}
-		//将信息写入response
-		err = json.NewEncoder(w).Encode(commodities)
+// commodityFromForm read a commodity from the form values name, introduction, picture, category, tags and price,
+// tags are separated by commas
+func commodityFromForm(w http.ResponseWriter, r *http.Request) (*model.Commodity, bool) {
+	var commodity model.Commodity
+	commodity.Introduction = r.FormValue("introduction")
+	commodity.Name = r.FormValue("name")
+	//URL 也保存为图片的 id，这样收集孤立图片时能找到引用
+	commodity.Picture = pictureID(r.FormValue("picture"))
+	commodity.Category = r.FormValue("category")
+	commodity.Tags = splitList(r.FormValue("tags"))
+	if commodity.Name == "" {
+		sendErr(w, http.StatusBadRequest, "name is required")
+		return nil, false
+	}
+	//string转float64，没有填价格时为0（有规格的商品价格由规格决定）
+	if v := r.FormValue("price"); v != "" {
+		price, err := strconv.ParseFloat(v, 64)
 		if err != nil {
-			sendErr(w, http.StatusInternalServerError, err.Error())
-		}
-	} else { //为商店添加新商品
-		var commodity model.Commodity
-		r.ParseMultipartForm(512)
-		fmt.Println("Add a new commodity")
-		for k, v := range r.MultipartForm.Value {
-			fmt.Println("value,k,v = ", k, ",", v)
+			sendErr(w, http.StatusBadRequest, "price must be a number")
+			return nil, false
 		}
-		//将信息写入数据库
-		commodity.Introduction = r.MultipartForm.Value["introduction"][0]
-		commodity.Name = r.MultipartForm.Value["name"][0]
-		commodity.Picture = r.MultipartForm.Value["picture"][0]
-		//string转float64
-		commodity.Price, _ = strconv.ParseFloat(r.MultipartForm.Value["price"][0], 64)
-		a.d.PostCommodity(&commodity)
+		commodity.Price = price
 	}
-
+	return &commodity, true
 }
 
-// GetCommodity define all the api in the form as /commodities/
+// GetCommodity get a commodity by id
 func (a *App) GetCommodity(w http.ResponseWriter, r *http.Request) {
+	//从数据库获取信息
+	commodity, err := a.d.GetOneCommodity(r.Context(), pathParam(r, "id"))
+	writeCommodity(w, commodity, err)
+}
+
+// GetCommodityBySlug get a commodity by the slug made from its name
+func (a *App) GetCommodityBySlug(w http.ResponseWriter, r *http.Request) {
+	commodity, err := a.d.GetCommodityBySlug(r.Context(), pathParam(r, "slug"))
+	writeCommodity(w, commodity, err)
+}
+
+func writeCommodity(w http.ResponseWriter, commodity *model.Commodity, err error) {
+	if err != nil {
+		sendDBErr(w, err)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	//获取url“commodities/”后面的字段
-	urlStr := r.URL.String()
-	fmt.Println("get a commodity")
-	commodityname := urlStr[len("/commodities")+1:]
-	//判断是否是操作商品（/commodities/{}/comments评论的url
-	if isComment(urlStr) {
-		fmt.Println("Operate a commodity's comment")
-		a.OperateCommentsForCM(w, r)
-	} else { //请求单个商品的详细信息
-		//将url编码解编码
-		cName, _ := url.QueryUnescape(commodityname)
-		println(cName)
-		//从数据库获取信息
-		commodity, err := a.d.GetOneCommodity(cName)
-		if err != nil {
-			sendErr(w, http.StatusInternalServerError, err.Error())
-			return
-		}
-		//写信息
-		err = json.NewEncoder(w).Encode(commodity)
-		if err != nil {
-			sendErr(w, http.StatusInternalServerError, err.Error())
-		}
+	//写信息，图片换成URL
+	err = json.NewEncoder(w).Encode(withImageURLs(commodity))
+	if err != nil {
+		sendErr(w, http.StatusInternalServerError, err.Error())
 	}
 }
 
-// OperateCommentsForCM get post patch delete the coments of a commodity
-func (a *App) OperateCommentsForCM(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "GET" { //获取某商品的评论
-		w.Header().Set("Content-Type", "application/json")
-		//获取商品名
-		urlStr := r.URL.String()
-		println(urlStr)
-		commodityname := urlStr[len("/commodities")+1 : len(urlStr)-len("/comments")]
-		cName, _ := url.QueryUnescape(commodityname)
-		fmt.Println("get comments for a commodity", cName)
-		//从数据库取数据
-		commemts, err := a.d.GetCommentsForCM(cName)
-		if err != nil {
-			sendErr(w, http.StatusInternalServerError, err.Error())
-			return
-		}
-		//写数据
-		err = json.NewEncoder(w).Encode(commemts)
-		if err != nil {
-			sendErr(w, http.StatusInternalServerError, err.Error())
-		}
-	} else if r.Method == "POST" { //发布新评论
-		var comment model.Comment
-		r.ParseMultipartForm(128)
-		for k, v := range r.MultipartForm.Value {
-			fmt.Println("value,k,v = ", k, ",", v)
-		}
-		comment.Username = r.MultipartForm.Value["username"][0]
-		comment.Comment = r.MultipartForm.Value["comment"][0]
-		comment.Commodity = r.MultipartForm.Value["commodity"][0]
-		a.d.WriteComment(&comment)
-		fmt.Println(comment)
-	} else if r.Method == "DELETE" { //删除评论
-		fmt.Println("Delete a commet")
-		var comment model.Comment
-		r.ParseMultipartForm(128)
-		for k, v := range r.MultipartForm.Value {
-			fmt.Println("value,k,v = ", k, ",", v)
-		}
-		comment.Username = r.MultipartForm.Value["username"][0]
-		comment.Comment = r.MultipartForm.Value["comment"][0]
-		comment.Commodity = r.MultipartForm.Value["commodity"][0]
-		a.d.DeleteComment(&comment)
-	} else if r.Method == "PATCH" { //修改某评论
-		fmt.Println("Update a comment")
-		var comment model.Comment
-		r.ParseMultipartForm(128)
-		comment.Username = r.MultipartForm.Value["username"][0]
-		comment.Comment = r.MultipartForm.Value["comment"][0]
-		comment.Commodity = r.MultipartForm.Value["commodity"][0]
-		a.d.UpdateComment(&comment)
+// GetComments get the comments of a commodity
+func (a *App) GetComments(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	//获取商品id
+	id := pathParam(r, "id")
+	q := db.CommentQuery{Sort: r.FormValue("sort"), Cursor: r.FormValue("cursor")}
+	var ok bool
+	if q.Limit, ok = intParam(w, r, "limit"); !ok {
+		return
+	}
+	//从数据库取数据
+	page, err := a.d.ListComments(r.Context(), id, q)
+	if err != nil {
+		sendDBErr(w, err)
+		return
+	}
+	setNextLink(w, r, page.Next)
+	//写数据
+	err = json.NewEncoder(w).Encode(page.Comments)
+	if err != nil {
+		sendErr(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// PostComment write a new comment, the author is the logged in user
+func (a *App) PostComment(w http.ResponseWriter, r *http.Request) {
+	var comment model.Comment
+	comment.Username = identityFrom(r).Username
+	comment.Comment = r.FormValue("comment")
+	comment.CommodityId = pathParam(r, "id")
+	if comment.Comment == "" {
+		sendErr(w, http.StatusBadRequest, "comment is empty")
+		return
+	}
+	if _, err := a.d.GetOneCommodity(r.Context(), comment.CommodityId); err != nil {
+		writeCommodity(w, nil, err)
+		return
+	}
+	if err := a.d.WriteComment(r.Context(), &comment); err != nil {
+		sendDBErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeComment(w, &comment, nil)
+}
+
+// findComment get the comment in the path, it must belong to the commodity in the path
+func (a *App) findComment(w http.ResponseWriter, r *http.Request) *model.Comment {
+	comment, err := a.d.GetComment(r.Context(), pathParam(r, "comment"))
+	if err == nil && comment.CommodityId != pathParam(r, "id") {
+		err = db.ErrCommentNotFound
+	}
+	if err != nil {
+		writeComment(w, nil, err)
+		return nil
+	}
+	return comment
+}
+
+// GetComment get one comment of a commodity
+func (a *App) GetComment(w http.ResponseWriter, r *http.Request) {
+	if comment := a.findComment(w, r); comment != nil {
+		writeComment(w, comment, nil)
 	}
+}
 
+// UpdateComment change the text of a comment, only its author or a moderator can do it
+func (a *App) UpdateComment(w http.ResponseWriter, r *http.Request) {
+	comment := a.findComment(w, r)
+	if comment == nil || !checkAuthor(w, r, comment.Username) {
+		return
+	}
+	text := r.FormValue("comment")
+	if text == "" {
+		sendErr(w, http.StatusBadRequest, "comment is empty")
+		return
+	}
+	comment, err := a.d.UpdateComment(r.Context(), comment.Id, text)
+	writeComment(w, comment, err)
 }
 
-//isComment return true if name is a comment or false is not a comment
-func isComment(name string) bool {
-	commentMode := regexp.MustCompile(`[A-Za-z0-9%]+/comments`)
-	return commentMode.MatchString(name)
+// DeleteComment delete a comment, only its author or a moderator can do it
+func (a *App) DeleteComment(w http.ResponseWriter, r *http.Request) {
+	comment := a.findComment(w, r)
+	if comment == nil || !checkAuthor(w, r, comment.Username) {
+		return
+	}
+	if err := a.d.DeleteComment(r.Context(), comment.Id); err != nil {
+		writeComment(w, nil, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
+// writeComment write a comment as JSON, or the error
+func writeComment(w http.ResponseWriter, comment *model.Comment, err error) {
+	if err != nil {
+		sendDBErr(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(comment)
 }
 
 // GetUsersInfo get all usersinfo
 func (a *App) GetUsersInfo(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	user, err := a.d.GetUsersInfo()
+	user, err := a.d.GetUsersInfo(r.Context())
 	if err != nil {
-		sendErr(w, http.StatusInternalServerError, err.Error())
+		sendDBErr(w, err)
 		return
 	}
 	err = json.NewEncoder(w).Encode(user)
@@ -282,149 +485,82 @@ func (a *App) GetUsersInfo(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-//isGetCart :判断url是否是请求用户的购物车
-func isGetCart(urlStr string) bool {
-	commentMode := regexp.MustCompile(`[A-Za-z0-9%]+/cart`)
-	return commentMode.MatchString(urlStr)
-
-}
-
-// GetAUserInfo get a userinfo获取某用户信息，以及用户的购物车信息获取和修改
+// GetAUserInfo get a userinfo获取某用户信息
 func (a *App) GetAUserInfo(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	username := r.URL.String()[len("/users/"):]
-	cUsername, _ := url.QueryUnescape(username)
-	if isGetCart(username) { //购物车信息的获取和修改
-		fmt.Println("Get a cart")
-		a.GetAUserCart(w, r)
-	} else { //获取用户的详细信息
-		fmt.Println("Get A user Info")
-		//从数据库取信息
-		user, err := a.d.GetAUserInfo(cUsername)
-		if err != nil {
-			sendErr(w, http.StatusInternalServerError, err.Error())
-			return
-		}
-		err = json.NewEncoder(w).Encode(user)
-		if err != nil {
-			sendErr(w, http.StatusInternalServerError, err.Error())
-		}
+	username := pathParam(r, "user")
+	if !checkUserOrAdmin(w, r, username) {
+		return
 	}
-}
-
-// GetAUserCart if r.Method is GET it will get the cartInfo of a user or update the cartInfo if the r.Method is POST
-//该Api需要token认证，检验客户端发送过来的token字段
-func (a *App) GetAUserCart(w http.ResponseWriter, r *http.Request) {
-	//获取用户名
-	urlStr := r.URL.String()
-	username := urlStr[len("/users/") : len(urlStr)-len("/cart")]
-	cUsername, _ := url.QueryUnescape(username)
-	//从数据库获取该用户的密钥
-	akey, _ := a.d.GetAToken(cUsername)
-	//进行token认证
-	token, err := request.ParseFromRequest(r, request.AuthorizationHeaderExtractor,
-		func(token *jwt.Token) (interface{}, error) {
-			return []byte(akey.Key), nil
-		})
-	if err == nil { //如果token字段正确，允许对用户的购物车信息进行申请和修改
-		if token.Valid {
-			fmt.Println("token is valid")
-			w.WriteHeader(http.StatusOK)
-
-			if r.Method == "GET" { //获取购物车信息
-				w.Header().Set("Content-Type", "application/json")
-				fmt.Println("get cart for a user")
-				//从数据库取数据
-				cart, err := a.d.GetCart(cUsername)
-				if err != nil {
-					sendErr(w, http.StatusInternalServerError, err.Error())
-					return
-				}
-				//写数据
-				err = json.NewEncoder(w).Encode(cart)
-				if err != nil {
-					sendErr(w, http.StatusInternalServerError, err.Error())
-				}
-			} else { //修改用户购物车，即对数据进行如果存在则更新，如果不存在则添加的操作
-				var cart model.Cart
-				r.ParseMultipartForm(512)
-				for k, v := range r.MultipartForm.Value {
-					fmt.Println("value,k,v = ", k, ",", v)
-				}
-
-				cart.Username = r.MultipartForm.Value["username"][0]
-				//coms是一个字符串，需要进行反序列化为json格式结构体
-				coms := r.MultipartForm.Value["commodities"][0]
-				if err := json.Unmarshal([]byte(coms), &cart.Commodities); err == nil {
-					fmt.Println("change string to json :", cart.Commodities)
-				} else {
-					log.Fatal(err)
-				}
-				//写数据
-				a.d.WriteCart(&cart)
-				w.Write([]byte("Successfully updated shopping cart information"))
-			}
-		} else { //token已经失效，可能是过了有效期
-			fmt.Println("Token is not valid")
-			w.WriteHeader(http.StatusUnauthorized)
-		}
-	} else { //token字段错误，无权访问
-		fmt.Println("Unauthorized access to this resource")
-		w.WriteHeader(http.StatusUnauthorized)
+	//从数据库取信息
+	user, err := a.d.GetAUserInfo(r.Context(), username)
+	if err != nil {
+		sendDBErr(w, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(user)
+	if err != nil {
+		sendErr(w, http.StatusInternalServerError, err.Error())
 	}
-
 }
 
 // UserRegister register
-//用户注册，将当前时间，有效时间，和密钥（用户名，密码）生成token返回给客户端
+//用户注册，密码哈希后保存，并返回用服务器密钥签发的token
 func (a *App) UserRegister(w http.ResponseWriter, r *http.Request) {
 	//从request获取用户的信息
 	username := r.PostFormValue("username")
 	password := r.PostFormValue("password")
-	balance1 := r.PostFormValue("balance")
-	balance, _ := strconv.ParseFloat(balance1, 64)
-	//往数据库添加用户
-	_, err := a.d.UserRegister(username, password, balance)
+	if username == "" || password == "" {
+		sendErr(w, http.StatusBadRequest, "username and password are required")
+		return
+	}
+	if len(password) > auth.MaxPasswordLength {
+		sendErr(w, http.StatusBadRequest, "password must not be longer than "+strconv.Itoa(auth.MaxPasswordLength)+" bytes")
+		return
+	}
+	hash, err := auth.HashPassword(password)
 	if err != nil {
 		sendErr(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	//往数据库添加用户，已存在的用户不会被覆盖；新用户余额为0，由管理员修改
+	_, err = a.d.UserRegister(r.Context(), username, hash, 0)
+	if err != nil {
+		sendDBErr(w, err)
+		return
+	}
+	a.writeTokens(w, r, username, model.RoleCustomer, "")
+}
 
-	//生成Token：
-	token := jwt.New(jwt.SigningMethodHS256)
-	claims := make(jwt.MapClaims)
-	//失效时间
-	claims["exp"] = time.Now().Add(time.Hour * time.Duration(2)).Unix()
-	//生效时间
-	claims["iat"] = time.Now().Unix()
-	token.Claims = claims
-	//密钥字段
-	secretKey := username + password
-	//生成token字符串
-	tokenStr, _ := token.SignedString([]byte(secretKey))
-	/*
-		var user model.User
-		user.Balance = balance
-		user.Password = password
-		user.Username = username
-	*/
-	w.Header().Set("Content-Type", "application/json")
-	/*
-		err = json.NewEncoder(w).Encode(user)
-		if err != nil {
-			sendErr(w, http.StatusInternalServerError, err.Error())
-		}*/
-	//生成结构体Token,包括用户名和token字符串，写进response
-	var tokenStruct model.Token
-	tokenStruct.Username = username
-	tokenStruct.TokenStr = tokenStr
-	err = json.NewEncoder(w).Encode(tokenStruct)
-	//生成TokenKey结构体，包括用户名和密钥，储存入数据库
-	var tkey model.TokenKey
-	tkey.Key = secretKey
-	tkey.Username = username
-	a.d.AddToken(&tkey)
+// UserLogin check the username and password and return a new token
+//旧的明文密码在第一次登录成功后改为哈希保存
+func (a *App) UserLogin(w http.ResponseWriter, r *http.Request) {
+	username := r.PostFormValue("username")
+	password := r.PostFormValue("password")
+
+	user, err := a.d.GetUser(r.Context(), username)
+	if errors.Is(err, db.ErrUserNotFound) {
+		auth.CheckNoUser(password)
+		sendErr(w, http.StatusUnauthorized, "wrong username or password")
+		return
+	}
 	if err != nil {
-		sendErr(w, http.StatusInternalServerError, err.Error())
+		sendDBErr(w, err)
+		return
+	}
+	ok, needsRehash := auth.CheckPassword(user.Password, password)
+	if !ok {
+		sendErr(w, http.StatusUnauthorized, "wrong username or password")
+		return
+	}
+	if needsRehash {
+		hash, err := auth.HashPassword(password)
+		if err == nil {
+			err = a.d.UpdatePassword(r.Context(), username, hash)
+		}
+		if err != nil { //迁移失败不影响本次登录，下次登录会再次尝试
+			log.Println("Error while migrating a plaintext password:", err)
+		}
 	}
+	a.writeTokens(w, r, username, user.Role, "")
 }
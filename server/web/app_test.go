@@ -1,57 +1,1407 @@
 package web
 
 import (
-	"errors"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"webapp/auth"
+	"webapp/db"
 	"webapp/model"
+	"webapp/picture"
+	"webapp/search"
 )
 
-type MockDb struct {
-	tech []*model.Technology
-	err  error
+// testApp is an App on an in-memory database
+type testApp struct {
+	t   *testing.T
+	app App
+	mem *db.Memory
 }
 
-func (m *MockDb) GetTechnologies() ([]*model.Technology, error) {
-	return m.tech, m.err
+// pictureDir is the directory of the pictures of the apps made by newTestApp
+var pictureDir = "./picture"
+
+// testMediaSize is the size limit of the videos of the apps made by newTestApp, larger than the pictures
+const testMediaSize = 2 * picture.MaxSize
+
+func newTestApp(t *testing.T) *testApp {
+	keys, err := auth.NewHS256KeySet("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := db.NewMemory()
+	return &testApp{t: t, app: NewApp(mem, keys, false, 0, picture.NewLocal(pictureDir), picture.NewUploads(filepath.Join(pictureDir, ".uploads"), testMediaSize, time.Hour)), mem: mem}
+}
+
+// do send a request with the form values, token is the access token or empty
+func (ta *testApp) do(method, path string, form url.Values, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	ta.app.ServeHTTP(w, r)
+	return w
+}
+
+// expect fail the test when the status is not code and decode the body into v
+func (ta *testApp) expect(w *httptest.ResponseRecorder, code int, v interface{}) {
+	ta.t.Helper()
+	if w.Code != code {
+		ta.t.Fatalf("got status %d want %d, body %s", w.Code, code, w.Body.String())
+	}
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			ta.t.Fatalf("cannot decode %s: %v", w.Body.String(), err)
+		}
+	}
+}
+
+// user register a user with a role and a balance and return its access token
+func (ta *testApp) user(name string, role string, balance string) string {
+	ta.t.Helper()
+	form := url.Values{"username": {name}, "password": {"secret-" + name}}
+	var token model.Token
+	ta.expect(ta.do("POST", "/users/register", form, ""), http.StatusOK, &token)
+	//注册时余额为0，由管理员修改
+	amount, err := strconv.ParseFloat(balance, 64)
+	if err != nil {
+		ta.t.Fatal(err)
+	}
+	if err := ta.mem.SetBalance(context.Background(), name, amount); err != nil {
+		ta.t.Fatal(err)
+	}
+	if role == model.RoleCustomer {
+		return token.TokenStr
+	}
+	if err := ta.mem.SetUserRole(context.Background(), name, role); err != nil {
+		ta.t.Fatal(err)
+	}
+	ta.expect(ta.do("POST", "/users/login", form, ""), http.StatusOK, &token)
+	return token.TokenStr
+}
+
+// commodity add a commodity as a merchant
+func (ta *testApp) commodity(merchant string, name string, price string, stock string) model.Commodity {
+	ta.t.Helper()
+	var c model.Commodity
+	form := url.Values{"name": {name}, "price": {price}, "stock": {stock}, "introduction": {"about " + name}}
+	ta.expect(ta.do("POST", "/commodities", form, merchant), http.StatusCreated, &c)
+	return c
+}
+
+func TestCommodities(t *testing.T) {
+	ta := newTestApp(t)
+	merchant := ta.user("shop", model.RoleMerchant, "0")
+	customer := ta.user("alice", model.RoleCustomer, "0")
+
+	ta.expect(ta.do("POST", "/commodities", url.Values{"name": {"Tea"}}, ""), http.StatusUnauthorized, nil)
+	ta.expect(ta.do("POST", "/commodities", url.Values{"name": {"Tea"}}, customer), http.StatusForbidden, nil)
+	ta.expect(ta.do("POST", "/commodities", url.Values{"price": {"1"}}, merchant), http.StatusBadRequest, nil)
+	for _, price := range []string{"cheap", "1,5", "NaN", "Inf", "-1"} {
+		ta.expect(ta.do("POST", "/commodities", url.Values{"name": {"Tea"}, "price": {price}}, merchant), http.StatusBadRequest, nil)
+	}
+	for _, stock := range []string{"many", "1.5", "-1"} {
+		ta.expect(ta.do("POST", "/commodities", url.Values{"name": {"Tea"}, "price": {"1"}, "stock": {stock}}, merchant), http.StatusBadRequest, nil)
+	}
+
+	tea := ta.commodity(merchant, "Green Tea", "12.5", "3")
+	if tea.Id == "" || tea.Slug != "green-tea" || tea.Stock != 3 {
+		t.Fatalf("unexpected commodity %+v", tea)
+	}
+	ta.commodity(merchant, "Coffee", "30", "1")
+
+	var all []model.Commodity
+	ta.expect(ta.do("GET", "/commodities", nil, ""), http.StatusOK, &all)
+	if len(all) != 2 || all[0].Id != tea.Id {
+		t.Fatalf("unexpected commodities %+v", all)
+	}
+
+	var got model.Commodity
+	ta.expect(ta.do("GET", "/commodities/by-slug/green-tea", nil, ""), http.StatusOK, &got)
+	if got.Id != tea.Id {
+		t.Fatalf("by slug got %+v", got)
+	}
+
+	//改名后id不变，库存不受影响
+	form := url.Values{"name": {"Black Tea"}, "price": {"15"}}
+	ta.expect(ta.do("PUT", "/commodities/"+tea.Id, form, merchant), http.StatusOK, &got)
+	ta.expect(ta.do("GET", "/commodities/"+tea.Id, nil, ""), http.StatusOK, &got)
+	if got.Name != "Black Tea" || got.Price != 15 || got.Stock != 3 || got.Slug != "black-tea" {
+		t.Fatalf("after update got %+v", got)
+	}
+	ta.expect(ta.do("GET", "/commodities/unknown", nil, ""), http.StatusNotFound, nil)
+	ta.expect(ta.do("DELETE", "/commodities/"+tea.Id, nil, merchant), http.StatusMethodNotAllowed, nil)
+}
+
+func TestCommodityIds(t *testing.T) {
+	ta := newTestApp(t)
+	merchant := ta.user("shop", model.RoleMerchant, "0")
+	alice := ta.user("alice", model.RoleCustomer, "0")
+
+	//id由服务器分配，表单中的id不起作用，同名的商品是不同的商品
+	var tea, other model.Commodity
+	form := url.Values{"id": {"chosen"}, "name": {"Tea"}, "price": {"10"}, "stock": {"5"}}
+	ta.expect(ta.do("POST", "/commodities", form, merchant), http.StatusCreated, &tea)
+	ta.expect(ta.do("POST", "/commodities", form, merchant), http.StatusCreated, &other)
+	if tea.Id == "" || tea.Id == "chosen" || other.Id == tea.Id || other.Slug == tea.Slug {
+		t.Fatalf("unexpected ids %+v, %+v", tea, other)
+	}
+
+	var comment model.Comment
+	ta.expect(ta.do("POST", "/commodities/"+tea.Id+"/comments", url.Values{"comment": {"nice"}}, alice), http.StatusCreated, &comment)
+	ta.expect(ta.do("POST", "/users/alice/cart/lines", url.Values{"commodityId": {tea.Id}}, alice), http.StatusOK, nil)
+
+	//改名后评论和购物车仍然指向这个商品，旧的slug不再可用
+	var got model.Commodity
+	ta.expect(ta.do("PUT", "/commodities/"+tea.Id, url.Values{"id": {other.Id}, "name": {"绿茶"}, "price": {"10"}}, merchant), http.StatusOK, &got)
+	if got.Id != tea.Id {
+		t.Fatalf("id changed to %s", got.Id)
+	}
+	var comments []model.Comment
+	ta.expect(ta.do("GET", "/commodities/"+tea.Id+"/comments", nil, ""), http.StatusOK, &comments)
+	if len(comments) != 1 || comments[0].Id != comment.Id {
+		t.Fatalf("unexpected comments %+v", comments)
+	}
+	var priced model.PricedCart
+	ta.expect(ta.do("GET", "/users/alice/cart", nil, alice), http.StatusOK, &priced)
+	if len(priced.Lines) != 1 || priced.Lines[0].Name != "绿茶" || priced.Lines[0].Missing {
+		t.Fatalf("unexpected cart %+v", priced)
+	}
+	ta.expect(ta.do("GET", "/commodities/by-slug/"+tea.Slug, nil, ""), http.StatusNotFound, nil)
+	ta.expect(ta.do("GET", "/commodities/by-slug/"+url.PathEscape(got.Slug), nil, ""), http.StatusOK, &got)
+	if got.Id != tea.Id {
+		t.Fatalf("by slug got %+v", got)
+	}
+	ta.expect(ta.do("GET", "/commodities/"+other.Id, nil, ""), http.StatusOK, &got)
+	if got.Name != "Tea" {
+		t.Fatalf("other commodity changed %+v", got)
+	}
+}
+
+func TestCommodityList(t *testing.T) {
+	ta := newTestApp(t)
+	merchant := ta.user("shop", model.RoleMerchant, "0")
+	for _, name := range []string{"drink", "fruit"} {
+		ta.mem.WriteCategory(context.Background(), &model.Category{Name: name})
+	}
+	for _, c := range []url.Values{
+		{"name": {"Tea"}, "price": {"10"}, "category": {"drink"}},
+		{"name": {"Apple"}, "price": {"3"}, "category": {"fruit"}},
+		{"name": {"Coffee"}, "price": {"30"}, "category": {"drink"}},
+	} {
+		ta.expect(ta.do("POST", "/commodities", c, merchant), http.StatusCreated, nil)
+	}
+
+	//按Link头翻页
+	var names []string
+	next := "/commodities?sort=-price&limit=2"
+	for next != "" {
+		var page []model.Commodity
+		w := ta.do("GET", next, nil, "")
+		ta.expect(w, http.StatusOK, &page)
+		for _, c := range page {
+			names = append(names, c.Name)
+		}
+		next = ""
+		if link := w.Header().Get("Link"); link != "" {
+			next = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+		}
+	}
+	if strings.Join(names, ",") != "Coffee,Tea,Apple" {
+		t.Fatalf("pages got %v", names)
+	}
+
+	var drinks []model.Commodity
+	ta.expect(ta.do("GET", "/commodities?category=drink&maxPrice=20", nil, ""), http.StatusOK, &drinks)
+	if len(drinks) != 1 || drinks[0].Name != "Tea" || drinks[0].Category != "drink" {
+		t.Fatalf("filter got %+v", drinks)
+	}
+	ta.expect(ta.do("GET", "/commodities?limit=x", nil, ""), http.StatusBadRequest, nil)
+	ta.expect(ta.do("GET", "/commodities?minPrice=-1", nil, ""), http.StatusBadRequest, nil)
+	ta.expect(ta.do("GET", "/commodities?sort=stock", nil, ""), http.StatusBadRequest, nil)
+	ta.expect(ta.do("GET", "/commodities?cursor=bad", nil, ""), http.StatusBadRequest, nil)
+}
+
+func TestCategories(t *testing.T) {
+	ta := newTestApp(t)
+	admin := ta.user("root", model.RoleAdmin, "0")
+	merchant := ta.user("shop", model.RoleMerchant, "0")
+
+	category := func(name string, parent string) model.Category {
+		var c model.Category
+		ta.expect(ta.do("POST", "/categories", url.Values{"name": {name}, "parentId": {parent}}, admin), http.StatusCreated, &c)
+		return c
+	}
+	ta.expect(ta.do("POST", "/categories", url.Values{"name": {"Drinks"}}, merchant), http.StatusForbidden, nil)
+	drinks := category("Drinks", "")
+	tea := category("Tea", drinks.Id)
+	green := category("Green Tea", tea.Id)
+	category("Fruit", "")
+	ta.expect(ta.do("POST", "/categories", url.Values{"name": {"Oolong"}, "parentId": {"missing"}}, admin), http.StatusBadRequest, nil)
+	ta.expect(ta.do("PUT", "/categories/"+drinks.Id, url.Values{"name": {"Drinks"}, "parentId": {green.Id}}, admin), http.StatusBadRequest, nil)
+
+	var tree []categoryNode
+	ta.expect(ta.do("GET", "/categories", nil, ""), http.StatusOK, &tree)
+	if len(tree) != 2 || tree[0].Id != drinks.Id || tree[0].Children[0].Children[0].Id != green.Id {
+		t.Fatalf("tree got %+v", tree)
+	}
+	var node struct {
+		categoryNode
+		Path []model.Category `json:"path"`
+	}
+	ta.expect(ta.do("GET", "/categories/"+tea.Id, nil, ""), http.StatusOK, &node)
+	if node.Name != "Tea" || len(node.Children) != 1 || len(node.Path) != 1 || node.Path[0].Id != drinks.Id {
+		t.Fatalf("category got %+v", node)
+	}
+	ta.expect(ta.do("GET", "/categories/missing", nil, ""), http.StatusNotFound, nil)
+
+	//商品的分类必须存在，标签用逗号分隔
+	form := url.Values{"name": {"Longjing"}, "price": {"80"}, "category": {"nothing"}}
+	ta.expect(ta.do("POST", "/commodities", form, merchant), http.StatusBadRequest, nil)
+	var longjing model.Commodity
+	form.Set("category", green.Id)
+	form.Set("tags", "Hot, new,")
+	ta.expect(ta.do("POST", "/commodities", form, merchant), http.StatusCreated, &longjing)
+	if longjing.Category != green.Id || strings.Join(longjing.Tags, ",") != "hot,new" {
+		t.Fatalf("commodity got %+v", longjing)
+	}
+	form = url.Values{"name": {"Cola"}, "price": {"3"}, "category": {drinks.Id}, "tags": {"new"}}
+	ta.expect(ta.do("POST", "/commodities", form, merchant), http.StatusCreated, nil)
+
+	var list []model.Commodity
+	ta.expect(ta.do("GET", "/commodities?category="+drinks.Id+"&tag=new&tag=hot", nil, ""), http.StatusOK, &list)
+	if len(list) != 1 || list[0].Id != longjing.Id {
+		t.Fatalf("filter got %+v", list)
+	}
+	var faceted struct {
+		Items  []model.Commodity `json:"items"`
+		Facets db.Facets         `json:"facets"`
+	}
+	ta.expect(ta.do("GET", "/commodities?category="+drinks.Id+"&limit=1&facets=true", nil, ""), http.StatusOK, &faceted)
+	if len(faceted.Items) != 1 || len(faceted.Facets.Categories) != 3 || faceted.Facets.Categories[0].Count != 2 ||
+		len(faceted.Facets.Tags) != 2 || len(faceted.Facets.Prices) != 2 {
+		t.Fatalf("facets got %+v", faceted)
+	}
+	ta.expect(ta.do("GET", "/commodities?facets=maybe", nil, ""), http.StatusBadRequest, nil)
+
+	ta.expect(ta.do("DELETE", "/categories/"+green.Id, nil, admin), http.StatusConflict, nil)
+	ta.expect(ta.do("PUT", "/categories/"+green.Id, url.Values{"name": {"Green"}, "parentId": {drinks.Id}}, admin), http.StatusOK, nil)
+	ta.expect(ta.do("DELETE", "/categories/"+tea.Id, nil, admin), http.StatusNoContent, nil)
+	ta.expect(ta.do("DELETE", "/categories/"+tea.Id, nil, admin), http.StatusNotFound, nil)
+}
+
+func TestSearch(t *testing.T) {
+	ta := newTestApp(t)
+	merchant := ta.user("shop", model.RoleMerchant, "0")
+	phone := ta.commodity(merchant, "华为手机", "3000", "1")
+	ta.commodity(merchant, "绿茶", "20", "1")
+
+	var res search.Result
+	ta.expect(ta.do("GET", "/search?q="+url.QueryEscape("手机"), nil, ""), http.StatusOK, &res)
+	if res.Total != 1 || res.Hits[0].Id != phone.Id || res.Hits[0].Highlight.Name != "华为<em>手机</em>" {
+		t.Fatalf("search got %+v", res)
+	}
+
+	//改名后索引立即更新
+	form := url.Values{"name": {"华为平板"}, "price": {"3000"}}
+	ta.expect(ta.do("PUT", "/commodities/"+phone.Id, form, merchant), http.StatusOK, nil)
+	ta.expect(ta.do("GET", "/search?q="+url.QueryEscape("手机"), nil, ""), http.StatusOK, &res)
+	if res.Total != 0 {
+		t.Fatalf("old name still found: %+v", res)
+	}
+	ta.expect(ta.do("GET", "/search?q="+url.QueryEscape("平板"), nil, ""), http.StatusOK, &res)
+	if res.Total != 1 {
+		t.Fatalf("new name not found: %+v", res)
+	}
+	ta.expect(ta.do("GET", "/search", nil, ""), http.StatusBadRequest, nil)
+
+	//拼音和拼音首字母
+	ta.expect(ta.do("GET", "/search?q=pingban", nil, ""), http.StatusOK, &res)
+	if res.Total != 1 || res.Hits[0].Highlight.Name != "华为<em>平板</em>" {
+		t.Fatalf("pinyin search got %+v", res)
+	}
+	var suggestions []search.Suggestion
+	for _, prefix := range []string{"华为", "huaw", "hwpb", "pingb"} {
+		ta.expect(ta.do("GET", "/search/suggest?prefix="+url.QueryEscape(prefix), nil, ""), http.StatusOK, &suggestions)
+		if len(suggestions) != 1 || suggestions[0].Id != phone.Id {
+			t.Fatalf("suggest %q got %+v", prefix, suggestions)
+		}
+	}
+	ta.expect(ta.do("GET", "/search/suggest", nil, ""), http.StatusBadRequest, nil)
+
+	//启动时从数据库建立索引
+	keys, _ := auth.NewHS256KeySet("test", nil)
+	restarted := &testApp{t: t, app: NewApp(ta.mem, keys, false, 0, picture.NewLocal(pictureDir), picture.NewUploads(filepath.Join(pictureDir, ".uploads"), testMediaSize, time.Hour)), mem: ta.mem}
+	restarted.expect(restarted.do("GET", "/search?q="+url.QueryEscape("绿茶"), nil, ""), http.StatusOK, &res)
+	if res.Total != 1 {
+		t.Fatalf("index not loaded: %+v", res)
+	}
+}
+
+func TestComments(t *testing.T) {
+	ta := newTestApp(t)
+	merchant := ta.user("shop", model.RoleMerchant, "0")
+	alice := ta.user("alice", model.RoleCustomer, "0")
+	bob := ta.user("bob", model.RoleCustomer, "0")
+	admin := ta.user("root", model.RoleAdmin, "0")
+	tea := ta.commodity(merchant, "Tea", "10", "1")
+	comments := "/commodities/" + tea.Id + "/comments"
+
+	ta.expect(ta.do("POST", comments, url.Values{"comment": {"nice"}}, ""), http.StatusUnauthorized, nil)
+	ta.expect(ta.do("POST", "/commodities/unknown/comments", url.Values{"comment": {"nice"}}, alice), http.StatusNotFound, nil)
+
+	//作者是登录的用户，表单里的username不起作用
+	var c model.Comment
+	form := url.Values{"comment": {"nice"}, "username": {"bob"}}
+	ta.expect(ta.do("POST", comments, form, alice), http.StatusCreated, &c)
+	if c.Id == "" || c.Username != "alice" || c.CommodityId != tea.Id || c.CreatedAt.IsZero() {
+		t.Fatalf("unexpected comment %+v", c)
+	}
+
+	ta.expect(ta.do("PATCH", comments+"/"+c.Id, url.Values{"comment": {"bad"}}, bob), http.StatusForbidden, nil)
+	ta.expect(ta.do("PATCH", comments+"/"+c.Id, url.Values{"comment": {"very nice"}}, alice), http.StatusOK, &c)
+	if c.Comment != "very nice" || c.EditedAt == nil || len(c.History) != 1 || c.History[0].Comment != "nice" {
+		t.Fatalf("unexpected edited comment %+v", c)
+	}
+
+	var list []model.Comment
+	ta.expect(ta.do("GET", comments, nil, ""), http.StatusOK, &list)
+	if len(list) != 1 || list[0].Id != c.Id {
+		t.Fatalf("unexpected comments %+v", list)
+	}
+
+	//评论必须属于路径中的商品
+	coffee := ta.commodity(merchant, "Coffee", "10", "1")
+	ta.expect(ta.do("GET", "/commodities/"+coffee.Id+"/comments/"+c.Id, nil, ""), http.StatusNotFound, nil)
+
+	ta.expect(ta.do("DELETE", comments+"/"+c.Id, nil, bob), http.StatusForbidden, nil)
+	ta.expect(ta.do("DELETE", comments+"/"+c.Id, nil, admin), http.StatusNoContent, nil)
+	ta.expect(ta.do("GET", comments+"/"+c.Id, nil, ""), http.StatusNotFound, nil)
+}
+
+func TestCommentIds(t *testing.T) {
+	ta := newTestApp(t)
+	merchant := ta.user("shop", model.RoleMerchant, "0")
+	alice := ta.user("alice", model.RoleCustomer, "0")
+	tea := ta.commodity(merchant, "Tea", "10", "1")
+	comments := "/commodities/" + tea.Id + "/comments"
+
+	//同一个用户对同一商品的相同评论也是不同的评论
+	var first, second model.Comment
+	ta.expect(ta.do("POST", comments, url.Values{"comment": {"nice"}}, alice), http.StatusCreated, &first)
+	ta.expect(ta.do("POST", comments, url.Values{"comment": {"nice"}}, alice), http.StatusCreated, &second)
+	if first.Id == second.Id {
+		t.Fatalf("same id %s", first.Id)
+	}
+
+	var c model.Comment
+	ta.expect(ta.do("PATCH", comments+"/"+second.Id, url.Values{"comment": {"good"}}, alice), http.StatusOK, &c)
+	ta.expect(ta.do("PATCH", comments+"/"+second.Id, url.Values{"comment": {"great"}}, alice), http.StatusOK, &c)
+	if c.Comment != "great" || len(c.History) != 2 || c.History[1].Comment != "good" || !c.CreatedAt.Equal(second.CreatedAt) {
+		t.Fatalf("unexpected edited comment %+v", c)
+	}
+	var other model.Comment
+	ta.expect(ta.do("GET", comments+"/"+first.Id, nil, ""), http.StatusOK, &other)
+	if other.Comment != "nice" || other.EditedAt != nil || len(other.History) != 0 {
+		t.Fatalf("other comment changed %+v", other)
+	}
+
+	ta.expect(ta.do("DELETE", comments+"/"+first.Id, nil, alice), http.StatusNoContent, nil)
+	ta.expect(ta.do("DELETE", comments+"/"+first.Id, nil, alice), http.StatusNotFound, nil)
+	ta.expect(ta.do("PATCH", comments+"/unknown", url.Values{"comment": {"x"}}, alice), http.StatusNotFound, nil)
+	var list []model.Comment
+	ta.expect(ta.do("GET", comments, nil, ""), http.StatusOK, &list)
+	if len(list) != 1 || list[0].Id != second.Id {
+		t.Fatalf("unexpected comments %+v", list)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	ta := newTestApp(t)
+	alice := ta.user("alice", model.RoleCustomer, "100")
+	admin := ta.user("root", model.RoleAdmin, "0")
+
+	form := url.Values{"username": {"alice"}, "password": {"other"}}
+	ta.expect(ta.do("POST", "/users/register", form, ""), http.StatusConflict, nil)
+	ta.expect(ta.do("POST", "/users/login", form, ""), http.StatusUnauthorized, nil)
+	form.Set("username", "nobody")
+	ta.expect(ta.do("POST", "/users/login", form, ""), http.StatusUnauthorized, nil)
+
+	//密码不会出现在响应中
+	w := ta.do("GET", "/users/alice", nil, alice)
+	var users []model.User
+	ta.expect(w, http.StatusOK, &users)
+	if len(users) != 1 || users[0].Balance != 100 || strings.Contains(w.Body.String(), "secret") {
+		t.Fatalf("unexpected user %s", w.Body.String())
+	}
+
+	//其他用户不能查看余额和角色
+	ta.expect(ta.do("GET", "/users/alice", nil, ""), http.StatusUnauthorized, nil)
+	ta.expect(ta.do("GET", "/users/root", nil, alice), http.StatusForbidden, nil)
+	ta.expect(ta.do("GET", "/users/alice", nil, admin), http.StatusOK, &users)
+
+	ta.expect(ta.do("GET", "/users", nil, alice), http.StatusForbidden, nil)
+	ta.expect(ta.do("GET", "/users", nil, admin), http.StatusOK, &users)
+	if len(users) != 2 {
+		t.Fatalf("got %d users", len(users))
+	}
+
+	//余额不能在注册时指定，只有管理员可以修改
+	form = url.Values{"username": {"carol"}, "password": {"secret"}, "balance": {"1000"}}
+	ta.expect(ta.do("POST", "/users/register", form, ""), http.StatusOK, nil)
+	if u, _ := ta.mem.GetUser(context.Background(), "carol"); u.Balance != 0 {
+		t.Fatalf("registered with balance %v", u.Balance)
+	}
+	ta.expect(ta.do("PUT", "/users/carol/balance", url.Values{"balance": {"30"}}, alice), http.StatusForbidden, nil)
+	ta.expect(ta.do("PUT", "/users/carol/balance", url.Values{"balance": {"-1"}}, admin), http.StatusBadRequest, nil)
+	ta.expect(ta.do("PUT", "/users/nobody/balance", url.Values{"balance": {"1"}}, admin), http.StatusNotFound, nil)
+	ta.expect(ta.do("PUT", "/users/carol/balance", url.Values{"balance": {"30"}}, admin), http.StatusNoContent, nil)
+	if u, _ := ta.mem.GetUser(context.Background(), "carol"); u.Balance != 30 {
+		t.Fatalf("balance not changed: %v", u.Balance)
+	}
+	//bcrypt只接受72字节以内的密码
+	form = url.Values{"username": {"dave"}, "password": {strings.Repeat("x", 73)}}
+	ta.expect(ta.do("POST", "/users/register", form, ""), http.StatusBadRequest, nil)
+
+	ta.expect(ta.do("PUT", "/users/alice/role", url.Values{"role": {"merchant"}}, admin), http.StatusNoContent, nil)
+	if u, _ := ta.mem.GetUser(context.Background(), "alice"); u.Role != model.RoleMerchant {
+		t.Fatalf("role not changed: %+v", u)
+	}
+
+	//无效的token在公开接口上当作未登录
+	ta.expect(ta.do("GET", "/commodities", nil, "bad"), http.StatusOK, nil)
+	w = ta.do("GET", "/users", nil, "bad")
+	ta.expect(w, http.StatusUnauthorized, nil)
+	if !strings.Contains(w.Body.String(), "invalid token") {
+		t.Fatalf("unexpected error %s", w.Body.String())
+	}
+}
+
+func TestAccess(t *testing.T) {
+	ta := newTestApp(t)
+	tokens := map[string]string{
+		"":                 "",
+		model.RoleCustomer: ta.user("alice", model.RoleCustomer, "0"),
+		model.RoleMerchant: ta.user("shop", model.RoleMerchant, "0"),
+		model.RoleAdmin:    ta.user("root", model.RoleAdmin, "0"),
+	}
+	tea := ta.commodity(tokens[model.RoleMerchant], "Tea", "10", "1")
+
+	//每个角色能否访问：401未登录，403权限不足，0表示允许（状态码取决于请求内容）
+	for _, c := range []struct {
+		method, path                         string
+		anonymous, customer, merchant, admin int
+	}{
+		{"POST", "/commodities", 401, 403, 0, 0},
+		{"PUT", "/commodities/" + tea.Id, 401, 403, 0, 0},
+		{"POST", "/picture/upload", 401, 403, 0, 0},
+		{"POST", "/commodities/" + tea.Id + "/images", 401, 403, 0, 0},
+		{"PATCH", "/commodities/" + tea.Id + "/stock", 401, 403, 403, 0},
+		{"GET", "/users", 401, 403, 403, 0},
+		{"PUT", "/users/alice/role", 401, 403, 403, 0},
+		{"POST", "/categories", 401, 403, 403, 0},
+		{"GET", "/admin/pictures", 401, 403, 403, 0},
+		{"POST", "/commodities/" + tea.Id + "/comments", 401, 0, 0, 0},
+		{"GET", "/users/alice/cart", 401, 0, 403, 403},
+		{"GET", "/commodities", 0, 0, 0, 0},
+		{"GET", "/commodities/" + tea.Id + "/comments", 0, 0, 0, 0},
+	} {
+		for role, want := range map[string]int{"": c.anonymous, model.RoleCustomer: c.customer, model.RoleMerchant: c.merchant, model.RoleAdmin: c.admin} {
+			code := ta.do(c.method, c.path, nil, tokens[role]).Code
+			denied := code == http.StatusUnauthorized || code == http.StatusForbidden
+			if (want == 0 && denied) || (want != 0 && code != want) {
+				t.Errorf("%s %s as %q: got %d want %d", c.method, c.path, role, code, want)
+			}
+		}
+	}
+
+	//只有作者和管理员可以修改删除评论
+	var comment model.Comment
+	ta.expect(ta.do("POST", "/commodities/"+tea.Id+"/comments", url.Values{"comment": {"nice"}}, tokens[model.RoleCustomer]), http.StatusCreated, &comment)
+	path := "/commodities/" + tea.Id + "/comments/" + comment.Id
+	ta.expect(ta.do("PATCH", path, url.Values{"comment": {"bad"}}, tokens[model.RoleMerchant]), http.StatusForbidden, nil)
+	ta.expect(ta.do("PATCH", path, url.Values{"comment": {"moderated"}}, tokens[model.RoleAdmin]), http.StatusOK, nil)
+	ta.expect(ta.do("DELETE", path, nil, tokens[model.RoleCustomer]), http.StatusNoContent, nil)
+
+	//返回的用户不带密码
+	w := ta.do("GET", "/users", nil, tokens[model.RoleAdmin])
+	ta.expect(w, http.StatusOK, nil)
+	if strings.Contains(w.Body.String(), "secret") || strings.Contains(w.Body.String(), "$2a$") {
+		t.Fatalf("passwords returned: %s", w.Body.String())
+	}
+}
+
+func TestLogin(t *testing.T) {
+	ta := newTestApp(t)
+	ctx := context.Background()
+	ta.user("alice", model.RoleCustomer, "50")
+
+	//密码哈希后保存
+	u, _ := ta.mem.GetUser(ctx, "alice")
+	if !auth.IsHashed(u.Password) || strings.Contains(u.Password, "secret-alice") {
+		t.Fatalf("password not hashed: %q", u.Password)
+	}
+	var token model.Token
+	form := url.Values{"username": {"alice"}, "password": {"secret-alice"}}
+	ta.expect(ta.do("POST", "/users/login", form, ""), http.StatusOK, &token)
+	if token.Username != "alice" || token.TokenStr == "" {
+		t.Fatalf("unexpected token %+v", token)
+	}
+	ta.expect(ta.do("GET", "/users/alice/cart", nil, token.TokenStr), http.StatusOK, nil)
+
+	//再次注册不会覆盖已有用户
+	form.Set("password", "other")
+	ta.expect(ta.do("POST", "/users/register", form, ""), http.StatusConflict, nil)
+	ta.expect(ta.do("POST", "/users/login", form, ""), http.StatusUnauthorized, nil)
+	if u, _ := ta.mem.GetUser(ctx, "alice"); u.Balance != 50 {
+		t.Fatalf("balance overwritten: %v", u.Balance)
+	}
+
+	//旧的明文密码在第一次登录后改为哈希
+	ta.mem.UserRegister(ctx, "bob", "plain", 0)
+	form = url.Values{"username": {"bob"}, "password": {"wrong"}}
+	ta.expect(ta.do("POST", "/users/login", form, ""), http.StatusUnauthorized, nil)
+	form.Set("password", "plain")
+	ta.expect(ta.do("POST", "/users/login", form, ""), http.StatusOK, &token)
+	if u, _ := ta.mem.GetUser(ctx, "bob"); !auth.IsHashed(u.Password) {
+		t.Fatalf("plaintext password kept: %q", u.Password)
+	}
+	ta.expect(ta.do("POST", "/users/login", form, ""), http.StatusOK, &token)
+}
+
+func TestTokenKeys(t *testing.T) {
+	ta := newTestApp(t)
+	var token model.Token
+	form := url.Values{"username": {"alice"}, "password": {"secret"}}
+	ta.expect(ta.do("POST", "/users/register", form, ""), http.StatusOK, &token)
+	ta.user("bob", model.RoleCustomer, "0")
+
+	//token由服务器的密钥签发，sub是用户名，头部带kid
+	var claims auth.Claims
+	parsed, err := ta.app.keys.Parse(token.TokenStr, &claims)
+	if err != nil || claims.Subject != "alice" || parsed.Header["kid"] != "test" {
+		t.Fatalf("got claims %+v, header %v, %v", claims, parsed.Header, err)
+	}
+	ta.expect(ta.do("GET", "/users/bob/cart", nil, token.TokenStr), http.StatusForbidden, nil)
+
+	//其他密钥签发的token无效
+	other, _ := auth.NewHS256KeySet("test", nil)
+	forged, _, _ := other.IssueAccessToken("alice", model.RoleAdmin)
+	ta.expect(ta.do("GET", "/users/alice/cart", nil, forged), http.StatusUnauthorized, nil)
+
+	//轮换密钥后旧密钥签发的token仍然有效
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secret := func(c byte) string { return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{c}, 32)) }
+	keyFile := func(active string) *auth.KeySet {
+		path := filepath.Join(dir, active+".json")
+		data := `{"active":"` + active + `","keys":[{"kid":"old","alg":"HS256","secret":"` + secret('o') +
+			`"},{"kid":"new","alg":"HS256","secret":"` + secret('n') + `"}]}`
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		keys, err := auth.LoadKeySet(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+	old, _, _ := keyFile("old").IssueAccessToken("alice", model.RoleCustomer)
+	rotated := &testApp{t: t, app: NewApp(ta.mem, keyFile("new"), false, 0, picture.NewLocal(pictureDir), picture.NewUploads(filepath.Join(pictureDir, ".uploads"), testMediaSize, time.Hour)), mem: ta.mem}
+	rotated.expect(rotated.do("GET", "/users/alice/cart", nil, old), http.StatusOK, nil)
+	rotated.expect(rotated.do("POST", "/users/login", form, ""), http.StatusOK, &token)
+	if parsed, _ := rotated.app.keys.Parse(token.TokenStr, &claims); parsed == nil || parsed.Header["kid"] != "new" {
+		t.Fatalf("new tokens not signed by the active key")
+	}
+}
+
+func TestRefreshAndLogout(t *testing.T) {
+	ta := newTestApp(t)
+	form := url.Values{"username": {"alice"}, "password": {"secret"}}
+	var first, second model.Token
+	ta.expect(ta.do("POST", "/users/register", form, ""), http.StatusOK, &first)
+
+	//每次刷新都换一个新的 refresh token
+	ta.expect(ta.do("POST", "/auth/refresh", url.Values{"refresh_token": {first.RefreshToken}}, ""), http.StatusOK, &second)
+	if second.RefreshToken == "" || second.RefreshToken == first.RefreshToken || second.TokenStr == "" {
+		t.Fatalf("tokens not rotated: %+v", second)
+	}
+	ta.expect(ta.do("GET", "/users/alice/cart", nil, second.TokenStr), http.StatusOK, nil)
+	//每个 access token 都有自己的 jti，吊销列表按 jti 记录
+	var c1, c2 auth.Claims
+	ta.app.keys.Parse(first.TokenStr, &c1)
+	ta.app.keys.Parse(second.TokenStr, &c2)
+	if c1.Id == "" || c1.Id == c2.Id || c2.ExpiresAt-c2.IssuedAt != second.ExpiresIn {
+		t.Fatalf("unexpected claims %+v, %+v", c1, c2)
+	}
+
+	//旧的 refresh token 再次使用时整个家族被撤销，新的也不能用了
+	ta.expect(ta.do("POST", "/auth/refresh", url.Values{"refresh_token": {first.RefreshToken}}, ""), http.StatusUnauthorized, nil)
+	ta.expect(ta.do("POST", "/auth/refresh", url.Values{"refresh_token": {second.RefreshToken}}, ""), http.StatusUnauthorized, nil)
+	ta.expect(ta.do("POST", "/auth/refresh", url.Values{"refresh_token": {"unknown"}}, ""), http.StatusUnauthorized, nil)
+
+	//退出登录后 access token 和 refresh token 都不能再用
+	var login model.Token
+	ta.expect(ta.do("POST", "/users/login", form, ""), http.StatusOK, &login)
+	ta.expect(ta.do("POST", "/auth/logout", url.Values{"refresh_token": {login.RefreshToken}}, login.TokenStr), http.StatusNoContent, nil)
+	w := ta.do("GET", "/users/alice/cart", nil, login.TokenStr)
+	ta.expect(w, http.StatusUnauthorized, nil)
+	if !strings.Contains(w.Body.String(), "token revoked") {
+		t.Fatalf("unexpected error %s", w.Body.String())
+	}
+	ta.expect(ta.do("POST", "/auth/refresh", url.Values{"refresh_token": {login.RefreshToken}}, ""), http.StatusUnauthorized, nil)
+
+	//已撤销或无效的 access token 不影响刷新和退出
+	ta.expect(ta.do("POST", "/users/login", form, ""), http.StatusOK, &login)
+	ta.expect(ta.do("POST", "/auth/refresh", url.Values{"refresh_token": {login.RefreshToken}}, "bad"), http.StatusOK, &second)
+	ta.expect(ta.do("POST", "/auth/logout", url.Values{"refresh_token": {second.RefreshToken}}, "bad"), http.StatusNoContent, nil)
+	ta.expect(ta.do("POST", "/auth/refresh", url.Values{"refresh_token": {second.RefreshToken}}, ""), http.StatusUnauthorized, nil)
+}
+
+func TestCartAndCheckout(t *testing.T) {
+	ta := newTestApp(t)
+	merchant := ta.user("shop", model.RoleMerchant, "0")
+	alice := ta.user("alice", model.RoleCustomer, "50")
+	bob := ta.user("bob", model.RoleCustomer, "0")
+	tea := ta.commodity(merchant, "Tea", "10", "3")
+	coffee := ta.commodity(merchant, "Coffee", "25", "1")
+	cart := "/users/alice/cart"
+
+	ta.expect(ta.do("GET", cart, nil, bob), http.StatusForbidden, nil)
+
+	var priced model.PricedCart
+	ta.expect(ta.do("GET", cart, nil, alice), http.StatusOK, &priced)
+	if len(priced.Lines) != 0 {
+		t.Fatalf("new cart is not empty: %+v", priced)
+	}
+
+	ta.expect(ta.do("POST", cart+"/lines", url.Values{"commodityId": {tea.Id}}, alice), http.StatusOK, &priced)
+	ta.expect(ta.do("POST", cart+"/lines", url.Values{"commodityId": {tea.Id}, "quantity": {"2"}}, alice), http.StatusOK, &priced)
+	if len(priced.Lines) != 1 || priced.Lines[0].Quantity != 3 || priced.Total != 30 {
+		t.Fatalf("unexpected cart %+v", priced)
+	}
+	//超过库存
+	ta.expect(ta.do("POST", cart+"/lines", url.Values{"commodityId": {tea.Id}}, alice), http.StatusConflict, nil)
+	ta.expect(ta.do("POST", cart+"/lines", url.Values{"commodityId": {"unknown"}}, alice), http.StatusConflict, nil)
+
+	ta.expect(ta.do("PATCH", cart+"/lines/"+tea.Id, url.Values{"quantity": {"1"}}, alice), http.StatusOK, &priced)
+	ta.expect(ta.do("POST", cart+"/lines", url.Values{"commodityId": {coffee.Id}}, alice), http.StatusOK, &priced)
+	if len(priced.Lines) != 2 || priced.Total != 35 {
+		t.Fatalf("unexpected cart %+v", priced)
+	}
+	ta.expect(ta.do("DELETE", cart+"/lines/unknown", nil, alice), http.StatusNotFound, nil)
+
+	var order model.Order
+	ta.expect(ta.do("POST", "/users/alice/orders", nil, alice), http.StatusCreated, &order)
+	if order.Total != 35 || len(order.Lines) != 2 {
+		t.Fatalf("unexpected order %+v", order)
+	}
+	ta.expect(ta.do("GET", cart, nil, alice), http.StatusOK, &priced)
+	if len(priced.Lines) != 0 {
+		t.Fatalf("cart not emptied: %+v", priced)
+	}
+	if u, _ := ta.mem.GetUser(context.Background(), "alice"); u.Balance != 15 {
+		t.Fatalf("balance %v want 15", u.Balance)
+	}
+	if c, _ := ta.mem.GetOneCommodity(context.Background(), coffee.Id); c.Stock != 0 {
+		t.Fatalf("stock %d want 0", c.Stock)
+	}
+
+	ta.expect(ta.do("POST", "/users/alice/orders", nil, alice), http.StatusBadRequest, nil)
+	ta.expect(ta.do("POST", cart+"/lines", url.Values{"commodityId": {tea.Id}, "quantity": {"2"}}, alice), http.StatusOK, nil)
+	ta.expect(ta.do("POST", "/users/alice/orders", nil, alice), http.StatusPaymentRequired, nil)
+
+	var orders []model.Order
+	ta.expect(ta.do("GET", "/users/alice/orders", nil, alice), http.StatusOK, &orders)
+	if len(orders) != 1 || orders[0].Id != order.Id {
+		t.Fatalf("unexpected orders %+v", orders)
+	}
+}
+
+func TestCartLines(t *testing.T) {
+	ta := newTestApp(t)
+	merchant := ta.user("shop", model.RoleMerchant, "0")
+	alice := ta.user("alice", model.RoleCustomer, "0")
+	tea := ta.commodity(merchant, "Tea", "10", "9")
+	coffee := ta.commodity(merchant, "Coffee", "25", "9")
+	cart := "/users/alice/cart"
+
+	//客户端给的价格不起作用，同一商品的行合并
+	lines := `[{"commodityId":"` + tea.Id + `","quantity":1,"price":0.01},
+		{"commodityId":"` + coffee.Id + `","quantity":2},{"commodityId":"` + tea.Id + `","quantity":2}]`
+	var priced model.PricedCart
+	ta.expect(ta.do("POST", cart, url.Values{"lines": {lines}}, alice), http.StatusOK, &priced)
+	if len(priced.Lines) != 2 || priced.Lines[0].Quantity != 3 || priced.Lines[0].Price != 10 ||
+		priced.Lines[0].Amount != 30 || priced.Lines[1].Amount != 50 || priced.Total != 80 {
+		t.Fatalf("unexpected cart %+v", priced)
+	}
+	ta.expect(ta.do("POST", cart, url.Values{"lines": {"tea"}}, alice), http.StatusBadRequest, nil)
+	ta.expect(ta.do("POST", cart, url.Values{"lines": {`[{"commodityId":"` + tea.Id + `","quantity":0}]`}}, alice), http.StatusBadRequest, nil)
+	ta.expect(ta.do("POST", cart, url.Values{"lines": {`[{"commodityId":"` + tea.Id + `","quantity":10}]`}}, alice), http.StatusConflict, nil)
+
+	//购物车按商品表的当前价格计算
+	ta.expect(ta.do("PUT", "/commodities/"+tea.Id, url.Values{"name": {"Tea"}, "price": {"12"}}, merchant), http.StatusOK, nil)
+	ta.expect(ta.do("GET", cart, nil, alice), http.StatusOK, &priced)
+	if priced.Lines[0].Amount != 36 || priced.Total != 86 {
+		t.Fatalf("cart not re-priced %+v", priced)
+	}
+
+	ta.expect(ta.do("PATCH", cart+"/lines/"+coffee.Id, url.Values{"quantity": {"-1"}}, alice), http.StatusBadRequest, nil)
+	ta.expect(ta.do("PATCH", cart+"/lines/"+coffee.Id, url.Values{"quantity": {"10"}}, alice), http.StatusConflict, nil)
+	ta.expect(ta.do("PATCH", cart+"/lines/unknown", url.Values{"quantity": {"1"}}, alice), http.StatusConflict, nil)
+	//数量为0时删除这一行
+	ta.expect(ta.do("PATCH", cart+"/lines/"+coffee.Id, url.Values{"quantity": {"0"}}, alice), http.StatusOK, &priced)
+	if len(priced.Lines) != 1 || priced.Lines[0].CommodityId != tea.Id || priced.Total != 36 {
+		t.Fatalf("unexpected cart %+v", priced)
+	}
+	ta.expect(ta.do("DELETE", cart+"/lines/"+tea.Id, nil, alice), http.StatusOK, &priced)
+	if len(priced.Lines) != 0 || priced.Total != 0 {
+		t.Fatalf("unexpected cart %+v", priced)
+	}
+}
+
+func TestStock(t *testing.T) {
+	ta := newTestApp(t)
+	admin := ta.user("root", model.RoleAdmin, "0")
+	merchant := ta.user("shop", model.RoleMerchant, "0")
+	tea := ta.commodity(merchant, "Tea", "10", "2")
+	stock := "/commodities/" + tea.Id + "/stock"
+
+	var list []model.Commodity
+	ta.expect(ta.do("GET", "/commodities", nil, ""), http.StatusOK, &list)
+	if len(list) != 1 || list[0].Stock != 2 {
+		t.Fatalf("unexpected commodities %+v", list)
+	}
+	ta.expect(ta.do("POST", "/commodities", url.Values{"name": {"Coffee"}, "price": {"1"}, "stock": {"-1"}}, merchant), http.StatusBadRequest, nil)
+
+	//只有管理员可以修改库存，库存不会小于0
+	ta.expect(ta.do("PATCH", stock, url.Values{"delta": {"3"}}, merchant), http.StatusForbidden, nil)
+	ta.expect(ta.do("PATCH", stock, url.Values{"delta": {"x"}}, admin), http.StatusBadRequest, nil)
+	ta.expect(ta.do("PATCH", stock, url.Values{"delta": {"-3"}}, admin), http.StatusConflict, nil)
+	var c model.Commodity
+	ta.expect(ta.do("PATCH", stock, url.Values{"delta": {"3"}}, admin), http.StatusOK, &c)
+	if c.Stock != 5 {
+		t.Fatalf("stock %d want 5", c.Stock)
+	}
+	ta.expect(ta.do("PUT", stock, url.Values{"stock": {"-1"}}, admin), http.StatusBadRequest, nil)
+	ta.expect(ta.do("PUT", stock, url.Values{"stock": {"2"}}, admin), http.StatusOK, &c)
+	ta.expect(ta.do("PUT", "/commodities/unknown/stock", url.Values{"stock": {"2"}}, admin), http.StatusNotFound, nil)
+
+	//同时下单不会超卖
+	tokens := make([]string, 5)
+	for i := range tokens {
+		name := "user" + strconv.Itoa(i)
+		tokens[i] = ta.user(name, model.RoleCustomer, "100")
+		ta.expect(ta.do("POST", "/users/"+name+"/cart/lines", url.Values{"commodityId": {tea.Id}}, tokens[i]), http.StatusOK, nil)
+	}
+	codes := make(chan int, len(tokens))
+	var wg sync.WaitGroup
+	for i, token := range tokens {
+		wg.Add(1)
+		go func(name, token string) {
+			defer wg.Done()
+			codes <- ta.do("POST", "/users/"+name+"/orders", nil, token).Code
+		}("user"+strconv.Itoa(i), token)
+	}
+	wg.Wait()
+	close(codes)
+	created := 0
+	for code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusConflict:
+		default:
+			t.Fatalf("unexpected status %d", code)
+		}
+	}
+	ta.expect(ta.do("GET", "/commodities/"+tea.Id, nil, ""), http.StatusOK, &c)
+	if created != 2 || c.Stock != 0 {
+		t.Fatalf("%d orders, stock %d", created, c.Stock)
+	}
+}
+
+func TestOrders(t *testing.T) {
+	ta := newTestApp(t)
+	merchant := ta.user("shop", model.RoleMerchant, "0")
+	alice := ta.user("alice", model.RoleCustomer, "100")
+	bob := ta.user("bob", model.RoleCustomer, "100")
+	tea := ta.commodity(merchant, "Tea", "10", "5")
+	orders := "/users/alice/orders"
+
+	ta.expect(ta.do("POST", orders, nil, ""), http.StatusUnauthorized, nil)
+	ta.expect(ta.do("POST", orders, nil, bob), http.StatusForbidden, nil)
+	ta.expect(ta.do("POST", "/users/alice/cart/lines", url.Values{"commodityId": {tea.Id}, "quantity": {"2"}}, alice), http.StatusOK, nil)
+	var order model.Order
+	ta.expect(ta.do("POST", orders, nil, alice), http.StatusCreated, &order)
+	if order.Id == "" || order.Username != "alice" || order.Total != 20 || order.Lines[0].Price != 10 {
+		t.Fatalf("unexpected order %+v", order)
+	}
+
+	var got model.Order
+	ta.expect(ta.do("GET", orders+"/"+order.Id, nil, alice), http.StatusOK, &got)
+	if got.Id != order.Id || got.Total != 20 {
+		t.Fatalf("unexpected order %+v", got)
+	}
+	ta.expect(ta.do("GET", orders+"/"+order.Id, nil, bob), http.StatusForbidden, nil)
+	ta.expect(ta.do("GET", "/users/bob/orders/"+order.Id, nil, bob), http.StatusNotFound, nil)
+	ta.expect(ta.do("GET", orders+"/unknown", nil, alice), http.StatusNotFound, nil)
+
+	//商品已下架时不能下单，余额和库存不变
+	ta.mem.AddCartLine(context.Background(), "alice", model.CartLine{CommodityId: "gone", Quantity: 1})
+	ta.expect(ta.do("POST", orders, nil, alice), http.StatusConflict, nil)
+	if u, _ := ta.mem.GetUser(context.Background(), "alice"); u.Balance != 80 {
+		t.Fatalf("balance %v want 80", u.Balance)
+	}
+	var list []model.Order
+	ta.expect(ta.do("GET", orders, nil, alice), http.StatusOK, &list)
+	if len(list) != 1 {
+		t.Fatalf("unexpected orders %+v", list)
+	}
 }
 
-func TestApp_GetTechnologies(t *testing.T) {
-	app := App{d: &MockDb{
-		tech: []*model.Technology{
-			{"Tech1", "Details1"},
-			{"Tech2", "Details2"},
-		},
-	}}
+func TestVariants(t *testing.T) {
+	ta := newTestApp(t)
+	admin := ta.user("root", model.RoleAdmin, "0")
+	merchant := ta.user("shop", model.RoleMerchant, "0")
+	alice := ta.user("alice", model.RoleCustomer, "500")
+	shirt := ta.commodity(merchant, "Shirt", "99", "0")
+	path := "/commodities/" + shirt.Id
+	cart := "/users/alice/cart"
+
+	variants := `[{"options":{"color":"Red","size":"M"},"price":89,"stock":2},
+		{"sku":"blue-m","options":{"color":"Blue","size":"M"},"price":79,"stock":1}]`
+	ta.expect(ta.do("PUT", path+"/variants", url.Values{"variants": {variants}}, alice), http.StatusForbidden, nil)
+	ta.expect(ta.do("PUT", path+"/variants", url.Values{"variants": {"red"}}, merchant), http.StatusBadRequest, nil)
+	ta.expect(ta.do("PUT", path+"/variants", url.Values{"variants": {`[{"options":{}}]`}}, merchant), http.StatusBadRequest, nil)
+	var c model.Commodity
+	ta.expect(ta.do("PUT", path+"/variants", url.Values{"variants": {variants}}, merchant), http.StatusOK, &c)
+	if len(c.Variants) != 2 || c.Variants[0].Sku != "red-m" || c.Price != 79 || c.Stock != 3 || len(c.Options) != 2 {
+		t.Fatalf("unexpected variants %+v", c)
+	}
+	//有规格的商品价格由规格决定
+	ta.expect(ta.do("PUT", path, url.Values{"name": {"Shirt"}, "price": {"1"}}, merchant), http.StatusOK, &c)
+	if c.Price != 79 || len(c.Variants) != 2 {
+		t.Fatalf("update changed the variants %+v", c)
+	}
+
+	ta.expect(ta.do("PATCH", path+"/stock", url.Values{"delta": {"1"}}, admin), http.StatusBadRequest, nil)
+	ta.expect(ta.do("PATCH", path+"/stock", url.Values{"delta": {"1"}, "sku": {"green"}}, admin), http.StatusNotFound, nil)
+	ta.expect(ta.do("PUT", path+"/stock", url.Values{"stock": {"4"}, "sku": {"blue-m"}}, admin), http.StatusOK, &c)
+	if c.Variant("blue-m").Stock != 4 || c.Stock != 6 {
+		t.Fatalf("unexpected stock %+v", c)
+	}
+
+	var priced model.PricedCart
+	ta.expect(ta.do("POST", cart+"/lines", url.Values{"commodityId": {shirt.Id}}, alice), http.StatusBadRequest, nil)
+	ta.expect(ta.do("POST", cart+"/lines", url.Values{"commodityId": {shirt.Id}, "sku": {"green"}}, alice), http.StatusConflict, nil)
+	ta.expect(ta.do("POST", cart+"/lines", url.Values{"commodityId": {shirt.Id}, "sku": {"red-m"}, "quantity": {"3"}}, alice), http.StatusConflict, nil)
+	ta.expect(ta.do("POST", cart+"/lines", url.Values{"commodityId": {shirt.Id}, "sku": {"red-m"}, "quantity": {"2"}}, alice), http.StatusOK, &priced)
+	ta.expect(ta.do("POST", cart+"/lines", url.Values{"commodityId": {shirt.Id}, "sku": {"blue-m"}}, alice), http.StatusOK, &priced)
+	if len(priced.Lines) != 2 || priced.Total != 257 || priced.Lines[0].Options["color"] != "Red" {
+		t.Fatalf("unexpected cart %+v", priced)
+	}
+	ta.expect(ta.do("PATCH", cart+"/lines/"+shirt.Id, url.Values{"sku": {"blue-m"}, "quantity": {"2"}}, alice), http.StatusOK, &priced)
+	ta.expect(ta.do("DELETE", cart+"/lines/"+shirt.Id+"?sku=red-m", nil, alice), http.StatusOK, &priced)
+	if len(priced.Lines) != 1 || priced.Lines[0].Sku != "blue-m" || priced.Total != 158 {
+		t.Fatalf("unexpected cart %+v", priced)
+	}
+
+	var order model.Order
+	ta.expect(ta.do("POST", "/users/alice/orders", nil, alice), http.StatusCreated, &order)
+	if order.Total != 158 || order.Lines[0].Sku != "blue-m" {
+		t.Fatalf("unexpected order %+v", order)
+	}
+	if c, _ := ta.mem.GetOneCommodity(context.Background(), shirt.Id); c.Variant("blue-m").Stock != 2 || c.Stock != 4 {
+		t.Fatalf("unexpected stock %+v", c)
+	}
+}
+
+func TestImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "picture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"front.jpg", "back.jpg", "side view.png"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("image"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(old string) { pictureDir = old }(pictureDir)
+	pictureDir = dir
+
+	ta := newTestApp(t)
+	merchant := ta.user("shop", model.RoleMerchant, "0")
+	alice := ta.user("alice", model.RoleCustomer, "0")
+	tea := ta.commodity(merchant, "Tea", "10", "1")
+	images := "/commodities/" + tea.Id + "/images"
+
+	var c model.Commodity
+	ta.expect(ta.do("POST", images, url.Values{"image": {"front.jpg"}}, alice), http.StatusForbidden, nil)
+	ta.expect(ta.do("POST", images, url.Values{"image": {"missing.jpg"}}, merchant), http.StatusBadRequest, nil)
+	ta.expect(ta.do("POST", images, url.Values{"image": {"../app.go"}}, merchant), http.StatusBadRequest, nil)
+	ta.expect(ta.do("POST", images, url.Values{"image": {"front.jpg"}, "alt": {"front"}}, merchant), http.StatusCreated, &c)
+	ta.expect(ta.do("POST", images, url.Values{"image": {"front.jpg"}}, merchant), http.StatusConflict, nil)
+	ta.expect(ta.do("POST", images, url.Values{"image": {"back.jpg"}}, merchant), http.StatusCreated, &c)
+	ta.expect(ta.do("POST", images, url.Values{"image": {"side view.png"}, "cover": {"true"}}, merchant), http.StatusCreated, &c)
+	if len(c.Images) != 3 || c.Images[0].URL != "/picture/side%20view.png" || c.Picture != "/picture/side%20view.png" || c.Images[1].Alt != "front" {
+		t.Fatalf("unexpected images %+v", c)
+	}
+
+	ta.expect(ta.do("PUT", images, url.Values{"order": {"back.jpg,front.jpg"}}, merchant), http.StatusBadRequest, nil)
+	ta.expect(ta.do("PUT", images, url.Values{"order": {"back.jpg,front.jpg,front.jpg"}}, merchant), http.StatusBadRequest, nil)
+	ta.expect(ta.do("PUT", images, url.Values{"order": {"back.jpg, front.jpg, side view.png"}}, merchant), http.StatusOK, &c)
+	if c.Images[0].Id != "back.jpg" || c.Images[2].Id != "side view.png" || c.Picture != "/picture/back.jpg" {
+		t.Fatalf("unexpected order %+v", c)
+	}
+	ta.expect(ta.do("PATCH", images+"/front.jpg", url.Values{"alt": {"the front"}, "cover": {"true"}}, merchant), http.StatusOK, &c)
+	if c.Images[0].Id != "front.jpg" || c.Images[0].Alt != "the front" || c.Images[1].Id != "back.jpg" {
+		t.Fatalf("unexpected cover %+v", c)
+	}
+	ta.expect(ta.do("PATCH", images+"/missing.jpg", url.Values{"alt": {"x"}}, merchant), http.StatusNotFound, nil)
+
+	//修改商品不会改变图片和封面
+	ta.expect(ta.do("PUT", "/commodities/"+tea.Id, url.Values{"name": {"Tea"}, "price": {"10"}, "picture": {"back.jpg"}}, merchant), http.StatusOK, &c)
+	if len(c.Images) != 3 || c.Picture != "/picture/front.jpg" {
+		t.Fatalf("update changed the images %+v", c)
+	}
+
+	ta.expect(ta.do("DELETE", images+"/front.jpg", nil, merchant), http.StatusOK, &c)
+	ta.expect(ta.do("DELETE", images+"/front.jpg", nil, merchant), http.StatusNotFound, nil)
+	ta.expect(ta.do("GET", "/commodities/"+tea.Id, nil, ""), http.StatusOK, &c)
+	if len(c.Images) != 2 || c.Picture != "/picture/back.jpg" || c.Images[1].URL != "/picture/side%20view.png" {
+		t.Fatalf("unexpected images %+v", c)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "front.jpg")); err != nil {
+		t.Fatalf("detaching removed the picture: %v", err)
+	}
+
+	//只有 picture 的旧商品把它当作唯一的图片
+	coffee := model.Commodity{Name: "Coffee", Picture: "1.png"}
+	ta.mem.PostCommodity(context.Background(), &coffee)
+	ta.expect(ta.do("GET", "/commodities/"+coffee.Id, nil, ""), http.StatusOK, &c)
+	if len(c.Images) != 1 || c.Images[0].URL != "/picture/1.png" || c.Picture != "/picture/1.png" {
+		t.Fatalf("unexpected legacy picture %+v", c)
+	}
+}
 
-	r, _ := http.NewRequest("GET", "/api/technologies", nil)
+// upload send data as the multipart file image of /picture/upload
+func (ta *testApp) upload(data []byte, filename string, token string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("image", filename)
+	if err != nil {
+		ta.t.Fatal(err)
+	}
+	fw.Write(data)
+	mw.Close()
+	r := httptest.NewRequest("POST", "/picture/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+token)
 	w := httptest.NewRecorder()
+	ta.app.ServeHTTP(w, r)
+	return w
+}
+
+func TestUploadPicture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "picture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { pictureDir = old }(pictureDir)
+	pictureDir = dir
 
-	app.GetTechnologies(w, r)
+	ta := newTestApp(t)
+	merchant := ta.user("shop", model.RoleMerchant, "0")
+	alice := ta.user("alice", model.RoleCustomer, "0")
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 3, 2)))
 
-	if w.Code != http.StatusOK {
-		t.Errorf("handler returned wrong status code: got %v want %v", w.Code, http.StatusOK)
+	ta.expect(ta.upload(buf.Bytes(), "a.png", alice), http.StatusForbidden, nil)
+	//文件名不会被使用，不能跳出图片目录
+	var info struct {
+		Id          string `json:"imageId"`
+		URL         string `json:"url"`
+		Width       int    `json:"width"`
+		Height      int    `json:"height"`
+		Hash        string `json:"hash"`
+		ContentType string `json:"contentType"`
+	}
+	ta.expect(ta.upload(buf.Bytes(), "../../evil.png", merchant), http.StatusCreated, &info)
+	if info.Id != info.Hash+".png" || info.URL != "/picture/"+info.Id || info.Width != 3 || info.Height != 2 || info.ContentType != "image/png" {
+		t.Fatalf("unexpected picture %+v", info)
+	}
+	ta.expect(ta.upload(buf.Bytes(), "other.png", merchant), http.StatusOK, nil)
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 || files[0].Name() != info.Id {
+		t.Fatalf("unexpected files %v", files)
 	}
+	w := ta.do("GET", info.URL, nil, "")
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), buf.Bytes()) {
+		t.Fatalf("got status %d serving the picture", w.Code)
+	}
+
+	ta.expect(ta.upload([]byte("<html>not a picture</html>"), "a.png", merchant), http.StatusUnsupportedMediaType, nil)
+	ta.expect(ta.upload(buf.Bytes()[:30], "a.png", merchant), http.StatusBadRequest, nil)
+	ta.expect(ta.upload(make([]byte, picture.MaxSize+1), "big.png", merchant), http.StatusRequestEntityTooLarge, nil)
+	ta.expect(ta.do("POST", "/picture/upload", url.Values{"image": {"a.png"}}, merchant), http.StatusBadRequest, nil)
 
-	want := `[{"name":"Tech1","details":"Details1"},{"name":"Tech2","details":"Details2"}]` + "\n"
-	if got := w.Body.String(); got != want {
-		t.Errorf("handler returned unexpected body: got %v want %v", got, want)
+	//上传的图片可以添加到商品
+	tea := ta.commodity(merchant, "Tea", "10", "1")
+	var c model.Commodity
+	ta.expect(ta.do("POST", "/commodities/"+tea.Id+"/images", url.Values{"image": {info.Id}}, merchant), http.StatusCreated, &c)
+	if len(c.Images) != 1 || c.Images[0].URL != info.URL {
+		t.Fatalf("unexpected images %+v", c.Images)
 	}
 }
 
-func TestApp_GetTechnologies_WithDBError(t *testing.T) {
-	app := App{d: &MockDb{
-		tech: nil,
-		err:  errors.New("unknown error"),
-	}}
+func TestPictureVariants(t *testing.T) {
+	dir, err := ioutil.TempDir("", "picture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { pictureDir = old }(pictureDir)
+	pictureDir = dir
+
+	ta := newTestApp(t)
+	merchant := ta.user("shop", model.RoleMerchant, "0")
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 600, 300)), nil)
+	var info struct {
+		URL string `json:"url"`
+	}
+	ta.expect(ta.upload(buf.Bytes(), "a.jpg", merchant), http.StatusCreated, &info)
 
-	r, _ := http.NewRequest("GET", "/api/technologies", nil)
+	for query, width := range map[string]int{"?w=100": 160, "?preset=list": 320, "?w=1000": 600} {
+		w := ta.do("GET", info.URL+query, nil, "")
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" {
+			t.Fatalf("%s: got status %d, %s", query, w.Code, w.Header().Get("Content-Type"))
+		}
+		if !strings.Contains(w.Header().Get("Cache-Control"), "immutable") {
+			t.Fatalf("%s: Cache-Control %q", query, w.Header().Get("Cache-Control"))
+		}
+		config, err := jpeg.DecodeConfig(w.Body)
+		if err != nil || config.Width != width {
+			t.Fatalf("%s: got width %d, %v want %d", query, config.Width, err, width)
+		}
+	}
+	ta.expect(ta.do("GET", info.URL+"?w=0", nil, ""), http.StatusBadRequest, nil)
+	ta.expect(ta.do("GET", info.URL+"?w=big", nil, ""), http.StatusBadRequest, nil)
+	ta.expect(ta.do("GET", info.URL+"?w=5000", nil, ""), http.StatusBadRequest, nil)
+	ta.expect(ta.do("GET", info.URL+"?preset=huge", nil, ""), http.StatusBadRequest, nil)
+	ta.expect(ta.do("GET", "/picture/missing.jpg?w=100", nil, ""), http.StatusNotFound, nil)
+	ta.expect(ta.do("GET", "/picture/missing.jpg", nil, ""), http.StatusNotFound, nil)
+	//缓存目录和目录列表不对外
+	ta.expect(ta.do("GET", "/picture/.cache", nil, ""), http.StatusNotFound, nil)
+	ta.expect(ta.do("GET", "/picture/", nil, ""), http.StatusNotFound, nil)
+}
+
+// tus send a request of the resumable upload protocol with the headers and body
+func (ta *testApp) tus(method, path string, header map[string]string, body []byte, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, bytes.NewReader(body))
+	r.Header.Set("Tus-Resumable", "1.0.0")
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
 	w := httptest.NewRecorder()
+	ta.app.ServeHTTP(w, r)
+	return w
+}
+
+func TestResumableUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "picture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { pictureDir = old }(pictureDir)
+	pictureDir = dir
+
+	ta := newTestApp(t)
+	merchant := ta.user("shop", model.RoleMerchant, "0")
+	other := ta.user("other", model.RoleMerchant, "0")
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 40, 30)))
+	data := buf.Bytes()
+	length := strconv.Itoa(len(data))
+	chunk := map[string]string{"Content-Type": "application/offset+octet-stream"}
+	at := func(offset int) map[string]string {
+		return map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": strconv.Itoa(offset)}
+	}
+
+	w := ta.tus("OPTIONS", "/picture/uploads", nil, nil, "")
+	if w.Code != http.StatusNoContent || w.Header().Get("Tus-Version") != "1.0.0" || w.Header().Get("Tus-Max-Size") != strconv.Itoa(testMediaSize) {
+		t.Fatalf("got status %d, headers %v", w.Code, w.Header())
+	}
+	ta.expect(ta.tus("POST", "/picture/uploads", map[string]string{"Upload-Length": length}, nil, ""), http.StatusUnauthorized, nil)
+	ta.expect(ta.tus("POST", "/picture/uploads", nil, nil, merchant), http.StatusBadRequest, nil)
+	ta.expect(ta.tus("POST", "/picture/uploads", map[string]string{"Upload-Length": "0"}, nil, merchant), http.StatusBadRequest, nil)
+	ta.expect(ta.tus("POST", "/picture/uploads", map[string]string{"Upload-Length": strconv.Itoa(testMediaSize + 1)}, nil, merchant), http.StatusRequestEntityTooLarge, nil)
+	ta.expect(ta.tus("POST", "/picture/uploads", map[string]string{"Upload-Length": length, "Tus-Resumable": "0.2.2"}, nil, merchant), http.StatusPreconditionFailed, nil)
+
+	w = ta.tus("POST", "/picture/uploads", map[string]string{"Upload-Length": length, "Upload-Metadata": "filename YS5wbmc="}, nil, merchant)
+	location := w.Header().Get("Location")
+	if w.Code != http.StatusCreated || !strings.HasPrefix(location, "/picture/uploads/") || w.Header().Get("Upload-Expires") == "" {
+		t.Fatalf("got status %d, headers %v", w.Code, w.Header())
+	}
+	progress := func(token string, code int, offset string) {
+		t.Helper()
+		w := ta.tus("HEAD", location, nil, nil, token)
+		if w.Code != code || w.Header().Get("Upload-Offset") != offset {
+			t.Fatalf("got status %d offset %q want %d %q", w.Code, w.Header().Get("Upload-Offset"), code, offset)
+		}
+	}
+	progress(merchant, http.StatusOK, "0")
+	//别人的上传看不到
+	progress(other, http.StatusNotFound, "")
+
+	half := len(data) / 2
+	w = ta.tus("PATCH", location, at(0), data[:half], merchant)
+	if w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Fatalf("got status %d offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	progress(merchant, http.StatusOK, strconv.Itoa(half))
+	//偏移不对时返回409和当前的偏移
+	w = ta.tus("PATCH", location, at(0), data[:half], merchant)
+	if w.Code != http.StatusConflict || w.Header().Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Fatalf("got status %d offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	ta.expect(ta.tus("PATCH", location, chunk, data[half:], merchant), http.StatusBadRequest, nil)
+	ta.expect(ta.tus("PATCH", location, map[string]string{"Upload-Offset": strconv.Itoa(half)}, data[half:], merchant), http.StatusUnsupportedMediaType, nil)
+	ta.expect(ta.tus("PATCH", location, at(half), append(data[half:len(data):len(data)], 0), merchant), http.StatusRequestEntityTooLarge, nil)
+	ta.expect(ta.tus("PATCH", location, at(half), data[half:], other), http.StatusNotFound, nil)
+
+	var info struct {
+		Id  string `json:"imageId"`
+		URL string `json:"url"`
+	}
+	ta.expect(ta.tus("PATCH", location, at(half), data[half:], merchant), http.StatusOK, &info)
+	if info.URL != "/picture/"+info.Id {
+		t.Fatalf("unexpected picture %+v", info)
+	}
+	if stored, err := ioutil.ReadFile(filepath.Join(dir, info.Id)); err != nil || !bytes.Equal(stored, data) {
+		t.Fatalf("stored picture %v", err)
+	}
+	//完成后仍然可以查询，没收到回答的客户端再发一次空块得到同样的回答
+	progress(merchant, http.StatusOK, length)
+	var again struct {
+		Id string `json:"imageId"`
+	}
+	ta.expect(ta.tus("PATCH", location, at(len(data)), nil, merchant), http.StatusOK, &again)
+	if again.Id != info.Id {
+		t.Fatalf("got %s want %s", again.Id, info.Id)
+	}
+
+	//不是图片的上传在最后一块被拒绝并删除
+	w = ta.tus("POST", "/picture/uploads", map[string]string{"Upload-Length": "26"}, nil, merchant)
+	text := w.Header().Get("Location")
+	ta.expect(ta.tus("PATCH", text, at(0), []byte("<html>not a picture</html>"), merchant), http.StatusUnsupportedMediaType, nil)
+	ta.expect(ta.tus("HEAD", text, nil, nil, merchant), http.StatusNotFound, nil)
+
+	//视频可以比图片大，保存在 media 目录，可以按范围读取
+	video := append([]byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"), make([]byte, picture.MaxSize)...)
+	w = ta.tus("POST", "/picture/uploads", map[string]string{"Upload-Length": strconv.Itoa(len(video))}, nil, merchant)
+	movie := w.Header().Get("Location")
+	ta.expect(ta.tus("PATCH", movie, at(0), video, merchant), http.StatusOK, &info)
+	if info.URL != "/media/"+info.Id || !strings.HasSuffix(info.Id, ".mp4") {
+		t.Fatalf("unexpected video %+v", info)
+	}
+	if stored, err := ioutil.ReadFile(filepath.Join(dir, "media", info.Id)); err != nil || !bytes.Equal(stored, video) {
+		t.Fatalf("stored video %v", err)
+	}
+	w = ta.tus("GET", info.URL, map[string]string{"Range": "bytes=4-7"}, nil, "")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "ftyp" || w.Header().Get("Content-Type") != "video/mp4" {
+		t.Fatalf("got status %d, headers %v", w.Code, w.Header())
+	}
+	ta.expect(ta.do("GET", "/media/unknown.mp4", nil, ""), http.StatusNotFound, nil)
+	ta.expect(ta.do("GET", "/picture/"+info.Id, nil, ""), http.StatusNotFound, nil)
+	//图片仍然最大 10 MiB
+	big := append(append([]byte{}, data...), make([]byte, picture.MaxSize)...)
+	w = ta.tus("POST", "/picture/uploads", map[string]string{"Upload-Length": strconv.Itoa(len(big))}, nil, merchant)
+	ta.expect(ta.tus("PATCH", w.Header().Get("Location"), at(0), big, merchant), http.StatusRequestEntityTooLarge, nil)
+
+	//放弃的上传
+	w = ta.tus("POST", "/picture/uploads", map[string]string{"Upload-Length": length}, nil, merchant)
+	abandoned := w.Header().Get("Location")
+	ta.expect(ta.tus("DELETE", abandoned, nil, nil, other), http.StatusNotFound, nil)
+	ta.expect(ta.tus("DELETE", abandoned, nil, nil, merchant), http.StatusNoContent, nil)
+	ta.expect(ta.tus("HEAD", abandoned, nil, nil, merchant), http.StatusNotFound, nil)
+	ta.expect(ta.tus("HEAD", "/picture/uploads/../secret", nil, nil, merchant), http.StatusNotFound, nil)
+}
+
+func TestCollectPictures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "picture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { pictureDir = old }(pictureDir)
+	pictureDir = dir
+
+	ta := newTestApp(t)
+	admin := ta.user("root", model.RoleAdmin, "0")
+	merchant := ta.user("shop", model.RoleMerchant, "0")
+	upload := func(w, h int) string {
+		var buf bytes.Buffer
+		png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h)))
+		var info struct {
+			Id string `json:"imageId"`
+		}
+		ta.expect(ta.upload(buf.Bytes(), "a.png", merchant), http.StatusCreated, &info)
+		old := time.Now().Add(-30 * 24 * time.Hour)
+		os.Chtimes(filepath.Join(dir, info.Id), old, old)
+		return info.Id
+	}
+	cover, variant, orphan, byURL, byFullURL := upload(3, 2), upload(4, 2), upload(5, 2), upload(6, 2), upload(7, 2)
+	//旧商品的 picture 和变体的图片也算引用
+	ioutil.WriteFile(filepath.Join(dir, "legacy.jpg"), []byte("legacy"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "side view.png"), []byte("legacy"), 0644)
+	ta.mem.PostCommodity(context.Background(), &model.Commodity{Name: "Old", Picture: "legacy.jpg"})
+	//picture 可以是图片的 URL：表单中的 URL 保存为 id，已经保存的 URL 在收集时换成 id
+	var c model.Commodity
+	form := url.Values{"name": {"Cup"}, "price": {"3"}, "picture": {"/picture/" + byURL}}
+	ta.expect(ta.do("POST", "/commodities", form, merchant), http.StatusCreated, &c)
+	if stored, _ := ta.mem.GetOneCommodity(context.Background(), c.Id); stored.Picture != byURL {
+		t.Fatalf("picture stored as %q", stored.Picture)
+	}
+	ta.mem.PostCommodity(context.Background(), &model.Commodity{Name: "Full", Picture: "https://shop.example/picture/" + byFullURL + "?w=320"})
+	ta.mem.PostCommodity(context.Background(), &model.Commodity{Name: "Escaped", Picture: "/picture/side%20view.png"})
+	tea := ta.commodity(merchant, "Tea", "10", "1")
+	ta.expect(ta.do("POST", "/commodities/"+tea.Id+"/images", url.Values{"image": {cover}}, merchant), http.StatusCreated, nil)
+	variants := `[{"options":{"size":"big"},"price":12,"images":["` + variant + `"]}]`
+	ta.expect(ta.do("PUT", "/commodities/"+tea.Id+"/variants", url.Values{"variants": {variants}}, merchant), http.StatusOK, nil)
+
+	ta.expect(ta.do("GET", "/admin/pictures", nil, merchant), http.StatusForbidden, nil)
+	var usage picture.Usage
+	ta.expect(ta.do("GET", "/admin/pictures", nil, admin), http.StatusOK, &usage)
+	if usage.Pictures != 7 || usage.Referenced != 6 || len(usage.Orphans) != 1 || usage.Orphans[0].Id != orphan || !usage.Orphans[0].Collectable || usage.Deleted != 0 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+	ta.expect(ta.do("POST", "/admin/pictures/gc", url.Values{"dryRun": {"true"}}, admin), http.StatusOK, &usage)
+	if usage.Deleted != 0 || !usage.DryRun {
+		t.Fatalf("dry run deleted %+v", usage)
+	}
+	ta.expect(ta.do("POST", "/admin/pictures/gc", url.Values{"grace": {"soon"}}, admin), http.StatusBadRequest, nil)
+	ta.expect(ta.do("POST", "/admin/pictures/gc", url.Values{"dryRun": {"maybe"}}, admin), http.StatusBadRequest, nil)
+	//宽限期内的不删除
+	ta.expect(ta.do("POST", "/admin/pictures/gc", url.Values{"grace": {"1000h"}}, admin), http.StatusOK, &usage)
+	if usage.Deleted != 0 {
+		t.Fatalf("deleted within the grace period %+v", usage)
+	}
+	ta.expect(ta.do("POST", "/admin/pictures/gc", nil, admin), http.StatusOK, &usage)
+	if usage.Deleted != 1 || usage.Grace != "168h0m0s" {
+		t.Fatalf("unexpected collection %+v", usage)
+	}
+	ta.expect(ta.do("GET", "/picture/"+orphan, nil, ""), http.StatusNotFound, nil)
+	for _, id := range []string{cover, variant, byURL, byFullURL, "legacy.jpg", "side%20view.png"} {
+		ta.expect(ta.do("GET", "/picture/"+id, nil, ""), http.StatusOK, nil)
+	}
+}
+
+// linkBlobs is a local storage handing out links like a storage with pre-signed links
+type linkBlobs struct {
+	*picture.Local
+}
+
+func (l linkBlobs) URL(name string) (string, error) {
+	return "https://storage.example/" + name + "?signature=x", nil
+}
+
+func TestPictureLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "picture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keys, _ := auth.NewHS256KeySet("test", nil)
+	mem := db.NewMemory()
+	ta := &testApp{t: t, app: NewApp(mem, keys, false, 0, linkBlobs{picture.NewLocal(dir)}, picture.NewUploads(filepath.Join(dir, ".uploads"), testMediaSize, time.Hour)), mem: mem}
+	merchant := ta.user("shop", model.RoleMerchant, "0")
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 300, 200)))
+	var info struct {
+		Id  string `json:"imageId"`
+		URL string `json:"url"`
+	}
+	ta.expect(ta.upload(buf.Bytes(), "a.png", merchant), http.StatusCreated, &info)
+	//接口返回的地址不变，读取时重定向到存储的链接
+	if info.URL != "/picture/"+info.Id {
+		t.Fatalf("unexpected url %s", info.URL)
+	}
+	w := ta.do("GET", info.URL, nil, "")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://storage.example/"+info.Id+"?signature=x" {
+		t.Fatalf("got status %d, location %q", w.Code, w.Header().Get("Location"))
+	}
+	//变体先生成再重定向
+	w = ta.do("GET", info.URL+"?preset=thumb", nil, "")
+	if w.Code != http.StatusFound || !strings.HasPrefix(w.Header().Get("Location"), "https://storage.example/.cache/160/") {
+		t.Fatalf("got status %d, location %q", w.Code, w.Header().Get("Location"))
+	}
+	ta.expect(ta.do("GET", "/picture/missing.png", nil, ""), http.StatusNotFound, nil)
+}
+
+// slowDB is a database that does not answer before the request times out
+type slowDB struct {
+	*db.Memory
+}
+
+func (s slowDB) GetCommodityBySlug(ctx context.Context, slug string) (*model.Commodity, error) {
+	<-ctx.Done()
+	return nil, db.Unavailable(ctx.Err())
+}
+
+func TestErrorStatus(t *testing.T) {
+	ta := newTestApp(t)
+	merchant := ta.user("shop", model.RoleMerchant, "0")
+	alice := ta.user("alice", model.RoleCustomer, "0")
+	tea := ta.commodity(merchant, "Tea", "10", "1")
+
+	//参数不合法是400，不存在是404，冲突是409
+	ta.expect(ta.do("POST", "/commodities", url.Values{"name": {"Tea"}, "price": {"-1"}}, merchant), http.StatusBadRequest, nil)
+	ta.expect(ta.do("POST", "/commodities/"+tea.Id+"/comments", url.Values{"comment": {""}}, alice), http.StatusBadRequest, nil)
+	ta.expect(ta.do("GET", "/commodities/"+tea.Id+"/comments/unknown", nil, ""), http.StatusNotFound, nil)
+	ta.expect(ta.do("POST", "/users/register", url.Values{"username": {"alice"}, "password": {"x"}}, ""), http.StatusConflict, nil)
+}
 
-	app.GetTechnologies(w, r)
+func TestTimeout(t *testing.T) {
+	ta := newTestApp(t)
+	merchant := ta.user("shop", model.RoleMerchant, "0")
+	tea := ta.commodity(merchant, "Tea", "10", "1")
 
-	if w.Code != http.StatusInternalServerError {
-		t.Errorf("handler returned wrong status code: got %v want %v", w.Code, http.StatusOK)
+	//数据库超时是503，客户端可以重试
+	keys, _ := auth.NewHS256KeySet("test", nil)
+	slow := &testApp{t: t, app: NewApp(slowDB{ta.mem}, keys, false, 20*time.Millisecond, picture.NewLocal(pictureDir), picture.NewUploads(filepath.Join(pictureDir, ".uploads"), testMediaSize, time.Hour)), mem: ta.mem}
+	w := slow.do("GET", "/commodities/by-slug/tea", nil, "")
+	slow.expect(w, http.StatusServiceUnavailable, nil)
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatal("503 without Retry-After")
 	}
+	slow.expect(slow.do("GET", "/commodities/"+tea.Id, nil, ""), http.StatusOK, nil)
 }
@@ -0,0 +1,156 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+	"webapp/auth"
+	"webapp/db"
+	"webapp/model"
+)
+
+// RefreshToken exchange a refresh token (form value refresh_token) for a new access token and a new refresh token.
+// A refresh token can be used only once: using it again means it was stolen, and the whole family is revoked.
+func (a *App) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	id := auth.RefreshTokenID(r.PostFormValue("refresh_token"))
+	token, err := a.d.GetAToken(r.Context(), id)
+	if errors.Is(err, db.ErrTokenNotFound) {
+		sendErr(w, http.StatusUnauthorized, "invalid refresh token")
+		return
+	}
+	if err != nil {
+		sendDBErr(w, err)
+		return
+	}
+	if token.Revoked || time.Now().After(token.ExpiresAt) {
+		sendErr(w, http.StatusUnauthorized, "refresh token expired or revoked")
+		return
+	}
+	//UseToken只会成功一次，同一个token并发刷新时只有一个请求能拿到新token
+	if err := a.d.UseToken(r.Context(), id); err != nil {
+		if errors.Is(err, db.ErrTokenReused) {
+			log.Println("Refresh token reused, revoking family of", token.Username)
+			if err := a.d.RevokeTokenFamily(r.Context(), token.Family); err != nil {
+				sendDBErr(w, err)
+				return
+			}
+			sendErr(w, http.StatusUnauthorized, "refresh token already used")
+			return
+		}
+		sendDBErr(w, err)
+		return
+	}
+	//角色可能已经被管理员修改，以数据库中的为准
+	user, err := a.d.GetUser(r.Context(), token.Username)
+	if errors.Is(err, db.ErrUserNotFound) {
+		sendErr(w, http.StatusUnauthorized, "user no longer exists")
+		return
+	}
+	if err != nil {
+		sendDBErr(w, err)
+		return
+	}
+	a.writeTokens(w, r, user.Username, user.Role, token.Family)
+}
+
+// Logout revoke the family of the refresh token (form value refresh_token) and,
+// when the request carries an access token, put it in the revocation list
+func (a *App) Logout(w http.ResponseWriter, r *http.Request) {
+	if refresh := r.PostFormValue("refresh_token"); refresh != "" {
+		token, err := a.d.GetAToken(r.Context(), auth.RefreshTokenID(refresh))
+		if err == nil {
+			err = a.d.RevokeTokenFamily(r.Context(), token.Family)
+		}
+		if err != nil && !errors.Is(err, db.ErrTokenNotFound) {
+			sendDBErr(w, err)
+			return
+		}
+	}
+	if id := identityFrom(r); id != nil {
+		if err := a.d.RevokeAccessToken(r.Context(), id.TokenId, time.Unix(id.ExpiresAt, 0)); err != nil {
+			sendDBErr(w, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeTokens issue an access token and a refresh token for username and write them to the response,
+// family is the refresh token family to continue, a new family is started when it is empty (login)
+func (a *App) writeTokens(w http.ResponseWriter, r *http.Request, username string, role string, family string) {
+	var err error
+	if family == "" {
+		if family, err = auth.NewFamily(); err != nil {
+			sendErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	tokenStr, claims, err := a.keys.IssueAccessToken(username, role)
+	if err != nil {
+		sendErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	refresh, id, err := auth.NewRefreshToken()
+	if err != nil {
+		sendErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	now := time.Now()
+	err = a.d.AddToken(r.Context(), &model.RefreshToken{
+		Id:        id,
+		Family:    family,
+		Username:  username,
+		CreatedAt: now,
+		ExpiresAt: now.Add(auth.RefreshTokenTTL),
+	})
+	if err != nil {
+		sendDBErr(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	//生成结构体Token,包括用户名和token字符串，写进response
+	err = json.NewEncoder(w).Encode(model.Token{
+		Username:     username,
+		TokenStr:     tokenStr,
+		ExpiresIn:    claims.ExpiresAt - claims.IssuedAt,
+		RefreshToken: refresh,
+	})
+	if err != nil {
+		log.Println("Error while writing tokens:", err)
+	}
+}
+
+// SetUserRole change the role of a user (form value role), only admins are allowed.
+// The new role shows up in the user's tokens after their next refresh.
+func (a *App) SetUserRole(w http.ResponseWriter, r *http.Request) {
+	username := pathParam(r, "user")
+	role := r.FormValue("role")
+	if role != model.RoleCustomer && role != model.RoleMerchant && role != model.RoleAdmin {
+		sendErr(w, http.StatusBadRequest, "role must be customer, merchant or admin")
+		return
+	}
+	if err := a.d.SetUserRole(r.Context(), username, role); err != nil {
+		sendDBErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetBalance change the balance of a user (form value balance, not negative), only admins are allowed
+func (a *App) SetBalance(w http.ResponseWriter, r *http.Request) {
+	balance, err := strconv.ParseFloat(r.FormValue("balance"), 64)
+	if err != nil || balance < 0 || math.IsInf(balance, 0) || math.IsNaN(balance) {
+		sendErr(w, http.StatusBadRequest, "balance must be a number not less than 0")
+		return
+	}
+	if err := a.d.SetBalance(r.Context(), pathParam(r, "user"), balance); err != nil {
+		sendDBErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,168 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"webapp/db"
+	"webapp/model"
+)
+
+// GetAUserCart get the cart of a user priced from the current catalog
+// 该Api需要token认证，只能访问自己的购物车
+func (a *App) GetAUserCart(w http.ResponseWriter, r *http.Request) {
+	username := pathParam(r, "user")
+	if !checkUser(w, r, username) {
+		return
+	}
+	cart, err := a.d.GetCart(r.Context(), username)
+	if err != nil {
+		sendCartErr(w, err)
+		return
+	}
+	a.writePricedCart(w, r, cart)
+}
+
+// WriteCart replace all the lines of the cart (form value lines, a json list of model.CartLine)
+func (a *App) WriteCart(w http.ResponseWriter, r *http.Request) {
+	username := pathParam(r, "user")
+	if !checkUser(w, r, username) {
+		return
+	}
+	var lines []model.CartLine
+	if err := json.Unmarshal([]byte(r.FormValue("lines")), &lines); err != nil {
+		sendErr(w, http.StatusBadRequest, "lines must be a json list of {commodityId, sku, quantity}")
+		return
+	}
+	cart := &model.Cart{Username: username, Lines: mergeLines(lines)}
+	for _, l := range cart.Lines {
+		if l.CommodityId == "" || l.Quantity <= 0 {
+			sendErr(w, http.StatusBadRequest, "every line needs a commodityId and a positive quantity")
+			return
+		}
+	}
+	//购物车中的商品数量不能超过库存
+	if err := a.checkStock(r.Context(), cart.Lines); err != nil {
+		sendCartErr(w, err)
+		return
+	}
+	if err := a.d.WriteCart(r.Context(), cart); err != nil {
+		sendDBErr(w, err)
+		return
+	}
+	a.writePricedCart(w, r, cart)
+}
+
+// AddCartLine add a commodity to the cart (form values commodityId, sku, quantity), quantities are summed.
+// A commodity with variants needs the sku of one of them
+func (a *App) AddCartLine(w http.ResponseWriter, r *http.Request) {
+	username := pathParam(r, "user")
+	if !checkUser(w, r, username) {
+		return
+	}
+	line, ok := parseLine(w, r, r.FormValue("commodityId"), 1)
+	if !ok {
+		return
+	}
+	cart, err := a.d.GetCart(r.Context(), username)
+	if err == nil {
+		err = a.checkStock(r.Context(), mergeLines(append(cart.Lines, line)))
+	}
+	if err == nil {
+		cart, err = a.d.AddCartLine(r.Context(), username, line)
+	}
+	if err != nil {
+		sendCartErr(w, err)
+		return
+	}
+	a.writePricedCart(w, r, cart)
+}
+
+// SetCartLine change the quantity of a commodity in the cart (form values sku, quantity, 0 removes it)
+func (a *App) SetCartLine(w http.ResponseWriter, r *http.Request) {
+	username := pathParam(r, "user")
+	if !checkUser(w, r, username) {
+		return
+	}
+	line, ok := parseLine(w, r, pathParam(r, "id"), -1)
+	if !ok {
+		return
+	}
+	var err error
+	if line.Quantity > 0 {
+		err = a.checkStock(r.Context(), []model.CartLine{line})
+	}
+	var cart *model.Cart
+	if err == nil {
+		cart, err = a.d.SetCartLine(r.Context(), username, line)
+	}
+	if err != nil {
+		sendCartErr(w, err)
+		return
+	}
+	a.writePricedCart(w, r, cart)
+}
+
+// RemoveCartLine remove a commodity from the cart, the sku query value picks one of its variants
+func (a *App) RemoveCartLine(w http.ResponseWriter, r *http.Request) {
+	username := pathParam(r, "user")
+	if !checkUser(w, r, username) {
+		return
+	}
+	cart, err := a.d.RemoveCartLine(r.Context(), username, pathParam(r, "id"), r.FormValue("sku"))
+	if err != nil {
+		sendCartErr(w, err)
+		return
+	}
+	a.writePricedCart(w, r, cart)
+}
+
+// writePricedCart write the cart with every line re-priced from the catalog
+func (a *App) writePricedCart(w http.ResponseWriter, r *http.Request, cart *model.Cart) {
+	lines, total, err := db.PriceLines(cart.Lines, func(id string) (*model.Commodity, error) {
+		return a.d.GetOneCommodity(r.Context(), id)
+	})
+	if err != nil {
+		sendDBErr(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(model.PricedCart{Username: cart.Username, Lines: lines, Total: total})
+	if err != nil {
+		sendErr(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// parseLine read the sku and quantity form values of a cart line, def is used when the form has no quantity (-1: required)
+func parseLine(w http.ResponseWriter, r *http.Request, commodityId string, def int) (model.CartLine, bool) {
+	line := model.CartLine{CommodityId: commodityId, Sku: r.FormValue("sku"), Quantity: def}
+	if q := r.FormValue("quantity"); q != "" || def < 0 {
+		n, err := strconv.Atoi(q)
+		if err != nil || n < 0 || (n == 0 && r.Method == "POST") {
+			sendErr(w, http.StatusBadRequest, "quantity must be a positive integer")
+			return line, false
+		}
+		line.Quantity = n
+	}
+	if line.CommodityId == "" {
+		sendErr(w, http.StatusBadRequest, "commodityId is required")
+		return line, false
+	}
+	return line, true
+}
+
+// mergeLines sum the quantities of lines for the same commodity and variant
+func mergeLines(lines []model.CartLine) []model.CartLine {
+	type key struct{ id, sku string }
+	merged := make([]model.CartLine, 0, len(lines))
+	index := make(map[key]int)
+	for _, l := range lines {
+		if i, ok := index[key{l.CommodityId, l.Sku}]; ok {
+			merged[i].Quantity += l.Quantity
+			continue
+		}
+		index[key{l.CommodityId, l.Sku}] = len(merged)
+		merged = append(merged, l)
+	}
+	return merged
+}
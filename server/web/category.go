@@ -0,0 +1,131 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"webapp/db"
+	"webapp/model"
+)
+
+// categoryNode is a category with its subcategories, the form of the category tree sent to clients
+type categoryNode struct {
+	*model.Category
+	Children []*categoryNode `json:"children"`
+}
+
+// categoryTree build the tree of a flat list of categories, the roots are returned with the node of every category
+func categoryTree(categories []*model.Category) ([]*categoryNode, map[string]*categoryNode) {
+	nodes := make(map[string]*categoryNode)
+	for _, c := range categories {
+		nodes[c.Id] = &categoryNode{Category: c, Children: []*categoryNode{}}
+	}
+	roots := []*categoryNode{}
+	//列表已经按名字排序，子分类也按名字排列
+	for _, c := range categories {
+		if parent, ok := nodes[c.Parent]; ok {
+			parent.Children = append(parent.Children, nodes[c.Id])
+		} else {
+			roots = append(roots, nodes[c.Id])
+		}
+	}
+	return roots, nodes
+}
+
+// GetCategories get the category tree
+func (a *App) GetCategories(w http.ResponseWriter, r *http.Request) {
+	categories, err := a.d.ListCategories(r.Context())
+	if err != nil {
+		sendDBErr(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	roots, _ := categoryTree(categories)
+	json.NewEncoder(w).Encode(roots)
+}
+
+// GetCategory get a category with its subcategories and the path from the root category down to it
+func (a *App) GetCategory(w http.ResponseWriter, r *http.Request) {
+	categories, err := a.d.ListCategories(r.Context())
+	if err != nil {
+		sendDBErr(w, err)
+		return
+	}
+	_, nodes := categoryTree(categories)
+	node, ok := nodes[pathParam(r, "id")]
+	if !ok {
+		sendDBErr(w, db.ErrCategoryNotFound)
+		return
+	}
+	//面包屑：从根分类到上级分类
+	path := []*model.Category{}
+	for p, ok := nodes[node.Parent]; ok; p, ok = nodes[p.Parent] {
+		path = append([]*model.Category{p.Category}, path...)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		*categoryNode
+		Path []*model.Category `json:"path"`
+	}{node, path})
+}
+
+// PostCategory add a category from the form values name and parentId, its id is made from the name
+func (a *App) PostCategory(w http.ResponseWriter, r *http.Request) {
+	category := model.Category{Name: strings.TrimSpace(r.FormValue("name")), Parent: r.FormValue("parentId")}
+	if err := a.d.WriteCategory(r.Context(), &category); err != nil {
+		sendDBErr(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(category)
+}
+
+// UpdateCategory rename a category or move it below another one (form values name and parentId), its id never changes
+func (a *App) UpdateCategory(w http.ResponseWriter, r *http.Request) {
+	category := model.Category{Id: pathParam(r, "id"), Name: strings.TrimSpace(r.FormValue("name")), Parent: r.FormValue("parentId")}
+	if err := a.d.WriteCategory(r.Context(), &category); err != nil {
+		sendDBErr(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(category)
+}
+
+// DeleteCategory delete a category without subcategories and commodities
+func (a *App) DeleteCategory(w http.ResponseWriter, r *http.Request) {
+	if err := a.d.DeleteCategory(r.Context(), pathParam(r, "id")); err != nil {
+		sendDBErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkCategory make sure the category given to a commodity exists
+func (a *App) checkCategory(w http.ResponseWriter, r *http.Request, id string) bool {
+	if id == "" {
+		return true
+	}
+	_, err := a.d.GetCategory(r.Context(), id)
+	if errors.Is(err, db.ErrCategoryNotFound) {
+		sendErr(w, http.StatusBadRequest, "category "+id+" does not exist")
+		return false
+	}
+	if err != nil {
+		sendDBErr(w, err)
+		return false
+	}
+	return true
+}
+
+// splitList split a comma separated form value, the items are trimmed and empty ones dropped
+func splitList(v string) []string {
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
@@ -0,0 +1,86 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"webapp/db"
+	"webapp/picture"
+)
+
+// errStatus map an error of db to an http status code by its kind
+func errStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrInsufficientBalance):
+		return http.StatusPaymentRequired
+	case errors.Is(err, db.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, db.ErrInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, db.ErrUnavailable), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// sendDBErr write the error of a db call with the status of its kind
+func sendDBErr(w http.ResponseWriter, err error) {
+	status := errStatus(err)
+	switch status {
+	case http.StatusInternalServerError:
+		log.Println("Database error:", err)
+	case http.StatusServiceUnavailable:
+		//数据库超时或连不上，客户端可以稍后重试
+		w.Header().Set("Retry-After", "1")
+	}
+	sendErr(w, status, err.Error())
+}
+
+// sendCartErr is sendDBErr for carts and checkout: a commodity of the cart that no longer exists
+// is a conflict with the cart, not a missing resource
+func sendCartErr(w http.ResponseWriter, err error) {
+	var gone *db.CommodityGoneError
+	if errors.As(err, &gone) {
+		sendErr(w, http.StatusConflict, err.Error())
+		return
+	}
+	sendDBErr(w, err)
+}
+
+// sendPictureErr write the error of an upload: a picture or video too large, of another type or that cannot be decoded
+func sendPictureErr(w http.ResponseWriter, err error) {
+	switch err {
+	case picture.ErrTooLarge, picture.ErrTooManyPixels, picture.ErrMediaTooLarge:
+		sendErr(w, http.StatusRequestEntityTooLarge, err.Error())
+	case picture.ErrUnsupported, picture.ErrUnsupportedMedia:
+		sendErr(w, http.StatusUnsupportedMediaType, err.Error())
+	case picture.ErrCorrupt:
+		sendErr(w, http.StatusBadRequest, err.Error())
+	default:
+		log.Println("Error while saving a picture:", err)
+		sendErr(w, http.StatusInternalServerError, "cannot save the picture")
+	}
+}
+
+// sendUploadErr write the error of a resumable upload
+func sendUploadErr(w http.ResponseWriter, err error) {
+	switch {
+	case err == picture.ErrLength:
+		sendErr(w, http.StatusBadRequest, err.Error())
+	case err == picture.ErrOffset:
+		sendErr(w, http.StatusConflict, err.Error())
+	case err == picture.ErrUploadBusy:
+		sendErr(w, http.StatusLocked, err.Error())
+	case err == picture.ErrUploadTooLarge:
+		sendErr(w, http.StatusRequestEntityTooLarge, err.Error())
+	case os.IsNotExist(err):
+		sendErr(w, http.StatusNotFound, "upload not found")
+	default:
+		log.Println("Error while receiving an upload:", err)
+		sendErr(w, http.StatusInternalServerError, "cannot receive the upload")
+	}
+}
@@ -0,0 +1,113 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+	"webapp/db"
+	"webapp/picture"
+)
+
+// pictureReferences give the pictures used by the commodities: their cover, their images and the images of their variants.
+// References saved as URLs count for the picture they point to
+func pictureReferences(ctx context.Context, d db.DB) (map[string]bool, error) {
+	refs := make(map[string]bool)
+	q := db.CommodityQuery{Limit: db.MaxLimit}
+	for {
+		page, err := d.ListCommodities(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range page.Commodities {
+			refs[pictureID(c.Picture)] = true
+			for _, img := range c.Images {
+				refs[pictureID(img.Id)] = true
+			}
+			for _, v := range c.Variants {
+				for _, id := range v.Images {
+					refs[pictureID(id)] = true
+				}
+			}
+		}
+		if page.Next == "" {
+			return refs, nil
+		}
+		q.Cursor = page.Next
+	}
+}
+
+// CollectPictures find the pictures no commodity uses and delete those older than grace, see picture.Store.Collect
+func (a *App) CollectPictures(ctx context.Context, grace time.Duration, dryRun bool) (*picture.Usage, error) {
+	refs, err := pictureReferences(ctx, a.d)
+	if err != nil {
+		return nil, err
+	}
+	return a.pictures.Collect(ctx, refs, grace, dryRun)
+}
+
+// RunPictureGC collect the orphaned pictures every interval until ctx is done
+func (a *App) RunPictureGC(ctx context.Context, interval, grace time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		usage, err := a.CollectPictures(ctx, grace, false)
+		if err != nil {
+			log.Println("Cannot collect the orphaned pictures:", err)
+			continue
+		}
+		log.Println("Deleted", usage.Deleted, "orphaned pictures,", usage.DeletedBytes, "bytes;",
+			usage.Pictures-usage.Deleted, "pictures left,", usage.Bytes-usage.DeletedBytes, "bytes")
+	}
+}
+
+// PictureUsage report the storage used by the pictures and the orphaned pictures, nothing is deleted.
+// The orphans older than the query value grace (a duration, 7 days by default) are marked collectable
+func (a *App) PictureUsage(w http.ResponseWriter, r *http.Request) {
+	a.collectPictures(w, r, true)
+}
+
+// CollectOrphans delete the orphaned pictures older than the form value grace (a duration, 7 days by default)
+// and report the storage used; with dryRun true nothing is deleted
+func (a *App) CollectOrphans(w http.ResponseWriter, r *http.Request) {
+	dryRun, ok := boolParam(w, r, "dryRun")
+	if !ok {
+		return
+	}
+	a.collectPictures(w, r, dryRun)
+}
+
+func (a *App) collectPictures(w http.ResponseWriter, r *http.Request, dryRun bool) {
+	grace := picture.DefaultGrace
+	if v := r.FormValue("grace"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			sendErr(w, http.StatusBadRequest, "grace must be a duration such as 72h")
+			return
+		}
+		grace = d
+	}
+	refs, err := pictureReferences(r.Context(), a.d)
+	if err != nil {
+		sendDBErr(w, err)
+		return
+	}
+	usage, err := a.pictures.Collect(r.Context(), refs, grace, dryRun)
+	if err == picture.ErrCollecting {
+		sendErr(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Cannot collect the orphaned pictures:", err)
+		sendErr(w, http.StatusInternalServerError, "cannot collect the orphaned pictures")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
@@ -0,0 +1,345 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"webapp/db"
+	"webapp/model"
+	"webapp/picture"
+)
+
+// pictureURL give the URL of an uploaded picture. Pictures saved before the image list may already be URLs
+func pictureURL(id string) string {
+	if id == "" || strings.HasPrefix(id, "/") || strings.Contains(id, "://") {
+		return id
+	}
+	return "/picture/" + url.PathEscape(id)
+}
+
+// pictureID give the id of a reference to an uploaded picture: the id itself or its URL, /picture/<id> with
+// or without a scheme and host. References to other places are returned unchanged
+func pictureID(ref string) string {
+	p := ref
+	if strings.Contains(ref, "://") {
+		u, err := url.Parse(ref)
+		if err != nil {
+			return ref
+		}
+		p = u.EscapedPath()
+	} else if i := strings.IndexAny(p, "?#"); i >= 0 {
+		p = p[:i]
+	}
+	if !strings.HasPrefix(p, "/picture/") {
+		return ref
+	}
+	id, err := url.PathUnescape(strings.TrimPrefix(p, "/picture/"))
+	if err != nil || id == "" {
+		return ref
+	}
+	return id
+}
+
+// uploadOverhead is the room left for the multipart headers around an uploaded picture
+const uploadOverhead = 64 << 10
+
+// UploadPicture store the picture uploaded as the multipart file image, a JPEG, PNG, WebP or GIF image of at most 10 MiB.
+// It is saved under a name made from the hash of its content whatever the name of the uploaded file,
+// the answer describes it: 201 for a new picture, 200 when the same picture was already uploaded
+func (a *App) UploadPicture(w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength > picture.MaxSize+uploadOverhead {
+		sendPictureErr(w, picture.ErrTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, picture.MaxSize+uploadOverhead)
+	f, _, err := r.FormFile("image")
+	if err != nil {
+		sendErr(w, http.StatusBadRequest, "image must be a multipart file of at most 10 MiB")
+		return
+	}
+	defer f.Close()
+	data, err := picture.Read(f)
+	var info *picture.Info
+	created := false
+	if err == nil {
+		info, created, err = a.pictures.Save(r.Context(), data)
+	}
+	if err != nil {
+		sendPictureErr(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(struct {
+		*picture.Info
+		URL string `json:"url"`
+	}{info, pictureURL(info.Id)})
+}
+
+// ServePicture serve an uploaded picture. With the query value w (a width in pixels) or preset (thumb, list or detail)
+// a resized variant is served instead, see picture.Variants. When the storage hands out links (S3 with a link expiry)
+// the client is redirected to a time-limited link of the storage
+func (a *App) ServePicture(w http.ResponseWriter, r *http.Request) {
+	width, ok := variantWidth(w, r)
+	if !ok {
+		return
+	}
+	id := pathParam(r, "file")
+	name, err := a.locatePicture(r.Context(), id, width)
+	link := ""
+	if err == nil {
+		link, err = a.pictures.Blobs().URL(name)
+	}
+	if err == nil && link != "" {
+		http.Redirect(w, r, link, http.StatusFound)
+		return
+	}
+	var obj *picture.Object
+	if err == nil {
+		obj, err = a.pictures.Blobs().Get(r.Context(), name)
+	}
+	if os.IsNotExist(err) {
+		sendErr(w, http.StatusNotFound, "picture not found")
+		return
+	}
+	if err != nil {
+		log.Println("Cannot serve picture", id, err)
+		sendErr(w, http.StatusInternalServerError, "cannot serve the picture")
+		return
+	}
+	defer obj.Close()
+	//图片的名字由内容决定，上传不会覆盖已有的图片
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(w, r, path.Base(name), obj.ModTime, obj)
+}
+
+// mediaURL give the URL of an uploaded video
+func mediaURL(id string) string {
+	return "/media/" + url.PathEscape(id)
+}
+
+// ServeMedia serve a video uploaded through /picture/uploads, ranges are supported so that players can seek.
+// Like for the pictures the client is redirected to a time-limited link when the storage hands them out
+func (a *App) ServeMedia(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "file")
+	name := a.media.Name(id)
+	var err error = os.ErrNotExist
+	link := ""
+	if name != "" {
+		link, err = a.pictures.Blobs().URL(name)
+	}
+	if err == nil && link != "" {
+		http.Redirect(w, r, link, http.StatusFound)
+		return
+	}
+	var obj *picture.Object
+	if err == nil {
+		obj, err = a.pictures.Blobs().Get(r.Context(), name)
+	}
+	if os.IsNotExist(err) {
+		sendErr(w, http.StatusNotFound, "video not found")
+		return
+	}
+	if err != nil {
+		log.Println("Cannot serve video", id, err)
+		sendErr(w, http.StatusInternalServerError, "cannot serve the video")
+		return
+	}
+	defer obj.Close()
+	//视频的名字由内容决定，同样可以一直缓存
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(w, r, path.Base(name), obj.ModTime, obj)
+}
+
+// locatePicture give the name of the blob of picture id, or of its variant at width when width is not 0
+func (a *App) locatePicture(ctx context.Context, id string, width int) (string, error) {
+	if width != 0 {
+		return a.variants.Locate(ctx, id, width)
+	}
+	exists, err := a.pictures.Exists(ctx, id)
+	if err == nil && !exists {
+		err = os.ErrNotExist
+	}
+	return id, err
+}
+
+// variantWidth read the width of the variant asked by the query values preset or w, 0 for the picture itself
+func variantWidth(w http.ResponseWriter, r *http.Request) (int, bool) {
+	if preset := r.FormValue("preset"); preset != "" {
+		width, ok := picture.Presets[preset]
+		if !ok {
+			sendErr(w, http.StatusBadRequest, "preset must be thumb, list or detail")
+		}
+		return width, ok
+	}
+	v := r.FormValue("w")
+	if v == "" {
+		return 0, true
+	}
+	n, err := strconv.Atoi(v)
+	if err == nil {
+		n, err = picture.VariantWidth(n)
+	}
+	if err != nil {
+		sendErr(w, http.StatusBadRequest, picture.ErrWidth.Error())
+		return 0, false
+	}
+	return n, true
+}
+
+// imagesOf give a copy of the images of a commodity, a commodity saved with only a picture has it as its single image
+func imagesOf(c *model.Commodity) []model.Image {
+	if len(c.Images) == 0 && c.Picture != "" {
+		return []model.Image{{Id: c.Picture}}
+	}
+	return append([]model.Image{}, c.Images...)
+}
+
+// withImageURLs give a copy of a commodity to send to clients: every image and the cover get their URL
+func withImageURLs(c *model.Commodity) *model.Commodity {
+	if c == nil {
+		return nil
+	}
+	cp := *c
+	cp.Images = imagesOf(c)
+	for i := range cp.Images {
+		cp.Images[i].URL = pictureURL(cp.Images[i].Id)
+	}
+	cp.Picture = pictureURL(c.Picture)
+	return &cp
+}
+
+// findImage give the position of the image id in images, -1 when it is not there
+func findImage(images []model.Image, id string) int {
+	for i, img := range images {
+		if img.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// AttachImage attach a picture uploaded through /picture/upload to a commodity (form values image, alt and cover).
+// The image is added last, or first when cover is true
+func (a *App) AttachImage(w http.ResponseWriter, r *http.Request) {
+	cover, ok := boolParam(w, r, "cover")
+	if !ok {
+		return
+	}
+	id := r.FormValue("image")
+	exists, err := a.pictures.Exists(r.Context(), id)
+	if err != nil {
+		log.Println("Cannot check picture", id, err)
+		sendErr(w, http.StatusInternalServerError, "cannot check the picture")
+		return
+	}
+	if !exists {
+		sendErr(w, http.StatusBadRequest, "image must be a picture uploaded through /picture/upload")
+		return
+	}
+	a.editImages(w, r, http.StatusCreated, func(images []model.Image) ([]model.Image, error) {
+		if findImage(images, id) >= 0 {
+			return nil, db.ErrImageAttached
+		}
+		img := model.Image{Id: id, Alt: r.FormValue("alt")}
+		if cover {
+			return append([]model.Image{img}, images...), nil
+		}
+		return append(images, img), nil
+	})
+}
+
+// ReorderImages put the images of a commodity in a new order (form value order, all the image ids separated by commas),
+// the first one becomes the cover
+func (a *App) ReorderImages(w http.ResponseWriter, r *http.Request) {
+	order := splitList(r.FormValue("order"))
+	a.editImages(w, r, http.StatusOK, func(images []model.Image) ([]model.Image, error) {
+		if len(order) != len(images) {
+			return nil, db.ErrImageOrder
+		}
+		sorted := make([]model.Image, 0, len(images))
+		for _, id := range order {
+			i := findImage(images, id)
+			if i < 0 || findImage(sorted, id) >= 0 {
+				return nil, db.ErrImageOrder
+			}
+			sorted = append(sorted, images[i])
+		}
+		return sorted, nil
+	})
+}
+
+// UpdateImage change the alt text of an image (form value alt) or make it the cover (form value cover=true)
+func (a *App) UpdateImage(w http.ResponseWriter, r *http.Request) {
+	cover, ok := boolParam(w, r, "cover")
+	if !ok {
+		return
+	}
+	id := pathParam(r, "image")
+	a.editImages(w, r, http.StatusOK, func(images []model.Image) ([]model.Image, error) {
+		i := findImage(images, id)
+		if i < 0 {
+			return nil, db.ErrImageNotFound
+		}
+		if _, ok := r.Form["alt"]; ok {
+			images[i].Alt = r.FormValue("alt")
+		}
+		if cover {
+			img := images[i]
+			copy(images[1:i+1], images[:i])
+			images[0] = img
+		}
+		return images, nil
+	})
+}
+
+// DetachImage remove an image from a commodity, the uploaded picture itself is kept
+func (a *App) DetachImage(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "image")
+	a.editImages(w, r, http.StatusOK, func(images []model.Image) ([]model.Image, error) {
+		i := findImage(images, id)
+		if i < 0 {
+			return nil, db.ErrImageNotFound
+		}
+		return append(images[:i], images[i+1:]...), nil
+	})
+}
+
+// editAttempts is how many times an edit of the images is tried again when the images change in the meantime
+const editAttempts = 3
+
+// editImages apply edit to the images of the commodity of the request and send the commodity with status code.
+// The images are saved only if nobody changed them since they were read, otherwise the edit is applied again
+// to the new images
+func (a *App) editImages(w http.ResponseWriter, r *http.Request, code int, edit func(images []model.Image) ([]model.Image, error)) {
+	var commodity *model.Commodity
+	var err error = db.ErrImagesChanged
+	for i := 0; i < editAttempts && err == db.ErrImagesChanged; i++ {
+		commodity, err = a.d.GetOneCommodity(r.Context(), pathParam(r, "id"))
+		if err != nil {
+			break
+		}
+		var images []model.Image
+		images, err = edit(imagesOf(commodity))
+		if err == nil {
+			commodity, err = a.d.SetImages(r.Context(), commodity.Id, imagesOf(commodity), images)
+		}
+	}
+	if err != nil {
+		writeCommodity(w, nil, err)
+		return
+	}
+	//封面可能变了
+	a.index.Add(commodity)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(withImageURLs(commodity))
+}
@@ -0,0 +1,147 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"time"
+	"webapp/model"
+
+	"github.com/dgrijalva/jwt-go/request"
+)
+
+// Identity is the caller of a request, taken from its access token
+type Identity struct {
+	Username  string
+	Role      string
+	TokenId   string
+	ExpiresAt int64
+}
+
+type contextKey int
+
+const identityKey contextKey = 0
+
+// authErrorKey keep why the token of a request was refused, the request then goes on as anonymous
+const authErrorKey contextKey = 2
+
+// identityFrom get the caller attached by authenticate, nil for anonymous requests
+func identityFrom(r *http.Request) *Identity {
+	id, _ := r.Context().Value(identityKey).(*Identity)
+	return id
+}
+
+// withTimeout cancel the context of every request after timeout, so that a slow database
+// call returns db.ErrUnavailable (503) instead of holding the connection
+func withTimeout(h http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// authenticate attach the caller identity to the request context when the request carries
+// a valid access token; the access of every route is then checked by the router.
+// A bad, expired or revoked token leaves the request anonymous: public routes (/auth/refresh, /auth/logout...)
+// still work and the other routes answer 401 with the reason the token was refused
+func (a *App) authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tokenStr, err := request.AuthorizationHeaderExtractor.ExtractToken(r); err == nil {
+			claims, err := a.keys.ParseAccessToken(tokenStr)
+			if err != nil { //token签名错误或已经过了有效期
+				h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authErrorKey, "invalid token")))
+				return
+			}
+			revoked, err := a.d.IsAccessTokenRevoked(r.Context(), claims.Id)
+			if err != nil { //无法确认token是否有效，不能当作未登录处理
+				sendDBErr(w, err)
+				return
+			}
+			if revoked { //已经退出登录
+				h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authErrorKey, "token revoked")))
+				return
+			}
+			role := claims.Role
+			if role == "" {
+				role = model.RoleCustomer
+			}
+			id := &Identity{Username: claims.Subject, Role: role, TokenId: claims.Id, ExpiresAt: claims.ExpiresAt}
+			r = r.WithContext(context.WithValue(r.Context(), identityKey, id))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// loginRequired write 401 for an anonymous caller, with the reason its token was refused if it sent one
+func loginRequired(w http.ResponseWriter, r *http.Request) {
+	if msg, ok := r.Context().Value(authErrorKey).(string); ok {
+		sendErr(w, http.StatusUnauthorized, msg)
+		return
+	}
+	sendErr(w, http.StatusUnauthorized, "login required")
+}
+
+// authorize check the caller against the access of a route, 401 or 403 is written to w when it is refused
+func authorize(w http.ResponseWriter, r *http.Request, acc access) bool {
+	if !acc.login {
+		return true
+	}
+	id := identityFrom(r)
+	if id == nil {
+		loginRequired(w, r)
+		return false
+	}
+	if len(acc.roles) == 0 || hasRole(id, acc.roles...) {
+		return true
+	}
+	sendErr(w, http.StatusForbidden, "permission denied")
+	return false
+}
+
+func hasRole(id *Identity, roles ...string) bool {
+	for _, role := range roles {
+		if id.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUser make sure the caller is username, 401 or 403 is written to w when it is not
+func checkUser(w http.ResponseWriter, r *http.Request, username string) bool {
+	id := identityFrom(r)
+	if id == nil {
+		loginRequired(w, r)
+		return false
+	}
+	if id.Username != username { //token属于其他用户
+		sendErr(w, http.StatusForbidden, "token does not belong to "+username)
+		return false
+	}
+	return true
+}
+
+// checkUserOrAdmin make sure the caller is username or an admin, 401 or 403 is written to w when it is not
+func checkUserOrAdmin(w http.ResponseWriter, r *http.Request, username string) bool {
+	if id := identityFrom(r); id != nil && hasRole(id, model.RoleAdmin) {
+		return true
+	}
+	return checkUser(w, r, username)
+}
+
+// checkAuthor make sure the caller wrote the comment or is a moderator (admin)
+func checkAuthor(w http.ResponseWriter, r *http.Request, author string) bool {
+	id := identityFrom(r)
+	if id == nil {
+		loginRequired(w, r)
+		return false
+	}
+	if id.Username != author && !hasRole(id, model.RoleAdmin) {
+		sendErr(w, http.StatusForbidden, "only the author or a moderator can change this comment")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,63 @@
+package web
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Checkout turn the cart of a user into an order
+// 该Api与购物车一样需要token认证
+func (a *App) Checkout(w http.ResponseWriter, r *http.Request) {
+	username := pathParam(r, "user")
+	if !checkUser(w, r, username) {
+		return
+	}
+	order, err := a.d.Checkout(r.Context(), username)
+	if err != nil {
+		sendCartErr(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(order)
+	if err != nil {
+		log.Println("Error while writing an order:", err)
+	}
+}
+
+// GetOrders get all orders of a user
+func (a *App) GetOrders(w http.ResponseWriter, r *http.Request) {
+	username := pathParam(r, "user")
+	if !checkUser(w, r, username) {
+		return
+	}
+	orders, err := a.d.GetOrders(r.Context(), username)
+	if err != nil {
+		sendCartErr(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(orders)
+	if err != nil {
+		sendErr(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// GetOrder get one order of a user
+func (a *App) GetOrder(w http.ResponseWriter, r *http.Request) {
+	username := pathParam(r, "user")
+	if !checkUser(w, r, username) {
+		return
+	}
+	order, err := a.d.GetOrder(r.Context(), username, pathParam(r, "order"))
+	if err != nil {
+		sendCartErr(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(order)
+	if err != nil {
+		sendErr(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,61 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// intParam read an optional non-negative integer query value, 0 when it is missing
+func intParam(w http.ResponseWriter, r *http.Request, name string) (int, bool) {
+	v := r.FormValue(name)
+	if v == "" {
+		return 0, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		sendErr(w, http.StatusBadRequest, name+" must be a non-negative integer")
+		return 0, false
+	}
+	return n, true
+}
+
+// boolParam read an optional boolean query value (true, false, 1, 0), false when it is missing
+func boolParam(w http.ResponseWriter, r *http.Request, name string) (bool, bool) {
+	v := r.FormValue(name)
+	if v == "" {
+		return false, true
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		sendErr(w, http.StatusBadRequest, name+" must be true or false")
+		return false, false
+	}
+	return b, true
+}
+
+// priceParam read an optional price query value, nil when it is missing
+func priceParam(w http.ResponseWriter, r *http.Request, name string) (*float64, bool) {
+	v := r.FormValue(name)
+	if v == "" {
+		return nil, true
+	}
+	p, err := strconv.ParseFloat(v, 64)
+	if err != nil || p < 0 {
+		sendErr(w, http.StatusBadRequest, name+" must be a non-negative number")
+		return nil, false
+	}
+	return &p, true
+}
+
+// setNextLink point the Link header to the next page of a list: the same request with the cursor next,
+// nothing is set on the last page
+func setNextLink(w http.ResponseWriter, r *http.Request, next string) {
+	if next == "" {
+		return
+	}
+	q := r.URL.Query()
+	q.Set("cursor", next)
+	u := *r.URL
+	u.RawQuery = q.Encode()
+	w.Header().Set("Link", "<"+u.RequestURI()+`>; rel="next"`)
+}
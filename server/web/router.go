@@ -0,0 +1,178 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// access say who may call a route
+type access struct {
+	login bool
+	roles []string
+}
+
+var (
+	// public routes can be called without a token
+	public = access{}
+	// loggedIn routes need a valid access token, ownership is checked by the handler
+	loggedIn = access{login: true}
+)
+
+// only restrict a route to the given roles
+func only(roles ...string) access {
+	return access{login: true, roles: roles}
+}
+
+// route is one entry of the routing table. Pattern segments are literals, {name} matching one
+// segment or {name...} as the last segment matching the rest of the path; handlers read them with pathParam.
+type route struct {
+	method  string
+	pattern string
+	access  access
+	handler http.HandlerFunc
+}
+
+type compiledRoute struct {
+	route
+	segments []string
+}
+
+// router dispatch requests on method and path pattern, it answers 404 when no pattern matches the path
+// and 405 with an Allow header when patterns match the path but none of them has the method
+type router struct {
+	routes []*compiledRoute
+}
+
+func newRouter(routes []route) *router {
+	rt := &router{}
+	for _, r := range routes {
+		rt.routes = append(rt.routes, &compiledRoute{route: r, segments: splitPath(r.pattern)})
+	}
+	return rt
+}
+
+const paramsKey contextKey = 1
+
+// pathParam get a path parameter of the matched route, already unescaped
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(paramsKey).(map[string]string)
+	return params[name]
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	//按段解码，商品名中的中文和 %2F 都不会影响匹配
+	segments := splitPath(r.URL.EscapedPath())
+	for i, s := range segments {
+		u, err := url.PathUnescape(s)
+		if err != nil {
+			sendErr(w, http.StatusBadRequest, "malformed path")
+			return
+		}
+		segments[i] = u
+	}
+
+	//多个模式都能匹配时先试最具体的，例如 /users/login 优先于 /users/{user}；
+	//最具体的模式没有这个方法时再试下一个，都没有时才返回405
+	var matches []routeMatch
+	for _, cr := range rt.routes {
+		if p, rank, ok := match(cr.segments, segments); ok {
+			matches = append(matches, routeMatch{cr, rank, p})
+		}
+	}
+	if len(matches) == 0 {
+		sendErr(w, http.StatusNotFound, "not found")
+		return
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return moreSpecific(matches[i].rank, matches[j].rank)
+	})
+
+	methods := map[string]bool{"OPTIONS": true}
+	for _, m := range matches {
+		cr := m.route
+		if cr.method == r.Method || (cr.method == "GET" && r.Method == "HEAD") {
+			r = r.WithContext(context.WithValue(r.Context(), paramsKey, m.params))
+			if !authorize(w, r, cr.access) {
+				return
+			}
+			cr.handler(w, r)
+			return
+		}
+		methods[cr.method] = true
+		if cr.method == "GET" {
+			methods["HEAD"] = true
+		}
+	}
+	var allowed []string
+	for method := range methods {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	if r.Method == "OPTIONS" { //CORS预检请求
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	sendErr(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// routeMatch is a route whose pattern matches the path of a request, with its rank and path parameters
+type routeMatch struct {
+	route  *compiledRoute
+	rank   []int
+	params map[string]string
+}
+
+// splitPath split a path in segments, ignoring the leading and trailing slash
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// match a pattern against the path segments, rank gives for every segment 2 for a literal,
+// 1 for a parameter and 0 for the rest of the path
+func match(pattern []string, segments []string) (map[string]string, []int, bool) {
+	params := make(map[string]string)
+	rank := make([]int, 0, len(pattern))
+	for i, p := range pattern {
+		if strings.HasPrefix(p, "{") && strings.HasSuffix(p, "...}") {
+			rest := ""
+			if i < len(segments) {
+				rest = strings.Join(segments[i:], "/")
+			}
+			params[p[1:len(p)-4]] = rest
+			return params, append(rank, 0), true
+		}
+		if i >= len(segments) {
+			return nil, nil, false
+		}
+		if strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}") {
+			params[p[1:len(p)-1]] = segments[i]
+			rank = append(rank, 1)
+		} else if p == segments[i] {
+			rank = append(rank, 2)
+		} else {
+			return nil, nil, false
+		}
+	}
+	if len(pattern) != len(segments) {
+		return nil, nil, false
+	}
+	return params, rank, true
+}
+
+// moreSpecific compare two ranks segment by segment
+func moreSpecific(a, b []int) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return len(a) > len(b)
+}
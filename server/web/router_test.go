@@ -0,0 +1,75 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// echoRoute is a public route answering with its method, pattern and path parameters
+func echoRoute(method, pattern string) route {
+	return route{method, pattern, public, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method + " " + pattern + " " + pathParam(r, "id") + pathParam(r, "file")))
+	}}
+}
+
+func TestRouter(t *testing.T) {
+	rt := newRouter([]route{
+		echoRoute("GET", "/commodities"),
+		echoRoute("POST", "/commodities"),
+		echoRoute("GET", "/commodities/{id}"),
+		echoRoute("PUT", "/commodities/{id}"),
+		echoRoute("GET", "/commodities/by-slug/{id}"),
+		//字面量更具体，但只有 POST；其他方法要落到 {id}
+		echoRoute("POST", "/items/special"),
+		echoRoute("GET", "/items/{id}"),
+		echoRoute("DELETE", "/items/{id}"),
+		echoRoute("OPTIONS", "/uploads"),
+		echoRoute("POST", "/uploads"),
+		echoRoute("GET", "/picture/{file...}"),
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		code   int
+		body   string
+		allow  string
+	}{
+		{"literal", "GET", "/commodities", 200, "GET /commodities ", ""},
+		{"parameter", "GET", "/commodities/42", 200, "GET /commodities/{id} 42", ""},
+		{"head is get", "HEAD", "/commodities/42", 200, "", ""},
+		{"more specific literal", "GET", "/commodities/by-slug/tea", 200, "GET /commodities/by-slug/{id} tea", ""},
+		{"trailing slash", "GET", "/commodities/42/", 200, "GET /commodities/{id} 42", ""},
+		{"query string", "GET", "/commodities/42?sort=price&q=%2F", 200, "GET /commodities/{id} 42", ""},
+		{"chinese segment", "GET", "/commodities/%E7%BB%BF%E8%8C%B6", 200, "GET /commodities/{id} 绿茶", ""},
+		{"escaped slash stays in the segment", "GET", "/commodities/a%2Fb", 200, "GET /commodities/{id} a/b", ""},
+		{"rest of the path", "GET", "/picture/.cache/160/%E5%9B%BE.jpg", 200, "GET /picture/{file...} .cache/160/图.jpg", ""},
+		{"unknown path", "GET", "/nothing", 404, "", ""},
+		{"too many segments", "GET", "/commodities/42/comments", 404, "", ""},
+		{"method not allowed", "DELETE", "/commodities/42", 405, "", "GET, HEAD, OPTIONS, PUT"},
+		{"allow of the list", "PATCH", "/commodities", 405, "", "GET, HEAD, OPTIONS, POST"},
+		{"preflight", "OPTIONS", "/commodities/42", 204, "", "GET, HEAD, OPTIONS, PUT"},
+		{"explicit options route", "OPTIONS", "/uploads", 200, "OPTIONS /uploads ", ""},
+		{"literal with its method", "POST", "/items/special", 200, "POST /items/special ", ""},
+		{"literal falls through to parameter", "GET", "/items/special", 200, "GET /items/{id} special", ""},
+		{"falls through for every method", "DELETE", "/items/special", 200, "DELETE /items/{id} special", ""},
+		{"allow of every matching pattern", "PUT", "/items/special", 405, "", "DELETE, GET, HEAD, OPTIONS, POST"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			rt.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+			if w.Code != tt.code {
+				t.Fatalf("got status %d want %d: %s", w.Code, tt.code, w.Body)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Fatalf("got body %q want %q", w.Body, tt.body)
+			}
+			if got := w.Header().Get("Allow"); got != tt.allow {
+				t.Fatalf("got Allow %q want %q", got, tt.allow)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+	"webapp/db"
+)
+
+// 自动补全在用户输入时调用，模糊匹配最多用 suggestBudget，超时后返回已找到的结果
+const (
+	suggestBudget       = 50 * time.Millisecond
+	suggestDefaultLimit = 10
+	suggestMaxLimit     = 20
+)
+
+// Search find commodities by name and introduction (query value q), best match first.
+// limit and offset page through the hits
+func (a *App) Search(w http.ResponseWriter, r *http.Request) {
+	query := r.FormValue("q")
+	if query == "" {
+		sendErr(w, http.StatusBadRequest, "q is required")
+		return
+	}
+	limit, ok := intParam(w, r, "limit")
+	if !ok {
+		return
+	}
+	offset, ok := intParam(w, r, "offset")
+	if !ok {
+		return
+	}
+	if limit == 0 {
+		limit = db.DefaultLimit
+	}
+	if limit > db.MaxLimit {
+		limit = db.MaxLimit
+	}
+	res := a.index.Search(query, offset, limit)
+	for i := range res.Hits {
+		res.Hits[i].Picture = pictureURL(res.Hits[i].Picture)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// Suggest complete the prefix typed by a user (query value prefix) into commodity names:
+// by the name, its pinyin, the initials of the pinyin, or with a few typos
+func (a *App) Suggest(w http.ResponseWriter, r *http.Request) {
+	prefix := r.FormValue("prefix")
+	if prefix == "" {
+		sendErr(w, http.StatusBadRequest, "prefix is required")
+		return
+	}
+	limit, ok := intParam(w, r, "limit")
+	if !ok {
+		return
+	}
+	if limit == 0 {
+		limit = suggestDefaultLimit
+	}
+	if limit > suggestMaxLimit {
+		limit = suggestMaxLimit
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), suggestBudget)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.index.Suggest(ctx, prefix, limit))
+}
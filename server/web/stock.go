@@ -0,0 +1,82 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"webapp/db"
+	"webapp/model"
+)
+
+// AdjustStock adjust the stock of a commodity, or of its variant given by the form value sku, by the form value delta,
+// only admins are allowed
+func (a *App) AdjustStock(w http.ResponseWriter, r *http.Request) {
+	//在当前库存基础上增减
+	delta, err := strconv.Atoi(r.FormValue("delta"))
+	if err != nil {
+		sendErr(w, http.StatusBadRequest, "delta must be an integer")
+		return
+	}
+	commodity, err := a.d.AdjustStock(r.Context(), pathParam(r, "id"), r.FormValue("sku"), delta)
+	writeStock(w, commodity, err)
+}
+
+// SetStock overwrite the stock of a commodity, or of its variant given by the form value sku, by the form value stock,
+// only admins are allowed
+func (a *App) SetStock(w http.ResponseWriter, r *http.Request) {
+	//直接设置库存
+	stock, err := strconv.Atoi(r.FormValue("stock"))
+	if err != nil || stock < 0 {
+		sendErr(w, http.StatusBadRequest, "stock must be a non-negative integer")
+		return
+	}
+	commodity, err := a.d.SetStock(r.Context(), pathParam(r, "id"), r.FormValue("sku"), stock)
+	writeStock(w, commodity, err)
+}
+
+// SetVariants replace the variants of a commodity by the form value variants, a json list of model.Variant.
+// Variants without a sku get one made from their option values, existing skus keep their stock
+func (a *App) SetVariants(w http.ResponseWriter, r *http.Request) {
+	var variants []model.Variant
+	if err := json.Unmarshal([]byte(r.FormValue("variants")), &variants); err != nil {
+		sendErr(w, http.StatusBadRequest, "variants must be a json list of {sku, options, price, stock}")
+		return
+	}
+	commodity, err := a.d.SetVariants(r.Context(), pathParam(r, "id"), variants)
+	if err == nil {
+		//价格可能变了
+		a.index.Add(commodity)
+	}
+	writeStock(w, commodity, err)
+}
+
+func writeStock(w http.ResponseWriter, commodity *model.Commodity, err error) {
+	if err != nil {
+		sendDBErr(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(withImageURLs(commodity))
+	if err != nil {
+		sendErr(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// checkStock make sure every commodity or variant of the cart lines has enough stock, nothing is reserved here
+func (a *App) checkStock(ctx context.Context, lines []model.CartLine) error {
+	for _, l := range lines {
+		commodity, err := a.d.GetOneCommodity(ctx, l.CommodityId)
+		if err != nil {
+			return err
+		}
+		stock, err := db.StockOf(commodity, l.Sku)
+		if err != nil {
+			return err
+		}
+		if stock < l.Quantity {
+			return &db.StockError{Id: l.CommodityId, Sku: l.Sku, Requested: l.Quantity, Available: stock}
+		}
+	}
+	return nil
+}
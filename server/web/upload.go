@@ -0,0 +1,184 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"webapp/model"
+	"webapp/picture"
+)
+
+// tusVersion is the version of the tus resumable upload protocol spoken by /picture/uploads
+const tusVersion = "1.0.0"
+
+// tusHeaders set the headers of every tus answer and check the version asked by the client, 412 is written when it is not supported
+func tusHeaders(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if v := r.Header.Get("Tus-Resumable"); v != "" && v != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		sendErr(w, http.StatusPreconditionFailed, "Tus-Resumable must be "+tusVersion)
+		return false
+	}
+	return true
+}
+
+// uploadHeaders describe the progress of an upload
+func uploadHeaders(w http.ResponseWriter, up *picture.Upload) {
+	h := w.Header()
+	h.Set("Upload-Offset", strconv.FormatInt(up.Offset, 10))
+	h.Set("Upload-Length", strconv.FormatInt(up.Length, 10))
+	h.Set("Upload-Expires", up.ExpiresAt.UTC().Format(http.TimeFormat))
+	h.Set("Cache-Control", "no-store")
+}
+
+// UploadOptions describe the resumable uploads: version, largest size (the size limit of the videos,
+// pictures are still limited to 10 MiB) and the tus extensions supported
+func (a *App) UploadOptions(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Tus-Resumable", tusVersion)
+	h.Set("Tus-Version", tusVersion)
+	h.Set("Tus-Max-Size", strconv.FormatInt(a.uploads.MaxSize(), 10))
+	h.Set("Tus-Extension", "creation,expiration,termination")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateUpload start a resumable upload of a picture or a video of Upload-Length bytes, the answer gives its URL in Location.
+// Upload-Metadata is accepted but not used, the picture or video is named by its content like with /picture/upload
+func (a *App) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	if !tusHeaders(w, r) {
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil {
+		sendErr(w, http.StatusBadRequest, "Upload-Length must be the size of the picture or video in bytes")
+		return
+	}
+	up, err := a.uploads.Create(identityFrom(r).Username, length)
+	if err != nil {
+		sendUploadErr(w, err)
+		return
+	}
+	uploadHeaders(w, up)
+	w.Header().Set("Location", "/picture/uploads/"+url.PathEscape(up.Id))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// UploadProgress give the offset of an upload in Upload-Offset, the client sends the rest from there
+func (a *App) UploadProgress(w http.ResponseWriter, r *http.Request) {
+	if !tusHeaders(w, r) {
+		return
+	}
+	up, ok := a.ownUpload(w, r)
+	if !ok {
+		return
+	}
+	uploadHeaders(w, up)
+	w.WriteHeader(http.StatusOK)
+}
+
+// AppendUpload add a chunk (Content-Type application/offset+octet-stream) to an upload at Upload-Offset, the bytes received so far.
+// The answer is 204 with the new offset; the last chunk hands a picture to the picture store, an MP4 or WebM video
+// to the media store, and the answer is 200 with the picture or video described like by /picture/upload.
+// Sending no bytes at the end of a complete upload gives that answer again
+func (a *App) AppendUpload(w http.ResponseWriter, r *http.Request) {
+	if !tusHeaders(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		sendErr(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		sendErr(w, http.StatusBadRequest, "Upload-Offset must be the number of bytes already received")
+		return
+	}
+	if _, ok := a.ownUpload(w, r); !ok {
+		return
+	}
+	id := pathParam(r, "id")
+	up, err := a.uploads.Append(id, offset, r.Body)
+	if err == picture.ErrOffset {
+		uploadHeaders(w, up)
+	}
+	if err != nil {
+		sendUploadErr(w, err)
+		return
+	}
+	if up.Done() && up.Picture == nil {
+		data, err := a.uploads.Data(id)
+		var info *picture.Info
+		if err == nil && picture.IsVideo(data) {
+			info, _, err = a.media.Save(r.Context(), data)
+		} else if err == nil {
+			info, _, err = a.pictures.Save(r.Context(), data)
+		}
+		if err == picture.ErrUnsupported {
+			err = picture.ErrUnsupportedMedia
+		}
+		switch err {
+		case nil:
+		case picture.ErrTooLarge, picture.ErrTooManyPixels, picture.ErrUnsupportedMedia, picture.ErrCorrupt, picture.ErrMediaTooLarge:
+			//不是可以保存的图片或视频，重传也没有用
+			a.uploads.Delete(id)
+			sendPictureErr(w, err)
+			return
+		default:
+			sendUploadErr(w, err)
+			return
+		}
+		if up, err = a.uploads.Complete(id, info); err != nil {
+			sendUploadErr(w, err)
+			return
+		}
+	}
+	uploadHeaders(w, up)
+	if up.Picture == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		*picture.Info
+		URL string `json:"url"`
+	}{up.Picture, uploadedURL(up.Picture)})
+}
+
+// uploadedURL give the URL of the picture or video stored from an upload
+func uploadedURL(info *picture.Info) string {
+	if strings.HasPrefix(info.ContentType, "video/") {
+		return mediaURL(info.Id)
+	}
+	return pictureURL(info.Id)
+}
+
+// DeleteUpload give up an upload, the bytes received are removed
+func (a *App) DeleteUpload(w http.ResponseWriter, r *http.Request) {
+	if !tusHeaders(w, r) {
+		return
+	}
+	if _, ok := a.ownUpload(w, r); !ok {
+		return
+	}
+	if err := a.uploads.Delete(pathParam(r, "id")); err != nil {
+		sendUploadErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ownUpload get the upload of the path, 404 is written when it does not exist or belongs to someone else (admins see them all)
+func (a *App) ownUpload(w http.ResponseWriter, r *http.Request) (*picture.Upload, bool) {
+	up, err := a.uploads.Get(pathParam(r, "id"))
+	if err != nil {
+		sendUploadErr(w, err)
+		return nil, false
+	}
+	if id := identityFrom(r); up.Owner != id.Username && id.Role != model.RoleAdmin {
+		sendErr(w, http.StatusNotFound, "upload not found")
+		return nil, false
+	}
+	return up, true
+}